@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// AccountTokenForm represents the refresh token revoked on the account page
+type AccountTokenForm struct {
+	TokenID string
+}
+
+// issuedToken describes a refresh token on the account page
+type issuedToken struct {
+	ID              string
+	ClientID        string
+	ApplicationName string
+	Scopes          []ScopeDescription
+	Issued          string
+}
+
+// getAccountTokens returns the view listing the refresh tokens applications hold for the user
+func getAccountTokens(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	viewAccountTokens(ctx, user)
+}
+
+// viewAccountTokens renders the user's refresh tokens, which let applications keep their access without asking the
+// user again
+func viewAccountTokens(ctx iris.Context, user *User) {
+	tokens, err := userRefreshTokens(kongContext(ctx), authenticatedUserID(user))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	issued := make([]issuedToken, 0, len(tokens))
+	for _, token := range tokens {
+		issued = append(issued, describeToken(ctx, token))
+	}
+
+	ctx.ViewData("Tokens", issued)
+	ctx.View("account-tokens.html")
+}
+
+// describeToken returns the view of a refresh token, named with its client's application name on Kong when it is
+// available
+func describeToken(ctx iris.Context, token kongAccessToken) issuedToken {
+	issued := issuedToken{
+		ID:     token.ID,
+		Scopes: describeScopes(ctx, strings.Fields(token.Scope)),
+		Issued: time.Unix(token.CreatedAt, 0).UTC().Format(time.RFC1123),
+	}
+	if clientID, err := getCredentialClientID(kongContext(ctx), token.Credential.ID); err == nil {
+		issued.ClientID = clientID
+		issued.ApplicationName = clientID
+		if name, err := getApplicationName(kongContext(ctx), clientID); err == nil {
+			issued.ApplicationName = name
+		}
+	}
+	return issued
+}
+
+// postAccountTokenRevoke revokes one of the user's refresh tokens, and the access token issued with it
+//
+// The user's grant to the application is kept; removing it from the connected apps revokes the grant.
+func postAccountTokenRevoke(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := AccountTokenForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Only the user's own tokens can be revoked, whatever ID the form names
+	tokens, err := userRefreshTokens(kongContext(ctx), authenticatedUserID(user))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	var token *kongAccessToken
+	for i := range tokens {
+		if tokens[i].ID == form.TokenID {
+			token = &tokens[i]
+			break
+		}
+	}
+	if form.TokenID == "" || token == nil {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	revoked := describeToken(ctx, *token)
+	if err := deleteKongToken(kongContext(ctx), token.ID); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "token.revoked_by_user", map[string]string{"client_id": revoked.ClientID})
+
+	name := revoked.ApplicationName
+	if name == "" {
+		name = "The application"
+	}
+	ctx.ViewData("Notice", name+" was signed out. It will need to ask you again to use your account.")
+	viewAccountTokens(ctx, user)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// httpLogPath is the JSON lines file API activity received from Kong is kept in, held in memory if unset
+	httpLogPath = os.Getenv("HTTP_LOG_PATH")
+	// httpLogRetention is how long API activity is kept
+	httpLogRetention = envDuration("HTTP_LOG_RETENTION", 7*24*time.Hour)
+	// httpLogMaxEntries is the most API requests kept, the oldest being dropped first
+	httpLogMaxEntries = envInt("HTTP_LOG_MAX_ENTRIES", 100000)
+)
+
+// activities holds the API activity received from Kong's HTTP Log plugin
+var activities = &activityStore{}
+
+// activityRecord is an API request attributed to a user's grant to a client
+type activityRecord struct {
+	AuthenticatedUserID string `json:"authenticated_userid"`
+	ClientID            string `json:"client_id"`
+	APIActivity
+}
+
+// activityStore holds API activity in memory, bounded by HTTP_LOG_RETENTION and HTTP_LOG_MAX_ENTRIES, and
+// optionally appends it to a JSON lines file that is compacted as records expire
+type activityStore struct {
+	path string
+
+	mu       sync.Mutex
+	records  []activityRecord
+	file     *os.File
+	appended int
+}
+
+// openActivityStore opens the activity store at path, or an in-memory store if path is empty
+//
+// Expired records are dropped and the file is rewritten with the records that remain.
+func openActivityStore(path string) (*activityStore, error) {
+	store := &activityStore{path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, wrapError(ErrStore, "reading activity store", err)
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			record := activityRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return nil, wrapError(ErrStore, "parsing activity store", err)
+			}
+			store.records = append(store.records, record)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, wrapError(ErrStore, "reading activity store", err)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.prune(time.Now())
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Add stores records and appends them to the store's file
+func (s *activityStore) Add(records []activityRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, records...)
+	s.prune(time.Now())
+	if s.path == "" {
+		return nil
+	}
+
+	// Rewrite the file without expired records once HTTP_LOG_MAX_ENTRIES records have been appended since it was
+	// last rewritten, so that it stays bounded
+	if s.appended+len(records) > httpLogMaxEntries {
+		return s.compact()
+	}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return wrapError(ErrStore, "encoding activity store", err)
+		}
+		if _, err := s.file.Write(append(line, '\n')); err != nil {
+			return wrapError(ErrStore, "writing activity store", err)
+		}
+	}
+	s.appended += len(records)
+	return nil
+}
+
+// Recent returns at most limit of the most recent requests made for a user's grant to a client, newest first
+func (s *activityStore) Recent(authenticatedUserID, clientID string, limit int) []APIActivity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity := []APIActivity{}
+	for _, record := range s.records {
+		if record.AuthenticatedUserID == authenticatedUserID && record.ClientID == clientID {
+			activity = append(activity, record.APIActivity)
+		}
+	}
+	sort.SliceStable(activity, func(i, j int) bool { return activity[i].Time.After(activity[j].Time) })
+	if len(activity) > limit {
+		activity = activity[:limit]
+	}
+	return activity
+}
+
+// Remove drops the records match returns true for, rewriting the store's file, and returns the number removed
+func (s *activityStore) Remove(match func(record activityRecord) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.records[:0]
+	for _, record := range s.records {
+		if !match(record) {
+			kept = append(kept, record)
+		}
+	}
+	removed := len(s.records) - len(kept)
+	s.records = kept
+	if s.path == "" || removed == 0 {
+		return removed, nil
+	}
+	return removed, s.compact()
+}
+
+// Rekey attributes the records of oldUserID to newUserID, rewriting the store's file
+func (s *activityStore) Rekey(oldUserID, newUserID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for i := range s.records {
+		if s.records[i].AuthenticatedUserID == oldUserID {
+			s.records[i].AuthenticatedUserID = newUserID
+			changed = true
+		}
+	}
+	if s.path == "" || !changed {
+		return nil
+	}
+	return s.compact()
+}
+
+// Compact drops expired records and rewrites the store's file
+func (s *activityStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+	if s.path == "" {
+		return nil
+	}
+	return s.compact()
+}
+
+// Records returns a copy of the records held in the store
+func (s *activityStore) Records() []activityRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]activityRecord(nil), s.records...)
+}
+
+// prune drops records older than HTTP_LOG_RETENTION and the oldest records beyond HTTP_LOG_MAX_ENTRIES; the
+// caller must hold the lock
+func (s *activityStore) prune(now time.Time) {
+	cutoff := now.Add(-httpLogRetention)
+	kept := s.records[:0]
+	for _, record := range s.records {
+		if record.Time.After(cutoff) {
+			kept = append(kept, record)
+		}
+	}
+	if httpLogMaxEntries > 0 && len(kept) > httpLogMaxEntries {
+		kept = kept[len(kept)-httpLogMaxEntries:]
+	}
+	s.records = kept
+}
+
+// compact rewrites the store's file with the records held in memory and reopens it for appending; the caller
+// must hold the lock
+func (s *activityStore) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return wrapError(ErrStore, "writing activity store", err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range s.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return wrapError(ErrStore, "encoding activity store", err)
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return wrapError(ErrStore, "writing activity store", err)
+	}
+	if err := file.Close(); err != nil {
+		return wrapError(ErrStore, "writing activity store", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return wrapError(ErrStore, "writing activity store", err)
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return wrapError(ErrStore, "writing activity store", err)
+	}
+	s.appended = 0
+	return nil
+}
+
+// storeUsageSource provides API activity from the records received by the HTTP Log receiver
+type storeUsageSource struct{}
+
+// Recent returns the grant's requests from the activity store
+func (storeUsageSource) Recent(ctx context.Context, authenticatedUserID, clientID string, limit int) ([]APIActivity, error) {
+	return activities.Recent(authenticatedUserID, clientID, limit), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// kongAdminRateLimit is the number of Admin API calls per minute allowed by Kong, or 0 if it is not limited
+	kongAdminRateLimit = envInt("KONG_ADMIN_RATE_LIMIT", 0)
+
+	// kongAdminRateWarn is the fraction of KONG_ADMIN_RATE_LIMIT at which a warning is logged
+	kongAdminRateWarn = float64(envInt("KONG_ADMIN_RATE_WARN_PERCENT", 80)) / 100
+)
+
+// adminUsage counts the calls made to Kong's Admin API
+var adminUsage = newAdminUsage()
+
+// adminCallUsage tracks Admin API calls over the last minute, by endpoint
+type adminCallUsage struct {
+	mu        sync.Mutex
+	endpoints map[string]*minuteWindow
+	total     *minuteWindow
+	warned    time.Time
+	warnings  *Counter
+}
+
+// minuteWindow counts events over a sliding minute in one second buckets
+type minuteWindow struct {
+	buckets [60]uint64
+	seconds [60]int64
+}
+
+// newAdminUsage creates the usage tracker and registers its metrics
+func newAdminUsage() *adminCallUsage {
+	u := &adminCallUsage{
+		endpoints: map[string]*minuteWindow{},
+		total:     &minuteWindow{},
+		warnings:  metrics.Counter("kong_admin_rate_warnings_total", "Number of times Admin API calls approached KONG_ADMIN_RATE_LIMIT."),
+	}
+	metrics.GaugeFunc("kong_admin_requests_per_minute", "Number of Admin API calls in the last minute.", func() float64 {
+		return float64(u.rate(""))
+	}, "endpoint", "all")
+	metrics.GaugeFunc("kong_admin_rate_limit", "Admin API calls allowed per minute, or 0 if not limited.", func() float64 {
+		return float64(kongAdminRateLimit)
+	})
+	return u
+}
+
+// add counts an event at time now
+func (w *minuteWindow) add(now time.Time) {
+	second := now.Unix()
+	i := second % 60
+	if w.seconds[i] != second {
+		w.seconds[i] = second
+		w.buckets[i] = 0
+	}
+	w.buckets[i]++
+}
+
+// count returns the number of events in the minute before now
+func (w *minuteWindow) count(now time.Time) uint64 {
+	second := now.Unix()
+	var n uint64
+	for i := range w.buckets {
+		if second-w.seconds[i] < 60 {
+			n += w.buckets[i]
+		}
+	}
+	return n
+}
+
+// adminEndpoint returns the Admin API endpoint a request is for, such as "/oauth2", or "" if it is not an Admin
+// API request
+func adminEndpoint(req *http.Request) string {
+	if kongAdminEndpoint == "" || !strings.HasPrefix(req.URL.String(), kongAdminEndpoint) {
+		return ""
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(req.URL.String(), kongAdminEndpoint), "/")
+	if i := strings.IndexAny(path, "/?"); i >= 0 {
+		path = path[:i]
+	}
+	return "/" + path
+}
+
+// record counts an Admin API call and logs a warning, at most once a minute, when calls approach the rate limit
+func (u *adminCallUsage) record(req *http.Request) {
+	endpoint := adminEndpoint(req)
+	if endpoint == "" {
+		return
+	}
+	metrics.Counter("kong_admin_requests_total", "Number of Admin API calls.", "endpoint", endpoint).Inc()
+
+	now := time.Now()
+	u.mu.Lock()
+	window, ok := u.endpoints[endpoint]
+	if !ok {
+		window = &minuteWindow{}
+		u.endpoints[endpoint] = window
+	}
+	window.add(now)
+	u.total.add(now)
+	rate := u.total.count(now)
+	warn := kongAdminRateLimit > 0 && now.Sub(u.warned) >= time.Minute &&
+		float64(rate) >= kongAdminRateWarn*float64(kongAdminRateLimit)
+	if warn {
+		u.warned = now
+	}
+	u.mu.Unlock()
+
+	// The gauge is registered without holding the lock, as collecting metrics calls rate
+	if !ok {
+		metrics.GaugeFunc("kong_admin_requests_per_minute", "Number of Admin API calls in the last minute.", func() float64 {
+			return float64(u.rate(endpoint))
+		}, "endpoint", endpoint)
+	}
+	if warn {
+		u.warnings.Inc()
+		log.Printf("warning: %d Admin API calls in the last minute, approaching the limit of %d", rate, kongAdminRateLimit)
+	}
+}
+
+// rate returns the number of calls to endpoint in the last minute, or to all endpoints if endpoint is ""
+func (u *adminCallUsage) rate(endpoint string) uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if endpoint == "" {
+		return u.total.count(time.Now())
+	}
+	if window, ok := u.endpoints[endpoint]; ok {
+		return window.count(time.Now())
+	}
+	return 0
+}
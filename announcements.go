@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// announcementsPath is the JSON file holding the announcements, held in memory if unset
+var announcementsPath = os.Getenv("ANNOUNCEMENTS_PATH")
+
+// announcements are the notices administrators show users on the login and consent pages
+var announcements = &announcementStore{}
+
+// The levels of announcements, from the least to the most urgent
+const (
+	announcementInfo     = "info"
+	announcementWarning  = "warning"
+	announcementCritical = "critical"
+)
+
+// announcementLevels are the levels of announcements in order of urgency
+var announcementLevels = []string{announcementInfo, announcementWarning, announcementCritical}
+
+// announcementColors are the colors of the banners of each level
+var announcementColors = map[string]string{
+	announcementInfo:     "#0b5394",
+	announcementWarning:  "#b45f06",
+	announcementCritical: "#c00",
+}
+
+// announcementTimeLayout is the layout of the start and end times submitted by the admin form, in UTC
+const announcementTimeLayout = "2006-01-02T15:04"
+
+// Announcement is a notice shown to users on the login and consent pages, such as planned maintenance
+type Announcement struct {
+	ID      string `json:"id"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+
+	// Locales are the languages of the users the announcement is shown to, or every user's if empty
+	Locales []string `json:"locales,omitempty"`
+
+	// Starts and Ends bound when the announcement is shown; either may be zero
+	Starts time.Time `json:"starts"`
+	Ends   time.Time `json:"ends"`
+
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AnnouncementForm represents an announcement created, or deleted by ID, on the admin page
+type AnnouncementForm struct {
+	ID      string
+	Level   string
+	Message string
+	Locales []string
+	Starts  string
+	Ends    string
+}
+
+// Color returns the color of the announcement's banner
+func (a Announcement) Color() string {
+	return announcementColors[a.Level]
+}
+
+// Status describes on the admin page whether the announcement is shown now
+func (a Announcement) Status(now time.Time) string {
+	switch {
+	case !a.Starts.IsZero() && now.Before(a.Starts):
+		return "Scheduled"
+	case !a.Ends.IsZero() && !now.Before(a.Ends):
+		return "Ended"
+	}
+	return "Showing"
+}
+
+// shownTo reports whether the announcement is shown at a time to users of a language
+func (a Announcement) shownTo(now time.Time, language string) bool {
+	if a.Status(now) != "Showing" {
+		return false
+	}
+	return len(a.Locales) == 0 || containsString(a.Locales, language)
+}
+
+// announcementStore holds announcements in memory, and optionally in a JSON file
+type announcementStore struct {
+	path string
+	mu   sync.RWMutex
+	list []Announcement
+}
+
+// openAnnouncementStore opens the announcements at path, or an in-memory store if path is empty
+func openAnnouncementStore(path string) (*announcementStore, error) {
+	store := &announcementStore{path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, wrapError(ErrStore, "reading announcements", err)
+	}
+	if err := json.Unmarshal(data, &store.list); err != nil {
+		return nil, wrapError(ErrStore, "parsing announcements", err)
+	}
+	return store, nil
+}
+
+// List returns every announcement, the most recently created first
+func (s *announcementStore) List() []Announcement {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Announcement, len(s.list))
+	copy(list, s.list)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Shown returns the announcements shown at a time to users of a language, the most urgent first
+func (s *announcementStore) Shown(now time.Time, language string) []Announcement {
+	shown := []Announcement{}
+	for _, announcement := range s.List() {
+		if announcement.shownTo(now, language) {
+			shown = append(shown, announcement)
+		}
+	}
+	urgency := func(level string) int {
+		for i, l := range announcementLevels {
+			if l == level {
+				return i
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(shown, func(i, j int) bool { return urgency(shown[i].Level) > urgency(shown[j].Level) })
+	return shown
+}
+
+// Add stores a new announcement and writes the store to disk
+func (s *announcementStore) Add(announcement Announcement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.list = append(s.list, announcement)
+	return s.flush()
+}
+
+// Delete removes an announcement and writes the store to disk, and reports whether it existed
+func (s *announcementStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.list {
+		if s.list[i].ID == id {
+			s.list = append(s.list[:i], s.list[i+1:]...)
+			return true, s.flush()
+		}
+	}
+	return false, nil
+}
+
+// flush writes the announcements to the store's file; the caller must hold the write lock
+func (s *announcementStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list, "", "  ")
+	if err != nil {
+		return wrapError(ErrStore, "encoding announcements", err)
+	}
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		return wrapError(ErrStore, "writing announcements", err)
+	}
+	return nil
+}
+
+// addAnnouncements is middleware that adds the announcements shown to the user, in the language of their pages, to
+// the view data
+func addAnnouncements(ctx iris.Context) {
+	language := supportedLanguages[0]
+	if locale := ctx.GetLocale(); locale != nil {
+		if matched := matchLanguage(locale.Language()); matched != "" {
+			language = matched
+		}
+	}
+	if shown := announcements.Shown(time.Now(), language); len(shown) > 0 {
+		ctx.ViewData("Announcements", shown)
+	}
+	ctx.Next()
+}
+
+// getAdminAnnouncements returns the view where administrators manage the announcements
+func getAdminAnnouncements(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+	viewAdminAnnouncements(ctx)
+}
+
+// viewAdminAnnouncements renders the announcements with the form that adds them
+func viewAdminAnnouncements(ctx iris.Context) {
+	ctx.ViewData("Now", time.Now())
+	ctx.ViewData("List", announcements.List())
+	ctx.ViewData("Levels", announcementLevels)
+	ctx.ViewData("Languages", supportedLanguages)
+	ctx.View("admin-announcements.html")
+}
+
+// postAdminAnnouncements adds an announcement
+//
+// Start and end times are in UTC, and either may be left empty to show the announcement from now or until it is
+// deleted.
+func postAdminAnnouncements(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	form := AnnouncementForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	announcement, problem := parseAnnouncementForm(form)
+	if problem != "" {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", problem)
+		viewAdminAnnouncements(ctx)
+		return
+	}
+	if announcement.ID, err = randomTokenPart(); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	announcement.CreatedBy = admin.Username
+	announcement.CreatedAt = time.Now().UTC()
+	if err := announcements.Add(announcement); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "announcement.created", map[string]string{
+		"id": announcement.ID, "level": announcement.Level, "locales": strings.Join(announcement.Locales, ","),
+	})
+
+	ctx.Redirect("/admin/announcements", iris.StatusSeeOther)
+}
+
+// parseAnnouncementForm returns the announcement submitted on the admin page, and the problem with it to show the
+// administrator, or "" if it can be added
+func parseAnnouncementForm(form AnnouncementForm) (Announcement, string) {
+	announcement := Announcement{Level: form.Level, Message: strings.TrimSpace(form.Message)}
+	if !containsString(announcementLevels, announcement.Level) {
+		return announcement, "Please choose a level."
+	}
+	if announcement.Message == "" {
+		return announcement, "Please enter a message."
+	}
+	for _, locale := range form.Locales {
+		if !containsString(supportedLanguages, locale) {
+			return announcement, "Please choose from the supported languages."
+		}
+		announcement.Locales = append(announcement.Locales, locale)
+	}
+
+	var err error
+	if form.Starts != "" {
+		if announcement.Starts, err = time.Parse(announcementTimeLayout, form.Starts); err != nil {
+			return announcement, "Please enter the start time as 2006-01-02T15:04."
+		}
+	}
+	if form.Ends != "" {
+		if announcement.Ends, err = time.Parse(announcementTimeLayout, form.Ends); err != nil {
+			return announcement, "Please enter the end time as 2006-01-02T15:04."
+		}
+	}
+	if !announcement.Starts.IsZero() && !announcement.Ends.IsZero() && !announcement.Ends.After(announcement.Starts) {
+		return announcement, "The end time must be after the start time."
+	}
+	return announcement, ""
+}
+
+// postAdminAnnouncementDelete deletes an announcement
+func postAdminAnnouncementDelete(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	form := AnnouncementForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	deleted, err := announcements.Delete(form.ID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if !deleted {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	audit(ctx, "announcement.deleted", map[string]string{"id": form.ID})
+
+	ctx.Redirect("/admin/announcements", iris.StatusSeeOther)
+}
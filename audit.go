@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// auditLogPath is the file audit events are appended to as JSON lines; without it they are written to the log
+var auditLogPath = os.Getenv("AUDIT_LOG_PATH")
+
+// auditLog writes audit events
+var auditLog = &auditWriter{}
+
+// auditWriter appends audit events to AUDIT_LOG_PATH, opening it on the first event
+type auditWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// audit records a security-relevant event with the acting user, client address and request ID
+//
+// While an administrator is impersonating a user, the administrator is recorded as the actor and the user as
+// the subject.
+func audit(ctx iris.Context, event string, fields map[string]string) {
+	session := sess.Start(ctx)
+	entry := map[string]string{}
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["event"] = event
+	entry["client_ip"] = clientIPString(ctx)
+	entry["request_id"] = requestID(ctx)
+	if admin := session.GetString("impersonator"); admin != "" {
+		entry["actor"] = admin
+		entry["subject"] = session.GetString("username")
+	} else if username := session.GetString("username"); username != "" {
+		entry["actor"] = username
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	auditLog.write(line)
+	auditStream.publish(entry)
+}
+
+// write appends a line to the audit log file, falling back to the log if it cannot be written
+func (w *auditWriter) write(line []byte) {
+	if auditLogPath == "" {
+		log.Printf("audit: %s", line)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		file, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Printf("audit: %v: %s", err, line)
+			return
+		}
+		w.file = file
+	}
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v: %s", err, line)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// auditStreamPath is the path of the server-sent events stream of audit events
+const auditStreamPath = "/admin/events/stream"
+
+var (
+	// auditStreamMaxSubscribers limits the streams open at the same time
+	auditStreamMaxSubscribers = envInt("AUDIT_STREAM_MAX_SUBSCRIBERS", 100)
+	// auditStreamHeartbeat is how often an idle stream is sent a comment, so that proxies do not close it
+	auditStreamHeartbeat = envDuration("AUDIT_STREAM_HEARTBEAT", 15*time.Second)
+	// auditStreamBuffer is how many events a slow subscriber can fall behind before events are dropped for it
+	auditStreamBuffer = envInt("AUDIT_STREAM_BUFFER", 256)
+
+	auditStreamDropped = metrics.Counter("audit_stream_dropped_total", "Number of audit events not streamed to subscribers that fell behind.")
+)
+
+// auditStream fans audit events out to the subscribers of the stream
+var auditStream = newAuditBroker()
+
+// auditBroker delivers audit events to subscribers without waiting for them
+type auditBroker struct {
+	mu          sync.Mutex
+	subscribers map[*auditSubscriber]struct{}
+}
+
+// auditSubscriber is an open stream and the events it asked for
+type auditSubscriber struct {
+	filter auditFilter
+	// admin subscribers are sent every field; others are not sent the addresses of users
+	admin  bool
+	events chan []byte
+}
+
+// auditFilter selects audit events by client, user and event type; empty fields match every event
+type auditFilter struct {
+	ClientID string
+	User     string
+	// Events are event types, or prefixes of them ending in "*" such as "grant.*"
+	Events []string
+}
+
+// matches reports whether an audit event is selected by the filter
+func (f auditFilter) matches(entry map[string]string) bool {
+	if f.ClientID != "" && entry["client_id"] != f.ClientID {
+		return false
+	}
+	if f.User != "" && entry["actor"] != f.User && entry["subject"] != f.User {
+		return false
+	}
+	if len(f.Events) == 0 {
+		return true
+	}
+	for _, event := range f.Events {
+		if event == entry["event"] || (strings.HasSuffix(event, "*") && strings.HasPrefix(entry["event"], strings.TrimSuffix(event, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAuditBroker creates the broker and registers its metrics
+func newAuditBroker() *auditBroker {
+	b := &auditBroker{subscribers: map[*auditSubscriber]struct{}{}}
+	metrics.GaugeFunc("audit_stream_subscribers", "Number of open audit event streams.", func() float64 {
+		return float64(b.count())
+	})
+	return b
+}
+
+// subscribe adds a subscriber, or returns nil if there are already AUDIT_STREAM_MAX_SUBSCRIBERS
+func (b *auditBroker) subscribe(filter auditFilter, admin bool) *auditSubscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subscribers) >= auditStreamMaxSubscribers {
+		return nil
+	}
+	s := &auditSubscriber{filter: filter, admin: admin, events: make(chan []byte, auditStreamBuffer)}
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// unsubscribe removes a subscriber
+func (b *auditBroker) unsubscribe(s *auditSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, s)
+}
+
+// count returns the number of subscribers
+func (b *auditBroker) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// publish sends an audit event to the subscribers whose filter selects it, dropping it for those that are behind
+func (b *auditBroker) publish(entry map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subscribers) == 0 {
+		return
+	}
+
+	var full, redacted []byte
+	for s := range b.subscribers {
+		if !s.filter.matches(entry) {
+			continue
+		}
+		if full == nil {
+			full, redacted = encodeStreamedEvent(entry)
+		}
+		line := redacted
+		if s.admin {
+			line = full
+		}
+		select {
+		case s.events <- line:
+		default:
+			auditStreamDropped.Inc()
+		}
+	}
+}
+
+// encodeStreamedEvent returns an audit event as JSON for administrators, and without the client address for others
+func encodeStreamedEvent(entry map[string]string) ([]byte, []byte) {
+	full, _ := json.Marshal(entry)
+	others := map[string]string{}
+	for key, value := range entry {
+		if key != "client_ip" {
+			others[key] = value
+		}
+	}
+	redacted, _ := json.Marshal(others)
+	return full, redacted
+}
+
+// getAuditStream streams audit events to the admin dashboard as server-sent events
+//
+// The client_id, user and event query parameters filter the events on the server; event is a comma separated list
+// of event types, each of which may end in "*" to match a prefix. Administrators can stream every event. Owners of
+// a client in the developer portal can stream the events of their client, by naming it with client_id, without the
+// addresses users connected from. Permission is checked when the stream is opened.
+func getAuditStream(ctx iris.Context) {
+	filter := auditFilter{
+		ClientID: strings.TrimSpace(ctx.URLParam("client_id")),
+		User:     strings.TrimSpace(ctx.URLParam("user")),
+	}
+	for _, event := range strings.Split(ctx.URLParam("event"), ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			filter.Events = append(filter.Events, event)
+		}
+	}
+
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		if filter.ClientID == "" {
+			ctx.StatusCode(iris.StatusForbidden)
+			ctx.WriteString("You are not an administrator.")
+			return
+		}
+		if _, ok := ownedClient(ctx, filter.ClientID); !ok {
+			return
+		}
+	}
+
+	subscriber := auditStream.subscribe(filter, admin != nil)
+	if subscriber == nil {
+		ctx.StatusCode(iris.StatusServiceUnavailable)
+		ctx.WriteString("Too many activity streams are open.")
+		return
+	}
+	defer auditStream.unsubscribe(subscriber)
+
+	ctx.ContentType("text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	// Ask nginx and similar proxies not to buffer the stream
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.StatusCode(iris.StatusOK)
+	ctx.WriteString(": connected\n\n")
+	ctx.ResponseWriter().Flush()
+
+	heartbeat := time.NewTicker(auditStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return
+		case line := <-subscriber.events:
+			if _, err := ctx.WriteString(fmt.Sprintf("event: audit\ndata: %s\n\n", line)); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := ctx.WriteString(": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		ctx.ResponseWriter().Flush()
+	}
+}
+
+// getAdminActivity shows administrators and client owners the live feed of audit events
+func getAdminActivity(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+	ctx.ViewData("ClientID", strings.TrimSpace(ctx.URLParam("client_id")))
+	ctx.ViewData("User", strings.TrimSpace(ctx.URLParam("user")))
+	ctx.ViewData("Event", strings.TrimSpace(ctx.URLParam("event")))
+	ctx.View("admin-activity.html")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// kongAuthorizationCodeTTL is how long Kong accepts an authorization code for; the OAuth 2.0 plugin does not let it
+// be configured
+const kongAuthorizationCodeTTL = 5 * time.Minute
+
+// authorizationCodes remembers when the codes issued through the consent page were issued and exchanged, by codeKey,
+// so that a refused exchange can be explained
+var authorizationCodes = newCache("authorization_codes",
+	envInt("AUTHORIZATION_CODES_MAX_ENTRIES", 100000),
+	int64(envInt("AUTHORIZATION_CODES_MAX_BYTES", 16<<20)),
+	envDuration("AUTHORIZATION_CODES_TTL", time.Hour))
+
+var codeReplays = metrics.Counter("authorization_code_replays_total", "Number of authorization codes presented again after being exchanged.")
+
+// The outcomes of exchanging an authorization code at the token endpoint
+const (
+	// codeExchanged is a code Kong exchanged for tokens
+	codeExchanged = "exchanged"
+	// codeReplayed is a code Kong refused because it had already been exchanged
+	codeReplayed = "replayed"
+	// codeExpired is a code Kong refused because it was issued more than kongAuthorizationCodeTTL ago
+	codeExpired = "expired"
+	// codeUnknown is a code Kong refused that was not issued through the consent page, or has been forgotten
+	codeUnknown = "unknown"
+	// codeRefused is a code Kong refused for another reason, such as the wrong client, redirect URI or code verifier
+	codeRefused = "refused"
+)
+
+// authorizationCode is what is remembered of an authorization code; the code itself is not kept
+type authorizationCode struct {
+	Issued    time.Time
+	Exchanged time.Time
+}
+
+// recordAuthorizationCode remembers when the authorization code in an authorization response was issued, and whether
+// the user approved offline access with it
+func recordAuthorizationCode(consent ConsentRequest, redirectURI string, issued time.Time) error {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+	params := uri.Query()
+	if consent.fragment() {
+		if params, err = url.ParseQuery(uri.Fragment); err != nil {
+			return err
+		}
+	}
+	if code := params.Get("code"); code != "" {
+		authorizationCodes.Set(codeKey(code), authorizationCode{Issued: issued}, 64)
+		if _, offline := withoutOfflineAccess(splitScopes(consent.Scopes)); offline {
+			return recordOfflineAccess(codeKey(code))
+		}
+	}
+	return nil
+}
+
+// exchangeOutcome classifies the response Kong gave to exchanging an authorization code, and remembers when the
+// code was first exchanged
+//
+// Kong deletes a code once it has been exchanged, and refuses replayed and expired codes alike, so they are told
+// apart with what was remembered when the code was issued and exchanged.
+func exchangeOutcome(code string, status int, now time.Time) string {
+	key := codeKey(code)
+	value, known := authorizationCodes.Get(key)
+	record, _ := value.(authorizationCode)
+	switch {
+	case status == http.StatusOK:
+		if known && record.Exchanged.IsZero() {
+			record.Exchanged = now
+			authorizationCodes.Set(key, record, 64)
+		}
+		return codeExchanged
+	case !known:
+		return codeUnknown
+	case !record.Exchanged.IsZero():
+		return codeReplayed
+	case now.Sub(record.Issued) > kongAuthorizationCodeTTL:
+		return codeExpired
+	}
+	return codeRefused
+}
+
+// describeCodeOutcome returns the reason an authorization code exchange had the outcome it did
+func describeCodeOutcome(code string, outcome string) string {
+	value, _ := authorizationCodes.Get(codeKey(code))
+	record, _ := value.(authorizationCode)
+	switch outcome {
+	case codeExchanged:
+		return "Kong exchanged the code for tokens and deleted it, so it cannot be exchanged again."
+	case codeReplayed:
+		return "The code was already exchanged at " + record.Exchanged.UTC().Format(time.RFC1123) +
+			". Kong deletes codes once they are exchanged and answers a replayed code with invalid_request, " +
+			"\"Invalid code\". Kong does not revoke the tokens of the first exchange, so a client that sees this should " +
+			"discard them."
+	case codeExpired:
+		return "The code was issued at " + record.Issued.UTC().Format(time.RFC1123) + ". Kong only accepts codes for " +
+			kongAuthorizationCodeTTL.String() + " and answers an expired code with invalid_request, \"Invalid code\", " +
+			"as it does a replayed one."
+	case codeUnknown:
+		return "The code was not issued by this consent page, or was issued too long ago to be remembered. " +
+			"Kong answers codes it does not know with invalid_request, \"Invalid code\"."
+	}
+	return "Kong refused the code, which has not been exchanged and has not expired. The client, redirect URI or " +
+		"code verifier may not be the ones the code was issued for."
+}
+
+// auditCodeReplay records an authorization code presented again after it was exchanged, which may have been stolen
+// from the client that first exchanged it
+func auditCodeReplay(ctx iris.Context, clientID string) {
+	audit(ctx, "token.code_replayed", map[string]string{"client_id": clientID})
+	codeReplays.Inc()
+}
+
+// forwardTokenRequest sends a token request to Kong's token endpoint and returns Kong's status and response,
+// adding the ID token and authorization details kept with an authorization code on its first successful exchange, and
+// removing the refresh token, from the response and from Kong, when OFFLINE_ACCESS_REQUIRED is set and the user did
+// not approve offline access
+//
+// The outcome of exchanging an authorization code is returned, or "" for other grants.
+func forwardTokenRequest(ctx context.Context, body []byte, contentType, authorization string) (int, []byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kongProxyEndpoint+apiPath+"/oauth2/token", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	status, response, err := executeRequestStatus(req)
+	if err != nil {
+		return 0, nil, "", wrapError(ErrKongUnavailable, "exchanging OAuth 2.0 token", err)
+	}
+
+	form, _ := url.ParseQuery(string(body))
+	if form.Get("grant_type") != "authorization_code" {
+		return status, response, "", nil
+	}
+	code := form.Get("code")
+	outcome := exchangeOutcome(code, status, time.Now())
+	if status == http.StatusOK {
+		key := codeKey(code)
+		added := map[string]interface{}{}
+		idToken, ok, err := sharedStore.Take(pendingIDTokensPrefix + key)
+		if err != nil {
+			return 0, nil, "", err
+		}
+		if ok {
+			added["id_token"] = idToken
+		}
+		if details, ok := pendingAuthorizationDetails.Get(key); ok {
+			pendingAuthorizationDetails.Delete(key)
+			added["authorization_details"] = json.RawMessage(details.(string))
+		}
+		dropRefreshToken := false
+		if offlineAccessRequired {
+			approved, err := offlineAccessApproved(key)
+			if err != nil {
+				return 0, nil, "", err
+			}
+			dropRefreshToken = !approved
+		}
+		if len(added) > 0 || dropRefreshToken {
+			tokens := map[string]interface{}{}
+			if err := json.Unmarshal(response, &tokens); err == nil {
+				for name, value := range added {
+					tokens[name] = value
+				}
+				if _, issued := tokens["refresh_token"]; issued && dropRefreshToken {
+					// The refresh token is removed from Kong too, so that it cannot be used by anyone who obtains it
+					accessToken, _ := tokens["access_token"].(string)
+					if err := removeKongRefreshToken(ctx, accessToken); err != nil {
+						return 0, nil, "", err
+					}
+					delete(tokens, "refresh_token")
+				}
+				response, _ = json.Marshal(tokens)
+			}
+		}
+	}
+	return status, response, outcome, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// singleUseKong is a stand-in for Kong started by newSingleUseKongStub
+type singleUseKong struct {
+	mu   sync.Mutex
+	held map[string]bool
+	// tokens are Kong's records of the tokens it issued, by access token
+	tokens map[string]kongAccessToken
+}
+
+// newSingleUseKongStub starts a stand-in for Kong's token endpoint that, like Kong, deletes authorization codes once
+// they are exchanged, refuses codes it does not hold and issues a refresh token with every code, and for the Admin
+// API's tokens
+//
+// The code "offline" is issued with the offline_access scope, and the other codes without.
+func newSingleUseKongStub(t *testing.T, codes ...string) *singleUseKong {
+	kong := &singleUseKong{held: map[string]bool{}, tokens: map[string]kongAccessToken{}}
+	for _, code := range codes {
+		kong.held[code] = true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/myapi/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("client_id") != "client" || r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"Invalid client authentication"}`))
+			return
+		}
+		code := r.PostFormValue("code")
+		kong.mu.Lock()
+		ok := kong.held[code]
+		delete(kong.held, code)
+		if ok {
+			token := kongAccessToken{oauth2Token: oauth2Token{ID: "id-" + code, RefreshToken: "refresh-" + code}, Scope: "openid"}
+			if code == "offline" {
+				token.Scope = "openid offline_access"
+			}
+			kong.tokens["token-"+code] = token
+		}
+		kong.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_request","error_description":"Invalid code"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"token-` + code + `","refresh_token":"refresh-` + code + `","token_type":"bearer","expires_in":7200}`))
+	})
+	mux.HandleFunc("/oauth2_tokens", func(w http.ResponseWriter, r *http.Request) {
+		kong.mu.Lock()
+		defer kong.mu.Unlock()
+		page := oauth2Tokens{}
+		for _, token := range kong.tokens {
+			page.Data = append(page.Data, token)
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/oauth2_tokens/", func(w http.ResponseWriter, r *http.Request) {
+		update := map[string]interface{}{}
+		if r.Method != http.MethodPatch || json.NewDecoder(r.Body).Decode(&update) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		kong.mu.Lock()
+		defer kong.mu.Unlock()
+		// Tokens are looked up by their ID or access token, as on Kong
+		id := strings.TrimPrefix(r.URL.Path, "/oauth2_tokens/")
+		for accessToken, token := range kong.tokens {
+			if id == token.ID || id == accessToken {
+				if value, ok := update["refresh_token"]; ok && value == nil {
+					token.RefreshToken = ""
+				}
+				kong.tokens[accessToken] = token
+				w.Write([]byte(`{}`))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	kongProxyEndpoint = srv.URL
+	kongAdminEndpoint = srv.URL
+	apiPath = "/myapi"
+	return kong
+}
+
+// refreshTokens returns the refresh tokens Kong holds, by access token
+func (kong *singleUseKong) refreshTokens() map[string]string {
+	kong.mu.Lock()
+	defer kong.mu.Unlock()
+	refreshTokens := map[string]string{}
+	for accessToken, token := range kong.tokens {
+		refreshTokens[accessToken] = token.RefreshToken
+	}
+	return refreshTokens
+}
+
+// exchangeCode exchanges an authorization code as a client would and returns the outcome and the token response
+func exchangeCode(t *testing.T, code, clientSecret string) (string, map[string]interface{}) {
+	body := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {"client"},
+		"client_secret": {clientSecret},
+	}.Encode()
+	status, response, outcome, err := forwardTokenRequest(context.Background(), []byte(body), "application/x-www-form-urlencoded", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := map[string]interface{}{}
+	if err := json.Unmarshal(response, &tokens); err != nil {
+		t.Fatalf("token response %d is not JSON: %s", status, response)
+	}
+	if (status == http.StatusOK) != (outcome == codeExchanged) {
+		t.Errorf("status %d with outcome %s", status, outcome)
+	}
+	return outcome, tokens
+}
+
+// TestAuthorizationCodeSingleUse checks that a code is exchanged once, with the ID token minted for it, and that
+// exchanging it again is reported as a replay without handing out the ID token again
+func TestAuthorizationCodeSingleUse(t *testing.T) {
+	newSingleUseKongStub(t, "single-use")
+	consent := ConsentRequest{ClientID: "client", ResponseType: responseTypeCode}
+	if err := recordAuthorizationCode(consent, "https://client.example.com/callback?code=single-use", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sharedStore.Set(pendingIDTokensPrefix+codeKey("single-use"), "id-token", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	outcome, tokens := exchangeCode(t, "single-use", "secret")
+	if outcome != codeExchanged || tokens["access_token"] != "token-single-use" || tokens["id_token"] != "id-token" {
+		t.Fatalf("first exchange: outcome %s, tokens %v", outcome, tokens)
+	}
+
+	for i := 0; i < 2; i++ {
+		outcome, tokens = exchangeCode(t, "single-use", "secret")
+		if outcome != codeReplayed {
+			t.Errorf("replay %d: outcome %s, want %s", i+1, outcome, codeReplayed)
+		}
+		if tokens["access_token"] != nil || tokens["id_token"] != nil {
+			t.Errorf("replay %d handed out tokens: %v", i+1, tokens)
+		}
+		if tokens["error"] != "invalid_request" {
+			t.Errorf("replay %d: error %v, want invalid_request", i+1, tokens["error"])
+		}
+	}
+}
+
+// TestAuthorizationCodeRefusals checks that codes Kong refuses without being exchanged are told apart
+func TestAuthorizationCodeRefusals(t *testing.T) {
+	newSingleUseKongStub(t, "wrong-client")
+	consent := ConsentRequest{ClientID: "client", ResponseType: responseTypeCode}
+	now := time.Now()
+	// Kong has already deleted the expired code
+	if err := recordAuthorizationCode(consent, "https://client.example.com/callback?code=expired",
+		now.Add(-kongAuthorizationCodeTTL-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordAuthorizationCode(consent, "https://client.example.com/callback?code=wrong-client", now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code, clientSecret, want string
+	}{
+		{"expired", "secret", codeExpired},
+		{"never-issued", "secret", codeUnknown},
+		{"wrong-client", "not-the-secret", codeRefused},
+	}
+	for _, test := range tests {
+		if outcome, _ := exchangeCode(t, test.code, test.clientSecret); outcome != test.want {
+			t.Errorf("%s: outcome %s, want %s", test.code, outcome, test.want)
+		}
+		if describeCodeOutcome(test.code, test.want) == "" {
+			t.Errorf("%s: no explanation", test.code)
+		}
+	}
+
+	// A code refused for the wrong client can still be exchanged once by its own client
+	if outcome, _ := exchangeCode(t, "wrong-client", "secret"); outcome != codeExchanged {
+		t.Errorf("wrong-client: outcome %s after the right secret, want %s", outcome, codeExchanged)
+	}
+}
+
+// TestAuthorizationCodeOfflineAccess checks that with OFFLINE_ACCESS_REQUIRED only codes the user approved offline
+// access for are exchanged with a refresh token
+func TestAuthorizationCodeOfflineAccess(t *testing.T) {
+	kong := newSingleUseKongStub(t, "online", "offline", "unrecorded")
+	defer func(required bool) { offlineAccessRequired = required }(offlineAccessRequired)
+	offlineAccessRequired = true
+
+	online := ConsentRequest{ClientID: "client", ResponseType: responseTypeCode, Scopes: "openid,email"}
+	if err := recordAuthorizationCode(online, "https://client.example.com/callback?code=online", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	offline := ConsentRequest{ClientID: "client", ResponseType: responseTypeCode, Scopes: "openid,email,offline_access"}
+	if err := recordAuthorizationCode(offline, "https://client.example.com/callback?code=offline", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code         string
+		refreshToken interface{}
+	}{
+		{"online", nil},
+		{"offline", "refresh-offline"},
+		{"unrecorded", nil},
+	}
+	for _, test := range tests {
+		_, tokens := exchangeCode(t, test.code, "secret")
+		if tokens["access_token"] != "token-"+test.code || tokens["refresh_token"] != test.refreshToken {
+			t.Errorf("%s: tokens %v, want refresh token %v", test.code, tokens, test.refreshToken)
+		}
+	}
+
+	want := map[string]string{"token-online": "", "token-offline": "refresh-offline", "token-unrecorded": ""}
+	if got := kong.refreshTokens(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Kong holds refresh tokens %v, want %v", got, want)
+	}
+}
+
+// TestRemoveUnapprovedRefreshTokens checks that the refresh tokens of codes exchanged at Kong's token endpoint
+// directly are removed unless they were granted offline_access
+func TestRemoveUnapprovedRefreshTokens(t *testing.T) {
+	kong := newSingleUseKongStub(t, "online", "offline")
+	for _, code := range []string{"online", "offline"} {
+		res, err := http.PostForm(kongProxyEndpoint+apiPath+"/oauth2/token", url.Values{
+			"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"client"}, "client_secret": {"secret"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	removed, err := removeUnapprovedRefreshTokens(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"token-online": "", "token-offline": "refresh-offline"}
+	if got := kong.refreshTokens(); removed != 1 || !reflect.DeepEqual(got, want) {
+		t.Errorf("%d removed, Kong holds refresh tokens %v, want %v", removed, got, want)
+	}
+}
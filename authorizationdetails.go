@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// pendingAuthorizationDetails holds the authorization details approved with authorization codes until the client
+// exchanges the code at the token endpoint, keyed by the SHA-256 of the code
+var pendingAuthorizationDetails = newCache("pending_authorization_details",
+	envInt("PENDING_AUTHORIZATION_DETAILS_MAX_ENTRIES", 10000),
+	int64(envInt("PENDING_AUTHORIZATION_DETAILS_MAX_BYTES", 16<<20)),
+	envDuration("PENDING_AUTHORIZATION_DETAILS_TTL", 10*time.Minute))
+
+// maxAuthorizationDetailsLength bounds the authorization details clients may send, as they are kept in the session
+// and the consent form
+const maxAuthorizationDetailsLength = 4096
+
+// AuthorizationDetailsType is a client's template for one type of the RFC 9396 authorization details it may request,
+// listing the fields the details may have in the order they are shown on the consent page
+type AuthorizationDetailsType struct {
+	Type   string                      `json:"type"`
+	Label  string                      `json:"label,omitempty"`
+	Fields []AuthorizationDetailsField `json:"fields"`
+}
+
+// AuthorizationDetailsField is a field of a type of authorization details. Fields of nested objects are named by
+// their path, such as instructedAmount.amount.
+type AuthorizationDetailsField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label,omitempty"`
+	Required bool   `json:"required,omitempty"`
+
+	// Pattern is a regular expression the field's value must match in full, if set
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// authorizationDetail describes an authorization detail on the consent page
+type authorizationDetail struct {
+	Type   string
+	Label  string
+	Fields []authorizationDetailField
+}
+
+// authorizationDetailField describes a field of an authorization detail on the consent page
+type authorizationDetailField struct {
+	Name  string
+	Label string
+	Value string
+}
+
+// describeAuthorizationDetails validates the authorization_details of a request against the client's templates and
+// returns them as they are shown on the consent page, or false if they are invalid
+//
+// The details must be a JSON array of objects, each with a type the client has a template for. Every other field
+// must be in the template, as a string, number, boolean or array of them, so that the user is shown everything
+// they approve.
+func describeAuthorizationDetails(client *ClientSettings, raw string) ([]authorizationDetail, bool) {
+	if raw == "" {
+		return nil, true
+	}
+	if len(raw) > maxAuthorizationDetailsLength {
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	var details []map[string]interface{}
+	if err := decoder.Decode(&details); err != nil || decoder.More() || len(details) == 0 {
+		return nil, false
+	}
+
+	described := []authorizationDetail{}
+	for _, detail := range details {
+		detailType, _ := detail["type"].(string)
+		template := findAuthorizationDetailsType(client, detailType)
+		if template == nil {
+			return nil, false
+		}
+		values := map[string]string{}
+		delete(detail, "type")
+		if !flattenAuthorizationDetail(detail, "", values) {
+			return nil, false
+		}
+
+		fields := []authorizationDetailField{}
+		for _, field := range template.Fields {
+			value, ok := values[field.Name]
+			delete(values, field.Name)
+			if !ok {
+				if field.Required {
+					return nil, false
+				}
+				continue
+			}
+			if field.Pattern != "" {
+				pattern, err := regexp.Compile("^(?:" + field.Pattern + ")$")
+				if err != nil || !pattern.MatchString(value) {
+					return nil, false
+				}
+			}
+			fields = append(fields, authorizationDetailField{Name: field.Name, Label: orDefault(field.Label, field.Name), Value: value})
+		}
+		if len(values) > 0 {
+			return nil, false
+		}
+		described = append(described, authorizationDetail{Type: detailType, Label: orDefault(template.Label, detailType), Fields: fields})
+	}
+	return described, true
+}
+
+// findAuthorizationDetailsType returns the client's template for a type of authorization details, or nil
+func findAuthorizationDetailsType(client *ClientSettings, detailType string) *AuthorizationDetailsType {
+	for i := range client.AuthorizationDetailsTypes {
+		if detailType != "" && client.AuthorizationDetailsTypes[i].Type == detailType {
+			return &client.AuthorizationDetailsTypes[i]
+		}
+	}
+	return nil
+}
+
+// flattenAuthorizationDetail adds the fields of an authorization detail to values, naming the fields of nested
+// objects by their path, and reports whether every field has a value that can be shown
+func flattenAuthorizationDetail(detail map[string]interface{}, prefix string, values map[string]string) bool {
+	for name, value := range detail {
+		switch value := value.(type) {
+		case nil:
+		case map[string]interface{}:
+			if !flattenAuthorizationDetail(value, prefix+name+".", values) {
+				return false
+			}
+		case []interface{}:
+			items := []string{}
+			for _, item := range value {
+				text, ok := authorizationDetailValue(item)
+				if !ok {
+					return false
+				}
+				items = append(items, text)
+			}
+			values[prefix+name] = strings.Join(items, ", ")
+		default:
+			text, ok := authorizationDetailValue(value)
+			if !ok {
+				return false
+			}
+			values[prefix+name] = text
+		}
+	}
+	return true
+}
+
+// authorizationDetailValue returns the text of a string, number or boolean value of an authorization detail
+func authorizationDetailValue(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// orDefault returns s, or fallback if s is empty
+func orDefault(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// requireAuthorizationDetails returns the request's authorization details as they are shown on the consent page, and
+// reports whether it has completed the response with an error page because they are invalid for the client
+func requireAuthorizationDetails(ctx iris.Context, consent ConsentRequest, client *ClientSettings) ([]authorizationDetail, bool) {
+	details, ok := describeAuthorizationDetails(client, consent.AuthorizationDetails)
+	if !ok || (len(details) > 0 && consent.implicit()) {
+		viewError(ctx, iris.StatusBadRequest, "AuthorizationDetailsInvalid")
+		return nil, true
+	}
+	return details, false
+}
+
+// keepAuthorizationDetails holds the authorization details the user approved with the authorization code in
+// redirectURI, for the token endpoint to return them with the access token as RFC 9396 describes
+//
+// Kong knows nothing of authorization details, so resource servers see only the scopes of the token; clients are
+// expected to present the details to them, or to record them against the token.
+func keepAuthorizationDetails(consent ConsentRequest, redirectURI string) error {
+	if consent.AuthorizationDetails == "" {
+		return nil
+	}
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+	params := uri.Query()
+	if consent.fragment() {
+		if params, err = url.ParseQuery(uri.Fragment); err != nil {
+			return err
+		}
+	}
+	code := params.Get("code")
+	if code == "" {
+		return nil
+	}
+
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, []byte(consent.AuthorizationDetails)); err != nil {
+		return err
+	}
+	pendingAuthorizationDetails.Set(codeKey(code), compact.String(), int64(compact.Len()))
+	return nil
+}
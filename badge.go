@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	badgeLogin     = envBool("BADGE_LOGIN", false)
+	badgeAuthURL   = os.Getenv("BADGE_AUTH_URL")
+	badgeAuthToken = os.Getenv("BADGE_AUTH_TOKEN")
+
+	// badgeLimiter and badgeIPLimiter limit PIN attempts for each badge number and for each client address
+	badgeLimiter   = newKeyedLimiter(envInt("BADGE_LOGIN_RATE", 5), envInt("BADGE_LOGIN_BURST", 5))
+	badgeIPLimiter = newKeyedLimiter(envInt("BADGE_LOGIN_IP_RATE", 20), envInt("BADGE_LOGIN_IP_BURST", 20))
+)
+
+// badgeAuthenticator verifies badge numbers and PINs, against the user store unless BADGE_AUTH_URL is set
+var badgeAuthenticator = newBadgeAuthenticator()
+
+// pinPattern matches the PINs accepted for badge login
+var pinPattern = regexp.MustCompile(`^[0-9]{4,8}$`)
+
+// BadgeAuthenticator verifies a badge number and PIN and returns the user they belong to
+//
+// Implementations return ErrInvalidCredentials when the badge number and PIN do not match.
+type BadgeAuthenticator interface {
+	Authenticate(badge, pin string) (*User, error)
+}
+
+// BadgeLoginForm represents the badge number and PIN submitted on the badge login and enrollment pages
+type BadgeLoginForm struct {
+	Badge string
+	PIN   string
+}
+
+// newBadgeAuthenticator returns an HTTP callout authenticator if BADGE_AUTH_URL is configured, otherwise one
+// backed by the user store
+func newBadgeAuthenticator() BadgeAuthenticator {
+	if badgeAuthURL == "" {
+		return storeBadgeAuthenticator{}
+	}
+	return httpBadgeAuthenticator{
+		url:    badgeAuthURL,
+		token:  badgeAuthToken,
+		client: newExternalHTTPClient(5 * time.Second),
+	}
+}
+
+// storeBadgeAuthenticator verifies badge numbers and PINs enrolled on users in the user store
+type storeBadgeAuthenticator struct{}
+
+// Authenticate finds the user with the badge number and compares the PIN with its hash
+func (storeBadgeAuthenticator) Authenticate(badge, pin string) (*User, error) {
+	user, err := findUserByBadge(badge)
+	if err == ErrUserNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, rehash := checkPassword(user.PINHash, pin)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	if rehash {
+		hash, err := hashPassword(pin)
+		if err != nil {
+			return nil, err
+		}
+		countPasswordRehash(user.PINHash)
+		user.PINHash = hash
+		if err := users.Save(user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// httpBadgeAuthenticator verifies badge numbers and PINs with an external service, such as a door access system
+//
+// The service is sent {"badge": "...", "pin": "..."} and responds 200 OK with {"username": "..."} on success, or
+// 401 Unauthorized or 403 Forbidden if the badge number and PIN do not match. Users it vouches for are added to
+// the user store on their first login.
+type httpBadgeAuthenticator struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Authenticate posts the badge number and PIN to the service and returns the user it identifies
+func (a httpBadgeAuthenticator) Authenticate(badge, pin string) (*User, error) {
+	payload, err := json.Marshal(map[string]string{"badge": badge, "pin": pin})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, errors.New("badge authentication service responded " + res.Status)
+	}
+
+	response := struct {
+		Username string `json:"username"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Username == "" {
+		return nil, errors.New("badge authentication service did not return a username")
+	}
+
+	user, err := users.Get(response.Username)
+	if err == ErrUserNotFound {
+		user = &User{Username: response.Username, BadgeNumber: badge}
+		err = users.Create(user)
+		if err == ErrUserExists {
+			return users.Get(response.Username)
+		}
+	}
+	return user, err
+}
+
+// normalizeBadge removes spaces and dashes from a badge number so that it can be typed or scanned
+func normalizeBadge(badge string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(badge))
+}
+
+// findUserByBadge returns the user with the given badge number
+func findUserByBadge(badge string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		if user.BadgeNumber != "" && user.BadgeNumber == badge {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// getLoginBadge returns the badge login view on a GET request
+func getLoginBadge(ctx iris.Context) {
+	if !badgeLogin {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.View("badge-login.html")
+}
+
+// postLoginBadge handles POST requests to the badge login endpoint
+//
+// Attempts are rate limited for each badge number and each client address, and wrong PINs are counted with the
+// failed login counters, delaying and locking out the badge and the address like failed password logins. Users
+// who have enabled a second factor are asked for it before the login is completed.
+func postLoginBadge(ctx iris.Context) {
+	if !badgeLogin {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	form := BadgeLoginForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	badge := normalizeBadge(form.Badge)
+
+	if !badgeIPLimiter.Allow(rateLimitKey(ctx)) || !badgeLimiter.Allow(badge) {
+		ctx.StatusCode(iris.StatusTooManyRequests)
+		ctx.ViewData("Error", "Too many attempts. Please wait a minute and try again.")
+		ctx.View("badge-login.html")
+		return
+	}
+
+	_, ipKey := loginAttemptKeys(ctx, "")
+	attemptKeys := []loginAttemptKey{{"badge:" + badge, loginLockoutUser}, {ipKey, loginLockoutIP}}
+	wait, err := reserveLoginAttempt(attemptKeys...)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		ctx.StatusCode(iris.StatusTooManyRequests)
+		ctx.ViewData("Error", "Too many failed attempts. Please try again in "+strconv.Itoa(seconds)+" seconds.")
+		ctx.View("badge-login.html")
+		return
+	}
+	failed := false
+	defer func() {
+		if !failed {
+			releaseLoginAttempt(attemptKeys...)
+		}
+	}()
+
+	user, err := badgeAuthenticator.Authenticate(badge, form.PIN)
+	if err == ErrInvalidCredentials {
+		failed = true
+		if err := failLoginAttempt(attemptKeys...); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "Invalid badge number or PIN.")
+		ctx.View("badge-login.html")
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if err := loginAttempts.Delete(attemptKeys[0].key); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Shared terminals are never remembered
+	sess.Start(ctx).Set("rememberMe", false)
+
+	if requireSecondFactor(ctx, user) {
+		return
+	}
+
+	completeLogin(ctx, user)
+}
+
+// getAccountBadge returns the badge enrollment view on a GET request
+func getAccountBadge(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Badge", user.BadgeNumber)
+	ctx.View("badge-enroll.html")
+}
+
+// postAccountBadge handles POST requests to the badge enrollment endpoint, setting the user's badge number and PIN
+func postAccountBadge(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := BadgeLoginForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	badge := normalizeBadge(form.Badge)
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	message := ""
+	if badge == "" {
+		message = "Please enter your badge number."
+	} else if !pinPattern.MatchString(form.PIN) {
+		message = "PINs must be 4 to 8 digits."
+	} else if other, err := findUserByBadge(badge); err == nil && other.Username != user.Username {
+		message = "This badge number belongs to another account."
+	}
+	if message != "" {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", message)
+		ctx.ViewData("Badge", user.BadgeNumber)
+		ctx.View("badge-enroll.html")
+		return
+	}
+
+	hash, err := hashPassword(form.PIN)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	user.BadgeNumber = badge
+	user.PINHash = hash
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Notice", "Your badge number and PIN have been saved.")
+	ctx.ViewData("Badge", user.BadgeNumber)
+	ctx.View("badge-enroll.html")
+}
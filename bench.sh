@@ -0,0 +1,25 @@
+#!/bin/bash
+#
+# Runs the benchmark suite and compares the results against the recorded baseline.
+#
+#   ./bench.sh           compare the working tree against resources/bench-baseline.txt
+#   ./bench.sh baseline  record a new baseline
+#
+# Comparison requires benchstat (go install golang.org/x/perf/cmd/benchstat@latest).
+
+BASELINE="resources/bench-baseline.txt"
+COUNT="${BENCH_COUNT:-10}"
+
+if [ "$1" == "baseline" ]; then
+    go test -run '^$' -bench . -benchmem -count "$COUNT" . | tee "$BASELINE"
+    exit
+fi
+
+go test -run '^$' -bench . -benchmem -count "$COUNT" . | tee bench_output.txt
+
+if [ ! -f "$BASELINE" ]; then
+    echo "No baseline found at $BASELINE. Record one with './bench.sh baseline'."
+    exit 1
+fi
+
+benchstat "$BASELINE" bench_output.txt
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kataras/iris/v12"
+)
+
+// newKongStub starts a stand-in for Kong's admin and proxy endpoints and points the application at it
+func newKongStub(b *testing.B) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":[{"client_id":"client-id","name":"Test Client Application"}]}`))
+	})
+	mux.HandleFunc("/myapi/oauth2/authorize", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"redirect_uri":"http://some-domain/endpoint/?code=JJxhzunaoilSXgTpl24qjNM8hZqttAn5"}`))
+	})
+	srv := httptest.NewServer(mux)
+
+	kongAdminEndpoint = srv.URL
+	kongProxyEndpoint = srv.URL
+	apiPath = "/myapi"
+	provisionKey = "provision-key"
+
+	return srv
+}
+
+// newBenchApp builds the application so that requests can be served without a listener
+//
+// The audit log is discarded while the benchmark runs, so that it does not interleave with the results. Routes
+// registers any routes the benchmark serves in addition to the application's.
+func newBenchApp(b *testing.B, routes ...func(app *iris.Application)) http.Handler {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	app := newApp()
+	for _, register := range routes {
+		register(app)
+	}
+	if err := app.Build(); err != nil {
+		b.Fatal(err)
+	}
+	return app
+}
+
+// login authenticates a session and returns its cookie
+func login(b *testing.B, app http.Handler) *http.Cookie {
+	form := url.Values{"Username": {"user"}, "Password": {"pass"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == cookieNameForSessionID {
+			return c
+		}
+	}
+	b.Fatal("login did not set a session cookie")
+	return nil
+}
+
+func BenchmarkGetApplicationNameCacheHit(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+
+	if _, err := getApplicationName(context.Background(), "client-id"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getApplicationName(context.Background(), "client-id"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetApplicationNameCacheMiss(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clientCache.Delete("client-id")
+		if _, err := getApplicationName(context.Background(), "client-id"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCacheSetEvict(b *testing.B) {
+	cache := newCache("bench", 1000, 0, 0)
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		cache.Set(key, key, int64(len(key)*2))
+		cache.Get(key)
+	}
+}
+
+func BenchmarkGetRedirectURI(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+
+	consent := ConsentRequest{
+		ClientID:     "client-id",
+		ResponseType: "code",
+		Scopes:       "email,phone,address",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getRedirectURI(context.Background(), consent, "user", nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetConsentUnauthenticated(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+	app := newBenchApp(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/consent?client_id=client-id&response_type=code&scopes=email", nil)
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != http.StatusTemporaryRedirect {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+func BenchmarkGetConsentAuthenticated(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+	app := newBenchApp(b)
+	cookie := login(b, app)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/consent?client_id=client-id&response_type=code&scopes=email,phone,address", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+func BenchmarkPostConsent(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+	app := newBenchApp(b)
+
+	// The session approves far more often than a person would, which would otherwise be throttled
+	defer func(threshold int) { consentCycleThreshold = threshold }(consentCycleThreshold)
+	consentCycleThreshold = 0
+	cookie := login(b, app)
+
+	form := url.Values{
+		"ClientID":     {"client-id"},
+		"ResponseType": {"code"},
+		"Scopes":       {"email,phone,address"},
+	}.Encode()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/consent", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+func BenchmarkSessionMiddleware(b *testing.B) {
+	srv := newKongStub(b)
+	defer srv.Close()
+
+	// The route only reads the session, so that the middleware every request passes through is measured
+	app := newBenchApp(b, func(app *iris.Application) {
+		app.Get("/bench/session", func(ctx iris.Context) {
+			sess.Start(ctx).GetString("username")
+			ctx.StatusCode(iris.StatusNoContent)
+		})
+	})
+	cookie := login(b, app)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/bench/session", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
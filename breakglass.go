@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// breakGlassUsername is the username of the emergency administrator account
+	breakGlassUsername = envOrDefault("BREAK_GLASS_USERNAME", "break-glass")
+	// breakGlassPasswordHash is the password hash of the emergency administrator account, which is disabled if unset
+	breakGlassPasswordHash = os.Getenv("BREAK_GLASS_PASSWORD_HASH")
+	// breakGlassPasswordHashFile holds the password hash instead, such as a mounted secret
+	breakGlassPasswordHashFile = os.Getenv("BREAK_GLASS_PASSWORD_HASH_FILE")
+	// breakGlassTTL is how long a session of the emergency administrator account lasts
+	breakGlassTTL = envDuration("BREAK_GLASS_TTL", time.Hour)
+)
+
+// breakGlassLimiter limits login attempts to the emergency administrator account for each client address
+var breakGlassLimiter = newKeyedLimiter(3, 3)
+
+// BreakGlassLoginForm represents the credentials submitted on the break-glass login page
+type BreakGlassLoginForm struct {
+	Username string
+	Password string
+}
+
+// loadBreakGlassPasswordHash reads the password hash from BREAK_GLASS_PASSWORD_HASH_FILE, if it is set
+func loadBreakGlassPasswordHash() error {
+	if breakGlassPasswordHashFile == "" {
+		return nil
+	}
+	if breakGlassPasswordHash != "" {
+		return errors.New("only one of BREAK_GLASS_PASSWORD_HASH and BREAK_GLASS_PASSWORD_HASH_FILE may be set")
+	}
+	data, err := ioutil.ReadFile(breakGlassPasswordHashFile)
+	if err != nil {
+		return err
+	}
+	breakGlassPasswordHash = strings.TrimSpace(string(data))
+	return nil
+}
+
+// breakGlassSession reports whether the session belongs to the emergency administrator account
+func breakGlassSession(ctx iris.Context) bool {
+	return sess.Start(ctx).GetBooleanDefault("breakGlass", false)
+}
+
+// breakGlassAdmin returns the emergency administrator account, which does not exist in the user store
+func breakGlassAdmin() *User {
+	return &User{Username: breakGlassUsername, Roles: []string{adminRole}}
+}
+
+// getLoginBreakGlass returns the break-glass login view on a GET request
+func getLoginBreakGlass(ctx iris.Context) {
+	if breakGlassPasswordHash == "" {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.View("break-glass-login.html")
+}
+
+// postLoginBreakGlass logs in to the emergency administrator account
+//
+// The password is checked against the configured hash without the user store or the password authenticator, so
+// that administrators can still reach the administrative pages when the authentication backend is down. Every
+// attempt is recorded in the audit log and notified to administrators.
+func postLoginBreakGlass(ctx iris.Context) {
+	if breakGlassPasswordHash == "" {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	form := BreakGlassLoginForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if !breakGlassLimiter.Allow(rateLimitKey(ctx)) {
+		ctx.StatusCode(iris.StatusTooManyRequests)
+		ctx.ViewData("Error", "Too many attempts. Please wait a minute and try again.")
+		ctx.View("break-glass-login.html")
+		return
+	}
+
+	ok, _ := checkPassword(breakGlassPasswordHash, form.Password)
+	fields := map[string]string{"username": form.Username, "client_ip": clientIPString(ctx)}
+	if !ok || form.Username != breakGlassUsername {
+		audit(ctx, "breakglass.failed", fields)
+		notify(eventBreakGlassLogin, "Failed break-glass login", fields)
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "Invalid username or password.")
+		ctx.View("break-glass-login.html")
+		return
+	}
+
+	session := sess.Start(ctx)
+	session.Clear()
+	session.Set("authenticated", true)
+	session.Set("username", breakGlassUsername)
+	session.Set("authenticatedAt", time.Now().UnixNano())
+	session.Set("breakGlass", true)
+	audit(ctx, "breakglass.login", fields)
+	notify(eventBreakGlassLogin, "Break-glass login", fields)
+
+	ctx.Redirect("/admin/emails", iris.StatusSeeOther)
+}
+
+// restrictBreakGlass is middleware that limits sessions of the emergency administrator account to the
+// administrative pages, and ends them once BREAK_GLASS_TTL has passed
+func restrictBreakGlass(ctx iris.Context) {
+	if !breakGlassSession(ctx) {
+		ctx.Next()
+		return
+	}
+
+	session := sess.Start(ctx)
+	if time.Since(time.Unix(0, session.GetInt64Default("authenticatedAt", 0))) > breakGlassTTL {
+		session.Clear()
+		countSessionEnded("break_glass")
+		ctx.Redirect("/login/break-glass", iris.StatusSeeOther)
+		return
+	}
+
+	path := ctx.Path()
+	if strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/static/") || path == "/logout" {
+		ctx.Next()
+		return
+	}
+	viewError(ctx, iris.StatusForbidden, "BreakGlassRestricted")
+}
+
+// writePasswordHash reads a password from the first line of r and writes its hash to w, for configuring
+// BREAK_GLASS_PASSWORD_HASH
+func writePasswordHash(r io.Reader, w io.Writer) error {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("no password was given on standard input")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, hash)
+	return err
+}
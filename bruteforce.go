@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+)
+
+var (
+	loginDelayBase       = envDuration("LOGIN_DELAY_BASE", time.Second)
+	loginDelayMax        = envDuration("LOGIN_DELAY_MAX", 30*time.Second)
+	loginLockoutUser     = envInt("LOGIN_LOCKOUT_THRESHOLD", 5)
+	loginLockoutIP       = envInt("LOGIN_LOCKOUT_IP_THRESHOLD", 20)
+	loginLockoutDuration = envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginFailureWindow   = envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+
+	loginLockouts = metrics.Counter("login_lockouts_total", "Number of usernames and client addresses locked out after repeated failed logins.")
+)
+
+// sessionDB is the database sessions are stored in, or nil to hold sessions in memory
+//
+// It is opened in main when SESSION_STORE is redis, to run several replicas of the consent application.
+var sessionDB sessions.Database
+
+// loginAttempts holds failed login counters in the shared store, so that lockouts apply across replicas when it is
+// kept in Redis
+var loginAttempts = newLoginAttemptStore(sharedStore)
+
+// loginReservationTimeout is how long an attempt reserved with reserveLoginAttempt is counted for if the replica
+// verifying it never ends the reservation
+const loginReservationTimeout = time.Minute
+
+// loginFailures counts consecutive failed logins for a username or client address
+type loginFailures struct {
+	Count       int   `json:"count"`
+	LastFailure int64 `json:"last"`
+	LockedUntil int64 `json:"locked,omitempty"`
+	// Pending is the number of attempts reserved and still being verified, last reserved at Reserved
+	Pending  int   `json:"pending,omitempty"`
+	Reserved int64 `json:"reserved,omitempty"`
+}
+
+// retryAfter returns how long the client must wait before another attempt
+//
+// After each failure attempts are refused for an exponentially increasing delay, and after the lockout
+// threshold is reached for the lockout duration.
+func (f loginFailures) retryAfter(now time.Time) time.Duration {
+	until := time.Unix(0, f.LockedUntil)
+	if f.Count > 0 {
+		if delayed := time.Unix(0, f.LastFailure).Add(loginDelay(f.Count)); delayed.After(until) {
+			until = delayed
+		}
+	}
+	if wait := until.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// ttl returns how long the counter must be kept: until its failures are forgotten, its lockout ends and its
+// reservations time out, whichever is last
+func (f loginFailures) ttl(now time.Time) time.Duration {
+	ttl := time.Unix(0, f.LastFailure).Add(loginFailureWindow).Sub(now)
+	if locked := time.Unix(0, f.LockedUntil).Sub(now); locked > ttl {
+		ttl = locked
+	}
+	if f.Pending > 0 {
+		if reserved := time.Unix(0, f.Reserved).Add(loginReservationTimeout).Sub(now); reserved > ttl {
+			ttl = reserved
+		}
+	}
+	return ttl
+}
+
+// LoginAttemptStore keeps failed login counters in a SharedStore, where each expires on its own once it is no
+// longer needed
+type LoginAttemptStore struct {
+	store SharedStore
+}
+
+// newLoginAttemptStore returns a LoginAttemptStore keeping counters in store
+func newLoginAttemptStore(store SharedStore) LoginAttemptStore {
+	return LoginAttemptStore{store: store}
+}
+
+// loginAttemptsPrefix is prepended to the keys of counters in the shared store
+const loginAttemptsPrefix = "login-attempts:"
+
+// Get returns the counter for key, or a zero counter if there is none
+func (s LoginAttemptStore) Get(key string) (loginFailures, error) {
+	value, ok, err := s.store.Get(loginAttemptsPrefix + key)
+	if err != nil || !ok {
+		return loginFailures{}, err
+	}
+	return decodeLoginFailures(value, time.Now())
+}
+
+// update changes the counter for key with fn, unless fn returns false, with no other change of the counter in
+// between
+//
+// fn may be called again if another replica changed the counter meanwhile.
+func (s LoginAttemptStore) update(key string, now time.Time, fn func(failures *loginFailures) bool) error {
+	var decodeErr error
+	err := s.store.Update(loginAttemptsPrefix+key, func(value string, ok bool) (string, time.Duration, bool) {
+		failures := loginFailures{}
+		if ok {
+			if failures, decodeErr = decodeLoginFailures(value, now); decodeErr != nil {
+				return "", 0, false
+			}
+		}
+		if !fn(&failures) {
+			return "", 0, false
+		}
+		encoded, err := json.Marshal(failures)
+		if err != nil {
+			decodeErr = err
+			return "", 0, false
+		}
+		return string(encoded), failures.ttl(now), true
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// Delete removes the counter for key
+func (s LoginAttemptStore) Delete(key string) error {
+	return s.store.Delete(loginAttemptsPrefix + key)
+}
+
+// decodeLoginFailures decodes a stored counter, dropping reservations that have timed out
+func decodeLoginFailures(value string, now time.Time) (loginFailures, error) {
+	failures := loginFailures{}
+	if err := json.Unmarshal([]byte(value), &failures); err != nil {
+		return loginFailures{}, err
+	}
+	if failures.Pending > 0 && now.Sub(time.Unix(0, failures.Reserved)) > loginReservationTimeout {
+		failures.Pending = 0
+	}
+	return failures, nil
+}
+
+// loginAttemptKey is a counter a login attempt is reserved against, and the number of failures that locks it out,
+// or 0 for no lockout
+type loginAttemptKey struct {
+	key       string
+	threshold int
+}
+
+// reserveLoginAttempt reserves an attempt against the counter of each key before the attempt is verified, or returns
+// how long the client must wait before another attempt if any key is delayed or locked out
+//
+// A reservation is checked and counted in a single update of the counter, and attempts still being verified count
+// towards the lockout threshold, so that concurrent attempts cannot all pass the check before the first of them
+// has failed. Each reservation must be ended with failLoginAttempt or releaseLoginAttempt.
+func reserveLoginAttempt(keys ...loginAttemptKey) (time.Duration, error) {
+	now := time.Now()
+	for i, k := range keys {
+		var wait time.Duration
+		err := loginAttempts.update(k.key, now, func(failures *loginFailures) bool {
+			wait = failures.retryAfter(now)
+			if wait == 0 && k.threshold > 0 && failures.Count+failures.Pending >= k.threshold {
+				// The attempts being verified may lock the key out; the client tries again once they have ended
+				wait = time.Second
+			}
+			if wait > 0 {
+				return false
+			}
+			failures.Pending++
+			failures.Reserved = now.UnixNano()
+			return true
+		})
+		if err != nil || wait > 0 {
+			releaseLoginAttempt(keys[:i]...)
+			return wait, err
+		}
+	}
+	return 0, nil
+}
+
+// releaseLoginAttempt ends an attempt reserved with reserveLoginAttempt without counting it as a failure
+//
+// Errors are logged rather than returned, as the reservation times out on its own.
+func releaseLoginAttempt(keys ...loginAttemptKey) {
+	now := time.Now()
+	for _, k := range keys {
+		err := loginAttempts.update(k.key, now, func(failures *loginFailures) bool {
+			if failures.Pending == 0 {
+				return false
+			}
+			failures.Pending--
+			return true
+		})
+		if err != nil {
+			log.Printf("releasing login attempt: %v", err)
+		}
+	}
+}
+
+// failLoginAttempt ends an attempt reserved with reserveLoginAttempt, counting it as a failed login for each key and
+// locking a key out once its threshold of failures has been counted
+func failLoginAttempt(keys ...loginAttemptKey) error {
+	now := time.Now()
+	for _, k := range keys {
+		var lockedUntil int64
+		err := loginAttempts.update(k.key, now, func(failures *loginFailures) bool {
+			lockedUntil = 0
+			if failures.Pending > 0 {
+				failures.Pending--
+			}
+			failures.Count++
+			failures.LastFailure = now.UnixNano()
+			if k.threshold > 0 && failures.Count >= k.threshold {
+				// Delays start again from the base delay once the lockout has ended
+				failures.Count = 0
+				failures.LockedUntil = now.Add(loginLockoutDuration).UnixNano()
+				lockedUntil = failures.LockedUntil
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if lockedUntil != 0 {
+			loginLockouts.Inc()
+			notify(eventLoginLockout, "Logins locked out after repeated failures", map[string]string{
+				"key":   k.key,
+				"until": time.Unix(0, lockedUntil).UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	return nil
+}
+
+// loginDelay returns the delay after count consecutive failures, doubling with each failure up to the maximum
+func loginDelay(count int) time.Duration {
+	delay := loginDelayBase
+	for i := 1; i < count && delay < loginDelayMax; i++ {
+		delay *= 2
+	}
+	if delay > loginDelayMax {
+		delay = loginDelayMax
+	}
+	return delay
+}
+
+// loginAttemptKeys returns the counter keys for a login attempt with the username from the client's network
+func loginAttemptKeys(ctx iris.Context, username string) (userKey, ipKey string) {
+	return "user:" + username, "ip:" + rateLimitKey(ctx)
+}
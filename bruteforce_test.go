@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newRedisTestStore starts an in-memory Redis server and returns a function opening a shared store in it for each
+// replica, and the server
+func newRedisTestStore(t *testing.T) (func() SharedStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	return func() SharedStore {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return &redisStore{client: client, prefix: "test:shared:"}
+	}, server
+}
+
+// TestRedisAttemptStoreSharesLockouts checks that a lockout recorded by one replica in Redis is enforced by another,
+// and that each counter expires on its own
+func TestRedisAttemptStoreSharesLockouts(t *testing.T) {
+	replica, server := newRedisTestStore(t)
+	first, second := newLoginAttemptStore(replica()), newLoginAttemptStore(replica())
+	defer func(store LoginAttemptStore, base time.Duration) {
+		loginAttempts, loginDelayBase = store, base
+	}(loginAttempts, loginDelayBase)
+	loginDelayBase = 0
+
+	alice := loginAttemptKey{"user:alice", 3}
+	loginAttempts = first
+	for i := 0; i < 3; i++ {
+		if wait, err := reserveLoginAttempt(alice); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: wait %v, %v", i, wait, err)
+		}
+		if err := failLoginAttempt(alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loginAttempts = second
+	wait, err := reserveLoginAttempt(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < loginLockoutDuration-time.Minute {
+		t.Fatalf("the second replica waits %v after the lockout, expected about %v", wait, loginLockoutDuration)
+	}
+
+	bob := loginAttemptKey{"user:bob", 3}
+	if wait, err := reserveLoginAttempt(bob); err != nil || wait != 0 {
+		t.Fatalf("bob waits %v, %v", wait, err)
+	}
+	if err := failLoginAttempt(bob); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("test:shared:login-attempts:user:bob"); ttl <= 0 || ttl > loginFailureWindow {
+		t.Fatalf("bob's counter is kept for %v, expected up to %v", ttl, loginFailureWindow)
+	}
+	if ttl := server.TTL("test:shared:login-attempts:user:alice"); ttl <= loginLockoutDuration-time.Minute {
+		t.Fatalf("alice's counter is kept for %v, expected about %v", ttl, loginLockoutDuration)
+	}
+	server.FastForward(loginFailureWindow + time.Second)
+	if failures, err := first.Get("user:bob"); err != nil || failures.Count != 0 {
+		t.Fatalf("expired counter read as %+v, %v", failures, err)
+	}
+
+	if err := first.Delete("user:alice"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := reserveLoginAttempt(alice); err != nil || wait != 0 {
+		t.Fatalf("the second replica waits %v, %v after the counter was reset", wait, err)
+	}
+	releaseLoginAttempt(alice)
+}
+
+// TestReserveLoginAttemptConcurrently checks that concurrent attempts, in one replica or several, cannot together
+// make more guesses than the lockout threshold allows
+func TestReserveLoginAttemptConcurrently(t *testing.T) {
+	replica, _ := newRedisTestStore(t)
+	stores := map[string]func() SharedStore{
+		"memory": func() SharedStore { return newMemoryStore() },
+		"redis":  replica,
+	}
+	defer func(store LoginAttemptStore, base time.Duration) {
+		loginAttempts, loginDelayBase = store, base
+	}(loginAttempts, loginDelayBase)
+	loginDelayBase = 0
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			loginAttempts = newLoginAttemptStore(open())
+			key := loginAttemptKey{"user:carol", 3}
+
+			var mu sync.Mutex
+			reserved := 0
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					wait, err := reserveLoginAttempt(key)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if wait == 0 {
+						mu.Lock()
+						reserved++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if reserved != key.threshold {
+				t.Fatalf("%d concurrent attempts were reserved, expected %d", reserved, key.threshold)
+			}
+
+			// A released reservation can be made again, and failures lock the key out
+			releaseLoginAttempt(key)
+			if wait, err := reserveLoginAttempt(key); err != nil || wait != 0 {
+				t.Fatalf("attempt after a release waits %v, %v", wait, err)
+			}
+			for i := 0; i < key.threshold; i++ {
+				if err := failLoginAttempt(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if wait, err := reserveLoginAttempt(key); err != nil || wait < loginLockoutDuration-time.Minute {
+				t.Fatalf("attempt after %d failures waits %v, %v", key.threshold, wait, err)
+			}
+		})
+	}
+}
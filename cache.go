@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// clientCache holds client metadata fetched from Kong's Admin API, keyed by client_id
+var clientCache = newCache("client_metadata",
+	envInt("CLIENT_CACHE_MAX_ENTRIES", 1000),
+	int64(envInt("CLIENT_CACHE_MAX_BYTES", 1<<20)),
+	envDuration("CLIENT_CACHE_TTL", time.Minute))
+
+// Cache is a concurrency-safe LRU cache bounded by both entry count and approximate size in bytes
+//
+// Every cache in the consent application should be created with newCache so that memory use is
+// bounded on busy gateways and hits, misses and evictions are exposed on '/metrics'.
+type Cache struct {
+	maxEntries int
+	maxBytes   int64
+	ttl        time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	bytes int64
+
+	hits      *Counter
+	misses    *Counter
+	evictions *Counter
+}
+
+// cacheEntry is a single value held in a Cache
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// newCache creates a named cache holding at most maxEntries values and maxBytes bytes
+//
+// A maxEntries or maxBytes of zero disables that limit. A ttl of zero means entries never expire.
+func newCache(name string, maxEntries int, maxBytes int64, ttl time.Duration) *Cache {
+	c := &Cache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+		hits:       metrics.Counter("cache_hits_total", "Number of cache lookups that found a value.", "cache", name),
+		misses:     metrics.Counter("cache_misses_total", "Number of cache lookups that found no value.", "cache", name),
+		evictions:  metrics.Counter("cache_evictions_total", "Number of values evicted to stay within cache limits.", "cache", name),
+	}
+
+	metrics.GaugeFunc("cache_entries", "Number of values held in the cache.", func() float64 {
+		return float64(c.Len())
+	}, "cache", name)
+	metrics.GaugeFunc("cache_bytes", "Approximate size in bytes of the values held in the cache.", func() float64 {
+		return float64(c.Bytes())
+	}, "cache", name)
+
+	return c
+}
+
+// Get returns the value for key and marks it as recently used
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.removeElement(element)
+		c.misses.Inc()
+		return nil, false
+	}
+
+	c.ll.MoveToFront(element)
+	c.hits.Inc()
+	return entry.value, true
+}
+
+// Set adds or replaces the value for key, where size is the approximate size of the key and value in bytes
+//
+// Least recently used values are evicted until the cache is within its limits. A value larger
+// than maxBytes is not cached.
+func (c *Cache) Set(key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	entry := &cacheEntry{key: key, value: value, size: size}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	c.bytes += size
+
+	for (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeElement(c.ll.Back())
+		c.evictions.Inc()
+	}
+}
+
+// Delete removes the value for key
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// Len returns the number of values held in the cache
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Bytes returns the approximate size in bytes of the values held in the cache
+func (c *Cache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// removeElement removes an element from the cache; the caller must hold the lock
+func (c *Cache) removeElement(element *list.Element) {
+	entry := c.ll.Remove(element).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
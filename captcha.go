@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	captchaProviderName = os.Getenv("CAPTCHA_PROVIDER")
+	captchaSiteKey      = os.Getenv("CAPTCHA_SITE_KEY")
+	captchaSecret       = os.Getenv("CAPTCHA_SECRET")
+	captchaAfter        = envInt("CAPTCHA_AFTER_FAILURES", 3)
+)
+
+// captcha verifies CAPTCHA responses, or is nil when CAPTCHA_PROVIDER is unset
+var captcha = newCaptchaProvider(captchaProviderName)
+
+// CaptchaProvider verifies the response of a CAPTCHA widget rendered on a form
+type CaptchaProvider interface {
+	// Widget returns what a view needs to render the provider's widget
+	Widget() CaptchaWidget
+	// ResponseField is the name of the form field the widget submits its response in
+	ResponseField() string
+	// Verify reports whether the response was solved by a human, optionally from the given address
+	Verify(response, remoteIP string) (bool, error)
+}
+
+// CaptchaWidget is the script and markup class that render a CAPTCHA widget
+type CaptchaWidget struct {
+	ScriptURL string
+	Class     string
+	SiteKey   string
+}
+
+// siteverifyCaptcha is a provider using the 'siteverify' API shared by hCaptcha, reCAPTCHA and Turnstile
+type siteverifyCaptcha struct {
+	verifyURL     string
+	responseField string
+	widget        CaptchaWidget
+	secret        string
+	client        *http.Client
+}
+
+// newCaptchaProvider returns the named provider: hcaptcha, recaptcha or turnstile
+func newCaptchaProvider(name string) CaptchaProvider {
+	provider := &siteverifyCaptcha{
+		secret: captchaSecret,
+		client: newExternalHTTPClient(5 * time.Second),
+	}
+
+	switch name {
+	case "":
+		return nil
+	case "hcaptcha":
+		provider.verifyURL = "https://api.hcaptcha.com/siteverify"
+		provider.responseField = "h-captcha-response"
+		provider.widget = CaptchaWidget{ScriptURL: "https://js.hcaptcha.com/1/api.js", Class: "h-captcha"}
+	case "recaptcha":
+		provider.verifyURL = "https://www.google.com/recaptcha/api/siteverify"
+		provider.responseField = "g-recaptcha-response"
+		provider.widget = CaptchaWidget{ScriptURL: "https://www.google.com/recaptcha/api.js", Class: "g-recaptcha"}
+	case "turnstile":
+		provider.verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+		provider.responseField = "cf-turnstile-response"
+		provider.widget = CaptchaWidget{ScriptURL: "https://challenges.cloudflare.com/turnstile/v0/api.js", Class: "cf-turnstile"}
+	default:
+		log.Fatalf("unknown CAPTCHA_PROVIDER %q, expected hcaptcha, recaptcha or turnstile", name)
+	}
+	provider.widget.SiteKey = captchaSiteKey
+
+	return provider
+}
+
+// Widget returns the provider's widget
+func (c *siteverifyCaptcha) Widget() CaptchaWidget {
+	return c.widget
+}
+
+// ResponseField returns the form field of the provider's response
+func (c *siteverifyCaptcha) ResponseField() string {
+	return c.responseField
+}
+
+// Verify posts the response to the provider's 'siteverify' endpoint
+func (c *siteverifyCaptcha) Verify(response, remoteIP string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+
+	data := url.Values{}
+	data.Set("secret", c.secret)
+	data.Set("response", response)
+	if remoteIP != "" {
+		data.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.verifyURL, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	result := struct {
+		Success bool `json:"success"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// loginCaptchaRequired reports whether a login from the client, optionally for a username, must solve a CAPTCHA
+//
+// A CAPTCHA is required after CAPTCHA_AFTER_FAILURES failed logins for the username or from the client's address,
+// or always if it is zero or the address is listed by the IP reputation provider with IP_REPUTATION_ACTION=challenge.
+func loginCaptchaRequired(ctx iris.Context, username string) (bool, error) {
+	if captcha == nil {
+		return false, nil
+	}
+	if captchaAfter <= 0 || reputationChallenge(ctx) {
+		return true, nil
+	}
+
+	userKey, ipKey := loginAttemptKeys(ctx, username)
+	keys := []string{ipKey}
+	if username != "" {
+		keys = append(keys, userKey)
+	}
+	for _, key := range keys {
+		failures, err := loginAttempts.Get(key)
+		if err != nil {
+			return false, err
+		}
+		if failures.Count >= captchaAfter || failures.LockedUntil != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyCaptcha verifies the CAPTCHA response submitted with the request's form
+func verifyCaptcha(ctx iris.Context) (bool, error) {
+	return captcha.Verify(ctx.FormValue(captcha.ResponseField()), clientIPString(ctx))
+}
+
+// viewCaptcha adds the CAPTCHA widget to the view data when one is required
+func viewCaptcha(ctx iris.Context, required bool) {
+	if required {
+		ctx.ViewData("Captcha", captcha.Widget())
+	}
+}
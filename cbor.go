@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errCBORMalformed = errors.New("malformed CBOR data")
+
+// maxCBORDepth limits nesting when decoding CBOR so that crafted input cannot exhaust the stack
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR data item in data, as used by WebAuthn attestation objects and COSE keys
+//
+// Only the subset of CBOR produced by authenticators is supported. Integers decode to int64,
+// byte strings to []byte, text strings to string, arrays to []interface{} and maps to
+// map[interface{}]interface{}. The number of bytes consumed is returned alongside the value.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+// decodeCBORItem decodes a single data item at the given nesting depth
+func decodeCBORItem(data []byte, depth int) (interface{}, int, error) {
+	if len(data) == 0 || depth > maxCBORDepth {
+		return nil, 0, errCBORMalformed
+	}
+
+	major := data[0] >> 5
+	arg, n, err := decodeCBORArgument(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, 0, errCBORMalformed
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, 0, errCBORMalformed
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, errCBORMalformed
+		}
+		end := n + int(arg)
+		if major == 3 {
+			return string(data[n:end]), end, nil
+		}
+		return append([]byte(nil), data[n:end]...), end, nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errCBORMalformed
+		}
+		items := make([]interface{}, 0, int(arg))
+		for i := uint64(0); i < arg; i++ {
+			item, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += used
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errCBORMalformed
+		}
+		m := make(map[interface{}]interface{}, int(arg))
+		for i := uint64(0); i < arg; i++ {
+			key, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += used
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errCBORMalformed
+			}
+			value, used, err := decodeCBORItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += used
+			m[key] = value
+		}
+		return m, n, nil
+	case 7:
+		switch data[0] & 0x1f {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22, 23:
+			return nil, n, nil
+		}
+	}
+
+	return nil, 0, errCBORMalformed
+}
+
+// decodeCBORArgument decodes the argument of the initial byte, returning it and the header length
+func decodeCBORArgument(data []byte) (uint64, int, error) {
+	info := data[0] & 0x1f
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24 && len(data) >= 2:
+		return uint64(data[1]), 2, nil
+	case info == 25 && len(data) >= 3:
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26 && len(data) >= 5:
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27 && len(data) >= 9:
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	}
+	return 0, 0, errCBORMalformed
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/kataras/iris/v12"
+)
+
+// clientAuthLimiter slows down guessing of client secrets, per client network
+var clientAuthLimiter = newKeyedLimiter(envInt("CLIENT_AUTH_RATE_LIMIT", 60), 20)
+
+// oauth2ClientSecrets is a partial representation of Kong's OAuth 2.0 credentials resource, with the client secret
+type oauth2ClientSecrets struct {
+	Data []struct {
+		ClientSecret string `json:"client_secret"`
+	} `json:"data"`
+}
+
+// authenticateClient authenticates the client application calling an API with its Kong OAuth 2.0 credential, and
+// returns its client ID
+//
+// Clients send their client_id and client_secret with HTTP Basic authentication or in the form body, as they do to
+// Kong's token endpoint. Clients that fail to authenticate are refused with problem details.
+func authenticateClient(ctx iris.Context, realm string) (string, bool) {
+	if !clientAuthLimiter.Allow(rateLimitKey(ctx)) {
+		viewProblem(ctx, iris.StatusTooManyRequests, problemServiceUnavailable, "Too many client authentication attempts.")
+		return "", false
+	}
+
+	clientID, clientSecret, ok := ctx.Request().BasicAuth()
+	if ok {
+		// The credentials are form-encoded before they are Basic encoded, as RFC 6749 section 2.3.1 describes
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = ctx.PostValue("client_id"), ctx.PostValue("client_secret")
+	}
+	if clientID == "" || clientSecret == "" {
+		ctx.Header("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		viewProblem(ctx, iris.StatusUnauthorized, problemUnauthorized, "Client authentication is required.")
+		return "", false
+	}
+
+	secret, err := getOAuth2ClientSecret(kongContext(ctx), clientID)
+	if err != nil && !errors.Is(err, ErrUnknownClient) {
+		failWithProblem(ctx, err)
+		return "", false
+	}
+	if err != nil || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(secret)) != 1 {
+		audit(ctx, "client.authentication_failed", map[string]string{"client_id": clientID})
+		ctx.Header("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		viewProblem(ctx, iris.StatusUnauthorized, problemUnauthorized, "The client credentials are invalid.")
+		return "", false
+	}
+	return clientID, true
+}
+
+// getOAuth2ClientSecret queries the OAuth 2.0 credentials on Kong to fetch the client's secret
+//
+// Unlike the rest of the client's registration, the secret is not cached, so that rotated secrets stop working
+// straight away.
+func getOAuth2ClientSecret(ctx context.Context, clientID string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/oauth2?client_id="+url.QueryEscape(clientID), nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := executeRequest(req)
+	if err != nil {
+		return "", wrapError(ErrKongUnavailable, "fetching OAuth 2.0 credentials", err)
+	}
+
+	creds := oauth2ClientSecrets{}
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return "", wrapError(ErrKongUnavailable, "reading OAuth 2.0 credentials", err)
+	}
+	if len(creds.Data) == 0 || creds.Data[0].ClientSecret == "" {
+		return "", wrapError(ErrUnknownClient, "client_id "+clientID, ErrClientNotFound)
+	}
+	return creds.Data[0].ClientSecret, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+const (
+	clientCertUsernameCN    = "cn"
+	clientCertUsernameEmail = "email"
+)
+
+// clientCertUsername selects how a client certificate identifies its user: by the subject's common name, which is
+// the username, or by the first email address in the subject alternative names, which is looked up in the user store
+var clientCertUsername = envOrDefault("CLIENT_CERT_USERNAME", clientCertUsernameCN)
+
+// clientCertLogin logs in the user identified by the request's verified client certificate and reports whether it
+// has completed the response
+//
+// Requests without a certificate, or with one that does not identify a user, are left to the login form.
+// Certificates are only requested by the TLS listener when TLS_CLIENT_CA_FILE is set, and are not used in kiosk mode.
+func clientCertLogin(ctx iris.Context) bool {
+	state := ctx.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || kioskMode {
+		return false
+	}
+
+	user, err := findUserByCertificate(state.VerifiedChains[0][0])
+	if err == ErrUserNotFound {
+		log.Printf("client certificate from %s does not identify a user", clientIPString(ctx))
+		return false
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+
+	if requireSecondFactor(ctx, user) {
+		return true
+	}
+
+	completeLogin(ctx, user)
+	return true
+}
+
+// findUserByCertificate returns the user a client certificate identifies
+//
+// Common names vouched for by a trusted certificate authority are added to the user store on their first login.
+func findUserByCertificate(cert *x509.Certificate) (*User, error) {
+	switch clientCertUsername {
+	case clientCertUsernameEmail:
+		if len(cert.EmailAddresses) == 0 {
+			return nil, ErrUserNotFound
+		}
+		return findUserByEmail(cert.EmailAddresses[0])
+	default:
+		username := strings.TrimSpace(cert.Subject.CommonName)
+		if username == "" {
+			return nil, ErrUserNotFound
+		}
+		user, err := users.Get(username)
+		if err == ErrUserNotFound {
+			user = &User{Username: username}
+			err = users.Create(user)
+			if err == ErrUserExists {
+				return users.Get(username)
+			}
+		}
+		return user, err
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// trustedProxies are the networks of reverse proxies whose X-Forwarded-For header is believed
+	trustedProxies = parseCIDRs(envList("TRUSTED_PROXIES"))
+
+	// rateLimitIPv4Prefix and rateLimitIPv6Prefix are the prefix lengths client addresses are grouped by when
+	// rate limiting, since a single IPv6 client is usually assigned a whole /64
+	rateLimitIPv4Prefix = envInt("RATE_LIMIT_IPV4_PREFIX", 32)
+	rateLimitIPv6Prefix = envInt("RATE_LIMIT_IPV6_PREFIX", 64)
+)
+
+// parseCIDRs parses networks in CIDR notation, treating a bare address as a network of one address
+func parseCIDRs(values []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := normalizeIP(net.ParseIP(value)); ip != nil {
+				value = ip.String() + "/" + strconv.Itoa(8*len(ip))
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Printf("invalid network %q: %v", value, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// normalizeIP returns ip in its shortest form, so that IPv4-mapped IPv6 addresses such as ::ffff:192.0.2.1
+// compare equal to the IPv4 address
+func normalizeIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// parseIP parses an address that may include a port, brackets or an IPv6 zone
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return normalizeIP(net.ParseIP(addr))
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted reverse proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request
+//
+// When the request comes from a trusted proxy, the X-Forwarded-For header is read from right to left and the first
+// address that is not a trusted proxy is the client. Otherwise the connection's remote address is the client.
+func clientIP(ctx iris.Context) net.IP {
+	ip := parseIP(ctx.Request().RemoteAddr)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(ctx.GetHeader("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := parseIP(forwarded[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientIPString returns the client's address as a string, or an empty string if it is unknown
+func clientIPString(ctx iris.Context) string {
+	ip := clientIP(ctx)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// rateLimitKey returns the key client addresses are rate limited by: the address's network with the configured
+// IPv4 or IPv6 prefix length
+func rateLimitKey(ctx iris.Context) string {
+	ip := clientIP(ctx)
+	if ip == nil {
+		return ""
+	}
+
+	prefix := rateLimitIPv6Prefix
+	if len(ip) == net.IPv4len {
+		prefix = rateLimitIPv4Prefix
+	}
+	mask := net.CIDRMask(prefix, 8*len(ip))
+	if mask == nil {
+		return ip.String()
+	}
+	return ip.Mask(mask).String() + "/" + strconv.Itoa(prefix)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ErrClientNotFound is returned by a ClientStore when no settings exist for the requested client
+var ErrClientNotFound = errors.New("client not found")
+
+// clientRegistryPath is the JSON file holding client settings, held in memory if unset
+var clientRegistryPath = os.Getenv("CLIENT_REGISTRY_PATH")
+
+// clients holds settings for client applications that are not part of Kong's OAuth 2.0 credentials
+var clients ClientStore = &fileClientStore{clients: map[string]ClientSettings{}}
+
+// ClientSettings holds the consent application's settings for a client application registered with Kong
+type ClientSettings struct {
+	ClientID     string   `json:"client_id"`
+	Owners       []string `json:"owners,omitempty"`
+	LogoURI      string   `json:"logo_uri,omitempty"`
+	PrimaryColor string   `json:"primary_color,omitempty"`
+	AppLinks     []string `json:"app_links,omitempty"`
+
+	// WebhookURL is sent a signed event, with WebhookSecret, the first time each user authorizes the client
+	WebhookURL    string `json:"webhook_url,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+
+	// AuthorizationDetailsTypes are the templates of the RFC 9396 authorization details the client may request
+	AuthorizationDetailsTypes []AuthorizationDetailsType `json:"authorization_details_types,omitempty"`
+
+	// AllowedScopes are the scopes the client may request; it may request any scope configured on Kong if empty
+	AllowedScopes []string `json:"allowed_scopes,omitempty"`
+
+	// JWKS are the public keys the client signs request objects with, and RequestURIs the URIs it may publish them at
+	JWKS        *JSONWebKeySet `json:"jwks,omitempty"`
+	RequestURIs []string       `json:"request_uris,omitempty"`
+
+	// GrantTypes, ResponseTypes and TokenEndpointAuthMethod are what a client registered with dynamic client
+	// registration may use; clients without them may use any that Kong allows
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+}
+
+// ClientStore persists client settings
+type ClientStore interface {
+	Get(clientID string) (*ClientSettings, error)
+	List() ([]*ClientSettings, error)
+	Save(client *ClientSettings) error
+	Delete(clientID string) error
+}
+
+// fileClientStore is a ClientStore held in memory and optionally persisted to a JSON file
+type fileClientStore struct {
+	path    string
+	mu      sync.RWMutex
+	clients map[string]ClientSettings
+}
+
+// openClientStore opens the client registry at path, or an in-memory store if path is empty
+func openClientStore(path string) (ClientStore, error) {
+	store := &fileClientStore{path: path, clients: map[string]ClientSettings{}}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, wrapError(ErrStore, "reading client registry", err)
+	}
+
+	var list []ClientSettings
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, wrapError(ErrStore, "parsing client registry", err)
+	}
+	for _, client := range list {
+		store.clients[client.ClientID] = client
+	}
+
+	return store, nil
+}
+
+// Get returns a copy of the settings for the client
+func (s *fileClientStore) Get(clientID string) (*ClientSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, ok := s.clients[clientID]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return copyClientSettings(client), nil
+}
+
+// List returns a copy of the settings of every client in the store
+func (s *fileClientStore) List() ([]*ClientSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*ClientSettings, 0, len(s.clients))
+	for _, client := range s.clients {
+		list = append(list, copyClientSettings(client))
+	}
+	return list, nil
+}
+
+// Save creates or replaces the settings for a client and writes the store to disk
+func (s *fileClientStore) Save(client *ClientSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[client.ClientID] = *client
+	return s.flush()
+}
+
+// Delete removes the settings for a client and writes the store to disk
+func (s *fileClientStore) Delete(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[clientID]; !ok {
+		return ErrClientNotFound
+	}
+	delete(s.clients, clientID)
+	return s.flush()
+}
+
+// Compact rewrites the store's file from the settings held in memory
+func (s *fileClientStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+// flush writes all client settings to the store's file; the caller must hold the write lock
+func (s *fileClientStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+
+	list := make([]ClientSettings, 0, len(s.clients))
+	for _, client := range s.clients {
+		list = append(list, client)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return wrapError(ErrStore, "encoding client registry", err)
+	}
+
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		return wrapError(ErrStore, "writing client registry", err)
+	}
+	return nil
+}
+
+// copyClientSettings returns a copy of client that shares no slices with the stored value
+func copyClientSettings(client ClientSettings) *ClientSettings {
+	client.Owners = append([]string(nil), client.Owners...)
+	client.AppLinks = append([]string(nil), client.AppLinks...)
+	client.RequestURIs = append([]string(nil), client.RequestURIs...)
+	client.AllowedScopes = append([]string(nil), client.AllowedScopes...)
+	if client.JWKS != nil {
+		client.JWKS = &JSONWebKeySet{Keys: append([]JSONWebKey(nil), client.JWKS.Keys...)}
+	}
+	return &client
+}
+
+// getClientSettings returns the settings for a client, or empty settings if none are registered
+func getClientSettings(clientID string) (*ClientSettings, error) {
+	client, err := clients.Get(clientID)
+	if err == ErrClientNotFound {
+		return &ClientSettings{ClientID: clientID}, nil
+	}
+	return client, err
+}
+
+// isClientOwner reports whether the user may manage a client in the developer portal
+//
+// Without a CLIENT_REGISTRY_PATH the application runs as a demo and every user may manage every client.
+func isClientOwner(client *ClientSettings, username string) bool {
+	if clientRegistryPath == "" {
+		return true
+	}
+	for _, owner := range client.Owners {
+		if owner == username {
+			return true
+		}
+	}
+	return false
+}
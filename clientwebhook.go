@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// clientWebhookTimeout is how long a client's webhook endpoint has to respond to each delivery
+	clientWebhookTimeout = envDuration("CLIENT_WEBHOOK_TIMEOUT", 5*time.Second)
+	// clientWebhookAttempts is how many times a delivery is attempted before it is dropped
+	clientWebhookAttempts = envInt("CLIENT_WEBHOOK_ATTEMPTS", 3)
+)
+
+// clientWebhookClient sends client webhook deliveries
+var clientWebhookClient = newExternalHTTPClient(clientWebhookTimeout)
+
+// authorizationEvent is the payload sent to a client's webhook the first time a user authorizes the client
+type authorizationEvent struct {
+	ID                  string   `json:"id"`
+	Event               string   `json:"event"`
+	ClientID            string   `json:"client_id"`
+	AuthenticatedUserID string   `json:"authenticated_userid"`
+	Scopes              []string `json:"scopes"`
+	Time                string   `json:"time"`
+}
+
+// WebhookForm represents the webhook settings submitted in the developer portal
+type WebhookForm struct {
+	ClientID     string
+	URL          string
+	RotateSecret bool
+}
+
+// notifyFirstAuthorization sends the client's webhook, if it has one, an event for a user's first authorization
+//
+// The event is queued for delivery, retried with a growing delay if the endpoint fails, so that the user is not
+// kept waiting on the client's endpoint.
+func notifyFirstAuthorization(client *ClientSettings, authenticatedUserID string, scopes []string, now time.Time) {
+	if client.WebhookURL == "" || client.WebhookSecret == "" {
+		return
+	}
+
+	id, err := randomTokenPart()
+	if err != nil {
+		log.Printf("client webhook for %s: %v", client.ClientID, err)
+		return
+	}
+	payload, err := json.Marshal(authorizationEvent{
+		ID:                  id,
+		Event:               "authorization.created",
+		ClientID:            client.ClientID,
+		AuthenticatedUserID: authenticatedUserID,
+		Scopes:              scopes,
+		Time:                now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("client webhook for %s: %v", client.ClientID, err)
+		return
+	}
+
+	err = enqueue(deliveryClientWebhook, priorityNormal, clientWebhookDelivery{
+		ClientID: client.ClientID,
+		URL:      client.WebhookURL,
+		Secret:   client.WebhookSecret,
+		Payload:  payload,
+	})
+	if err != nil {
+		log.Printf("client webhook for %s: %v", client.ClientID, err)
+	}
+}
+
+// clientWebhookDelivery is an event queued for a client's webhook
+type clientWebhookDelivery struct {
+	ClientID string          `json:"client_id"`
+	URL      string          `json:"url"`
+	Secret   string          `json:"secret"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// deliverQueuedClientWebhook delivers a queued client webhook event
+func deliverQueuedClientWebhook(payload json.RawMessage) error {
+	delivery := clientWebhookDelivery{}
+	if err := json.Unmarshal(payload, &delivery); err != nil {
+		return err
+	}
+	err := deliverClientWebhook(delivery.URL, delivery.Secret, delivery.Payload)
+	metrics.Counter("client_webhook_deliveries_total", "Number of attempts to deliver client webhook events, by outcome.",
+		"outcome", deliveryOutcome(err)).Inc()
+	if err != nil {
+		return fmt.Errorf("client webhook for %s to %s: %w", delivery.ClientID, delivery.URL, err)
+	}
+	return nil
+}
+
+// deliverClientWebhook posts a signed payload to a client's webhook endpoint
+//
+// The X-Consent-Signature header holds t, the Unix time of the delivery, and v1, the hex encoded HMAC-SHA256 of
+// the time, a period and the body, keyed with the client's webhook secret.
+func deliverClientWebhook(webhookURL, secret string, payload []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Consent-Signature", "t="+timestamp+",v1="+signWebhookPayload(secret, timestamp, payload))
+
+	res, err := clientWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("webhook endpoint responded " + res.Status)
+	}
+	return nil
+}
+
+// signWebhookPayload returns the signature of a webhook delivery
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliveryOutcome returns the outcome label of a delivery attempt
+func deliveryOutcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "delivered"
+}
+
+// webhookURLProblem returns a user-facing message for a webhook URL that is invalid or would be sent events in
+// the clear, or "" if the URL is acceptable
+func webhookURLProblem(webhookURL string) string {
+	uri, err := url.Parse(webhookURL)
+	if err != nil || uri.Host == "" {
+		return "The webhook URL is not a valid URL."
+	}
+	if uri.Scheme != "https" {
+		return "The webhook URL must use https."
+	}
+	return ""
+}
+
+// getDeveloperWebhook returns the view of a client's webhook settings on a GET request
+func getDeveloperWebhook(ctx iris.Context) {
+	client, ok := ownedClient(ctx, ctx.URLParam("client_id"))
+	if !ok {
+		return
+	}
+	viewDeveloperWebhook(ctx, client)
+}
+
+// postDeveloperWebhook saves a client's webhook settings
+//
+// A signing secret is generated when the webhook is first set up or the owner asks for a new one, and shown only
+// once. Submitting an empty URL removes the webhook.
+func postDeveloperWebhook(ctx iris.Context) {
+	form := WebhookForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	client, ok := ownedClient(ctx, form.ClientID)
+	if !ok {
+		return
+	}
+
+	form.URL = strings.TrimSpace(form.URL)
+	if form.URL == "" {
+		client.WebhookURL = ""
+		client.WebhookSecret = ""
+	} else {
+		if problem := webhookURLProblem(form.URL); problem != "" {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.ViewData("Error", problem)
+			viewDeveloperWebhook(ctx, client)
+			return
+		}
+		client.WebhookURL = form.URL
+		if client.WebhookSecret == "" || form.RotateSecret {
+			secret, err := randomTokenPart()
+			if err != nil {
+				ctx.SetErr(err)
+				return
+			}
+			client.WebhookSecret = "whsec_" + secret
+			ctx.ViewData("Secret", client.WebhookSecret)
+		}
+	}
+
+	if err := clients.Save(client); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "developer.webhook", map[string]string{"client_id": client.ClientID, "url": client.WebhookURL})
+
+	ctx.ViewData("Notice", "The webhook settings were saved.")
+	viewDeveloperWebhook(ctx, client)
+}
+
+// viewDeveloperWebhook renders the webhook settings of a client
+func viewDeveloperWebhook(ctx iris.Context, client *ClientSettings) {
+	ctx.ViewData("ClientID", client.ClientID)
+	ctx.ViewData("URL", client.WebhookURL)
+	ctx.View("developer-webhook.html")
+}
+
+// ownedClient returns the settings of a client the logged in user owns, responding with the login page or
+// 403 Forbidden otherwise
+func ownedClient(ctx iris.Context, clientID string) (*ClientSettings, bool) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return nil, false
+	}
+
+	client, err := getClientSettings(clientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return nil, false
+	}
+	if clientID == "" || !isClientOwner(client, session.GetString("username")) {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an owner of this client application.")
+		return nil, false
+	}
+	return client, true
+}
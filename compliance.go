@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// complianceReportInterval is how often the compliance report is emailed to administrators; 0 disables it
+	complianceReportInterval = envDuration("COMPLIANCE_REPORT_INTERVAL", 0)
+	// complianceReportTo are the recipients of the report, the administrators with an email address if unset
+	complianceReportTo = envList("COMPLIANCE_REPORT_TO")
+
+	// consentReviewAge is how long a consent is relied on before the organization expects it to be given again
+	consentReviewAge = envDuration("CONSENT_REVIEW_AGE", 365*24*time.Hour)
+	// consentExpiryWarning is how long before it reaches CONSENT_REVIEW_AGE a consent is reported
+	consentExpiryWarning = envDuration("CONSENT_EXPIRY_WARNING", 30*24*time.Hour)
+
+	// complianceSensitiveScopes are the scopes reported when granted by users without a second factor
+	complianceSensitiveScopes = envListDefault("COMPLIANCE_SENSITIVE_SCOPES", stepUpScopes)
+
+	// denialSpikeWindow is the period in which each client's denials are counted and compared to the seven before it
+	denialSpikeWindow = envDuration("DENIAL_SPIKE_WINDOW", 24*time.Hour)
+	// denialSpikeFactor is how many times its usual number of denials a client must reach to be reported
+	denialSpikeFactor = envInt("DENIAL_SPIKE_FACTOR", 3)
+	// denialSpikeMinimum is the fewest denials in the window for a client to be reported
+	denialSpikeMinimum = envInt("DENIAL_SPIKE_MINIMUM", 10)
+)
+
+// denialSpikeBaselineWindows is the number of windows before the latest one that make up a client's usual denials
+const denialSpikeBaselineWindows = 7
+
+// ComplianceReport summarizes consents that need attention, generated from the user store and the audit log
+type ComplianceReport struct {
+	Generated time.Time
+
+	// ExpiringConsents are grants given again least recently, within CONSENT_EXPIRY_WARNING of CONSENT_REVIEW_AGE
+	// or past it
+	ExpiringConsents []ExpiringConsent
+	// UnprotectedGrants are grants of sensitive scopes by users without a second factor
+	UnprotectedGrants []UnprotectedGrant
+	// DenialSpikes are clients whose users denied them far more often than usual
+	DenialSpikes []DenialSpike
+	// DenialsUnavailable is set when there is no audit log to count denials in
+	DenialsUnavailable bool
+}
+
+// ExpiringConsent is a grant approaching the age at which consent should be given again
+type ExpiringConsent struct {
+	Username    string
+	ClientID    string
+	LastGranted time.Time
+	Expires     time.Time
+}
+
+// UnprotectedGrant is a grant of sensitive scopes by a user who has no second factor
+type UnprotectedGrant struct {
+	Username string
+	ClientID string
+	Scopes   []string
+}
+
+// DenialSpike is a client denied unusually often in the latest DENIAL_SPIKE_WINDOW
+type DenialSpike struct {
+	ClientID string
+	Denials  int
+	Baseline float64
+}
+
+// buildComplianceReport generates the report from the stores as of now
+func buildComplianceReport(now time.Time) (*ComplianceReport, error) {
+	allUsers, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(allUsers, func(i, j int) bool { return allUsers[i].Username < allUsers[j].Username })
+
+	report := &ComplianceReport{Generated: now}
+	for _, user := range allUsers {
+		secondFactor := user.TOTPEnabled || len(user.WebAuthnCredentials) > 0
+		for _, grant := range user.Grants {
+			if grant.RevokedAt != 0 {
+				continue
+			}
+			lastGranted := time.Unix(grant.LastGranted, 0)
+			if expires := lastGranted.Add(consentReviewAge); now.Add(consentExpiryWarning).After(expires) {
+				report.ExpiringConsents = append(report.ExpiringConsents, ExpiringConsent{
+					Username: user.Username, ClientID: grant.ClientID, LastGranted: lastGranted, Expires: expires,
+				})
+			}
+			if secondFactor {
+				continue
+			}
+			var sensitive []string
+			for _, scope := range grant.Scopes {
+				if containsString(complianceSensitiveScopes, scope) {
+					sensitive = append(sensitive, scope)
+				}
+			}
+			if len(sensitive) > 0 {
+				report.UnprotectedGrants = append(report.UnprotectedGrants, UnprotectedGrant{
+					Username: user.Username, ClientID: grant.ClientID, Scopes: sensitive,
+				})
+			}
+		}
+	}
+	sort.SliceStable(report.ExpiringConsents, func(i, j int) bool {
+		return report.ExpiringConsents[i].Expires.Before(report.ExpiringConsents[j].Expires)
+	})
+
+	if auditLogPath == "" {
+		report.DenialsUnavailable = true
+		return report, nil
+	}
+	spikes, err := denialSpikes(auditLogPath, now)
+	if err != nil {
+		return nil, err
+	}
+	report.DenialSpikes = spikes
+	return report, nil
+}
+
+// denialSpikes counts the consent.denied events of each client in the audit log and returns the clients denied at
+// least DENIAL_SPIKE_MINIMUM times and DENIAL_SPIKE_FACTOR times their average in the latest window
+func denialSpikes(path string, now time.Time) ([]DenialSpike, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	latestStart := now.Add(-denialSpikeWindow)
+	baselineStart := latestStart.Add(-denialSpikeBaselineWindows * denialSpikeWindow)
+	latest := map[string]int{}
+	baseline := map[string]int{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := map[string]string{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry["event"] != "consent.denied" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, entry["time"])
+		if err != nil || at.After(now) || at.Before(baselineStart) {
+			continue
+		}
+		if at.Before(latestStart) {
+			baseline[entry["client_id"]]++
+		} else {
+			latest[entry["client_id"]]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var spikes []DenialSpike
+	for _, clientID := range sortedKeys(latest) {
+		denials := latest[clientID]
+		usual := float64(baseline[clientID]) / denialSpikeBaselineWindows
+		if denials >= denialSpikeMinimum && float64(denials) >= float64(denialSpikeFactor)*usual {
+			spikes = append(spikes, DenialSpike{ClientID: clientID, Denials: denials, Baseline: usual})
+		}
+	}
+	return spikes, nil
+}
+
+// CSV returns the report as CSV, with a row for each finding and its section in the first column
+func (r *ComplianceReport) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"section", "username", "client_id", "detail", "time"})
+	for _, c := range r.ExpiringConsents {
+		w.Write([]string{"expiring_consent", c.Username, c.ClientID, "last granted " + c.LastGranted.UTC().Format(time.RFC3339),
+			c.Expires.UTC().Format(time.RFC3339)})
+	}
+	for _, g := range r.UnprotectedGrants {
+		w.Write([]string{"sensitive_scopes_without_mfa", g.Username, g.ClientID, strings.Join(g.Scopes, " "), ""})
+	}
+	for _, s := range r.DenialSpikes {
+		w.Write([]string{"denial_spike", "", s.ClientID,
+			strconv.Itoa(s.Denials) + " denials, usually " + strconv.FormatFloat(s.Baseline, 'f', 1, 64), ""})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Text returns a plain text summary of the report
+func (r *ComplianceReport) Text() string {
+	text := fmt.Sprintf("Consent compliance report, %s\n\n", r.Generated.UTC().Format(time.RFC1123))
+	text += fmt.Sprintf("Consents due to be given again: %d\n", len(r.ExpiringConsents))
+	text += fmt.Sprintf("Sensitive scopes granted without a second factor: %d\n", len(r.UnprotectedGrants))
+	if r.DenialsUnavailable {
+		text += "Clients with unusual denials: not available without AUDIT_LOG_PATH\n"
+	} else {
+		text += fmt.Sprintf("Clients with unusual denials: %d\n", len(r.DenialSpikes))
+	}
+	return text + "\nThe findings are attached as CSV.\n"
+}
+
+// complianceReportTemplate renders the report as the HTML email and the administrators' page
+var complianceReportTemplate = template.Must(template.New("compliance-report").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format("2006-01-02") },
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<title>Consent Compliance Report</title>
+</head>
+<body>
+	<h1>Consent Compliance Report</h1>
+	<p>Generated {{.Generated.UTC.Format "2006-01-02 15:04 MST"}}.</p>
+
+	<h2>Consents due to be given again</h2>
+	{{if .ExpiringConsents}}
+	<table>
+		<tr><th>User</th><th>Client</th><th>Last given</th><th>Due</th></tr>
+		{{range .ExpiringConsents}}
+		<tr><td>{{.Username}}</td><td>{{.ClientID}}</td><td>{{date .LastGranted}}</td><td>{{date .Expires}}</td></tr>
+		{{end}}
+	</table>
+	{{else}}
+	<p>None.</p>
+	{{end}}
+
+	<h2>Sensitive scopes granted without a second factor</h2>
+	{{if .UnprotectedGrants}}
+	<table>
+		<tr><th>User</th><th>Client</th><th>Scopes</th></tr>
+		{{range .UnprotectedGrants}}
+		<tr><td>{{.Username}}</td><td>{{.ClientID}}</td><td>{{join .Scopes " "}}</td></tr>
+		{{end}}
+	</table>
+	{{else}}
+	<p>None.</p>
+	{{end}}
+
+	<h2>Clients with unusual denials</h2>
+	{{if .DenialsUnavailable}}
+	<p>Denials are counted in the audit log, which is not configured.</p>
+	{{else if .DenialSpikes}}
+	<table>
+		<tr><th>Client</th><th>Denials</th><th>Usually</th></tr>
+		{{range .DenialSpikes}}
+		<tr><td>{{.ClientID}}</td><td>{{.Denials}}</td><td>{{printf "%.1f" .Baseline}}</td></tr>
+		{{end}}
+	</table>
+	{{else}}
+	<p>None.</p>
+	{{end}}
+</body>
+</html>`))
+
+// HTML renders the report
+func (r *ComplianceReport) HTML() (string, error) {
+	var buf bytes.Buffer
+	if err := complianceReportTemplate.Execute(&buf, r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// complianceRecipients returns COMPLIANCE_REPORT_TO, or the email addresses of the administrators
+func complianceRecipients() ([]string, error) {
+	if len(complianceReportTo) > 0 {
+		return complianceReportTo, nil
+	}
+	allUsers, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, user := range allUsers {
+		if user.Email != "" && user.EmailVerified && !user.Disabled && hasRole(user, []string{adminRole}) {
+			recipients = append(recipients, user.Email)
+		}
+	}
+	sort.Strings(recipients)
+	return recipients, nil
+}
+
+// sendComplianceReport generates the report and emails it to the recipients, with the findings attached as CSV
+func sendComplianceReport(now time.Time) error {
+	report, err := buildComplianceReport(now)
+	if err != nil {
+		return err
+	}
+	html, err := report.HTML()
+	if err != nil {
+		return err
+	}
+	data, err := report.CSV()
+	if err != nil {
+		return err
+	}
+	recipients, err := complianceRecipients()
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		log.Print("compliance report not sent: no administrator has a verified email address")
+		return nil
+	}
+
+	filename := "compliance-report-" + now.UTC().Format("2006-01-02") + ".csv"
+	for _, to := range recipients {
+		err := enqueue(deliveryEmail, priorityBulk, Message{
+			To:          to,
+			Subject:     "Consent compliance report",
+			Text:        report.Text(),
+			HTML:        html,
+			Attachments: []Attachment{{Filename: filename, ContentType: "text/csv; charset=UTF-8", Content: data}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runComplianceReports emails the compliance report every COMPLIANCE_REPORT_INTERVAL, if it is set
+func runComplianceReports() {
+	if complianceReportInterval <= 0 {
+		return
+	}
+	for now := range time.Tick(complianceReportInterval) {
+		if err := sendComplianceReport(now); err != nil {
+			log.Printf("sending compliance report: %v", err)
+			notify(eventJobFailed, "Sending the compliance report failed", map[string]string{"job": "compliance_report", "error": err.Error()})
+		}
+	}
+}
+
+// getAdminComplianceReport shows the compliance report to administrators, or downloads it as CSV with format=csv
+func getAdminComplianceReport(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	report, err := buildComplianceReport(time.Now())
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if ctx.URLParam("format") == "csv" {
+		data, err := report.CSV()
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		ctx.ContentType("text/csv; charset=UTF-8")
+		ctx.Header("Content-Disposition", `attachment; filename="compliance-report.csv"`)
+		ctx.Write(data)
+		return
+	}
+
+	html, err := report.HTML()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	ctx.ContentType("text/html; charset=UTF-8")
+	ctx.WriteString(html)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envOrDefault returns the value of the environment variable key, or def if it is unset
+func envOrDefault(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+// envInt returns the integer value of the environment variable key, or def if it is unset or invalid
+func envInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %d", value, key, def)
+		return def
+	}
+	return i
+}
+
+// envDuration returns the duration value of the environment variable key, or def if it is unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %s", value, key, def)
+		return def
+	}
+	return d
+}
+
+// envFloat returns the floating point value of the environment variable key, or def if it is unset or invalid
+func envFloat(key string, def float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %g", value, key, def)
+		return def
+	}
+	return f
+}
+
+// envBool returns the boolean value of the environment variable key, or def if it is unset or invalid
+func envBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %t", value, key, def)
+		return def
+	}
+	return b
+}
+
+// envList returns the comma separated values of the environment variable key
+func envList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// envListDefault returns the comma separated values of the environment variable key, or def if there are none
+func envListDefault(key string, def []string) []string {
+	if values := envList(key); len(values) > 0 {
+		return values
+	}
+	return def
+}
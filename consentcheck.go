@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/kataras/iris/v12"
+)
+
+// consentCheckPath is the path of the consent pre-check API
+const consentCheckPath = "/api/consent-check"
+
+// ConsentCheck is the answer to a client's consent pre-check
+type ConsentCheck struct {
+	// Granted reports whether the user has granted the client every scope checked, so that a consent request for
+	// them will not ask the user to approve any scope
+	Granted bool `json:"granted"`
+	// Scopes are the scopes checked that the user has granted
+	Scopes []string `json:"scopes"`
+	// MissingScopes are the scopes checked that the user has not granted, or has revoked
+	MissingScopes []string `json:"missing_scopes"`
+}
+
+// postConsentCheck tells a client application whether a user has already granted it scopes
+//
+// Clients authenticate with their Kong OAuth 2.0 credential and name the user by the authenticated_userid of their
+// tokens, as the sub form field, and the scopes with the scope field. A client only learns about its own grants, and
+// users who are unknown or disabled are answered as having granted nothing. The consent page may still ask the
+// user to log in again or to verify a second factor.
+func postConsentCheck(ctx iris.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	clientID, ok := authenticateClient(ctx, "consent-check")
+	if !ok {
+		return
+	}
+
+	subject := ctx.PostValue("sub")
+	scopes := splitScopes(ctx.PostValue("scope"))
+	if subject == "" || len(scopes) == 0 {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "sub and scope are required.")
+		return
+	}
+
+	missing := scopes
+	user, err := findUserByAuthenticatedUserID(subject)
+	if err != nil && err != ErrUserNotFound {
+		failWithProblem(ctx, err)
+		return
+	}
+	if err == nil && !user.Disabled {
+		missing = ungrantedScopes(user, clientID, scopes)
+	}
+
+	granted := []string{}
+	for _, scope := range scopes {
+		if !containsString(missing, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	metrics.Counter("consent_checks_total", "Number of consent pre-checks by client applications, by outcome.",
+		"granted", strconv.FormatBool(len(missing) == 0)).Inc()
+	ctx.JSON(ConsentCheck{Granted: len(missing) == 0, Scopes: granted, MissingScopes: missing})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// consentCopyPath is the JSON file of rules that change the consent page's copy for combinations of scopes
+var consentCopyPath = os.Getenv("CONSENT_COPY_PATH")
+
+// consentCopyRules are the rules loaded from CONSENT_COPY_PATH, in the order they are evaluated
+var consentCopyRules []ConsentCopyRule
+
+// ConsentCopyRule changes the consent page when every one of its scopes is requested
+//
+// The headline and warnings are locale keys, or the text itself if no translation exists. "{application}" in
+// them is replaced with the client's application name.
+type ConsentCopyRule struct {
+	// Scopes must all be requested for the rule to apply
+	Scopes []string `json:"scopes"`
+	// ClientIDs limits the rule to these clients, if set
+	ClientIDs []string `json:"client_ids,omitempty"`
+	// Attributes limits the rule to users with one of the listed values of each attribute, if set
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	// Headline replaces the page's headline; the first matching rule with a headline wins
+	Headline string `json:"headline,omitempty"`
+	// Warnings are shown above the requested permissions; the warnings of every matching rule are shown
+	Warnings []string `json:"warnings,omitempty"`
+	// Template renders the page instead of consent.html; the first matching rule with a template wins
+	Template string `json:"template,omitempty"`
+}
+
+// ConsentCopy is the copy of the consent page chosen by the rules matching a request
+type ConsentCopy struct {
+	Headline string
+	Warnings []string
+	Template string
+}
+
+// loadConsentCopyRules reads the rules at path, if it is set, and checks that their templates exist
+func loadConsentCopyRules(path string) ([]ConsentCopyRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading consent copy rules: %w", err)
+	}
+	return parseConsentCopyRules(data)
+}
+
+// parseConsentCopyRules parses the JSON rules and checks that their templates exist
+func parseConsentCopyRules(data []byte) ([]ConsentCopyRule, error) {
+	var rules []ConsentCopyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing consent copy rules: %w", err)
+	}
+
+	for i, rule := range rules {
+		if len(rule.Scopes) == 0 {
+			return nil, fmt.Errorf("consent copy rule %d has no scopes", i+1)
+		}
+		if rule.Template != "" {
+			if filepath.Base(rule.Template) != rule.Template || filepath.Ext(rule.Template) != ".html" {
+				return nil, fmt.Errorf("consent copy rule %d: template %q must be an .html file in the templates directory", i+1, rule.Template)
+			}
+			if _, err := os.Stat(filepath.Join("templates", rule.Template)); err != nil {
+				return nil, fmt.Errorf("consent copy rule %d: %w", i+1, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to the client's request for scopes from a user with the attributes
+func (r ConsentCopyRule) matches(clientID string, scopes []string, attributes map[string]string) bool {
+	if len(r.ClientIDs) > 0 && !containsString(r.ClientIDs, clientID) {
+		return false
+	}
+	for name, values := range r.Attributes {
+		if value, ok := attributes[name]; !ok || !containsString(values, value) {
+			return false
+		}
+	}
+	for _, scope := range r.Scopes {
+		if !containsString(scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// consentCopy evaluates the rules against the client's request for scopes and returns the localized copy
+func consentCopy(ctx iris.Context, clientID, applicationName string, scopes []string) ConsentCopy {
+	reloadMu.RLock()
+	rules := consentCopyRules
+	reloadMu.RUnlock()
+
+	attributes := sessionAttributes(ctx)
+	result := ConsentCopy{}
+	for _, rule := range rules {
+		if !rule.matches(clientID, scopes, attributes) {
+			continue
+		}
+		if result.Headline == "" && rule.Headline != "" {
+			result.Headline = translateCopy(ctx, rule.Headline, applicationName)
+		}
+		if result.Template == "" {
+			result.Template = rule.Template
+		}
+		for _, warning := range rule.Warnings {
+			if text := translateCopy(ctx, warning, applicationName); !containsString(result.Warnings, text) {
+				result.Warnings = append(result.Warnings, text)
+			}
+		}
+	}
+	return result
+}
+
+// translateCopy returns the translation of a locale key, or the text itself, with the application name filled in
+func translateCopy(ctx iris.Context, text, applicationName string) string {
+	if translated := ctx.Tr(text); translated != "" && translated != text {
+		text = translated
+	}
+	return strings.ReplaceAll(text, "{application}", applicationName)
+}
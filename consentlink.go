@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+)
+
+var (
+	// consentLinkToken is the bearer token first-party backends mint consent links with; the API is disabled if unset
+	consentLinkToken = os.Getenv("CONSENT_LINK_TOKEN")
+	// consentLinkTTL is how long consent links are valid for, and the longest a backend may ask for
+	consentLinkTTL = envDuration("CONSENT_LINK_TTL", 15*time.Minute)
+)
+
+// consentLinkPurpose is the purpose of the signed tokens in consent links
+const consentLinkPurpose = "consent-link"
+
+// Paths of the consent link API and of the links it mints
+const (
+	consentLinksPath = "/api/consent-links"
+	consentLinkPath  = "/consent/link"
+)
+
+// ConsentLinkRequest is a first-party backend's request for a consent link
+type ConsentLinkRequest struct {
+	ClientID     string `json:"client_id"`
+	ResponseType string `json:"response_type"`
+	Scopes       string `json:"scopes"`
+	RedirectURI  string `json:"redirect_uri"`
+	State        string `json:"state"`
+
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+	ResponseMode        string `json:"response_mode"`
+
+	// LoginHint is the username or email address of the user the link is for, who alone can consent with it
+	LoginHint string `json:"login_hint"`
+	// TTL is how long the link is valid for in seconds, at most CONSENT_LINK_TTL, which is the default
+	TTL int `json:"ttl"`
+}
+
+// ConsentLink is a minted consent link
+type ConsentLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// consentLinkData is carried by a consent link: the user it is for and their consent request
+type consentLinkData struct {
+	Username string         `json:"sub"`
+	Consent  ConsentRequest `json:"consent"`
+}
+
+// postConsentLink mints a signed, single-use link to the consent page for a user and consent request
+//
+// The request is checked as the consent page would check it, so that the link does not lead the user to an
+// error. Only backends holding CONSENT_LINK_TOKEN can mint links.
+func postConsentLink(ctx iris.Context) {
+	if consentLinkToken == "" {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(consentLinkToken)) != 1 {
+		ctx.Header("WWW-Authenticate", `Bearer realm="consent-links"`)
+		viewProblem(ctx, iris.StatusUnauthorized, problemUnauthorized, "")
+		return
+	}
+
+	request := ConsentLinkRequest{}
+	if err := ctx.ReadJSON(&request); err != nil {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "The body must be a JSON consent link request.")
+		return
+	}
+	consent := ConsentRequest{
+		ClientID:            request.ClientID,
+		ResponseType:        request.ResponseType,
+		Scopes:              strings.Join(splitScopes(request.Scopes), ","),
+		RedirectURI:         request.RedirectURI,
+		State:               request.State,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		Nonce:               request.Nonce,
+		ResponseMode:        request.ResponseMode,
+	}
+	if consent.ResponseType == "" {
+		consent.ResponseType = responseTypeCode
+	}
+	if detail := invalidConsentLinkRequest(consent, request); detail != "" {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, detail)
+		return
+	}
+
+	user, err := findUserByLoginHint(request.LoginHint)
+	if err == ErrUserNotFound {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "login_hint does not name a user.")
+		return
+	}
+	if err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
+	if err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	if _, ok := matchRedirectURI(credential, consent.RedirectURI); !ok {
+		if consent.RedirectURI == "" {
+			viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "redirect_uri is required for a client with several redirect URIs.")
+			return
+		}
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "redirect_uri is not registered for the client.")
+		return
+	}
+	if err := checkScopes(kongContext(ctx), splitScopes(consent.Scopes)); err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	if _, err := checkClientScopes(consent.ClientID, splitScopes(consent.Scopes)); err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+
+	ttl := consentLinkTTL
+	if request.TTL > 0 && time.Duration(request.TTL)*time.Second < ttl {
+		ttl = time.Duration(request.TTL) * time.Second
+	}
+	signed, err := signToken(consentLinkPurpose, ttl, consentLinkData{Username: user.Username, Consent: consent})
+	if err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	audit(ctx, "consent_link.created", map[string]string{"client_id": consent.ClientID, "scopes": consent.Scopes, "subject": user.Username})
+
+	ctx.StatusCode(iris.StatusCreated)
+	ctx.JSON(ConsentLink{
+		URL:       publicURL + consentLinkPath + "?token=" + url.QueryEscape(signed),
+		ExpiresAt: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	})
+}
+
+// invalidConsentLinkRequest returns why a consent link request would be refused by the consent page, if it would
+func invalidConsentLinkRequest(consent ConsentRequest, request ConsentLinkRequest) string {
+	switch {
+	case consent.ClientID == "":
+		return "client_id is required."
+	case request.LoginHint == "":
+		return "login_hint is required."
+	case consent.ResponseType != responseTypeCode && consent.ResponseType != responseTypeToken:
+		return "response_type must be code or token."
+	case !validCodeChallenge(consent):
+		return "code_challenge must be a base64url encoded SHA-256 hash, with code_challenge_method S256."
+	case !validResponseMode(consent):
+		return "response_mode must be query, fragment or form_post, and cannot be query with response_type=token."
+	case len(consent.Nonce) > maxNonceLength:
+		return "nonce must be at most 255 characters."
+	case request.TTL < 0:
+		return "ttl must be a positive number of seconds."
+	}
+	return ""
+}
+
+// findUserByLoginHint returns the user a login_hint names, by username or email address
+func findUserByLoginHint(hint string) (*User, error) {
+	user, err := users.Get(hint)
+	if err == ErrUserNotFound {
+		return findUserByEmail(hint)
+	}
+	return user, err
+}
+
+// failWithProblem responds with problem details for an API request that failed with err, which is logged
+func failWithProblem(ctx iris.Context, err error) {
+	status, _, problemType := errorResponse(err)
+	log.Printf("%s %s [%s]: %v", ctx.Method(), ctx.Path(), requestID(ctx), err)
+	viewProblem(ctx, status, problemType, "")
+}
+
+// getConsentLink starts the consent request carried by a consent link
+//
+// The request is bound to the user the link was minted for: they are asked to log in with their account, and the
+// consent page is refused to anyone else in the session until they have approved or denied the request.
+func getConsentLink(ctx iris.Context) {
+	data := consentLinkData{}
+	if _, err := verifySingleUseToken(consentLinkPurpose, ctx.URLParam("token"), &data); err != nil {
+		viewError(ctx, iris.StatusBadRequest, "ConsentLinkInvalid")
+		return
+	}
+
+	session := sess.Start(ctx)
+	setPendingConsent(session, data.Consent)
+	session.Set("consentLinkUsername", data.Username)
+	session.Set("consentLinkClientID", data.Consent.ClientID)
+	audit(ctx, "consent_link.opened", map[string]string{"client_id": data.Consent.ClientID, "subject": data.Username})
+
+	ctx.Redirect(pendingConsentURL(session)+"&login_hint="+url.QueryEscape(data.Username), iris.StatusSeeOther)
+}
+
+// requireConsentLinkUser refuses the consent request of a consent link to users other than the one it was minted
+// for, and reports whether it has completed the response
+func requireConsentLinkUser(ctx iris.Context, consent ConsentRequest) bool {
+	session := sess.Start(ctx)
+	username := session.GetString("consentLinkUsername")
+	if username == "" || session.GetString("consentLinkClientID") != consent.ClientID ||
+		username == session.GetString("username") || impersonating(ctx) {
+		return false
+	}
+
+	audit(ctx, "consent_link.refused", map[string]string{"client_id": consent.ClientID, "subject": username})
+	viewError(ctx, iris.StatusForbidden, "ConsentLinkWrongUser")
+	return true
+}
+
+// endConsentLink forgets the user a consent link bound the session's consent request for the client to, once the
+// request has been decided
+func endConsentLink(session *sessions.Session, clientID string) {
+	if session.GetString("consentLinkClientID") == clientID {
+		session.Delete("consentLinkUsername")
+		session.Delete("consentLinkClientID")
+	}
+}
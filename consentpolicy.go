@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// consentPoliciesPath is the JSON file of policies limiting when, and from where, scopes may be granted
+var consentPoliciesPath = os.Getenv("CONSENT_POLICIES_PATH")
+
+// consentPolicies are the policies loaded from CONSENT_POLICIES_PATH, in the order they are evaluated
+var consentPolicies []ConsentPolicy
+
+// consentPolicyDays are the names of the days policies are limited to, in the order of time.Weekday
+var consentPolicyDays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// ConsentPolicy limits a request for any of its scopes to users on some networks, at some times, or both
+//
+// A request violating any policy is refused with a page explaining the policy, instead of the consent page.
+type ConsentPolicy struct {
+	// Scopes are restricted by the policy when any one of them is requested
+	Scopes []string `json:"scopes"`
+	// ClientIDs limits the policy to these clients, if set
+	ClientIDs []string `json:"client_ids,omitempty"`
+	// Networks are the networks, in CIDR notation, the scopes may be granted from, or any network if empty
+	Networks []string `json:"networks,omitempty"`
+	// Days are the days of the week the scopes may be granted on, such as "Mon", or any day if empty
+	Days []string `json:"days,omitempty"`
+	// Hours is the time of day the scopes may be granted at, such as "09:00-17:00", or any time if empty. A window
+	// ending before it starts runs past midnight.
+	Hours string `json:"hours,omitempty"`
+	// TimeZone is the IANA time zone of the days and hours, UTC if empty
+	TimeZone string `json:"time_zone,omitempty"`
+	// Reason explains the policy to the user, as a locale key or the text itself, instead of the default explanation
+	Reason string `json:"reason,omitempty"`
+
+	networks []*net.IPNet
+	days     []time.Weekday
+	from     int
+	until    int
+	location *time.Location
+}
+
+// ConsentPolicyViolation explains on the denial page why scopes could not be granted
+type ConsentPolicyViolation struct {
+	Scopes      []ScopeDescription
+	Explanation string
+}
+
+// loadConsentPolicies reads the policies at path, if it is set
+func loadConsentPolicies(path string) ([]ConsentPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading consent policies: %w", err)
+	}
+	return parseConsentPolicies(data)
+}
+
+// parseConsentPolicies parses the JSON policies and their conditions
+//
+// Policies that cannot be parsed are an error rather than skipped, as a skipped policy would let its scopes be
+// granted from anywhere at any time.
+func parseConsentPolicies(data []byte) ([]ConsentPolicy, error) {
+	var policies []ConsentPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("parsing consent policies: %w", err)
+	}
+
+	for i := range policies {
+		policy := &policies[i]
+		if len(policy.Scopes) == 0 {
+			return nil, fmt.Errorf("consent policy %d has no scopes", i+1)
+		}
+		if len(policy.Networks) == 0 && len(policy.Days) == 0 && policy.Hours == "" {
+			return nil, fmt.Errorf("consent policy %d has no networks, days or hours", i+1)
+		}
+		for _, value := range policy.Networks {
+			networks := parseCIDRs([]string{value})
+			if len(networks) == 0 {
+				return nil, fmt.Errorf("consent policy %d: invalid network %q", i+1, value)
+			}
+			policy.networks = append(policy.networks, networks[0])
+		}
+		for _, value := range policy.Days {
+			day := indexString(consentPolicyDays, value)
+			if day < 0 {
+				return nil, fmt.Errorf("consent policy %d: day %q must be one of %s", i+1, value, strings.Join(consentPolicyDays, ", "))
+			}
+			policy.days = append(policy.days, time.Weekday(day))
+		}
+		if policy.Hours != "" {
+			var ok bool
+			if policy.from, policy.until, ok = parseConsentPolicyHours(policy.Hours); !ok {
+				return nil, fmt.Errorf("consent policy %d: hours %q must be like 09:00-17:00", i+1, policy.Hours)
+			}
+		}
+		var err error
+		if policy.location, err = time.LoadLocation(policy.TimeZone); err != nil {
+			return nil, fmt.Errorf("consent policy %d: %w", i+1, err)
+		}
+	}
+	return policies, nil
+}
+
+// parseConsentPolicyHours parses a window such as 09:00-17:00 into minutes since midnight
+func parseConsentPolicyHours(hours string) (from, until int, ok bool) {
+	parts := strings.SplitN(hours, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil || end.Equal(start) {
+		return 0, 0, false
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), true
+}
+
+// indexString returns the index of value in values, or -1
+func indexString(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// appliesTo reports whether the policy restricts a client's request for scopes
+func (p ConsentPolicy) appliesTo(clientID string, scopes []string) bool {
+	if len(p.ClientIDs) > 0 && !containsString(p.ClientIDs, clientID) {
+		return false
+	}
+	for _, scope := range p.Scopes {
+		if containsString(scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsNetwork reports whether the policy allows its scopes to be granted from an address
+func (p ConsentPolicy) allowsNetwork(ip net.IP) bool {
+	if len(p.networks) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsTime reports whether the policy allows its scopes to be granted at a time
+func (p ConsentPolicy) allowsTime(now time.Time) bool {
+	local := now.In(p.location)
+	if len(p.days) > 0 {
+		allowed := false
+		for _, day := range p.days {
+			allowed = allowed || local.Weekday() == day
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if p.Hours == "" {
+		return true
+	}
+	minute := local.Hour()*60 + local.Minute()
+	if p.from < p.until {
+		return minute >= p.from && minute < p.until
+	}
+	return minute >= p.from || minute < p.until
+}
+
+// schedule describes the days and hours the policy allows, such as "Mon, Tue 09:00-17:00 (Europe/Berlin)"
+func (p ConsentPolicy) schedule() string {
+	parts := []string{}
+	if len(p.Days) > 0 {
+		parts = append(parts, strings.Join(p.Days, ", "))
+	}
+	if p.Hours != "" {
+		parts = append(parts, p.Hours)
+	}
+	return strings.Join(parts, " ") + " (" + p.location.String() + ")"
+}
+
+// violatedConsentPolicies returns the policies a client's request for scopes, from an address at a time, violates
+func violatedConsentPolicies(policies []ConsentPolicy, clientID string, scopes []string, ip net.IP, now time.Time) []ConsentPolicy {
+	violated := []ConsentPolicy{}
+	for _, policy := range policies {
+		if policy.appliesTo(clientID, scopes) && (!policy.allowsNetwork(ip) || !policy.allowsTime(now)) {
+			violated = append(violated, policy)
+		}
+	}
+	return violated
+}
+
+// requireConsentPolicies refuses a request for scopes that violates a consent policy with a page explaining the
+// policies, and reports whether it has completed the response
+func requireConsentPolicies(ctx iris.Context, consent ConsentRequest, scopes []string) bool {
+	reloadMu.RLock()
+	policies := consentPolicies
+	reloadMu.RUnlock()
+
+	violated := violatedConsentPolicies(policies, consent.ClientID, scopes, clientIP(ctx), time.Now())
+	if len(violated) == 0 {
+		return false
+	}
+	audit(ctx, "consent.policy_denied", map[string]string{"client_id": consent.ClientID, "scopes": consent.Scopes})
+	viewConsentPolicyDenied(ctx, violated, scopes)
+	return true
+}
+
+// viewConsentPolicyDenied renders the page explaining the policies that prevent the scopes from being granted
+func viewConsentPolicyDenied(ctx iris.Context, violated []ConsentPolicy, scopes []string) {
+	violations := []ConsentPolicyViolation{}
+	for _, policy := range violated {
+		restricted := []string{}
+		for _, scope := range policy.Scopes {
+			if containsString(scopes, scope) {
+				restricted = append(restricted, scope)
+			}
+		}
+
+		var explanation string
+		switch {
+		case policy.Reason != "":
+			explanation = translateCopy(ctx, policy.Reason, "")
+		case len(policy.networks) > 0 && (len(policy.days) > 0 || policy.Hours != ""):
+			explanation = ctx.Tr("ConsentPolicyNetworkAndTime") + " " + policy.schedule()
+		case len(policy.networks) > 0:
+			explanation = ctx.Tr("ConsentPolicyNetwork")
+		default:
+			explanation = ctx.Tr("ConsentPolicyTime") + " " + policy.schedule()
+		}
+		violations = append(violations, ConsentPolicyViolation{Scopes: describeScopes(ctx, restricted), Explanation: explanation})
+	}
+
+	ctx.StatusCode(iris.StatusForbidden)
+	ctx.ViewData("Title", ctx.Tr("ErrorTitle"))
+	ctx.ViewData("Message", ctx.Tr("ConsentPolicyDenied"))
+	ctx.ViewData("Hint", ctx.Tr("ConsentPolicyDeniedHint"))
+	ctx.ViewData("Violations", violations)
+	ctx.View("consent-policy-denied.html")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// consentCycleThreshold is how many consent decisions a session may make within CONSENT_CYCLE_WINDOW before it
+	// must solve a CAPTCHA or wait, or zero to never throttle consent
+	consentCycleThreshold = envInt("CONSENT_CYCLE_THRESHOLD", 5)
+	// consentCycleWindow is the window consent decisions are counted in
+	consentCycleWindow = envDuration("CONSENT_CYCLE_WINDOW", time.Minute)
+	// consentCooldown is how long a session must wait before consenting again when no CAPTCHA provider is configured
+	consentCooldown = envDuration("CONSENT_COOLDOWN", 5*time.Minute)
+
+	consentThrottled = metrics.Counter("consent_throttled_total", "Number of sessions throttled after repeatedly approving and denying consent requests.")
+)
+
+// recordConsentDecision counts a consent decision, approval or denial, made by the session
+//
+// Once CONSENT_CYCLE_THRESHOLD decisions have been made within CONSENT_CYCLE_WINDOW, which people deciding for
+// themselves rarely do, the session must solve a CAPTCHA before its next decision, or wait for CONSENT_COOLDOWN if
+// no CAPTCHA provider is configured.
+func recordConsentDecision(ctx iris.Context, clientID string) {
+	if consentCycleThreshold <= 0 {
+		return
+	}
+
+	session := sess.Start(ctx)
+	now := time.Now()
+	decisions := session.GetIntDefault("consentDecisions", 0)
+	if time.Since(time.Unix(0, session.GetInt64Default("consentDecisionsSince", 0))) > consentCycleWindow {
+		decisions = 0
+		session.Set("consentDecisionsSince", now.UnixNano())
+	}
+	decisions++
+	session.Set("consentDecisions", decisions)
+	if decisions < consentCycleThreshold {
+		return
+	}
+
+	session.Delete("consentDecisions")
+	session.Delete("consentDecisionsSince")
+	if captcha != nil {
+		session.Set("consentCaptcha", true)
+	} else {
+		session.Set("consentCooldownUntil", now.Add(consentCooldown).Unix())
+	}
+	consentThrottled.Inc()
+	audit(ctx, "consent.throttled", map[string]string{"client_id": clientID, "decisions": strconv.Itoa(decisions)})
+}
+
+// consentCaptchaRequired reports whether the session must solve a CAPTCHA before its next consent decision, after
+// rapid decisions or because the client's address is listed by the IP reputation provider
+func consentCaptchaRequired(ctx iris.Context) bool {
+	return captcha != nil && (sess.Start(ctx).GetBooleanDefault("consentCaptcha", false) || reputationChallenge(ctx))
+}
+
+// requireConsentCooldown refuses consent requests with 429 Too Many Requests while the session is cooling down,
+// and reports whether it has completed the response
+func requireConsentCooldown(ctx iris.Context) bool {
+	until := time.Unix(sess.Start(ctx).GetInt64Default("consentCooldownUntil", 0), 0)
+	wait := time.Until(until)
+	if wait <= 0 {
+		return false
+	}
+
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	viewError(ctx, iris.StatusTooManyRequests, "ConsentThrottled")
+	return true
+}
+
+// requireConsentCaptcha verifies the CAPTCHA submitted with the consent form when the session must solve one, and
+// reports whether it has completed the response
+//
+// An unsolved CAPTCHA shows the consent page again with an error.
+func requireConsentCaptcha(ctx iris.Context, consent ConsentRequest) bool {
+	if !consentCaptchaRequired(ctx) {
+		return false
+	}
+
+	solved, err := verifyCaptcha(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+	if !solved {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please complete the CAPTCHA.")
+		viewConsent(ctx, consent, false)
+		return true
+	}
+	sess.Start(ctx).Delete("consentCaptcha")
+	return false
+}
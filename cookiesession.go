@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// The places sessions are kept, chosen by SESSION_STORE
+const (
+	// sessionStoreMemory keeps sessions in the memory of the replica
+	sessionStoreMemory = "memory"
+	// sessionStoreRedis keeps sessions in a Redis server shared by the replicas, with the failed login counters
+	sessionStoreRedis = "redis"
+	// sessionStoreCookie keeps sessions in encrypted cookies, so that any replica in any region can serve them
+	sessionStoreCookie = "cookie"
+)
+
+var (
+	sessionStore = envOrDefault("SESSION_STORE", sessionStoreMemory)
+	// sessionEncryptionKey encrypts cookie sessions; every replica in every region must share it
+	sessionEncryptionKey = os.Getenv("SESSION_ENCRYPTION_KEY")
+	// sessionCookieDomain is the domain of the session cookies, to share them between the hosts of several regions
+	sessionCookieDomain = os.Getenv("SESSION_COOKIE_DOMAIN")
+	// sessionIdleTimeout ends cookie sessions that have not been used for this long
+	sessionIdleTimeout = envDuration("SESSION_IDLE_TIMEOUT", 12*time.Hour)
+	// sessionLocalValueBytes is the encoded size above which a session value is kept in the region rather than in
+	// the cookie
+	sessionLocalValueBytes = envInt("SESSION_LOCAL_VALUE_BYTES", 512)
+
+	sessionCookieTooLarge = metrics.Counter("session_cookies_dropped_total", "Number of cookie sessions that were too large to be saved.")
+)
+
+// sessionStateCookie is the cookie, followed by numbered continuation cookies if needed, holding a cookie session
+const sessionStateCookie = "kongOAuthConsentAppState"
+
+// Cookie sessions are split into cookies of up to sessionCookieChunk characters, which browsers accept in every
+// case, and are not saved if they would need more than maxSessionCookies cookies
+const (
+	sessionCookieChunk = 3800
+	maxSessionCookies  = 4
+)
+
+// sessionCipher encrypts cookie sessions, or is nil when sessions are kept in memory
+var sessionCipher cipher.AEAD
+
+// localSessionValues holds the session values too large for the cookie, in the region they were set in, keyed by
+// session ID and value name
+var localSessionValues = newCache("local_session_values",
+	envInt("SESSION_LOCAL_VALUES_MAX_ENTRIES", 100000),
+	int64(envInt("SESSION_LOCAL_VALUES_MAX_BYTES", 64<<20)),
+	sessionIdleTimeout)
+
+// sessionState is the content of a cookie session
+type sessionState struct {
+	// Used is when the session was last saved, in Unix seconds
+	Used   int64
+	Values map[string]interface{}
+	// Local names the values kept in the region, by the region that holds them
+	Local map[string]string
+	// ID is the session ID the local values are kept under
+	ID string
+}
+
+// loadSessionStore checks the SESSION_STORE configuration, connecting to the session database for redis, where the
+// shared store is kept too, and preparing the encryption of cookie sessions
+func loadSessionStore() error {
+	switch sessionStore {
+	case sessionStoreMemory:
+		return nil
+	case sessionStoreRedis:
+		db, err := openRedisSessionDatabase()
+		if err != nil {
+			return err
+		}
+		sessionDB = db
+		sharedStore = &redisStore{client: db.client, prefix: sessionRedisPrefix + "shared:"}
+		return nil
+	case sessionStoreCookie:
+	default:
+		return errors.New("unknown SESSION_STORE " + strconv.Quote(sessionStore) + ", expected memory, redis or cookie")
+	}
+	if len(sessionEncryptionKey) < 32 {
+		return errors.New("SESSION_STORE=cookie requires a SESSION_ENCRYPTION_KEY of at least 32 characters")
+	}
+
+	key := sha256.Sum256([]byte(sessionEncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	sessionCipher, err = cipher.NewGCM(block)
+	return err
+}
+
+// cookieSessions is middleware that keeps the session in encrypted cookies when SESSION_STORE is cookie
+//
+// The session of the replica is replaced with the one in the cookie before the request is handled, and the cookie
+// is updated with the session afterwards; the response is held back until then so that the cookie can still be
+// set, except for streamed responses. Values too large for the cookie are kept in the region's memory and are lost
+// if the user moves to another region while they are needed.
+//
+// Whichever store is used, later calls to start the session in a request find the ID of a session started earlier
+// in it, so that a request without a session cookie does not start several sessions and keep the last one.
+func cookieSessions(ctx iris.Context) {
+	if sessionCipher == nil {
+		ctx.AddCookieOptions(iris.CookieAllowReclaim(cookieNameForSessionID))
+		ctx.Next()
+		return
+	}
+
+	// Later calls to start the session in this request find a new session's ID
+	ctx.AddCookieOptions(iris.CookieAllowReclaim(cookieNameForSessionID), sessionCookieOptions)
+	state, hadState := readSessionState(ctx)
+	if state != nil {
+		restoreSession(ctx, state)
+	}
+
+	// Streams are not held back, as they do not end; they read the session but do not change it
+	if ctx.Path() == auditStreamPath {
+		ctx.Next()
+		return
+	}
+
+	ctx.Record()
+	ctx.Next()
+
+	if ctx.GetCookie(cookieNameForSessionID) == "" {
+		if hadState {
+			clearSessionState(ctx, 0)
+		}
+		return
+	}
+	saveSessionState(ctx, state)
+}
+
+// sessionCookieOptions sets the attributes of the session cookies
+func sessionCookieOptions(ctx iris.Context, cookie *http.Cookie, op uint8) {
+	if cookie.Name != cookieNameForSessionID && !isSessionStateCookie(cookie.Name) {
+		return
+	}
+	if sessionCookieDomain != "" {
+		cookie.Domain = sessionCookieDomain
+	}
+	cookie.Secure = ctx.Request().TLS != nil || strings.HasPrefix(publicURL, "https:")
+	cookie.SameSite = http.SameSiteLaxMode
+}
+
+// isSessionStateCookie reports whether name is the name of one of the cookies holding a cookie session
+func isSessionStateCookie(name string) bool {
+	if name == sessionStateCookie {
+		return true
+	}
+	for i := 1; i < maxSessionCookies; i++ {
+		if name == sessionStateCookie+strconv.Itoa(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSessionState decrypts the cookie session of the request, and reports whether the request had one even if it
+// could not be used because it was forged, from another key or idle for too long
+func readSessionState(ctx iris.Context) (*sessionState, bool) {
+	sealed := ctx.GetCookie(sessionStateCookie)
+	if sealed == "" {
+		return nil, false
+	}
+	for i := 1; i < maxSessionCookies; i++ {
+		sealed += ctx.GetCookie(sessionStateCookie + strconv.Itoa(i))
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	size := sessionCipher.NonceSize()
+	if err != nil || len(data) < size {
+		return nil, true
+	}
+	plain, err := sessionCipher.Open(nil, data[:size], data[size:], []byte(sessionStateCookie))
+	if err != nil {
+		return nil, true
+	}
+	state := &sessionState{}
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(state); err != nil {
+		log.Printf("reading cookie session: %v", err)
+		return nil, true
+	}
+	if time.Since(time.Unix(state.Used, 0)) > sessionIdleTimeout {
+		return nil, true
+	}
+	return state, true
+}
+
+// restoreSession replaces the values of the replica's session with those of the cookie session
+func restoreSession(ctx iris.Context, state *sessionState) {
+	session := sess.Start(ctx)
+	session.Clear()
+	for key, value := range state.Values {
+		session.Set(key, value)
+	}
+	for key, region := range state.Local {
+		if region != currentRegion {
+			continue
+		}
+		if value, ok := localSessionValues.Get(state.ID + "/" + key); ok {
+			session.Set(key, value)
+		}
+	}
+}
+
+// saveSessionState encrypts the session into the session cookies if it changed since it was read, or if the cookie
+// session is halfway to becoming idle
+func saveSessionState(ctx iris.Context, previous *sessionState) {
+	session := sess.Start(ctx)
+	state := &sessionState{Values: map[string]interface{}{}, Local: map[string]string{}, ID: session.ID()}
+	for key, value := range session.GetAll() {
+		size, err := gobSize(value)
+		if err != nil {
+			log.Printf("session value %s cannot be kept in a cookie: %v", key, err)
+			continue
+		}
+		if size > sessionLocalValueBytes {
+			localSessionValues.Set(state.ID+"/"+key, value, int64(size))
+			state.Local[key] = currentRegion
+			continue
+		}
+		state.Values[key] = value
+	}
+	if previous != nil && previous.ID == state.ID && sameSessionValues(previous, state) &&
+		time.Since(time.Unix(previous.Used, 0)) < sessionIdleTimeout/2 {
+		return
+	}
+	state.Used = time.Now().Unix()
+
+	plain := bytes.Buffer{}
+	if err := gob.NewEncoder(&plain).Encode(state); err != nil {
+		log.Printf("saving cookie session: %v", err)
+		return
+	}
+	nonce := make([]byte, sessionCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Printf("saving cookie session: %v", err)
+		return
+	}
+	sealed := base64.RawURLEncoding.EncodeToString(sessionCipher.Seal(nonce, nonce, plain.Bytes(), []byte(sessionStateCookie)))
+	if len(sealed) > sessionCookieChunk*maxSessionCookies {
+		sessionCookieTooLarge.Inc()
+		log.Printf("cookie session of %d bytes is too large to be saved; lower SESSION_LOCAL_VALUE_BYTES", len(sealed))
+		return
+	}
+
+	chunks := 0
+	for ; len(sealed) > 0; chunks++ {
+		n := len(sealed)
+		if n > sessionCookieChunk {
+			n = sessionCookieChunk
+		}
+		name := sessionStateCookie
+		if chunks > 0 {
+			name += strconv.Itoa(chunks)
+		}
+		ctx.SetCookie(&http.Cookie{Name: name, Value: sealed[:n], Path: "/", HttpOnly: true})
+		sealed = sealed[n:]
+	}
+	clearSessionState(ctx, chunks)
+}
+
+// clearSessionState removes the session cookies from the first one, leaving those before it
+func clearSessionState(ctx iris.Context, first int) {
+	for i := first; i < maxSessionCookies; i++ {
+		name := sessionStateCookie
+		if i > 0 {
+			name += strconv.Itoa(i)
+		}
+		if i == 0 || ctx.GetCookie(name) != "" {
+			ctx.RemoveCookie(name)
+		}
+	}
+}
+
+// sameSessionValues reports whether two cookie sessions have the same values
+func sameSessionValues(a, b *sessionState) bool {
+	if len(a.Values) != len(b.Values) || len(a.Local) != len(b.Local) {
+		return false
+	}
+	for key, value := range a.Values {
+		if other, ok := b.Values[key]; !ok || !reflect.DeepEqual(other, value) {
+			return false
+		}
+	}
+	for key, region := range a.Local {
+		if b.Local[key] != region {
+			return false
+		}
+	}
+	return true
+}
+
+// gobSize returns the size of a session value once encoded
+func gobSize(value interface{}) (int, error) {
+	encoded := bytes.Buffer{}
+	err := gob.NewEncoder(&encoded).Encode(map[string]interface{}{"": value})
+	return encoded.Len(), err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// grafanaDashboard is the subset of Grafana's dashboard JSON model used by the generated dashboard
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	Timezone      string            `json:"timezone"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          grafanaTimeRange  `json:"time"`
+	Templating    grafanaTemplating `json:"templating"`
+	Panels        []grafanaPanel    `json:"panels"`
+}
+
+// grafanaTimeRange is the default time range of a dashboard
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// grafanaTemplating holds the variables of a dashboard
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+// grafanaVariable is a dashboard variable, used to choose the Prometheus data source on import
+type grafanaVariable struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+// grafanaDataSource refers to the data source chosen with the dashboard's variable
+type grafanaDataSource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// grafanaGridPos is the position and size of a panel on the dashboard's 24 column grid
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// grafanaTarget is a PromQL query of a panel
+type grafanaTarget struct {
+	RefID        string            `json:"refId"`
+	Datasource   grafanaDataSource `json:"datasource"`
+	Expr         string            `json:"expr"`
+	LegendFormat string            `json:"legendFormat,omitempty"`
+	Instant      bool              `json:"instant,omitempty"`
+}
+
+// grafanaFieldConfig sets the unit of a panel's values
+type grafanaFieldConfig struct {
+	Defaults  grafanaFieldDefaults `json:"defaults"`
+	Overrides []interface{}        `json:"overrides"`
+}
+
+// grafanaFieldDefaults are the field settings applied to every series of a panel
+type grafanaFieldDefaults struct {
+	Unit string `json:"unit,omitempty"`
+	Min  *int   `json:"min,omitempty"`
+}
+
+// grafanaPanel is a panel of the dashboard
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	GridPos     grafanaGridPos         `json:"gridPos"`
+	Datasource  *grafanaDataSource     `json:"datasource,omitempty"`
+	Targets     []grafanaTarget        `json:"targets,omitempty"`
+	FieldConfig *grafanaFieldConfig    `json:"fieldConfig,omitempty"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+}
+
+// prometheusDataSource is the data source chosen with the dashboard's datasource variable
+var prometheusDataSource = grafanaDataSource{Type: "prometheus", UID: "${datasource}"}
+
+// dashboardBuilder lays out panels in rows of the dashboard grid
+type dashboardBuilder struct {
+	panels []grafanaPanel
+	y      int
+}
+
+// row starts a new row titled title
+func (b *dashboardBuilder) row(title string) {
+	b.panels = append(b.panels, grafanaPanel{
+		ID:      len(b.panels) + 1,
+		Type:    "row",
+		Title:   title,
+		GridPos: grafanaGridPos{H: 1, W: 24, Y: b.y},
+	})
+	b.y++
+}
+
+// add adds panels side by side on the current row, each of equal width
+func (b *dashboardBuilder) add(panels ...grafanaPanel) {
+	width := 24 / len(panels)
+	for i, panel := range panels {
+		panel.ID = len(b.panels) + 1
+		panel.GridPos = grafanaGridPos{H: 8, W: width, X: i * width, Y: b.y}
+		panel.Datasource = &prometheusDataSource
+		if panel.FieldConfig == nil {
+			panel.FieldConfig = &grafanaFieldConfig{}
+		}
+		if panel.FieldConfig.Overrides == nil {
+			panel.FieldConfig.Overrides = []interface{}{}
+		}
+		for j := range panel.Targets {
+			panel.Targets[j].RefID = string(rune('A' + j))
+			panel.Targets[j].Datasource = prometheusDataSource
+		}
+		b.panels = append(b.panels, panel)
+	}
+	b.y += 8
+}
+
+// timeseries returns a time series panel of the queries, whose values are in unit
+func timeseries(title, description, unit string, targets ...grafanaTarget) grafanaPanel {
+	return grafanaPanel{
+		Type:        "timeseries",
+		Title:       title,
+		Description: description,
+		Targets:     targets,
+		FieldConfig: &grafanaFieldConfig{Defaults: grafanaFieldDefaults{Unit: unit}},
+	}
+}
+
+// query returns a PromQL query whose series are named with legend
+func query(expr, legend string) grafanaTarget {
+	return grafanaTarget{Expr: expr, LegendFormat: legend}
+}
+
+// newGrafanaDashboard returns a dashboard of the metrics exposed on '/metrics', named with the registry's prefix
+func newGrafanaDashboard(r *Registry) grafanaDashboard {
+	// m returns the full name of a metric, including METRICS_PREFIX
+	m := r.Name
+
+	b := &dashboardBuilder{}
+
+	b.row("Consent flow")
+	funnel := make([]grafanaTarget, len(flowSteps))
+	for i, step := range flowSteps {
+		funnel[i] = grafanaTarget{
+			Expr:         fmt.Sprintf(`sum(increase(%s{step=%q}[$__range]))`, m("consent_flow_steps_total"), step),
+			LegendFormat: strings.Replace(step, "_", " ", -1),
+			Instant:      true,
+		}
+	}
+	zero := 0
+	b.add(
+		grafanaPanel{
+			Type:        "bargauge",
+			Title:       "Consent flow funnel",
+			Description: "Users reaching each step of the consent flow over the dashboard's time range.",
+			Targets:     funnel,
+			FieldConfig: &grafanaFieldConfig{Defaults: grafanaFieldDefaults{Unit: "short", Min: &zero}},
+			Options: map[string]interface{}{
+				"orientation":   "horizontal",
+				"displayMode":   "gradient",
+				"showUnfilled":  true,
+				"reduceOptions": map[string]interface{}{"calcs": []string{"lastNotNull"}, "values": false},
+			},
+		},
+		timeseries("Consent flow steps", "Rate at which users reach each step of the consent flow.", "reqps",
+			query(fmt.Sprintf(`sum by (step) (rate(%s[5m]))`, m("consent_flow_steps_total")), "{{step}}")),
+	)
+
+	b.row("Kong")
+	b.add(
+		timeseries("Kong requests", "Requests made to Kong's Admin API and proxy.", "reqps",
+			query(fmt.Sprintf(`sum by (api) (rate(%s[5m]))`, m("kong_requests_total")), "{{api}}")),
+		timeseries("Kong latency", "Average time taken by requests to Kong.", "ms",
+			query(fmt.Sprintf(`sum by (api) (rate(%s[5m])) / sum by (api) (rate(%s[5m]))`,
+				m("kong_request_duration_milliseconds_total"), m("kong_requests_total")), "{{api}}")),
+		timeseries("Kong errors", "Ratio of requests to Kong that failed with a network or server error.", "percentunit",
+			query(fmt.Sprintf(`sum by (api) (rate(%s[5m])) / sum by (api) (rate(%s[5m]))`,
+				m("kong_request_errors_total"), m("kong_requests_total")), "{{api}}")),
+	)
+	b.add(
+		timeseries("Admin API calls per minute", "Admin API calls in the last minute and the rate limit, if configured.", "short",
+			query(fmt.Sprintf(`sum by (endpoint) (%s{endpoint!="all"})`, m("kong_admin_requests_per_minute")), "{{endpoint}}"),
+			query(fmt.Sprintf(`max(%s) > 0`, m("kong_admin_rate_limit")), "limit")),
+		timeseries("Cache hit ratio", "Ratio of cache lookups that found a value.", "percentunit",
+			query(fmt.Sprintf(`sum by (cache) (rate(%s[5m])) / (sum by (cache) (rate(%s[5m])) + sum by (cache) (rate(%s[5m])))`,
+				m("cache_hits_total"), m("cache_hits_total"), m("cache_misses_total")), "{{cache}}")),
+	)
+
+	b.row("Latency")
+	p95 := func(metric, label string) grafanaTarget {
+		return query(fmt.Sprintf(`histogram_quantile(0.95, sum by (le, %s) (rate(%s_bucket[5m])))`, label, m(metric)), "{{"+label+"}}")
+	}
+	b.add(
+		timeseries("Template render latency", "95th percentile time taken to render each page and email template.", "s",
+			p95("template_render_duration_seconds", "template")),
+		timeseries("Session store latency", "95th percentile time taken by round trips to the session database.", "s",
+			p95("session_store_duration_seconds", "operation")),
+		timeseries("User store latency", "95th percentile time taken by queries of the user store and its consent grants.", "s",
+			p95("user_store_duration_seconds", "operation")),
+	)
+
+	b.row("API usage")
+	b.add(
+		timeseries("API requests by client", "Requests made with tokens issued by the consent application, from Kong's HTTP Log plugin.", "reqps",
+			query(fmt.Sprintf(`sum by (client_id) (rate(%s[5m]))`, m("api_requests_total")), "{{client_id}}")),
+		timeseries("API errors by client", "Ratio of requests made with the client's tokens that failed.", "percentunit",
+			query(fmt.Sprintf(`sum by (client_id) (rate(%s{status=~"4xx|5xx"}[5m])) / sum by (client_id) (rate(%s[5m]))`,
+				m("api_requests_total"), m("api_requests_total")), "{{client_id}}")),
+	)
+
+	b.row("Errors")
+	b.add(
+		timeseries("Errors", "Requests that failed with an error, by problem type.", "reqps",
+			query(fmt.Sprintf(`sum by (type) (rate(%s[5m]))`, m("errors_total")), "{{type}}")),
+		timeseries("SLI error ratio", "Ratio of bad events of each service level indicator, against its objective.", "percentunit",
+			query(fmt.Sprintf(`1 - sum by (sli) (rate(%s[5m])) / sum by (sli) (rate(%s[5m]))`,
+				m("sli_good_events_total"), m("sli_events_total")), "{{sli}}"),
+			query(fmt.Sprintf(`1 - max by (sli) (%s)`, m("slo_objective")), "{{sli}} budget")),
+	)
+
+	b.row("Sessions")
+	b.add(
+		timeseries("Sessions started and ended", "Sessions established by a login and ended, by reason.", "short",
+			query(fmt.Sprintf(`sum(increase(%s{step=%q}[5m]))`, m("consent_flow_steps_total"), flowStepAuthenticated), "started"),
+			query(fmt.Sprintf(`sum by (reason) (increase(%s[5m]))`, m("sessions_ended_total")), "ended ({{reason}})")),
+		timeseries("Login lockouts", "Usernames and client addresses locked out after repeated failed logins.", "short",
+			query(fmt.Sprintf(`sum(increase(%s[5m]))`, m("login_lockouts_total")), "lockouts")),
+	)
+
+	return grafanaDashboard{
+		UID:           "kong-oauth2-consent",
+		Title:         "Kong OAuth 2.0 consent application",
+		Tags:          []string{"kong", "oauth2"},
+		Timezone:      "browser",
+		SchemaVersion: 38,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-6h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		}},
+		Panels: b.panels,
+	}
+}
+
+// writeGrafanaDashboard writes the Grafana dashboard JSON of the application's metrics to w
+func writeGrafanaDashboard(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(newGrafanaDashboard(metrics))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// deliveryWorkers is the number of emails and webhooks delivered at the same time
+	deliveryWorkers = envInt("DELIVERY_WORKERS", 4)
+	// deliveryQueueSize bounds the deliveries waiting in memory
+	deliveryQueueSize = envInt("DELIVERY_QUEUE_SIZE", 1000)
+	// deliverySpillDir holds the deliveries that do not fit in memory, and those waiting at shutdown, so that they
+	// are delivered after a restart; without it deliveries are refused once the queue is full
+	deliverySpillDir = os.Getenv("DELIVERY_SPILL_DIR")
+)
+
+// The priorities of deliveries, highest first. Workers take every delivery of a higher priority before any of a
+// lower one, so that security alerts are not held up behind reports.
+const (
+	// priorityUrgent is for emails users are waiting for and security alerts to administrators
+	priorityUrgent = iota
+	// priorityNormal is for client webhooks and other notifications
+	priorityNormal
+	// priorityBulk is for reports and digests
+	priorityBulk
+
+	numPriorities
+)
+
+// priorityNames label the priorities in metrics and spill file names
+var priorityNames = [numPriorities]string{"urgent", "normal", "bulk"}
+
+// The kinds of delivery, each with a deliverer in deliverers
+const (
+	deliveryEmail         = "email"
+	deliveryClientWebhook = "client_webhook"
+	deliveryNotification  = "notification"
+)
+
+// deliverers deliver the payload of each kind of delivery; they are set by startDeliveries, as the notifications of
+// abandoned deliveries would otherwise be an initialization cycle
+var deliverers map[string]func(payload json.RawMessage) error
+
+// deliveryAttempts is how many times each kind of delivery is attempted before it is dropped, once if unlisted
+var deliveryAttempts = map[string]int{deliveryClientWebhook: clientWebhookAttempts}
+
+// deliveries is the application's delivery queue
+var deliveries = newDeliveryQueue(deliveryQueueSize, deliverySpillDir)
+
+// deliveryJob is an email or webhook waiting to be delivered, as it is kept in memory and on disk
+type deliveryJob struct {
+	Kind     string          `json:"kind"`
+	Priority int             `json:"priority"`
+	Payload  json.RawMessage `json:"payload"`
+	Queued   int64           `json:"queued"`
+	Attempt  int             `json:"attempt"`
+}
+
+// deliveryQueue holds deliveries by priority for a pool of workers, spilling them to disk when it is full
+type deliveryQueue struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	pending  [numPriorities][]*deliveryJob
+	size     int
+	capacity int
+	spillDir string
+	// spilled counts the deliveries on disk by priority
+	spilled [numPriorities]int
+	closed  bool
+}
+
+// newDeliveryQueue returns a queue holding up to capacity deliveries in memory, and the rest in spillDir if set
+func newDeliveryQueue(capacity int, spillDir string) *deliveryQueue {
+	q := &deliveryQueue{capacity: capacity, spillDir: spillDir}
+	q.ready = sync.NewCond(&q.mu)
+	for priority := 0; priority < numPriorities; priority++ {
+		p := priority
+		metrics.GaugeFunc("delivery_queue_depth", "Number of deliveries waiting, by priority and where they are held.", func() float64 {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return float64(len(q.pending[p]))
+		}, "priority", priorityNames[p], "held", "memory")
+		metrics.GaugeFunc("delivery_queue_depth", "Number of deliveries waiting, by priority and where they are held.", func() float64 {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return float64(q.spilled[p])
+		}, "priority", priorityNames[p], "held", "disk")
+	}
+	return q
+}
+
+// startDeliveries sets up the deliverers, counts the deliveries spilled by a previous run and starts the workers
+func startDeliveries() error {
+	deliverers = map[string]func(payload json.RawMessage) error{
+		deliveryEmail:         deliverEmail,
+		deliveryClientWebhook: deliverQueuedClientWebhook,
+		deliveryNotification:  deliverNotification,
+	}
+	if err := deliveries.recover(); err != nil {
+		return err
+	}
+	for i := 0; i < deliveryWorkers; i++ {
+		go deliveries.work()
+	}
+	return nil
+}
+
+// enqueue queues a delivery of the given kind and priority, returning an error wrapping ErrBusy if the queue is
+// full and cannot spill to disk
+func enqueue(kind string, priority int, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return deliveries.push(&deliveryJob{Kind: kind, Priority: priority, Payload: data, Queued: time.Now().UnixNano()})
+}
+
+// push adds a delivery to the queue, or to the spill directory if the queue is full
+func (q *deliveryQueue) push(job *deliveryJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed && q.size < q.capacity && q.spilled[job.Priority] == 0 {
+		q.pending[job.Priority] = append(q.pending[job.Priority], job)
+		q.size++
+		q.ready.Signal()
+		return nil
+	}
+	if q.spillDir == "" {
+		metrics.Counter("deliveries_refused_total", "Number of deliveries refused because the delivery queue was full, by kind.", "kind", job.Kind).Inc()
+		if q.closed {
+			return wrapError(ErrBusy, "queueing "+job.Kind+" delivery", errors.New("shutting down"))
+		}
+		return wrapError(ErrBusy, "queueing "+job.Kind+" delivery", fmt.Errorf("%d deliveries are waiting", q.size))
+	}
+	if err := q.spill(job); err != nil {
+		return wrapError(ErrBusy, "spilling "+job.Kind+" delivery", err)
+	}
+	q.ready.Signal()
+	return nil
+}
+
+// spill writes a delivery to the spill directory; the file names sort by priority, then by time queued. The
+// caller must hold q.mu.
+func (q *deliveryQueue) spill(job *deliveryJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s-%020d-%s.json", job.Priority, priorityNames[job.Priority], job.Queued, hex.EncodeToString(suffix))
+	// Deliveries can hold links that log users in and webhook secrets, so only the application may read them
+	if err := ioutil.WriteFile(filepath.Join(q.spillDir, name), data, 0600); err != nil {
+		return err
+	}
+	q.spilled[job.Priority]++
+	return nil
+}
+
+// recover counts the deliveries left in the spill directory by a previous run, so that they are delivered
+func (q *deliveryQueue) recover() error {
+	if q.spillDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(q.spillDir, 0700); err != nil {
+		return err
+	}
+	names, err := q.spillFiles()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, name := range names {
+		if priority, err := strconv.Atoi(strings.SplitN(name, "-", 2)[0]); err == nil && priority >= 0 && priority < numPriorities {
+			q.spilled[priority]++
+		}
+	}
+	if len(names) > 0 {
+		log.Printf("%d deliveries spilled to %s will be delivered", len(names), q.spillDir)
+	}
+	return nil
+}
+
+// spillFiles returns the names of the spilled deliveries in the order they are to be delivered
+func (q *deliveryQueue) spillFiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(q.spillDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// refill moves spilled deliveries of the priority back into memory, oldest first, while there is room. The caller
+// must hold q.mu.
+func (q *deliveryQueue) refill(priority int) {
+	names, err := q.spillFiles()
+	if err != nil {
+		log.Printf("reading spilled deliveries: %v", err)
+		return
+	}
+	prefix := strconv.Itoa(priority) + "-"
+	q.spilled[priority] = 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if q.size >= q.capacity {
+			q.spilled[priority]++
+			continue
+		}
+		path := filepath.Join(q.spillDir, name)
+		data, err := ioutil.ReadFile(path)
+		job := &deliveryJob{}
+		if err == nil {
+			err = json.Unmarshal(data, job)
+		}
+		if err != nil {
+			log.Printf("dropping spilled delivery %s: %v", name, err)
+			os.Remove(path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("removing spilled delivery %s: %v", name, err)
+			continue
+		}
+		q.pending[priority] = append(q.pending[priority], job)
+		q.size++
+	}
+}
+
+// pop waits for the next delivery, taking the highest priority first and, within a priority, spilled deliveries
+// before those queued after them. It returns nil once the queue is closed.
+func (q *deliveryQueue) pop() *deliveryJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return nil
+		}
+		for priority := 0; priority < numPriorities; priority++ {
+			if len(q.pending[priority]) == 0 && q.spilled[priority] > 0 {
+				q.refill(priority)
+			}
+			if len(q.pending[priority]) > 0 {
+				job := q.pending[priority][0]
+				q.pending[priority] = q.pending[priority][1:]
+				q.size--
+				return job
+			}
+		}
+		q.ready.Wait()
+	}
+}
+
+// work delivers queued deliveries until the queue is closed, retrying failed ones with a growing delay
+func (q *deliveryQueue) work() {
+	for job := q.pop(); job != nil; job = q.pop() {
+		deliver, ok := deliverers[job.Kind]
+		if !ok {
+			log.Printf("dropping delivery of unknown kind %q", job.Kind)
+			continue
+		}
+		job.Attempt++
+		err := deliver(job.Payload)
+		metrics.Counter("deliveries_total", "Number of attempts to deliver emails and webhooks, by kind and outcome.",
+			"kind", job.Kind, "outcome", deliveryOutcome(err)).Inc()
+		if err == nil {
+			metrics.Counter("delivery_latency_milliseconds_total", "Time from queueing to delivery of delivered emails and webhooks, by kind.",
+				"kind", job.Kind).Add(uint64(time.Since(time.Unix(0, job.Queued)).Milliseconds()))
+			continue
+		}
+
+		attempts, ok := deliveryAttempts[job.Kind]
+		if !ok {
+			attempts = 1
+		}
+		log.Printf("%s delivery, attempt %d of %d: %v", job.Kind, job.Attempt, attempts, err)
+		if job.Attempt < attempts {
+			retry := job
+			time.AfterFunc(time.Second<<(2*uint(job.Attempt-1)), func() {
+				if err := q.push(retry); err != nil {
+					log.Printf("%s delivery dropped: %v", retry.Kind, err)
+				}
+			})
+			continue
+		}
+		if job.Kind != deliveryNotification {
+			notify(eventJobFailed, "Delivery abandoned", map[string]string{"job": job.Kind, "error": err.Error()})
+		}
+	}
+}
+
+// close stops the workers from taking more deliveries and spills the deliveries still waiting, and the retries
+// queued after it, so that they are delivered after a restart. Without a spill directory they are lost.
+func (q *deliveryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+
+	lost := 0
+	for priority := range q.pending {
+		for _, job := range q.pending[priority] {
+			if q.spillDir == "" {
+				lost++
+				continue
+			}
+			if err := q.spill(job); err != nil {
+				log.Printf("spilling %s delivery at shutdown: %v", job.Kind, err)
+				lost++
+			}
+		}
+		q.pending[priority] = nil
+	}
+	q.size = 0
+	if lost > 0 {
+		log.Printf("%d deliveries were not delivered before shutdown", lost)
+	}
+}
+
+// deliverEmail sends a queued email
+func deliverEmail(payload json.RawMessage) error {
+	msg := Message{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	return mailer.Send(msg)
+}
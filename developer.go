@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// getDeveloper returns the developer portal view on a GET request
+//
+// Client owners can choose one of their clients and a set of scopes to preview the consent page.
+func getDeveloper(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+	username := session.GetString("username")
+
+	registered, err := clients.List()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	owned := []string{}
+	for _, client := range registered {
+		if isClientOwner(client, username) {
+			owned = append(owned, client.ClientID)
+		}
+	}
+	sort.Strings(owned)
+
+	// Suggest the scopes configured on Kong's OAuth 2.0 plugins
+	scopes := "email,phone,address"
+	if catalog, err := getScopeCatalog(kongContext(ctx)); err == nil && len(catalog) > 0 {
+		scopes = strings.Join(catalog, ",")
+	}
+
+	ctx.ViewData("Clients", owned)
+	ctx.ViewData("Scopes", scopes)
+	ctx.View("developer.html")
+}
+
+// getDeveloperPreview returns the consent view in preview mode on a GET request
+//
+// The view is rendered with the client's branding and scope descriptions exactly as users would see
+// it, but no authorization is requested from Kong.
+func getDeveloperPreview(ctx iris.Context) {
+	var (
+		clientID = ctx.URLParam("client_id")
+		scopes   = ctx.URLParam("scopes")
+	)
+
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	client, err := getClientSettings(clientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if clientID == "" || !isClientOwner(client, session.GetString("username")) {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an owner of this client application.")
+		return
+	}
+
+	viewConsent(ctx, ConsentRequest{ClientID: clientID, ResponseType: "code", Scopes: scopes}, true)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	dnsCacheEnabled = envBool("DNS_CACHE", false)
+	dnsServer       = os.Getenv("DNS_SERVER")
+	dnsHosts        = parseDNSHosts(envList("DNS_HOSTS"))
+)
+
+// dnsCache holds the addresses of hosts resolved for outbound requests, for DNS_CACHE_TTL regardless of the
+// TTL of the DNS records
+var dnsCache = newCache("dns",
+	envInt("DNS_CACHE_MAX_ENTRIES", 100),
+	0,
+	envDuration("DNS_CACHE_TTL", time.Minute))
+
+// parseDNSHosts parses static host mappings of the form 'host=address'
+func parseDNSHosts(mappings []string) map[string][]string {
+	hosts := map[string][]string{}
+	for _, mapping := range mappings {
+		i := strings.IndexByte(mapping, '=')
+		if i < 0 || net.ParseIP(strings.TrimSpace(mapping[i+1:])) == nil {
+			log.Printf("invalid DNS_HOSTS mapping %q, expected host=address", mapping)
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(mapping[:i]))
+		hosts[host] = append(hosts[host], strings.TrimSpace(mapping[i+1:]))
+	}
+	return hosts
+}
+
+// cachingDialer dials outbound connections, resolving hosts from static mappings, the DNS cache, or a resolver
+type cachingDialer struct {
+	dialer   *net.Dialer
+	resolver *net.Resolver
+	cache    bool
+}
+
+// newCachingDialer returns a dialer using DNS_HOSTS, DNS_CACHE and DNS_SERVER, or nil if none are configured
+func newCachingDialer() *cachingDialer {
+	if !dnsCacheEnabled && dnsServer == "" && len(dnsHosts) == 0 {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	resolver := net.DefaultResolver
+	if dnsServer != "" {
+		// Send every DNS query to the configured server, for split-horizon setups
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	return &cachingDialer{dialer: dialer, resolver: resolver, cache: dnsCacheEnabled}
+}
+
+// DialContext connects to addr, trying each of the host's addresses in turn
+func (d *cachingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	addresses, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialErr error
+	for _, address := range addresses {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(address, port))
+		if err == nil {
+			return conn, nil
+		}
+		dialErr = err
+	}
+	if dialErr == nil {
+		dialErr = errors.New("no addresses found for " + host)
+	}
+	return nil, dialErr
+}
+
+// lookup returns the addresses of host
+func (d *cachingDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(host)
+	if addresses, ok := dnsHosts[host]; ok {
+		return addresses, nil
+	}
+
+	if d.cache {
+		if addresses, ok := dnsCache.Get(host); ok {
+			return addresses.([]string), nil
+		}
+	}
+
+	addresses, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.cache {
+		size := len(host)
+		for _, address := range addresses {
+			size += len(address)
+		}
+		dnsCache.Set(host, addresses, int64(size))
+	}
+	return addresses, nil
+}
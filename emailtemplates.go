@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// emailTemplatesDir holds the HTML and plain text templates of the emails sent to users
+	emailTemplatesDir = envOrDefault("EMAIL_TEMPLATES_DIR", "./emails")
+
+	// emailTheme brands the HTML emails
+	emailTheme = EmailTheme{
+		Name:         envOrDefault("EMAIL_BRAND_NAME", "Kong OAuth 2.0 Consent"),
+		LogoURL:      os.Getenv("EMAIL_LOGO_URL"),
+		PrimaryColor: envOrDefault("EMAIL_PRIMARY_COLOR", "#336699"),
+		Footer:       os.Getenv("EMAIL_FOOTER"),
+	}
+)
+
+// The emails sent to users, each rendered from <name>.html and <name>.txt in EMAIL_TEMPLATES_DIR
+const (
+	emailVerifyEmail    = "verify_email"
+	emailPasswordReset  = "password_reset"
+	emailMagicLink      = "magic_link"
+	emailLayoutTemplate = "layout.html"
+)
+
+// emailNames lists the emails in the order they are previewed
+var emailNames = []string{emailVerifyEmail, emailPasswordReset, emailMagicLink}
+
+// emailTemplates are the parsed templates of each email, loaded at startup
+var emailTemplates = map[string]*emailTemplate{}
+
+// EmailTheme is the branding of the HTML emails
+type EmailTheme struct {
+	Name         string
+	LogoURL      string
+	PrimaryColor string
+	Footer       string
+}
+
+// EmailData is the data emails are rendered with
+type EmailData struct {
+	Theme       EmailTheme
+	Environment *Environment
+	Username    string
+	Link        string
+	TTL         string
+}
+
+// emailTemplate holds the HTML body, wrapped in the layout, and the plain text body of an email
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// emailTemplateFuncs declares the functions templates can use; tr is bound to the request's locale when rendering
+var emailTemplateFuncs = map[string]interface{}{
+	"tr": func(key string) string { return key },
+}
+
+// loadEmailTemplates parses the templates of every email in dir
+func loadEmailTemplates(dir string) error {
+	templates := map[string]*emailTemplate{}
+	for _, name := range emailNames {
+		html, err := htmltemplate.New(emailLayoutTemplate).Funcs(emailTemplateFuncs).
+			ParseFiles(filepath.Join(dir, emailLayoutTemplate), filepath.Join(dir, name+".html"))
+		if err != nil {
+			return fmt.Errorf("parsing email templates: %w", err)
+		}
+		text, err := texttemplate.New(name + ".txt").Funcs(emailTemplateFuncs).ParseFiles(filepath.Join(dir, name+".txt"))
+		if err != nil {
+			return fmt.Errorf("parsing email templates: %w", err)
+		}
+		templates[name] = &emailTemplate{html: html, text: text}
+	}
+	reloadMu.Lock()
+	emailTemplates = templates
+	reloadMu.Unlock()
+	return nil
+}
+
+// renderEmail renders an email to a user in the language on their profile, or in the request's language
+//
+// The subject is the locale key 'EmailSubject_' followed by the email's name, prefixed with the environment's label
+// outside production.
+func renderEmail(ctx iris.Context, name string, user *User, link string, ttl time.Duration) (Message, error) {
+	reloadMu.RLock()
+	tmpl, ok := emailTemplates[name]
+	reloadMu.RUnlock()
+	if !ok {
+		return Message{}, fmt.Errorf("email template %q is not loaded", name)
+	}
+
+	tr := userTranslator(ctx, user)
+	funcs := map[string]interface{}{"tr": tr}
+	reloadMu.RLock()
+	theme := emailTheme
+	reloadMu.RUnlock()
+	data := EmailData{Theme: theme, Environment: environment, Username: user.Username, Link: link, TTL: ttl.String()}
+
+	html, err := tmpl.html.Clone()
+	if err != nil {
+		return Message{}, err
+	}
+	var htmlBody, textBody bytes.Buffer
+	start := time.Now()
+	if err := html.Funcs(funcs).Execute(&htmlBody, data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s email: %w", name, err)
+	}
+	observeTemplateRender("emails/"+name+".html", start)
+	text, err := tmpl.text.Clone()
+	if err != nil {
+		return Message{}, err
+	}
+	start = time.Now()
+	if err := text.Funcs(funcs).Execute(&textBody, data); err != nil {
+		return Message{}, fmt.Errorf("rendering %s email: %w", name, err)
+	}
+	observeTemplateRender("emails/"+name+".txt", start)
+
+	return Message{
+		To:      user.Email,
+		Subject: environmentSubject(tr("EmailSubject_" + name)),
+		Text:    textBody.String(),
+		HTML:    htmlBody.String(),
+	}, nil
+}
+
+// sendEmail renders an email to the user and queues it, ahead of other deliveries as the user is waiting for it
+func sendEmail(ctx iris.Context, name string, user *User, link string, ttl time.Duration) error {
+	msg, err := renderEmail(ctx, name, user, link, ttl)
+	if err != nil {
+		return err
+	}
+	return enqueue(deliveryEmail, priorityUrgent, msg)
+}
+
+// translate returns the request's translation of a locale key, or the key if there is none
+func translate(ctx iris.Context, key string) string {
+	if translated := ctx.Tr(key); translated != "" {
+		return translated
+	}
+	return key
+}
+
+// emailPreview is a rendered sample of an email on the preview page
+type emailPreview struct {
+	Name    string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// getAdminEmails shows administrators a rendered sample of every email, in their browser's language
+func getAdminEmails(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	sample := &User{Username: admin.Username, Email: admin.Email}
+	if sample.Email == "" {
+		sample.Email = admin.Username + "@example.com"
+	}
+	previews := []emailPreview{}
+	for _, name := range emailNames {
+		msg, err := renderEmail(ctx, name, sample, publicURL+"/"+strings.Replace(name, "_", "-", -1)+"?token=sample", 24*time.Hour)
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		previews = append(previews, emailPreview{Name: name, Subject: msg.Subject, Text: msg.Text, HTML: msg.HTML})
+	}
+
+	ctx.ViewData("Emails", previews)
+	ctx.View("admin-emails.html")
+}
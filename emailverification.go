@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+const emailVerificationPurpose = "email-verification"
+
+var (
+	requireVerifiedEmail = envBool("REQUIRE_VERIFIED_EMAIL", false)
+	emailVerificationTTL = envDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+)
+
+// emailVerificationData is carried by an email verification link: the user and the address being verified
+type emailVerificationData struct {
+	Username string `json:"sub"`
+	Email    string `json:"email"`
+}
+
+// EmailForm represents the email address submitted on the account email page
+type EmailForm struct {
+	Email string
+}
+
+// verifiedEmailRequired reports whether users must verify their email address before consenting, which the remote
+// configuration may change while running
+func verifiedEmailRequired() bool {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return requireVerifiedEmail
+}
+
+// sendVerificationEmail emails a signed link that verifies the user's current email address
+func sendVerificationEmail(ctx iris.Context, user *User) error {
+	token, err := signToken(emailVerificationPurpose, emailVerificationTTL, emailVerificationData{
+		Username: user.Username,
+		Email:    user.Email,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/verify-email?token=" + url.QueryEscape(token)
+	return sendEmail(ctx, emailVerifyEmail, user, link, emailVerificationTTL)
+}
+
+// requireEmailVerification shows the verification required view if verified email addresses are required and
+// the user in the session has not verified theirs
+//
+// It returns false if the user may continue with the consent request.
+func requireEmailVerification(ctx iris.Context) bool {
+	if !verifiedEmailRequired() {
+		return false
+	}
+
+	session := sess.Start(ctx)
+	user, err := users.Get(session.GetString("username"))
+	if err == nil && user.Email != "" && user.EmailVerified {
+		return false
+	}
+
+	ctx.StatusCode(iris.StatusForbidden)
+	if err == nil {
+		ctx.ViewData("Email", user.Email)
+	}
+	ctx.View("verify-email-required.html")
+	return true
+}
+
+// getVerifyEmail marks the user's email address as verified when a verification link is followed
+//
+// Links for an address other than the user's current one are refused, so changing the address invalidates them.
+func getVerifyEmail(ctx iris.Context) {
+	data := emailVerificationData{}
+	if _, err := verifyToken(emailVerificationPurpose, ctx.URLParam("token"), &data); err != nil {
+		viewVerifyEmailError(ctx)
+		return
+	}
+
+	user, err := users.Get(data.Username)
+	if err == ErrUserNotFound || (err == nil && !strings.EqualFold(user.Email, data.Email)) {
+		viewVerifyEmailError(ctx)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user.EmailVerified = true
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Email", user.Email)
+	ctx.View("verify-email.html")
+}
+
+// viewVerifyEmailError renders the verification view when a verification link cannot be used
+func viewVerifyEmailError(ctx iris.Context) {
+	ctx.StatusCode(iris.StatusBadRequest)
+	ctx.ViewData("Error", "This verification link is invalid or has expired. Please request a new one from your account.")
+	ctx.View("verify-email.html")
+}
+
+// getAccountEmail returns the account email view on a GET request
+func getAccountEmail(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Email", user.Email)
+	ctx.ViewData("EmailVerified", user.EmailVerified)
+	ctx.View("account-email.html")
+}
+
+// postAccountEmail handles POST requests to the account email endpoint
+//
+// A changed address is saved as unverified and a verification link is sent to it. Submitting the current
+// address resends the verification link.
+func postAccountEmail(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := EmailForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	address, err := mail.ParseAddress(strings.TrimSpace(form.Email))
+	if err != nil {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please enter a valid email address.")
+		ctx.ViewData("Email", user.Email)
+		ctx.ViewData("EmailVerified", user.EmailVerified)
+		ctx.View("account-email.html")
+		return
+	}
+
+	if !strings.EqualFold(address.Address, user.Email) {
+		if other, err := findUserByEmail(address.Address); err == nil && other.Username != user.Username {
+			ctx.StatusCode(iris.StatusConflict)
+			ctx.ViewData("Error", "An account with this email address already exists.")
+			ctx.ViewData("Email", user.Email)
+			ctx.ViewData("EmailVerified", user.EmailVerified)
+			ctx.View("account-email.html")
+			return
+		}
+
+		user.Email = address.Address
+		user.EmailVerified = false
+		if err := users.Save(user); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	if !user.EmailVerified {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		ctx.ViewData("Notice", "We have sent a verification link to "+user.Email+".")
+	}
+
+	ctx.ViewData("Email", user.Email)
+	ctx.ViewData("EmailVerified", user.EmailVerified)
+	ctx.View("account-email.html")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// enrichmentURL is the HTTP source of the attributes added to users when they log in, such as an HR system
+	enrichmentURL   = os.Getenv("ENRICHMENT_URL")
+	enrichmentToken = os.Getenv("ENRICHMENT_TOKEN")
+
+	// enrichmentLDAPURL is the directory users' attributes are read from instead, such as ldaps://ldap.example.com
+	enrichmentLDAPURL          = os.Getenv("ENRICHMENT_LDAP_URL")
+	enrichmentLDAPBindDN       = os.Getenv("ENRICHMENT_LDAP_BIND_DN")
+	enrichmentLDAPBindPassword = os.Getenv("ENRICHMENT_LDAP_BIND_PASSWORD")
+	enrichmentLDAPBaseDN       = os.Getenv("ENRICHMENT_LDAP_BASE_DN")
+	// enrichmentLDAPUserAttribute is the directory attribute holding the username
+	enrichmentLDAPUserAttribute = envOrDefault("ENRICHMENT_LDAP_USER_ATTRIBUTE", "uid")
+
+	// enrichmentAttributes maps the names of the attributes to the fields of the source they are read from,
+	// configured as a comma separated list of name=field entries
+	enrichmentAttributes = parseEnrichmentAttributes(envList("ENRICHMENT_ATTRIBUTES"))
+	// enrichmentAuthorizeAttributes are the attributes sent to Kong's authorize endpoint as headers
+	enrichmentAuthorizeAttributes = envList("ENRICHMENT_AUTHORIZE_ATTRIBUTES")
+	// enrichmentTimeout is how long the source has to respond
+	enrichmentTimeout = envDuration("ENRICHMENT_TIMEOUT", 5*time.Second)
+
+	enrichmentFailures = metrics.Counter("enrichment_failures_total", "Number of failures to fetch users' attributes.")
+)
+
+// attributeHeaderPrefix prefixes the headers carrying a user's attributes to Kong's authorize endpoint
+const attributeHeaderPrefix = "X-Consent-Attribute-"
+
+// attributeSource fetches the attributes of users from an HR system or directory when they log in, if one is
+// configured
+var attributeSource = newAttributeSource()
+
+// AttributeSource fetches extra attributes of a user, such as their department, employee ID or clearance
+//
+// Implementations return ErrUserNotFound when the source does not know the user.
+type AttributeSource interface {
+	Attributes(user *User) (map[string]string, error)
+}
+
+// newAttributeSource returns an HTTP source if ENRICHMENT_URL is configured, an LDAP source if
+// ENRICHMENT_LDAP_URL is, otherwise nil
+func newAttributeSource() AttributeSource {
+	switch {
+	case enrichmentURL != "":
+		return httpAttributeSource{
+			url:    enrichmentURL,
+			token:  enrichmentToken,
+			client: newExternalHTTPClient(enrichmentTimeout),
+		}
+	case enrichmentLDAPURL != "":
+		return ldapAttributeSource{client: ldapClient{
+			url:          enrichmentLDAPURL,
+			bindDN:       enrichmentLDAPBindDN,
+			bindPassword: enrichmentLDAPBindPassword,
+			timeout:      enrichmentTimeout,
+		}}
+	default:
+		return nil
+	}
+}
+
+// parseEnrichmentAttributes parses name=field entries; an entry without a field reads the field of the same name
+func parseEnrichmentAttributes(entries []string) map[string]string {
+	mapping := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			log.Printf("invalid enrichment attribute %q", entry)
+			continue
+		}
+		field := name
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) != "" {
+			field = strings.TrimSpace(parts[1])
+		}
+		mapping[name] = field
+	}
+	return mapping
+}
+
+// checkAttributeSource returns an error if both sources are configured, a source would be sent credentials in the
+// clear, or the directory source has no attributes to read
+//
+// Plain HTTP and LDAP are only allowed to a loopback address, such as a sidecar on the same host.
+func checkAttributeSource() error {
+	if enrichmentURL != "" && enrichmentLDAPURL != "" {
+		return errors.New("only one of ENRICHMENT_URL and ENRICHMENT_LDAP_URL can be set")
+	}
+	for name, value := range map[string]string{"ENRICHMENT_URL": enrichmentURL, "ENRICHMENT_LDAP_URL": enrichmentLDAPURL} {
+		if value == "" {
+			continue
+		}
+		uri, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(uri.Hostname())
+		if uri.Scheme != "https" && uri.Scheme != "ldaps" && (ip == nil || !ip.IsLoopback()) {
+			return errors.New(name + " must use https or ldaps")
+		}
+	}
+	if enrichmentLDAPURL != "" && (enrichmentLDAPBaseDN == "" || len(enrichmentAttributes) == 0) {
+		return errors.New("ENRICHMENT_LDAP_URL requires ENRICHMENT_LDAP_BASE_DN and ENRICHMENT_ATTRIBUTES")
+	}
+	return nil
+}
+
+// enrichUser refreshes the user's attributes from the attribute source after they authenticate
+//
+// The attributes are saved on the user so that consent copy rules, consent templates and the authorize call can
+// use them. Logins are not refused when the source fails; the attributes from the previous login are kept.
+func enrichUser(user *User) {
+	if attributeSource == nil {
+		return
+	}
+	attributes, err := attributeSource.Attributes(user)
+	if err == ErrUserNotFound {
+		attributes = map[string]string{}
+	} else if err != nil {
+		log.Printf("fetching attributes of %s: %v", user.Username, err)
+		enrichmentFailures.Inc()
+		return
+	}
+	if equalAttributes(attributes, user.Attributes) {
+		return
+	}
+	user.Attributes = attributes
+	if err := users.Save(user); err != nil {
+		log.Printf("saving attributes of %s: %v", user.Username, err)
+	}
+}
+
+// equalAttributes reports whether a and b hold the same attributes
+func equalAttributes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionAttributes returns the attributes of the logged in user, if any
+func sessionAttributes(ctx iris.Context) map[string]string {
+	username := sess.Start(ctx).GetString("username")
+	if username == "" {
+		return nil
+	}
+	user, err := users.Get(username)
+	if err != nil {
+		return nil
+	}
+	return user.Attributes
+}
+
+// authorizeAttributeHeaders returns the headers carrying the user's attributes listed in
+// ENRICHMENT_AUTHORIZE_ATTRIBUTES to Kong's authorize endpoint
+func authorizeAttributeHeaders(attributes map[string]string) http.Header {
+	header := http.Header{}
+	for _, name := range enrichmentAuthorizeAttributes {
+		if value, ok := attributes[name]; ok {
+			header.Set(attributeHeaderPrefix+name, value)
+		}
+	}
+	return header
+}
+
+// httpAttributeSource fetches attributes as a JSON object from an HTTP endpoint
+type httpAttributeSource struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Attributes requests the attributes of the user by their username and authenticated_userid
+func (s httpAttributeSource) Attributes(user *User) (map[string]string, error) {
+	query := url.Values{}
+	query.Set("username", user.Username)
+	query.Set("authenticated_userid", authenticatedUserID(user))
+	separator := "?"
+	if strings.Contains(s.url, "?") {
+		separator = "&"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.url+separator+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrUserNotFound
+	default:
+		return nil, errors.New("attribute source responded " + res.Status)
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&fields); err != nil {
+		return nil, err
+	}
+	attributes := map[string]string{}
+	for name, field := range attributeFields(fields) {
+		switch value := fields[field].(type) {
+		case string:
+			attributes[name] = value
+		case float64, bool:
+			attributes[name] = fmt.Sprint(value)
+		}
+	}
+	return attributes, nil
+}
+
+// attributeFields returns the configured mapping of attributes to fields, or every field of the response if
+// ENRICHMENT_ATTRIBUTES is not set
+func attributeFields(fields map[string]interface{}) map[string]string {
+	if len(enrichmentAttributes) > 0 {
+		return enrichmentAttributes
+	}
+	mapping := map[string]string{}
+	for field := range fields {
+		mapping[field] = field
+	}
+	return mapping
+}
+
+// ldapAttributeSource reads attributes from the user's entry in a directory
+type ldapAttributeSource struct {
+	client ldapClient
+}
+
+// Attributes searches the directory for the user's entry by username and reads the configured attributes
+//
+// Attributes with several values are joined with commas.
+func (s ldapAttributeSource) Attributes(user *User) (map[string]string, error) {
+	var fields []string
+	for _, field := range enrichmentAttributes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	entry, err := s.client.search(enrichmentLDAPBaseDN, enrichmentLDAPUserAttribute, user.Username, fields)
+	if err != nil {
+		return nil, err
+	}
+	attributes := map[string]string{}
+	for name, field := range enrichmentAttributes {
+		if values, ok := entry[strings.ToLower(field)]; ok {
+			attributes[name] = strings.Join(values, ",")
+		}
+	}
+	return attributes, nil
+}
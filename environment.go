@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// environment watermarks the pages and emails of deployments other than production, or is nil in production
+var environment = newEnvironment(os.Getenv("ENVIRONMENT_NAME"), os.Getenv("ENVIRONMENT_LABEL"), os.Getenv("ENVIRONMENT_COLOR"))
+
+// environmentColors are the default watermark colors of the usual environment names
+var environmentColors = map[string]string{
+	"dev":         "#38761d",
+	"development": "#38761d",
+	"test":        "#0b5394",
+	"qa":          "#0b5394",
+	"staging":     "#b45f06",
+}
+
+// environmentDefaultColor is the watermark color of other environment names
+const environmentDefaultColor = "#741b47"
+
+// Environment is the label and color a deployment's pages and emails are watermarked with
+type Environment struct {
+	Label string
+	Color string
+}
+
+// newEnvironment returns the watermark of the named environment, or nil for production or an empty name
+//
+// The label defaults to the name in upper case, and the color to the usual color of the name.
+func newEnvironment(name, label, color string) *Environment {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "production" || name == "prod" {
+		return nil
+	}
+	if label == "" {
+		label = strings.ToUpper(name)
+	}
+	if color == "" {
+		color = environmentColors[name]
+	}
+	if color == "" {
+		color = environmentDefaultColor
+	}
+	return &Environment{Label: label, Color: color}
+}
+
+// addEnvironment is middleware that adds the environment's watermark to the view data
+func addEnvironment(ctx iris.Context) {
+	if environment != nil {
+		ctx.ViewData("Environment", environment)
+	}
+	ctx.Next()
+}
+
+// environmentSubject prefixes an email's subject with the environment's label, so that test emails stand out in an
+// inbox
+func environmentSubject(subject string) string {
+	if environment == nil {
+		return subject
+	}
+	return "[" + environment.Label + "] " + subject
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/kataras/iris/v12"
+)
+
+// Kinds of error that handlers fail with. Errors are wrapped with context where they occur and matched with
+// errors.Is, so that the error page and status code do not depend on the wording of the underlying error.
+var (
+	// ErrKongUnavailable is matched by errors reaching, or reading a response from, Kong's Admin or Proxy API
+	ErrKongUnavailable = errors.New("kong unavailable")
+
+	// ErrUnknownClient is matched by errors for a client_id that has no OAuth 2.0 credentials on Kong
+	ErrUnknownClient = errors.New("unknown client")
+
+	// ErrInvalidScope is matched by errors for requested scopes that are not configured on Kong
+	ErrInvalidScope = errors.New("invalid scope")
+
+	// ErrStore is matched by errors reading or writing the user store or client registry
+	ErrStore = errors.New("store error")
+
+	// ErrBusy is matched by errors for work refused because the application is overloaded, such as emails that do not
+	// fit in the delivery queue
+	ErrBusy = errors.New("busy")
+)
+
+// kindError wraps an error with a description of what was being done and the kind of error it is
+type kindError struct {
+	kind    error
+	context string
+	err     error
+}
+
+// wrapError returns err annotated with context, matching kind with errors.Is
+func wrapError(kind error, context string, err error) error {
+	return &kindError{kind: kind, context: context, err: err}
+}
+
+// Error returns the context followed by the wrapped error
+func (e *kindError) Error() string {
+	return e.context + ": " + e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is the kind of the error
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// errorResponse returns the status code, the locale key of the message shown for err and its problem type
+func errorResponse(err error) (int, string, string) {
+	var kongErr *KongError
+	switch {
+	case errors.As(err, &kongErr):
+		return iris.StatusBadRequest, kongErrorKey(kongErr.Code), problemKongError
+	case errors.Is(err, ErrUnknownClient):
+		return iris.StatusBadRequest, "KongErrorInvalidClient", problemUnknownClient
+	case errors.Is(err, ErrInvalidScope):
+		return iris.StatusBadRequest, "KongErrorInvalidScope", problemInvalidScope
+	case errors.Is(err, ErrKongUnavailable):
+		return iris.StatusServiceUnavailable, "ErrorKongUnavailable", problemKongUnavailable
+	case errors.Is(err, ErrBusy):
+		return iris.StatusServiceUnavailable, "ErrorBusy", problemServiceUnavailable
+	case errors.Is(err, ErrStore):
+		return iris.StatusInternalServerError, "ErrorStore", problemStoreError
+	default:
+		return iris.StatusInternalServerError, "ErrorInternal", problemInternalError
+	}
+}
+
+// renderErrors is middleware that renders the error page for the error a handler failed with using ctx.SetErr
+//
+// Requests that accept JSON are sent problem details instead. The error itself is logged, and only shown to
+// users in debug mode.
+func renderErrors(ctx iris.Context) {
+	ctx.Next()
+
+	err := ctx.GetErr()
+	if err == nil {
+		return
+	}
+
+	status, key, problemType := errorResponse(err)
+	metrics.Counter("errors_total", "Number of requests that failed with an error, by problem type.", "type", problemType).Inc()
+	log.Printf("%s %s [%s]: %v", ctx.Method(), ctx.Path(), requestID(ctx), err)
+
+	if wantsProblem(ctx) {
+		viewProblem(ctx, status, problemType, "")
+		return
+	}
+
+	var kongErr *KongError
+	if errors.As(err, &kongErr) {
+		viewKongError(ctx, status, kongErr)
+		return
+	}
+	if debug {
+		ctx.ViewData("CodeLabel", ctx.Tr("ErrorCode"))
+		ctx.ViewData("Code", key)
+		ctx.ViewData("Description", err.Error())
+	}
+	viewError(ctx, status, key)
+}
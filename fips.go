@@ -0,0 +1,22 @@
+//go:build fips
+// +build fips
+
+package main
+
+import (
+	"crypto/boring"
+
+	// Restrict TLS to FIPS-approved versions, cipher suites and curves
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsMode is set by the fips build tag, which requires building with GOEXPERIMENT=boringcrypto
+const fipsMode = true
+
+// cryptoModule returns the cryptographic module the standard library's crypto packages use
+func cryptoModule() string {
+	if boring.Enabled() {
+		return cryptoModuleBoring
+	}
+	return cryptoModuleStandard
+}
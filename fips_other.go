@@ -0,0 +1,12 @@
+//go:build !fips
+// +build !fips
+
+package main
+
+// fipsMode is set by the fips build tag
+const fipsMode = false
+
+// cryptoModule returns the cryptographic module the standard library's crypto packages use
+func cryptoModule() string {
+	return cryptoModuleStandard
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Steps of the consent flow counted by consent_flow_steps_total, in the order a user passes through them
+const (
+	flowStepLoginForm      = "login_form"
+	flowStepAuthenticated  = "authenticated"
+	flowStepConsentForm    = "consent_form"
+	flowStepConsentGranted = "consent_granted"
+
+	// flowStepConsentDenied ends the flow without a grant, so it is counted but not part of the funnel
+	flowStepConsentDenied = "consent_denied"
+)
+
+// flowSteps lists the steps of the consent flow in order, as shown in the dashboard's funnel
+var flowSteps = []string{flowStepLoginForm, flowStepAuthenticated, flowStepConsentForm, flowStepConsentGranted}
+
+// countFlowStep counts a user reaching a step of the consent flow
+func countFlowStep(step string) {
+	metrics.Counter("consent_flow_steps_total", "Number of times users reached each step of the consent flow.", "step", step).Inc()
+}
+
+// countSessionEnded counts a session ending for reason, such as "logout"
+func countSessionEnded(reason string) {
+	metrics.Counter("sessions_ended_total", "Number of sessions ended, by reason.", "reason", reason).Inc()
+}
+
+// countKongRequest counts a request to Kong, how long it took and whether it failed with a network or server error
+func countKongRequest(req *http.Request, elapsed time.Duration, failed bool) {
+	api := "proxy"
+	if adminEndpoint(req) != "" {
+		api = "admin"
+	}
+	metrics.Counter("kong_requests_total", "Number of requests made to Kong.", "api", api).Inc()
+	metrics.Counter("kong_request_duration_milliseconds_total", "Total time spent on requests to Kong in milliseconds.", "api", api).
+		Add(uint64(elapsed / time.Millisecond))
+	if failed {
+		metrics.Counter("kong_request_errors_total", "Number of requests to Kong that failed with a network or server error.", "api", api).Inc()
+	}
+}
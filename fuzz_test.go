@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fuzz targets below cover the parsers of attacker-controlled input: the consent endpoint's query, the scopes,
+// the redirect URIs, authorization details and request objects clients send and the responses of Kong, which may be a compromised
+// or misconfigured proxy.
+// Without -fuzz, go test runs each target on its seed corpus and on the inputs saved in testdata/fuzz.
+//
+//	go test -run XXX -fuzz FuzzParseConsentRequest -fuzztime 1m
+
+func FuzzParseConsentRequest(f *testing.F) {
+	f.Add("client_id=client-id&response_type=code&scopes=email,phone,address&state=xyz")
+	f.Add("client_id=client-id&response_type=code&scope=openid+profile+email&redirect_uri=http%3A%2F%2F127.0.0.1%3A8000%2Fcallback")
+	f.Add("response_type=token&scopes=,,email,,email&code_challenge=E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM&code_challenge_method=S256")
+	f.Add("scopes=%00%FF&state=%E2%80%A8&code_challenge_method=plain")
+	f.Add("client_id=a&client_id=b;scopes=email")
+	f.Add("scopes=email&resource=https%3A%2F%2Fapi.example.com%2F&resource=https%3A%2F%2Fapi.example.com%2F&resource=%2Frelative%23x")
+
+	f.Fuzz(func(t *testing.T, rawQuery string) {
+		query, _ := url.ParseQuery(rawQuery)
+		consent := parseConsentRequest(query)
+
+		if consent.ClientID != query.Get("client_id") || consent.State != query.Get("state") {
+			t.Fatalf("parameters of %q not read as sent: %+v", rawQuery, consent)
+		}
+		if consent.Scopes != "" {
+			for _, scope := range strings.Split(consent.Scopes, ",") {
+				if scope == "" {
+					t.Fatalf("empty scope parsed from %q: %q", rawQuery, consent.Scopes)
+				}
+			}
+		}
+		validCodeChallenge(consent)
+		validResources(consent)
+		consent.implicit()
+	})
+}
+
+func FuzzSplitScopes(f *testing.F) {
+	f.Add("email,phone,address")
+	f.Add("openid profile\temail\n")
+	f.Add(",, email ,email,,")
+	f.Add(" email phone")
+	f.Add("\xff\xfe,")
+
+	f.Fuzz(func(t *testing.T, scopes string) {
+		split := splitScopes(scopes)
+		seen := map[string]bool{}
+		for _, scope := range split {
+			if scope == "" || strings.ContainsAny(scope, ", \t\r\n") {
+				t.Fatalf("splitScopes(%q) returned %q", scopes, scope)
+			}
+			if seen[scope] {
+				t.Fatalf("splitScopes(%q) repeated %q", scopes, scope)
+			}
+			seen[scope] = true
+		}
+
+		// The scopes survive being sent on as a comma separated list, as the consent form does
+		rejoined := splitScopes(strings.Join(split, ","))
+		if strings.Join(rejoined, ",") != strings.Join(split, ",") {
+			t.Fatalf("splitScopes(%q) = %q, but %q after joining", scopes, split, rejoined)
+		}
+	})
+}
+
+func FuzzMatchRedirectURI(f *testing.F) {
+	f.Add("http://some-domain/endpoint/", "http://some-domain/endpoint/")
+	f.Add("http://127.0.0.1/callback", "http://127.0.0.1:51004/callback")
+	f.Add("http://[::1]/callback?x=1", "http://[::1]:8080/callback?x=1")
+	f.Add("com.example.app:/oauth2/callback", "com.example.app:/oauth2/callback#fragment")
+	f.Add("javascript:alert(1)", "JavaScript:alert(1)")
+	f.Add("http://localhost/callback", "http://localhost:8080/callback")
+	f.Add("http://127.0.0.1/callback", "http://127.0.0.1:80@evil.example/callback")
+	f.Add("http://some-domain/endpoint/", "")
+
+	f.Fuzz(func(t *testing.T, registered, requested string) {
+		// A client with several registered redirect URIs must say which one it wants
+		several := &OAuth2Credential{RedirectURIs: []string{registered, registered + "/other"}}
+		if matched, ok := matchRedirectURI(several, ""); ok {
+			t.Fatalf("empty redirect URI matched %q of several", matched)
+		}
+
+		credential := &OAuth2Credential{RedirectURIs: []string{registered}}
+		matched, ok := matchRedirectURI(credential, requested)
+		if !ok {
+			return
+		}
+		// A client with one registered redirect URI may leave it out, and Kong is sent the registered one
+		if requested == "" {
+			if matched != registered {
+				t.Fatalf("empty redirect URI matched %q, not the registered %q", matched, registered)
+			}
+			return
+		}
+		if matched != registered {
+			t.Fatalf("%q matched %q, which is not registered", requested, matched)
+		}
+
+		uri, err := url.Parse(requested)
+		if err != nil {
+			t.Fatalf("unparseable %q matched %q", requested, registered)
+		}
+		if uri.Fragment != "" || unsafeRedirectSchemes[strings.ToLower(uri.Scheme)] {
+			t.Fatalf("%q matched %q", requested, registered)
+		}
+		// Only loopback redirect URIs may differ from their registration, and then only in the port
+		if requested != registered {
+			registeredURI, err := url.Parse(registered)
+			if err != nil || !isLoopbackRedirect(uri) || !isLoopbackRedirect(registeredURI) ||
+				uri.Hostname() != registeredURI.Hostname() || uri.EscapedPath() != registeredURI.EscapedPath() {
+				t.Fatalf("%q matched %q", requested, registered)
+			}
+			// Kong is sent the registered URI, and the user is returned to the requested port
+			withRequestedPort(registered+"?code=abc", requested)
+		}
+	})
+}
+
+func FuzzRedirectParameters(f *testing.F) {
+	f.Add("http://some-domain/endpoint/?code=abc", "xyz", "access_denied", false)
+	f.Add("http://some-domain/endpoint/#access_token=abc&token_type=bearer", "xyz", "invalid_scope", true)
+	f.Add("com.example.app:/callback?state=kept", "other", "server_error", false)
+	f.Add("http://some-domain/?a=1;b=2", "%zz", "", true)
+
+	f.Fuzz(func(t *testing.T, redirectURI, state, code string, fragment bool) {
+		withState(redirectURI, state, fragment)
+		redirectError(redirectURI)
+
+		result := withError(redirectURI, code, "description", state, fragment)
+		// Errors returned in the query can be read back from the redirect URI
+		if _, err := url.Parse(redirectURI); err != nil || fragment || code == "" {
+			return
+		}
+		if returned, _ := redirectError(result); returned != code {
+			t.Fatalf("withError(%q, %q) = %q, which has error %q", redirectURI, code, result, returned)
+		}
+	})
+}
+
+func FuzzDecodeAuthorizeResponse(f *testing.F) {
+	f.Add([]byte(`{"redirect_uri":"http://some-domain/endpoint/?code=JJxhzunaoilSXgTpl24qjNM8hZqttAn5"}`))
+	f.Add([]byte(`{"redirect_uri":"http://some-domain/endpoint/?error=invalid_scope&error_description=bad"}`))
+	f.Add([]byte(`{"redirect_uri":"http://some-domain/endpoint/#error=access_denied"}`))
+	f.Add([]byte(`{"error":"invalid_provision_key","error_description":"Invalid provision_key"}`))
+	f.Add([]byte(`{"redirect_uri":null,"error":""}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		redirectURI, err := decodeAuthorizeResponse(body)
+		if err != nil {
+			var kongErr *KongError
+			if !errors.As(err, &kongErr) && !errors.Is(err, ErrKongUnavailable) {
+				t.Fatalf("unexpected error for %q: %v", body, err)
+			}
+			return
+		}
+		// A redirect URI is only returned to the user as a success when it carries no error
+		if code, _ := redirectError(redirectURI); code != "" {
+			t.Fatalf("%q decoded as a success with error %q", body, code)
+		}
+	})
+}
+
+func FuzzDecodeOAuth2Credential(f *testing.F) {
+	f.Add([]byte(`{"data":[{"client_id":"client-id","name":"Test Client Application","redirect_uris":["http://some-domain/endpoint/"]}]}`))
+	f.Add([]byte(`{"data":[{"client_id":"other-client","name":"Other Application"},{"client_id":"client-id","name":"Test Client Application"}]}`))
+	f.Add([]byte(`{"data":[]}`))
+	f.Add([]byte(`{"data":null}`))
+	f.Add([]byte(`{"data":[{"client_id":"client-id","redirect_uris":"http://some-domain/endpoint/"}]}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		credential, err := decodeOAuth2Credential(body, "client-id")
+		if err != nil {
+			if !errors.Is(err, ErrKongUnavailable) && !errors.Is(err, ErrUnknownClient) {
+				t.Fatalf("unexpected error for %q: %v", body, err)
+			}
+			return
+		}
+		if credential == nil {
+			t.Fatalf("no credential or error for %q", body)
+		}
+		if credential.ClientID != "client-id" {
+			t.Fatalf("the credential of %q decoded for client-id from %q", credential.ClientID, body)
+		}
+	})
+}
+
+func FuzzDecodeScopeCatalog(f *testing.F) {
+	f.Add([]byte(`{"data":[{"name":"oauth2","config":{"scopes":["email","phone","address"]}}]}`))
+	f.Add([]byte(`{"data":[{"name":"oauth2","config":{"scopes":["email"]}},{"name":"oauth2","config":{"scopes":["email","phone"]}}]}`))
+	f.Add([]byte(`{"data":[{"name":"key-auth","config":{"scopes":["admin"]}}]}`))
+	f.Add([]byte(`{"data":[{"name":"oauth2","config":null}]}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		scopes, err := decodeScopeCatalog(body)
+		if err != nil {
+			if !errors.Is(err, ErrKongUnavailable) {
+				t.Fatalf("unexpected error for %q: %v", body, err)
+			}
+			return
+		}
+		seen := map[string]bool{}
+		for _, scope := range scopes {
+			if seen[scope] {
+				t.Fatalf("%q decoded with %q repeated", body, scope)
+			}
+			seen[scope] = true
+		}
+	})
+}
+
+func FuzzDescribeAuthorizationDetails(f *testing.F) {
+	f.Add(paymentDetails)
+	f.Add(`[{"type":"payment_initiation","instructedAmount":{"currency":"EUR","amount":"1"}},{"type":"payment_initiation"}]`)
+	f.Add(`[{"type":"payment_initiation","instructedAmount":{"currency":"eur","amount":1.5}}]`)
+	f.Add(`[{"type":"account_information","actions":["read"]}]`)
+	f.Add(`[{"type":"payment_initiation","creditorName":{"first":"A"},"instructedAmount":{"currency":"EUR","amount":"2"}}]`)
+	f.Add(`[] []`)
+	f.Add(`{"type":"payment_initiation"}`)
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		details, ok := describeAuthorizationDetails(paymentClient, raw)
+		if !ok {
+			return
+		}
+		template := paymentClient.AuthorizationDetailsTypes[0]
+		for _, detail := range details {
+			if detail.Type != template.Type {
+				t.Fatalf("%q described with type %q", raw, detail.Type)
+			}
+			// Only the fields of the template are shown, and so approved
+			for _, field := range detail.Fields {
+				known := false
+				for _, templateField := range template.Fields {
+					known = known || templateField.Name == field.Name
+				}
+				if !known {
+					t.Fatalf("%q described with field %q, which is not in the template", raw, field.Name)
+				}
+			}
+		}
+	})
+}
+
+// signRequestObject returns the claims as a request object signed with ES256
+func signRequestObject(tb testing.TB, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": kid, "typ": "oauth-authz-req+jwt"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	signature := append(paddedBytes(r, 32), paddedBytes(s, 32)...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func FuzzVerifyRequestObject(f *testing.F) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	client := &ClientSettings{ClientID: "client-id", JWKS: &JSONWebKeySet{Keys: []JSONWebKey{{
+		Kty: "EC", Kid: "key-1", Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(paddedBytes(key.X, 32)),
+		Y: base64.RawURLEncoding.EncodeToString(paddedBytes(key.Y, 32)),
+	}}}}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": client.ClientID, "aud": providerIssuer, "exp": now.Add(time.Minute).Unix(), "jti": "request-1",
+		"response_type": "code", "scope": "openid email", "resource": []string{"https://api.example.com/"},
+	}
+	valid := signRequestObject(f, key, "key-1", claims)
+	if _, err := verifyRequestObject(valid, client, now); err != nil {
+		f.Fatalf("the seed request object does not verify: %v", err)
+	}
+	f.Add(valid)
+	f.Add(signRequestObject(f, key, "key-2", claims))
+	claims["exp"] = now.Add(-time.Minute).Unix()
+	f.Add(signRequestObject(f, key, "key-1", claims))
+	f.Add("eyJhbGciOiJub25lIn0.eyJpc3MiOiJjbGllbnQtaWQifQ.")
+	f.Add("a.b.c.d.e")
+
+	f.Fuzz(func(t *testing.T, request string) {
+		verified, err := verifyRequestObject(request, client, now)
+		if err != nil {
+			return
+		}
+		if verified["iss"] != client.ClientID || !audienceIncludes(verified["aud"], providerIssuer) {
+			t.Fatalf("%q verified with claims %v", request, verified)
+		}
+		if exp, err := numericDate(verified["exp"]); err != nil || !now.Before(exp) {
+			t.Fatalf("%q verified without a future exp: %v", request, verified["exp"])
+		}
+		if jti, _ := verified["jti"].(string); jti == "" {
+			t.Fatalf("%q verified without a jti", request)
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// grantUndoWindow is how long a revoked grant can be restored before it is purged
+	grantUndoWindow = envDuration("GRANT_UNDO_WINDOW", 24*time.Hour)
+	// grantPurgeInterval is how often revoked grants past their undo window are purged
+	grantPurgeInterval = envDuration("GRANT_PURGE_INTERVAL", time.Hour)
+)
+
+// Grant records the scopes a user has granted a client application
+type Grant struct {
+	ClientID    string   `json:"client_id"`
+	Scopes      []string `json:"scopes"`
+	Granted     int64    `json:"granted"`
+	LastGranted int64    `json:"last_granted"`
+
+	// RevokedAt is when the user revoked the grant, in Unix seconds; revoked grants are kept for GRANT_UNDO_WINDOW
+	RevokedAt int64 `json:"revoked_at,omitempty"`
+}
+
+// GrantForm represents the client submitted when revoking or restoring a grant
+type GrantForm struct {
+	ClientID string
+}
+
+// grantedApp describes a grant on the account pages
+type grantedApp struct {
+	ClientID        string
+	ApplicationName string
+	Scopes          []ScopeDescription
+	Granted         string
+	LastGranted     string
+	UndoUntil       string
+}
+
+// recordGrant adds scopes granted to a client to the user's grants, keeping the scopes granted before
+//
+// Consent given to a client whose grant was revoked starts a new grant.
+func recordGrant(user *User, clientID string, scopes []string, now time.Time) {
+	grant := findGrant(user, clientID)
+	if grant == nil {
+		removeGrant(user, clientID)
+		user.Grants = append(user.Grants, Grant{ClientID: clientID, Granted: now.Unix()})
+		grant = &user.Grants[len(user.Grants)-1]
+	}
+
+	merged := append([]string{}, grant.Scopes...)
+	for _, scope := range scopes {
+		if scope != "" && !containsString(merged, scope) {
+			merged = append(merged, scope)
+		}
+	}
+	sort.Strings(merged)
+	grant.Scopes = merged
+	grant.LastGranted = now.Unix()
+}
+
+// findGrant returns the user's grant to the client, or nil if they have not granted it access or revoked it
+func findGrant(user *User, clientID string) *Grant {
+	for i := range user.Grants {
+		if user.Grants[i].ClientID == clientID && user.Grants[i].RevokedAt == 0 {
+			return &user.Grants[i]
+		}
+	}
+	return nil
+}
+
+// ungrantedScopes returns the scopes the user has not granted the client, or has revoked
+func ungrantedScopes(user *User, clientID string, scopes []string) []string {
+	grant := findGrant(user, clientID)
+	ungranted := []string{}
+	for _, scope := range scopes {
+		if grant == nil || !containsString(grant.Scopes, scope) {
+			ungranted = append(ungranted, scope)
+		}
+	}
+	return ungranted
+}
+
+// findRevokedGrant returns the user's revoked grant to the client if it can still be restored, or nil
+func findRevokedGrant(user *User, clientID string, now time.Time) *Grant {
+	for i := range user.Grants {
+		grant := &user.Grants[i]
+		if grant.ClientID == clientID && grant.RevokedAt != 0 && now.Before(grantUndoDeadline(*grant)) {
+			return grant
+		}
+	}
+	return nil
+}
+
+// grantUndoDeadline returns when a revoked grant stops being restorable
+func grantUndoDeadline(grant Grant) time.Time {
+	return time.Unix(grant.RevokedAt, 0).Add(grantUndoWindow)
+}
+
+// removeGrant removes the user's grants to a client
+func removeGrant(user *User, clientID string) {
+	kept := user.Grants[:0]
+	for _, grant := range user.Grants {
+		if grant.ClientID != clientID {
+			kept = append(kept, grant)
+		}
+	}
+	user.Grants = kept
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// describeGrant returns the view of a grant, named with the client's application name on Kong when it is available
+func describeGrant(ctx iris.Context, grant Grant) grantedApp {
+	name := grant.ClientID
+	if applicationName, err := getApplicationName(kongContext(ctx), grant.ClientID); err == nil {
+		name = applicationName
+	}
+	return grantedApp{
+		ClientID:        grant.ClientID,
+		ApplicationName: name,
+		Scopes:          describeScopes(ctx, grant.Scopes),
+		Granted:         time.Unix(grant.Granted, 0).UTC().Format(time.RFC1123),
+		LastGranted:     time.Unix(grant.LastGranted, 0).UTC().Format(time.RFC1123),
+	}
+}
+
+// getAccountApps returns the view listing the applications the user has granted access to
+func getAccountApps(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	viewAccountApps(ctx, user)
+}
+
+// viewAccountApps renders the user's grants, and the revoked grants they can still restore
+func viewAccountApps(ctx iris.Context, user *User) {
+	now := time.Now()
+	apps, revoked := []grantedApp{}, []grantedApp{}
+	for _, grant := range user.Grants {
+		switch {
+		case grant.RevokedAt == 0:
+			apps = append(apps, describeGrant(ctx, grant))
+		case now.Before(grantUndoDeadline(grant)):
+			app := describeGrant(ctx, grant)
+			app.UndoUntil = grantUndoDeadline(grant).UTC().Format(time.RFC1123)
+			revoked = append(revoked, app)
+		}
+	}
+	for _, list := range [][]grantedApp{apps, revoked} {
+		sort.Slice(list, func(i, j int) bool {
+			return strings.ToLower(list[i].ApplicationName) < strings.ToLower(list[j].ApplicationName)
+		})
+	}
+
+	ctx.ViewData("Apps", apps)
+	ctx.ViewData("RevokedApps", revoked)
+	ctx.View("account-apps.html")
+}
+
+// postAccountAppRevoke revokes the user's grant to a client
+//
+// The tokens Kong has issued to the client for the user are revoked straight away, but the grant is only marked
+// as revoked so that the user can restore it within GRANT_UNDO_WINDOW. It is purged afterwards.
+func postAccountAppRevoke(ctx iris.Context) {
+	user, form, ok := grantFormUser(ctx)
+	if !ok {
+		return
+	}
+	grant := findGrant(user, form.ClientID)
+	if grant == nil {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	credential, err := getOAuth2Credential(kongContext(ctx), form.ClientID)
+	if err != nil && !errors.Is(err, ErrUnknownClient) {
+		ctx.SetErr(err)
+		return
+	}
+	revoked := 0
+	if credential != nil {
+		if revoked, err = revokeClientTokens(kongContext(ctx), authenticatedUserID(user), credential.ID); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	grant.RevokedAt = time.Now().Unix()
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "grant.revoked", map[string]string{"client_id": form.ClientID, "tokens": strconv.Itoa(revoked)})
+
+	ctx.ViewData("Notice", "Access was removed. You can undo this until "+
+		grantUndoDeadline(*grant).UTC().Format(time.RFC1123)+".")
+	viewAccountApps(ctx, user)
+}
+
+// postAccountAppRestore restores a grant the user revoked within GRANT_UNDO_WINDOW
+//
+// The client's tokens are not restored; it is given new ones the next time it asks the user for access.
+func postAccountAppRestore(ctx iris.Context) {
+	user, form, ok := grantFormUser(ctx)
+	if !ok {
+		return
+	}
+	grant := findRevokedGrant(user, form.ClientID, time.Now())
+	if grant == nil || findGrant(user, form.ClientID) != nil {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	grant.RevokedAt = 0
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "grant.restored", map[string]string{"client_id": form.ClientID})
+
+	ctx.ViewData("Notice", "Access was restored.")
+	viewAccountApps(ctx, user)
+}
+
+// grantFormUser reads the grant form and returns it with the logged in user, redirecting to the login page if
+// there is none
+func grantFormUser(ctx iris.Context) (*User, GrantForm, bool) {
+	form := GrantForm{}
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return nil, form, false
+	}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return nil, form, false
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return nil, form, false
+	}
+	return user, form, true
+}
+
+// purgeRevokedGrants permanently removes revoked grants whose undo window has passed and returns the number removed
+func purgeRevokedGrants(now time.Time) (int, error) {
+	all, err := users.List()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, user := range all {
+		kept := user.Grants[:0]
+		for _, grant := range user.Grants {
+			if grant.RevokedAt != 0 && !now.Before(grantUndoDeadline(grant)) {
+				continue
+			}
+			kept = append(kept, grant)
+		}
+		if removed := len(user.Grants) - len(kept); removed > 0 {
+			user.Grants = kept
+			if err := users.Save(user); err != nil {
+				return purged, err
+			}
+			purged += removed
+		}
+	}
+	return purged, nil
+}
+
+// runGrantPurge purges revoked grants every GRANT_PURGE_INTERVAL, for the lifetime of the application
+func runGrantPurge() {
+	if grantPurgeInterval <= 0 {
+		return
+	}
+	for range time.Tick(grantPurgeInterval) {
+		purged, err := purgeRevokedGrants(time.Now())
+		if err != nil {
+			log.Printf("purging revoked grants: %v", err)
+			notify(eventJobFailed, "Purging revoked grants failed", map[string]string{"job": "grant_purge", "error": err.Error()})
+			continue
+		}
+		if purged > 0 {
+			log.Printf("purged %d revoked grants", purged)
+		}
+	}
+}
+
+// getAccountApp returns the detail view of the user's grant to a client, with recent API activity performed with it
+func getAccountApp(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	grant := findGrant(user, ctx.URLParam("client_id"))
+	if grant == nil {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.ViewData("App", describeGrant(ctx, *grant))
+
+	if usageSource != nil {
+		activity, err := usageSource.Recent(kongContext(ctx), authenticatedUserID(user), grant.ClientID, usageLimit)
+		if err != nil {
+			// The grant is still shown when the logs cannot be fetched
+			log.Printf("%s %s [%s]: fetching API activity: %v", ctx.Method(), ctx.Path(), requestID(ctx), err)
+			ctx.ViewData("ActivityUnavailable", true)
+		}
+		ctx.ViewData("Activity", activity)
+		ctx.ViewData("ActivityEnabled", true)
+	}
+
+	ctx.View("account-app.html")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newExternalHTTPClient returns a client for services other than Kong, such as identity providers, webhooks and
+// captcha providers, that verifies their TLS certificates
+//
+// Certificate verification is only disabled for Kong, on http.DefaultTransport, so that a demo Kong can use a
+// self-signed certificate; services that are sent passwords or trusted with their answers are never called without
+// it. Requests go through the same outbound proxy as requests to Kong. A zero timeout does not limit requests.
+func newExternalHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               externalProxy,
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        100,
+			ForceAttemptHTTP2:   true,
+		},
+	}
+}
+
+// externalProxy sends requests to external services through the outbound proxy set on http.DefaultTransport in
+// main, which is looked up for each request as clients are created before it is configured
+func externalProxy(req *http.Request) (*url.URL, error) {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return nil, nil
+	}
+	return transport.Proxy(req)
+}
+
+// trustCACert makes a client from newExternalHTTPClient trust only the certificate authorities in the PEM file at
+// path, for services with certificates from a private CA; an empty path leaves the system's CAs trusted
+func trustCACert(client *http.Client, path string) error {
+	if path == "" {
+		return nil
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("client does not have its own transport")
+	}
+
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New(path + " contains no PEM certificates")
+	}
+	transport.TLSClientConfig.RootCAs = pool
+	return nil
+}
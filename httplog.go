@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// httpLogToken authenticates Kong's HTTP Log plugin to the receiver, which is disabled if it is unset
+	httpLogToken = os.Getenv("HTTP_LOG_TOKEN")
+	// httpLogMaxBody is the largest batch of log entries accepted, in bytes
+	httpLogMaxBody = envInt("HTTP_LOG_MAX_BODY", 10<<20)
+)
+
+// tokenCache holds the grant each access token seen in Kong's logs was issued for, keyed by a hash of the token,
+// and the client_id of each OAuth 2.0 credential, keyed by "credential:" and its ID
+var tokenCache = newCache("access_tokens",
+	envInt("TOKEN_CACHE_MAX_ENTRIES", 10000),
+	int64(envInt("TOKEN_CACHE_MAX_BYTES", 1<<20)),
+	envDuration("TOKEN_CACHE_TTL", 5*time.Minute))
+
+// kongLogEntry is a partial representation of a log entry sent by Kong's HTTP Log plugin
+type kongLogEntry struct {
+	StartedAt int64  `json:"started_at"`
+	ClientIP  string `json:"client_ip"`
+	Request   struct {
+		Method  string                 `json:"method"`
+		URI     string                 `json:"uri"`
+		Headers map[string]interface{} `json:"headers"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+	AuthenticatedEntity struct {
+		ID string `json:"id"`
+	} `json:"authenticated_entity"`
+}
+
+// header returns the first value of a request header of the entry, whose names Kong logs in lower case
+func (e kongLogEntry) header(name string) string {
+	switch value := e.Request.Headers[name].(type) {
+	case string:
+		return value
+	case []interface{}:
+		if len(value) > 0 {
+			s, _ := value[0].(string)
+			return s
+		}
+	}
+	return ""
+}
+
+// tokenGrant is the user and client an access token was issued for
+type tokenGrant struct {
+	AuthenticatedUserID string
+	ClientID            string
+}
+
+// oauth2Token is a partial representation of Kong's OAuth 2.0 token resource
+type oauth2Token struct {
+	ID                  string `json:"id"`
+	AuthenticatedUserID string `json:"authenticated_userid"`
+	RefreshToken        string `json:"refresh_token"`
+	Credential          struct {
+		ID string `json:"id"`
+	} `json:"credential"`
+}
+
+// postKongHTTPLog receives batches of log entries from Kong's HTTP Log plugin
+//
+// Entries are attributed to the user and client of the access token the request was made with, and stored as the
+// API activity shown on the account pages. Requests that were not made with a token of this application's users
+// are ignored.
+func postKongHTTPLog(ctx iris.Context) {
+	if httpLogToken == "" {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	if !validHTTPLogToken(ctx) {
+		ctx.Header("WWW-Authenticate", `Bearer realm="http-log"`)
+		viewProblem(ctx, iris.StatusUnauthorized, problemUnauthorized, "")
+		return
+	}
+
+	ctx.Request().Body = http.MaxBytesReader(ctx.ResponseWriter(), ctx.Request().Body, int64(httpLogMaxBody))
+	body, err := ctx.GetBody()
+	if err != nil {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, err.Error())
+		return
+	}
+	entries, err := parseKongLogBatch(body)
+	if err != nil {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, err.Error())
+		return
+	}
+
+	records := make([]activityRecord, 0, len(entries))
+	for _, entry := range entries {
+		grant, err := correlateLogEntry(kongContext(ctx), entry)
+		if err != nil {
+			log.Printf("%s %s [%s]: attributing log entry: %v", ctx.Method(), ctx.Path(), requestID(ctx), err)
+			continue
+		}
+		if grant.AuthenticatedUserID == "" || grant.ClientID == "" {
+			continue
+		}
+
+		// The query string is dropped as it may carry an access token
+		path := entry.Request.URI
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		records = append(records, activityRecord{
+			AuthenticatedUserID: grant.AuthenticatedUserID,
+			ClientID:            grant.ClientID,
+			APIActivity: APIActivity{
+				Time:     time.Unix(0, entry.StartedAt*int64(time.Millisecond)).UTC(),
+				Method:   entry.Request.Method,
+				Path:     path,
+				Status:   entry.Response.Status,
+				ClientIP: entry.ClientIP,
+			},
+		})
+		metrics.Counter("api_requests_total", "Number of API requests made with tokens issued by the consent application, from Kong's logs.",
+			"client_id", grant.ClientID, "status", strconv.Itoa(entry.Response.Status/100)+"xx").Inc()
+	}
+
+	if err := activities.Add(records); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// validHTTPLogToken reports whether the request carries HTTP_LOG_TOKEN as a bearer token, or as the password of
+// basic authentication credentials in the plugin's http_endpoint
+func validHTTPLogToken(ctx iris.Context) bool {
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if _, password, ok := ctx.Request().BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(httpLogToken)) == 1
+}
+
+// parseKongLogBatch parses a single log entry, or a batch of entries when the plugin's queue sends several at once
+func parseKongLogBatch(body []byte) ([]kongLogEntry, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		var entries []kongLogEntry
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, err
+		}
+		return entries, nil
+	}
+	entry := kongLogEntry{}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return nil, err
+	}
+	return []kongLogEntry{entry}, nil
+}
+
+// correlateLogEntry returns the user and client the request of a log entry was made for
+//
+// Kong's OAuth 2.0 plugin passes them upstream in the X-Authenticated-Userid and X-Credential-Identifier headers,
+// which are logged with the request. Otherwise the access token, if it has not been redacted from the log, or the
+// authenticated credential is looked up on the Admin API.
+func correlateLogEntry(ctx context.Context, entry kongLogEntry) (tokenGrant, error) {
+	grant := tokenGrant{
+		AuthenticatedUserID: entry.header("x-authenticated-userid"),
+		ClientID:            entry.header("x-credential-identifier"),
+	}
+	if grant.AuthenticatedUserID != "" && grant.ClientID != "" {
+		return grant, nil
+	}
+
+	authorization := entry.header("authorization")
+	if strings.HasPrefix(authorization, "Bearer ") && strings.TrimPrefix(authorization, "Bearer ") != redacted {
+		return lookupAccessToken(ctx, strings.TrimPrefix(authorization, "Bearer "))
+	}
+
+	if grant.AuthenticatedUserID != "" && entry.AuthenticatedEntity.ID != "" {
+		clientID, err := getCredentialClientID(ctx, entry.AuthenticatedEntity.ID)
+		if err != nil {
+			return grant, err
+		}
+		grant.ClientID = clientID
+	}
+	return grant, nil
+}
+
+// lookupAccessToken returns the user and client an access token was issued for, from Kong's Admin API
+//
+// Unknown tokens are cached as an empty grant so that requests with them do not each cost an Admin API call.
+func lookupAccessToken(ctx context.Context, accessToken string) (tokenGrant, error) {
+	sum := sha256.Sum256([]byte(accessToken))
+	key := hex.EncodeToString(sum[:])
+	if grant, ok := tokenCache.Get(key); ok {
+		return grant.(tokenGrant), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/oauth2_tokens/"+url.PathEscape(accessToken), nil)
+	if err != nil {
+		return tokenGrant{}, err
+	}
+	grant := tokenGrant{}
+	body, err := executeRequest(req)
+	if err != nil {
+		return grant, wrapError(ErrKongUnavailable, "fetching OAuth 2.0 token", err)
+	}
+
+	token := oauth2Token{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return grant, wrapError(ErrKongUnavailable, "reading OAuth 2.0 token", err)
+	}
+	if token.AuthenticatedUserID != "" && token.Credential.ID != "" {
+		clientID, err := getCredentialClientID(ctx, token.Credential.ID)
+		if err != nil {
+			return grant, err
+		}
+		grant = tokenGrant{AuthenticatedUserID: token.AuthenticatedUserID, ClientID: clientID}
+	}
+
+	tokenCache.Set(key, grant, int64(len(key)+len(grant.AuthenticatedUserID)+len(grant.ClientID)))
+	return grant, nil
+}
+
+// getCredentialClientID returns the client_id of the OAuth 2.0 credential with the given ID
+func getCredentialClientID(ctx context.Context, credentialID string) (string, error) {
+	key := "credential:" + credentialID
+	if clientID, ok := tokenCache.Get(key); ok {
+		return clientID.(string), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/oauth2/"+url.PathEscape(credentialID), nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := executeRequest(req)
+	if err != nil {
+		return "", wrapError(ErrKongUnavailable, "fetching OAuth 2.0 credential", err)
+	}
+
+	credential := struct {
+		ClientID string `json:"client_id"`
+	}{}
+	if err := json.Unmarshal(body, &credential); err != nil {
+		return "", wrapError(ErrKongUnavailable, "reading OAuth 2.0 credential", err)
+	}
+	if credential.ClientID == "" {
+		return "", wrapError(ErrUnknownClient, "credential "+credentialID, errors.New("no client_id"))
+	}
+
+	tokenCache.Set(key, credential.ClientID, int64(len(key)+len(credential.ClientID)))
+	return credential.ClientID, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// idTokenTTL is how long ID tokens are valid for
+	idTokenTTL = envDuration("ID_TOKEN_TTL", time.Hour)
+
+	// pendingIDTokenTTL is how long the ID token minted with an authorization code is kept for the client to
+	// exchange the code at the token endpoint
+	pendingIDTokenTTL = envDuration("PENDING_ID_TOKENS_TTL", 10*time.Minute)
+)
+
+// pendingIDTokensPrefix is prepended to the keys of pending ID tokens in the shared store, where they are kept by the
+// codeKey of their authorization code so that the code can be exchanged on any replica
+const pendingIDTokensPrefix = "id-token:"
+
+// tokenPath is the token endpoint that adds ID tokens and authorization details to Kong's token responses
+const tokenPath = "/token"
+
+// maxNonceLength bounds the nonce clients may send, as it is kept in the session and the ID token
+const maxNonceLength = 255
+
+// usedNoncesPrefix is prepended to the keys of the nonces ID tokens were issued with in the shared store, where
+// they are kept until the ID tokens expire so that every replica refuses them
+const usedNoncesPrefix = "nonce:"
+
+// nonceKey returns the key a client's nonce is recorded under
+func nonceKey(consent ConsentRequest) string {
+	return usedNoncesPrefix + codeKey(consent.ClientID+"\x00"+consent.Nonce)
+}
+
+// nonceUsed reports whether an ID token has already been issued to the client with the request's nonce, and has
+// not yet expired
+func nonceUsed(consent ConsentRequest) (bool, error) {
+	if consent.Nonce == "" {
+		return false, nil
+	}
+	_, used, err := sharedStore.Get(nonceKey(consent))
+	return used, err
+}
+
+// useNonce records the request's nonce as used for as long as an ID token issued with it is valid, returning false
+// if it has already been used
+func useNonce(consent ConsentRequest) (bool, error) {
+	return sharedStore.Add(nonceKey(consent), "used", idTokenTTL)
+}
+
+// issueIDToken mints an ID token for the user and attaches it to the authorization response redirect URI
+//
+// An access token in the fragment of an implicit grant is given the ID token alongside it. The ID token for an
+// authorization code is kept until the client exchanges the code through the token endpoint, as Kong's own
+// token endpoint knows nothing of it.
+func issueIDToken(ctx iris.Context, consent ConsentRequest, user *User, scopes []string, redirectURI string) (string, error) {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", err
+	}
+	claims := userClaims(user, scopes)
+	now := time.Now()
+	claims["iss"] = providerIssuer
+	claims["aud"] = consent.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(idTokenTTL).Unix()
+	if authenticatedAt := sess.Start(ctx).GetInt64Default("authenticatedAt", 0); authenticatedAt > 0 {
+		claims["auth_time"] = time.Unix(0, authenticatedAt).Unix()
+	}
+	if consent.Nonce != "" {
+		claims["nonce"] = consent.Nonce
+	}
+
+	if consent.implicit() {
+		fragment, err := url.ParseQuery(uri.Fragment)
+		if err != nil {
+			return "", err
+		}
+		if accessToken := fragment.Get("access_token"); accessToken != "" {
+			claims["at_hash"] = tokenHash(accessToken)
+		}
+		idToken, err := signJWT(claims)
+		if err != nil {
+			return "", err
+		}
+		fragment.Set("id_token", idToken)
+		uri.Fragment = ""
+		return uri.String() + "#" + fragment.Encode(), nil
+	}
+
+	params := uri.Query()
+	if consent.fragment() {
+		if params, err = url.ParseQuery(uri.Fragment); err != nil {
+			return "", err
+		}
+	}
+	code := params.Get("code")
+	if code == "" {
+		return redirectURI, nil
+	}
+	claims["c_hash"] = tokenHash(code)
+	idToken, err := signJWT(claims)
+	if err != nil {
+		return "", err
+	}
+	if err := sharedStore.Set(pendingIDTokensPrefix+codeKey(code), idToken, pendingIDTokenTTL); err != nil {
+		return "", err
+	}
+	return redirectURI, nil
+}
+
+// signJWT returns the claims as a compact JWS signed with the provider signing key
+func signJWT(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": providerSigningKey.algorithm, "kid": providerSigningKey.id, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch key := providerSigningKey.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		// JWS encodes ES256 signatures as the fixed size r and s values rather than ASN.1
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, digest[:])
+		err = signErr
+		if err == nil {
+			signature = append(paddedBytes(r, 32), paddedBytes(s, 32)...)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// tokenHash returns the left half of the SHA-256 of a token, as the at_hash and c_hash claims require
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// codeKey returns the key an authorization code's ID token is kept under, so that codes are not held in memory
+func codeKey(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// postToken forwards token requests to Kong's token endpoint, adding the ID token minted with an authorization code,
+// and the authorization details approved with it, to the response
+//
+// The request is passed to Kong unchanged, including the client's credentials, and Kong's response is returned
+// as it is apart from the id_token and authorization_details members. These are handed out once, with the first
+// successful exchange. Codes presented again after they were exchanged are audited, as Kong refuses them without
+// saying why. Grant types and authentication methods a registered client did not register are refused before Kong
+// is called.
+func postToken(ctx iris.Context) {
+	body, err := ctx.GetBody()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	form, _ := url.ParseQuery(string(body))
+
+	// Clients registered with dynamic client registration may only use the grant types and authentication method
+	// they registered
+	code, description, err := registeredTokenRequestError(ctx.Request(), form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if code != "" {
+		status := iris.StatusBadRequest
+		if code == "invalid_client" {
+			status = iris.StatusUnauthorized
+		}
+		ctx.Header("Cache-Control", "no-store")
+		ctx.StatusCode(status)
+		ctx.JSON(iris.Map{"error": code, "error_description": description})
+		return
+	}
+
+	status, response, outcome, err := forwardTokenRequest(kongContext(ctx), body, ctx.GetHeader("Content-Type"), ctx.GetHeader("Authorization"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if outcome == codeReplayed {
+		auditCodeReplay(ctx, form.Get("client_id"))
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.ContentType("application/json")
+	ctx.StatusCode(status)
+	ctx.Write(response)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// adminRole is the role of users who may impersonate other users
+	adminRole = envOrDefault("ADMIN_ROLE", "admin")
+
+	// impersonationTTL ends impersonation automatically after this long
+	impersonationTTL = envDuration("IMPERSONATION_TTL", 30*time.Minute)
+
+	// impersonationAllowConsent lets administrators grant consent as the impersonated user; by default the
+	// consent page is shown but cannot be submitted
+	impersonationAllowConsent = envBool("IMPERSONATION_ALLOW_CONSENT", false)
+)
+
+// ImpersonationForm represents the user and reason submitted to start impersonating
+type ImpersonationForm struct {
+	Username string
+	Reason   string
+}
+
+// Impersonation describes the impersonated session for the banner shown on every page
+type Impersonation struct {
+	Admin   string
+	User    string
+	Expires time.Time
+}
+
+// isAdmin reports whether the user may impersonate other users
+func isAdmin(user *User) bool {
+	return hasRole(user, []string{adminRole})
+}
+
+// impersonating reports whether an administrator is impersonating a user in the request's session
+func impersonating(ctx iris.Context) bool {
+	return sess.Start(ctx).GetString("impersonator") != ""
+}
+
+// currentAdmin returns the logged in administrator, who may be impersonating a user, or nil
+func currentAdmin(ctx iris.Context) (*User, error) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		return nil, nil
+	}
+	if breakGlassSession(ctx) {
+		return breakGlassAdmin(), nil
+	}
+
+	username := session.GetString("impersonator")
+	if username == "" {
+		username = session.GetString("username")
+	}
+	user, err := users.Get(username)
+	if err == ErrUserNotFound || (err == nil && !isAdmin(user)) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// guardImpersonation is middleware for impersonated sessions
+//
+// It ends impersonation once IMPERSONATION_TTL has passed, records every request in the audit log, refuses
+// changes to the impersonated user's account and adds the impersonation banner to the view data.
+func guardImpersonation(ctx iris.Context) {
+	session := sess.Start(ctx)
+	admin := session.GetString("impersonator")
+	if admin == "" {
+		ctx.Next()
+		return
+	}
+
+	expires := time.Unix(session.GetInt64Default("impersonationStarted", 0), 0).Add(impersonationTTL)
+	if time.Now().After(expires) {
+		audit(ctx, "impersonation.expired", nil)
+		stopImpersonation(ctx)
+		ctx.Next()
+		return
+	}
+
+	audit(ctx, "impersonation.request", map[string]string{"method": ctx.Method(), "path": ctx.Path()})
+	ctx.ViewData("Impersonation", Impersonation{Admin: admin, User: session.GetString("username"), Expires: expires})
+
+	path := ctx.Path()
+	if strings.HasPrefix(path, "/account/") || strings.HasPrefix(path, "/webauthn/register/") {
+		viewError(ctx, iris.StatusForbidden, "ImpersonationReadOnly")
+		return
+	}
+
+	ctx.Next()
+}
+
+// stopImpersonation returns the session to the administrator
+func stopImpersonation(ctx iris.Context) {
+	session := sess.Start(ctx)
+	session.Set("username", session.GetString("impersonator"))
+	session.Delete("impersonator")
+	session.Delete("impersonationReason")
+	session.Delete("impersonationStarted")
+}
+
+// getAdminImpersonate returns the impersonation view to administrators on a GET request
+func getAdminImpersonate(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	ctx.ViewData("AllowConsent", impersonationAllowConsent)
+	ctx.View("admin-impersonate.html")
+}
+
+// postAdminImpersonate starts impersonating the submitted user
+//
+// A reason is required and recorded in the audit log. Other administrators cannot be impersonated.
+func postAdminImpersonate(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+	ctx.ViewData("AllowConsent", impersonationAllowConsent)
+	// The emergency administrator account may not use the pages of other users
+	if breakGlassSession(ctx) {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.ViewData("Error", "The break-glass account cannot impersonate users.")
+		ctx.View("admin-impersonate.html")
+		return
+	}
+	if impersonating(ctx) {
+		ctx.StatusCode(iris.StatusConflict)
+		ctx.ViewData("Error", "Stop impersonating the current user first.")
+		ctx.View("admin-impersonate.html")
+		return
+	}
+
+	form := ImpersonationForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	form.Reason = strings.TrimSpace(form.Reason)
+	if form.Reason == "" {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please give a reason, such as a support ticket number.")
+		ctx.View("admin-impersonate.html")
+		return
+	}
+
+	user, err := users.Get(strings.TrimSpace(form.Username))
+	if err == ErrUserNotFound || (err == nil && (isAdmin(user) || user.Username == admin.Username)) {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "That user does not exist or cannot be impersonated.")
+		ctx.View("admin-impersonate.html")
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	session := sess.Start(ctx)
+	session.Set("impersonator", admin.Username)
+	session.Set("impersonationReason", form.Reason)
+	session.Set("impersonationStarted", time.Now().Unix())
+	session.Set("username", user.Username)
+	audit(ctx, "impersonation.start", map[string]string{"reason": form.Reason})
+
+	ctx.Redirect("/", iris.StatusSeeOther)
+}
+
+// postAdminImpersonateStop stops impersonating and returns the session to the administrator
+func postAdminImpersonateStop(ctx iris.Context) {
+	if impersonating(ctx) {
+		audit(ctx, "impersonation.stop", nil)
+		stopImpersonation(ctx)
+	}
+	ctx.Redirect("/admin/impersonate", iris.StatusSeeOther)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// introspectionPath is the path of the token introspection endpoint
+const introspectionPath = "/introspect"
+
+var (
+	// introspectionClientIDs are the client IDs of the resource servers allowed to introspect tokens; the endpoint is
+	// not served if there are none
+	introspectionClientIDs = envList("INTROSPECTION_CLIENT_IDS")
+
+	// tokenIntrospections counts introspected tokens by whether they were active
+	tokenIntrospections = map[bool]*Counter{
+		true:  metrics.Counter("token_introspections_total", "Number of tokens introspected by resource servers, by whether they were active.", "active", "true"),
+		false: metrics.Counter("token_introspections_total", "Number of tokens introspected by resource servers, by whether they were active.", "active", "false"),
+	}
+)
+
+// TokenIntrospection is the RFC 7662 description of a token. Inactive tokens are described by Active alone.
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+}
+
+// postIntrospect describes an access token to a resource server, as RFC 7662 token introspection
+//
+// Resource servers authenticate with their Kong OAuth 2.0 credential and must be listed in
+// INTROSPECTION_CLIENT_IDS. The token is looked up on Kong's Admin API on every request, so that revoked and expired
+// tokens are inactive straight away, as are tokens of unknown or disabled users. Kong's refresh tokens cannot be
+// looked up, so they are always inactive; token_type_hint is ignored.
+func postIntrospect(ctx iris.Context) {
+	if len(introspectionClientIDs) == 0 {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.Header("Cache-Control", "no-store")
+	resourceServer, ok := authenticateClient(ctx, "introspection")
+	if !ok {
+		return
+	}
+	if !containsString(introspectionClientIDs, resourceServer) {
+		audit(ctx, "token.introspection_refused", map[string]string{"client_id": resourceServer})
+		viewProblem(ctx, iris.StatusForbidden, problemUnauthorized, "The client may not introspect tokens.")
+		return
+	}
+
+	accessToken := strings.TrimSpace(ctx.PostValue("token"))
+	if accessToken == "" {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "token is required.")
+		return
+	}
+
+	introspection, err := introspectToken(ctx, accessToken)
+	if err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	tokenIntrospections[introspection.Active].Inc()
+	ctx.JSON(introspection)
+}
+
+// introspectToken describes an access token from Kong's record of it and the user it was issued for
+func introspectToken(ctx iris.Context, accessToken string) (TokenIntrospection, error) {
+	inactive := TokenIntrospection{}
+	token, err := getKongAccessToken(kongContext(ctx), accessToken)
+	if err != nil {
+		return inactive, err
+	}
+	if token.ID == "" || token.AuthenticatedUserID == "" || token.Credential.ID == "" {
+		return inactive, nil
+	}
+	expiresAt := int64(0)
+	if token.ExpiresIn > 0 {
+		expiresAt = token.CreatedAt + token.ExpiresIn
+		if time.Unix(expiresAt, 0).Before(time.Now()) {
+			return inactive, nil
+		}
+	}
+
+	user, err := findUserByAuthenticatedUserID(token.AuthenticatedUserID)
+	if err == ErrUserNotFound || (err == nil && user.Disabled) {
+		return inactive, nil
+	}
+	if err != nil {
+		return inactive, err
+	}
+	// The token of a deleted client application is no longer active
+	clientID, err := getCredentialClientID(kongContext(ctx), token.Credential.ID)
+	if errors.Is(err, ErrUnknownClient) {
+		return inactive, nil
+	}
+	if err != nil {
+		return inactive, err
+	}
+
+	return TokenIntrospection{
+		Active:    true,
+		Scope:     token.Scope,
+		ClientID:  clientID,
+		Username:  user.Username,
+		Subject:   token.AuthenticatedUserID,
+		TokenType: "Bearer",
+		IssuedAt:  token.CreatedAt,
+		ExpiresAt: expiresAt,
+		Issuer:    providerIssuer,
+	}, nil
+}
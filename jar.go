@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// requestURITimeout limits fetching a request object from a client's request_uri
+	requestURITimeout = envDuration("REQUEST_URI_TIMEOUT", 5*time.Second)
+	// requestURIClient fetches request objects from clients
+	requestURIClient = newExternalHTTPClient(requestURITimeout)
+)
+
+// maxRequestObjectLength limits the size of request objects, whether sent by value or by reference
+const maxRequestObjectLength = 64 << 10
+
+// requestObjectAlgorithms are the JWS algorithms request objects may be signed with; unsigned request objects are
+// refused
+var requestObjectAlgorithms = []string{"RS256", "PS256", "ES256"}
+
+// errInvalidRequestObject is wrapped by the errors of request objects that cannot be used
+var errInvalidRequestObject = errors.New("invalid request object")
+
+// usedRequestObjectsPrefix is prepended to the keys of the jti of used request objects in the shared store, where
+// they are kept until the request objects expire so that every replica refuses them
+const usedRequestObjectsPrefix = "request-object:"
+
+// JSONWebKeySet is a client's set of public keys, as RFC 7517 describes
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey is an RSA or P-256 public key of a client
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// N and E are the modulus and exponent of RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Crv, X and Y are the curve and coordinates of EC keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// publicKey returns the key as an RSA public key of at least 2048 bits or a P-256 public key
+func (k JSONWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(name, value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("the key's %s is not base64url encoded", name)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || e.BitLen() > 31 {
+			return nil, errors.New("RSA keys must have at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("EC keys must use the P-256 curve")
+		}
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("the EC key is not on the P-256 curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("keys of type %q are not supported", k.Kty)
+}
+
+// requestObjectParams returns the authorization request parameters of a consent request, which are those of its
+// request object when it sends one, as RFC 9101 JWT-secured authorization requests describe
+//
+// A request object is sent by value in the request parameter, or by reference in request_uri, which must be one of
+// the client's registered request_uris. It must be signed with one of the client's registered keys, by the client as
+// its issuer, for this provider as its audience, and must not have expired. Its jti can only be used once until it
+// expires, so that a request object that has been seen cannot be replayed. Only the client_id of the query is used
+// alongside it; every other parameter is taken from the request object. The errors of request objects that cannot be
+// used wrap errInvalidRequestObject.
+func requestObjectParams(ctx context.Context, query url.Values) (url.Values, error) {
+	request, requestURI := query.Get("request"), query.Get("request_uri")
+	if request == "" && requestURI == "" {
+		return query, nil
+	}
+	if request != "" && requestURI != "" {
+		return nil, fmt.Errorf("%w: request and request_uri cannot both be sent", errInvalidRequestObject)
+	}
+	clientID := query.Get("client_id")
+	if clientID == "" {
+		return nil, fmt.Errorf("%w: client_id is required", errInvalidRequestObject)
+	}
+	client, err := clients.Get(clientID)
+	if err == ErrClientNotFound {
+		return nil, fmt.Errorf("%w: client %s has not registered keys", errInvalidRequestObject, clientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if requestURI != "" {
+		if request, err = fetchRequestObject(ctx, client, requestURI); err != nil {
+			return nil, err
+		}
+	}
+	claims, err := verifyRequestObject(request, client, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w from client %s: %v", errInvalidRequestObject, clientID, err)
+	}
+	if value, ok := claims["client_id"]; ok && value != clientID {
+		return nil, fmt.Errorf("%w from client %s: its client_id does not match", errInvalidRequestObject, clientID)
+	}
+	exp, _ := numericDate(claims["exp"])
+	fresh, err := sharedStore.Add(usedRequestObjectsPrefix+codeKey(clientID+"\x00"+claims["jti"].(string)), "used", time.Until(exp))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, fmt.Errorf("%w from client %s: its jti has already been used", errInvalidRequestObject, clientID)
+	}
+
+	params := url.Values{}
+	for name, value := range claims {
+		switch name {
+		case "iss", "aud", "exp", "nbf", "iat", "jti", "request", "request_uri":
+			continue
+		}
+		params[name] = claimValues(value)
+	}
+	params.Set("client_id", clientID)
+	return params, nil
+}
+
+// claimValues returns a request object claim as query parameter values: arrays of strings, such as resource, are
+// repeated parameters, and other arrays and objects, such as authorization_details, are JSON
+func claimValues(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case json.Number:
+		return []string{value.String()}
+	case bool:
+		return []string{strconv.FormatBool(value)}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				values = nil
+				break
+			}
+			values = append(values, s)
+		}
+		if values != nil {
+			return values
+		}
+	}
+	encoded, _ := json.Marshal(value)
+	return []string{string(encoded)}
+}
+
+// fetchRequestObject returns the request object a client published at one of its registered request_uris
+//
+// Only registered URIs are fetched, so that the consent page cannot be used to make requests to arbitrary hosts.
+// The fragment of the URI is ignored when matching, as clients may use it to version the request object.
+func fetchRequestObject(ctx context.Context, client *ClientSettings, requestURI string) (string, error) {
+	registered := false
+	for _, uri := range client.RequestURIs {
+		if strings.SplitN(uri, "#", 2)[0] == strings.SplitN(requestURI, "#", 2)[0] {
+			registered = true
+		}
+	}
+	if !registered {
+		return "", fmt.Errorf("%w: request_uri %s is not registered for client %s", errInvalidRequestObject, requestURI, client.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidRequestObject, err)
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt")
+	req.Header.Set("User-Agent", userAgent)
+	res, err := requestURIClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: fetching request_uri: %v", errInvalidRequestObject, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: request_uri %s responded %s", errInvalidRequestObject, requestURI, res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRequestObjectLength+1))
+	if err != nil {
+		return "", fmt.Errorf("%w: fetching request_uri: %v", errInvalidRequestObject, err)
+	}
+	if len(body) > maxRequestObjectLength {
+		return "", fmt.Errorf("%w: request_uri %s is too large", errInvalidRequestObject, requestURI)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// verifyRequestObject checks a request object's signature against the client's registered keys and returns its
+// claims
+func verifyRequestObject(request string, client *ClientSettings, now time.Time) (map[string]interface{}, error) {
+	if len(request) > maxRequestObjectLength {
+		return nil, errors.New("it is too large")
+	}
+	parts := strings.Split(request, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("it is not a signed JWT; encrypted request objects are not supported")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		Typ string `json:"typ"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("reading its header: %v", err)
+	}
+	if !containsString(requestObjectAlgorithms, header.Alg) {
+		return nil, fmt.Errorf("it is signed with %q rather than one of %s", header.Alg, strings.Join(requestObjectAlgorithms, ", "))
+	}
+	if header.Typ != "" && header.Typ != "JWT" && header.Typ != "oauth-authz-req+jwt" {
+		return nil, fmt.Errorf("it has the type %q", header.Typ)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("its signature is not base64url encoded")
+	}
+	if client.JWKS == nil || len(client.JWKS.Keys) == 0 {
+		return nil, errors.New("the client has not registered keys")
+	}
+
+	if !verifyJWTSignature(parts, header.Alg, header.Kid, signature, client.JWKS.Keys) {
+		return nil, errors.New("its signature does not match any of the client's keys")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("reading its claims: %v", err)
+	}
+	if claims["iss"] != client.ClientID {
+		return nil, errors.New("its issuer is not the client")
+	}
+	if !audienceIncludes(claims["aud"], providerIssuer) {
+		return nil, errors.New("its audience is not " + providerIssuer)
+	}
+	exp, err := numericDate(claims["exp"])
+	if err != nil || !now.Before(exp) {
+		return nil, errors.New("it has expired or has no exp")
+	}
+	if nbf, err := numericDate(claims["nbf"]); err == nil && now.Before(nbf) {
+		return nil, errors.New("it is not valid yet")
+	}
+	if jti, ok := claims["jti"].(string); !ok || jti == "" {
+		return nil, errors.New("it has no jti")
+	}
+	return claims, nil
+}
+
+// verifyJWTSignature reports whether signature is the signature of a JWT's header and claims by one of keys
+//
+// Keys are tried when their key ID matches the kid of the JWT's header, if it has one, and they are not for
+// encryption or for a different algorithm.
+func verifyJWTSignature(parts []string, alg, kid string, signature []byte, keys []JSONWebKey) bool {
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	for _, jwk := range keys {
+		if (kid != "" && jwk.Kid != kid) || jwk.Use == "enc" || (jwk.Alg != "" && jwk.Alg != alg) {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		if verifySignature(alg, key, digest[:], signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature reports whether signature is the JWS signature of digest with the public key and algorithm
+func verifySignature(alg string, key crypto.PublicKey, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256":
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil
+		case "PS256":
+			return rsa.VerifyPSS(key, crypto.SHA256, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		// JWS encodes ES256 signatures as the fixed size r and s values rather than ASN.1
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// decodeJWTPart decodes the base64url encoded JSON header or claims of a JWT, keeping numbers as json.Number
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// audienceIncludes reports whether the aud claim, a string or an array of strings, names audience
+func audienceIncludes(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numericDate returns the time of a JWT NumericDate claim
+func numericDate(value interface{}) (time.Time, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, errors.New("not a number")
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(seconds), 0), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newRequestObjectClient returns a client with a registered P-256 key, and the key's private half
+func newRequestObjectClient(t *testing.T) (*ClientSettings, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &ClientSettings{ClientID: "client-id", JWKS: &JSONWebKeySet{Keys: []JSONWebKey{{
+		Kty: "EC", Kid: "key-1", Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(paddedBytes(key.X, 32)),
+		Y: base64.RawURLEncoding.EncodeToString(paddedBytes(key.Y, 32)),
+	}}}}
+	return client, key
+}
+
+// TestVerifyRequestObjectRefusals checks that request objects are refused for their signature and each of the claims
+// that must be checked
+func TestVerifyRequestObjectRefusals(t *testing.T) {
+	client, key := newRequestObjectClient(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss": client.ClientID, "aud": providerIssuer, "exp": now.Add(time.Minute).Unix(), "jti": "request-1",
+			"response_type": "code",
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+				continue
+			}
+			claims[name] = value
+		}
+		return claims
+	}
+
+	if _, err := verifyRequestObject(signRequestObject(t, key, "key-1", claims(nil)), client, now); err != nil {
+		t.Fatalf("valid request object refused: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"signed with another key", signRequestObject(t, otherKey, "key-1", claims(nil))},
+		{"signed with an unknown kid", signRequestObject(t, key, "key-2", claims(nil))},
+		{"unsigned", "eyJhbGciOiJub25lIn0.eyJpc3MiOiJjbGllbnQtaWQifQ."},
+		{"another issuer", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"iss": "other-client"}))},
+		{"another audience", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"aud": "https://other.example.com"}))},
+		{"no audience", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"aud": nil}))},
+		{"expired", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"exp": now.Add(-time.Second).Unix()}))},
+		{"no exp", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"exp": nil}))},
+		{"not valid yet", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}))},
+		{"no jti", signRequestObject(t, key, "key-1", claims(map[string]interface{}{"jti": nil}))},
+	}
+	for _, test := range tests {
+		if _, err := verifyRequestObject(test.request, client, now); err == nil {
+			t.Errorf("%s: request object verified", test.name)
+		}
+	}
+}
+
+// TestRequestObjectParamsRefusals checks that a request object cannot be replayed and that only registered
+// request_uris are fetched
+func TestRequestObjectParamsRefusals(t *testing.T) {
+	client, key := newRequestObjectClient(t)
+	published := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(published))
+	}))
+	defer srv.Close()
+	client.RequestURIs = []string{srv.URL + "/request.jwt"}
+
+	defer func(store ClientStore) { clients = store }(clients)
+	clients = &fileClientStore{clients: map[string]ClientSettings{client.ClientID: *client}}
+
+	sign := func(jti string) string {
+		return signRequestObject(t, key, "key-1", map[string]interface{}{
+			"iss": client.ClientID, "aud": providerIssuer, "exp": time.Now().Add(time.Minute).Unix(), "jti": jti,
+			"response_type": "code",
+		})
+	}
+	params := func(query url.Values) error {
+		query.Set("client_id", client.ClientID)
+		_, err := requestObjectParams(context.Background(), query)
+		return err
+	}
+
+	request := sign("by-value")
+	if err := params(url.Values{"request": {request}}); err != nil {
+		t.Fatalf("request object refused: %v", err)
+	}
+	if err := params(url.Values{"request": {request}}); !errors.Is(err, errInvalidRequestObject) {
+		t.Errorf("replayed request object: %v", err)
+	}
+
+	published = sign("by-reference")
+	if err := params(url.Values{"request_uri": {srv.URL + "/request.jwt#v1"}}); err != nil {
+		t.Fatalf("request object at a registered request_uri refused: %v", err)
+	}
+	if err := params(url.Values{"request_uri": {srv.URL + "/request.jwt"}}); !errors.Is(err, errInvalidRequestObject) {
+		t.Errorf("replayed request object at a request_uri: %v", err)
+	}
+
+	published = sign("unregistered")
+	if err := params(url.Values{"request_uri": {srv.URL + "/other.jwt"}}); !errors.Is(err, errInvalidRequestObject) {
+		t.Errorf("unregistered request_uri: %v", err)
+	}
+	if err := params(url.Values{"request": {sign("both")}, "request_uri": {srv.URL + "/request.jwt"}}); !errors.Is(err, errInvalidRequestObject) {
+		t.Errorf("request and request_uri together: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+// authorizationResponseTTL is how long the signed JWTs of JARM authorization responses are valid for
+var authorizationResponseTTL = envDuration("AUTHORIZATION_RESPONSE_TTL", 10*time.Minute)
+
+// withJWTResponse replaces the authorization response in a redirect URI with a signed JWT of it, in the response
+// parameter, for requests with a JARM response mode
+//
+// The JWT holds the response parameters as claims, with the provider as its issuer and the client as its audience,
+// and is signed with the provider signing key like ID tokens. It is returned where the response mode names, or in
+// the fragment for form_post.jwt, which viewFormPost moves into the form. It must be called once the response is
+// complete, after the ID token and authorization details are kept against the code.
+func withJWTResponse(redirectURI string, consent ConsentRequest) (string, error) {
+	if !consent.jwtResponse() {
+		return redirectURI, nil
+	}
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", err
+	}
+	params := uri.Query()
+	fragment, err := url.ParseQuery(uri.Fragment)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": providerIssuer,
+		"aud": consent.ClientID,
+		"exp": now.Add(authorizationResponseTTL).Unix(),
+	}
+	for name := range params {
+		if authorizationResponseParams[name] {
+			claims[name] = params.Get(name)
+			params.Del(name)
+		}
+	}
+	for name := range fragment {
+		claims[name] = fragment.Get(name)
+	}
+	// The issuer of the response is the provider, whatever Kong returned
+	claims["iss"] = providerIssuer
+	response, err := signJWT(claims)
+	if err != nil {
+		return "", err
+	}
+
+	uri.Fragment = ""
+	if consent.responseMode() == responseModeQuery {
+		params.Set("response", response)
+		uri.RawQuery = params.Encode()
+		return uri.String(), nil
+	}
+	uri.RawQuery = params.Encode()
+	return uri.String() + "#" + url.Values{"response": {response}}.Encode(), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	kerberosKeytabPath       = os.Getenv("KERBEROS_KEYTAB")
+	kerberosServicePrincipal = os.Getenv("KERBEROS_SERVICE_PRINCIPAL")
+
+	// kerberosRealms are the realms whose principals may log in, any realm the keytab accepts if empty
+	kerberosRealms = envList("KERBEROS_REALMS")
+)
+
+// kerberosKeytab holds the service's keys when Kerberos single sign-on is enabled
+var kerberosKeytab *keytab.Keytab
+
+// ctxCredentials is the key gokrb5 stores the authenticated principal's credentials under
+const ctxCredentials = "github.com/jcmturner/gokrb5/v8/ctxCredentials"
+
+// loadKerberosKeytab loads the keytab if KERBEROS_KEYTAB is configured
+func loadKerberosKeytab() error {
+	if kerberosKeytabPath == "" {
+		return nil
+	}
+	kt, err := keytab.Load(kerberosKeytabPath)
+	if err != nil {
+		return err
+	}
+	kerberosKeytab = kt
+	return nil
+}
+
+// negotiateLogin attempts Kerberos single sign-on with the Negotiate scheme and reports whether it has
+// completed the response
+//
+// A request without a Negotiate token is answered 401 Unauthorized with a WWW-Authenticate: Negotiate header,
+// and the caller renders the login form as the body. Domain-joined browsers retry with a token and are logged in
+// without seeing the form, while other browsers display it. A token that cannot be verified, such as an NTLM
+// token from a machine outside the domain, is remembered in the session so that the form is shown from then on.
+func negotiateLogin(ctx iris.Context) bool {
+	session := sess.Start(ctx)
+	if kerberosKeytab == nil || kioskMode || session.GetBooleanDefault("negotiateFailed", false) {
+		return false
+	}
+
+	header := ctx.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Negotiate ") {
+		ctx.Header("WWW-Authenticate", "Negotiate")
+		ctx.StatusCode(iris.StatusUnauthorized)
+		return false
+	}
+
+	principal, err := verifyNegotiateToken(ctx, strings.TrimPrefix(header, "Negotiate "))
+	if err != nil {
+		log.Printf("kerberos login from %s failed: %v", clientIPString(ctx), err)
+		session.Set("negotiateFailed", true)
+		return false
+	}
+
+	user, err := users.Get(principal.UserName())
+	if err == ErrUserNotFound {
+		// Principals vouched for by the KDC are added to the user store on their first login
+		user = &User{Username: principal.UserName()}
+		err = users.Create(user)
+		if err == ErrUserExists {
+			user, err = users.Get(principal.UserName())
+		}
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+
+	if requireSecondFactor(ctx, user) {
+		return true
+	}
+
+	completeLogin(ctx, user)
+	return true
+}
+
+// verifyNegotiateToken verifies a base64 encoded SPNEGO token against the keytab and returns the client principal
+func verifyNegotiateToken(ctx iris.Context, token string) (*credentials.Credentials, error) {
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	st := spnego.SPNEGOToken{}
+	if err := st.Unmarshal(b); err != nil {
+		// Some clients send a raw Kerberos token rather than wrapping it in SPNEGO
+		k5t := spnego.KRB5Token{}
+		if k5t.Unmarshal(b) != nil {
+			return nil, err
+		}
+		st.Init = true
+		st.NegTokenInit = spnego.NegTokenInit{MechTypes: []asn1.ObjectIdentifier{k5t.OID}, MechTokenBytes: b}
+	}
+
+	options := []func(*service.Settings){}
+	if ip := clientIP(ctx); ip != nil {
+		options = append(options, service.ClientAddress(types.HostAddressFromNetIP(ip)))
+	}
+	if kerberosServicePrincipal != "" {
+		options = append(options, service.KeytabPrincipal(kerberosServicePrincipal))
+	}
+
+	authenticated, gssCtx, status := spnego.SPNEGOService(kerberosKeytab, options...).AcceptSecContext(&st)
+	if !authenticated || status.Code != gssapi.StatusComplete {
+		return nil, status
+	}
+
+	principal, ok := gssCtx.Value(ctxCredentials).(*credentials.Credentials)
+	if !ok {
+		return nil, gssapi.Status{Code: gssapi.StatusFailure, Message: "no credentials in security context"}
+	}
+	if len(kerberosRealms) > 0 && !acceptedRealm(principal.Domain()) {
+		return nil, gssapi.Status{Code: gssapi.StatusFailure, Message: "realm " + principal.Domain() + " is not accepted"}
+	}
+	return principal, nil
+}
+
+// acceptedRealm reports whether principals of the realm may log in
+func acceptedRealm(realm string) bool {
+	for _, r := range kerberosRealms {
+		if strings.EqualFold(r, realm) {
+			return true
+		}
+	}
+	return false
+}
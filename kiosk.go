@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+)
+
+var (
+	// kioskMode is for shared terminals: every consent requires a fresh login and the user is logged out as
+	// soon as they are redirected back to the client. Remember-me and persistent consent are never offered.
+	kioskMode = envBool("KIOSK_MODE", false)
+	// kioskSessionTimeout is how long a kiosk login remains valid for giving consent
+	kioskSessionTimeout = envDuration("KIOSK_SESSION_TIMEOUT", 2*time.Minute)
+)
+
+// kioskSessionExpired reports whether a kiosk session was authenticated too long ago to give consent
+func kioskSessionExpired(session *sessions.Session) bool {
+	authenticatedAt := session.GetInt64Default("authenticatedAt", 0)
+	return time.Since(time.Unix(0, authenticatedAt)) > kioskSessionTimeout
+}
+
+// endKioskSession logs the user out after consent has been given in kiosk mode
+func endKioskSession(ctx iris.Context) {
+	if kioskMode {
+		sess.Start(ctx).Clear()
+		countSessionEnded("kiosk")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// kongBasicAuth verifies passwords against the credentials of Kong's Basic Authentication plugin
+	kongBasicAuth = envBool("KONG_BASIC_AUTH", false)
+	// kongBasicAuthUserID selects the consumer attribute sent to Kong as the authenticated_userid of the user's tokens
+	kongBasicAuthUserID = envOrDefault("KONG_BASIC_AUTH_USERID", "consumer_id")
+)
+
+// basicAuthCredential is a partial representation of Kong's basic-auth credential resource
+type basicAuthCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Consumer struct {
+		ID string `json:"id"`
+	} `json:"consumer"`
+}
+
+// kongConsumer is a partial representation of Kong's consumer resource
+type kongConsumer struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	CustomID string `json:"custom_id"`
+}
+
+// kongBasicAuthenticator verifies usernames and passwords against Kong's basic-auth credentials
+//
+// Kong stores the SHA-1 hash of the password salted with the consumer's ID, which is fetched with the credential
+// from the Admin API. Users are added to the user store on their first login and identified to Kong by their
+// consumer, so the tokens they consent to belong to the same consumer that logs in with basic authentication.
+type kongBasicAuthenticator struct{}
+
+// Authenticate fetches the credential of the username from the Admin API and verifies the password against it
+func (kongBasicAuthenticator) Authenticate(credentials Credentials, clientIP string) (*User, error) {
+	if credentials.Username == "" || credentials.Password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	ctx := backgroundKongContext("basic-auth")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/basic-auths/"+url.PathEscape(credentials.Username), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := executeRequest(req)
+	if err != nil {
+		return nil, wrapError(ErrKongUnavailable, "fetching basic-auth credential", err)
+	}
+	credential := basicAuthCredential{}
+	if err := json.Unmarshal(body, &credential); err != nil {
+		return nil, wrapError(ErrKongUnavailable, "reading basic-auth credential", err)
+	}
+
+	// Unknown usernames are hashed too, so that they take as long to refuse as wrong passwords
+	sum := sha1.Sum([]byte(credentials.Password + credential.Consumer.ID))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(credential.Password))) != 1 ||
+		credential.Consumer.ID == "" || credential.Username != credentials.Username {
+		return nil, ErrInvalidCredentials
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/consumers/"+url.PathEscape(credential.Consumer.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err = executeRequest(req)
+	if err != nil {
+		return nil, wrapError(ErrKongUnavailable, "fetching consumer", err)
+	}
+	consumer := kongConsumer{}
+	if err := json.Unmarshal(body, &consumer); err != nil {
+		return nil, wrapError(ErrKongUnavailable, "reading consumer", err)
+	}
+	if consumer.ID == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	return syncBasicAuthUser(credentials.Username, consumerUserID(consumer))
+}
+
+// consumerUserID returns the authenticated_userid of a consumer's tokens, as selected by KONG_BASIC_AUTH_USERID
+func consumerUserID(consumer kongConsumer) string {
+	switch kongBasicAuthUserID {
+	case "custom_id":
+		if consumer.CustomID != "" {
+			return consumer.CustomID
+		}
+	case "username":
+		if consumer.Username != "" {
+			return consumer.Username
+		}
+	}
+	return consumer.ID
+}
+
+// syncBasicAuthUser returns the user who logged in with a basic-auth credential, creating them in the user store or
+// updating the authenticated_userid of their tokens if their consumer changed
+func syncBasicAuthUser(username, userID string) (*User, error) {
+	user, err := users.Get(username)
+	if err == ErrUserNotFound {
+		user = &User{Username: username, AuthenticatedUserID: userID}
+		err = users.Create(user)
+		if err == ErrUserExists {
+			user, err = users.Get(username)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.AuthenticatedUserID != userID {
+		user.AuthenticatedUserID = userID
+		if err := users.Save(user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
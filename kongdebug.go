@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// logLevel is "info" by default; "debug" logs every request to Kong and its response
+	logLevel = strings.ToLower(envOrDefault("LOG_LEVEL", "info"))
+
+	// kongDebugNetworks are the client networks allowed to turn on logging of Kong requests for a single request
+	// with the X-Debug-Kong header
+	kongDebugNetworks = parseCIDRs(envList("KONG_DEBUG_NETWORKS"))
+)
+
+// redacted replaces secret values in logged requests and responses
+const redacted = "REDACTED"
+
+// secretFields are the form fields, query parameters and JSON properties whose values are never logged
+var secretFields = map[string]bool{
+	"provision_key": true,
+	"client_secret": true,
+	"code":          true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"password":      true,
+	"token":         true,
+}
+
+// secretHeaders are the headers whose values are never logged
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Apikey", "Cookie", "Set-Cookie"}
+
+// kongLogKey is the context key of the request ID that Kong requests are logged under
+type kongLogKey struct{}
+
+// kongContext returns the context for Kong requests made while handling the request
+//
+// Kong requests are logged when LOG_LEVEL is debug, or when a client in KONG_DEBUG_NETWORKS sends the
+// X-Debug-Kong: true header.
+func kongContext(ctx iris.Context) context.Context {
+	parent := ctx.Request().Context()
+	if logLevel == "debug" || (ctx.GetHeader("X-Debug-Kong") == "true" && fromKongDebugNetwork(ctx)) {
+		return context.WithValue(parent, kongLogKey{}, requestID(ctx))
+	}
+	return parent
+}
+
+// backgroundKongContext returns the context for Kong requests made outside of a request, such as cache warm-up
+func backgroundKongContext(name string) context.Context {
+	if logLevel == "debug" {
+		return context.WithValue(context.Background(), kongLogKey{}, name)
+	}
+	return context.Background()
+}
+
+// fromKongDebugNetwork reports whether the client may turn on logging of Kong requests
+func fromKongDebugNetwork(ctx iris.Context) bool {
+	ip := clientIP(ctx)
+	if ip == nil {
+		return false
+	}
+	for _, network := range kongDebugNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// logKongRequest logs an outbound request and its body with secrets redacted, if its context asks for logging
+func logKongRequest(req *http.Request) {
+	id, ok := req.Context().Value(kongLogKey{}).(string)
+	if !ok {
+		return
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		if r, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(r)
+		}
+	}
+	log.Printf("kong request [%s]: %s %s %s %s", id, req.Method, redactURL(req.URL.String()),
+		redactHeaders(req.Header), redactBody(req.Header.Get("Content-Type"), body))
+}
+
+// logKongResponse logs a response to an outbound request with secrets redacted, if the request's context asks
+// for logging
+func logKongResponse(req *http.Request, res *http.Response, body []byte) {
+	id, ok := req.Context().Value(kongLogKey{}).(string)
+	if !ok {
+		return
+	}
+	log.Printf("kong response [%s]: %s %s %s", id, res.Status, redactHeaders(res.Header),
+		redactBody(res.Header.Get("Content-Type"), body))
+}
+
+// redactHeaders formats headers for logging with the values of secret headers replaced
+func redactHeaders(header http.Header) string {
+	clone := http.Header{}
+	for name, values := range header {
+		clone[name] = values
+	}
+	for _, name := range secretHeaders {
+		if clone.Get(name) != "" {
+			clone.Set(name, redacted)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	clone.Write(&buf)
+	return strings.Replace(strings.TrimSpace(buf.String()), "\r\n", "; ", -1)
+}
+
+// redactBody formats a form or JSON body for logging with secret values replaced
+func redactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return redacted
+		}
+		return redactValues(values).Encode()
+	case strings.Contains(contentType, "json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return redacted
+		}
+		buf := bytes.Buffer{}
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(redactJSON(v)); err != nil {
+			return redacted
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	return "(" + contentType + " body not logged)"
+}
+
+// redactValues replaces the values of secret fields
+func redactValues(values url.Values) url.Values {
+	for name := range values {
+		if secretFields[strings.ToLower(name)] {
+			values.Set(name, redacted)
+		}
+	}
+	return values
+}
+
+// redactURL replaces the values of secret query parameters, and access tokens looked up by value, in a URL
+func redactURL(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	// Tokens are looked up on the Admin API by their value
+	if i := strings.Index(parsed.Path, "/oauth2_tokens/"); i >= 0 {
+		parsed.Path = parsed.Path[:i] + "/oauth2_tokens/" + redacted
+		parsed.RawPath = ""
+	}
+	if parsed.RawQuery != "" {
+		parsed.RawQuery = redactValues(parsed.Query()).Encode()
+	}
+	return parsed.String()
+}
+
+// redactJSON replaces the values of secret properties, and secret query parameters in URL strings such as
+// redirect_uri, in a decoded JSON value
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if secretFields[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+		return v
+	case string:
+		if strings.Contains(v, "://") {
+			return redactURL(v)
+		}
+		return v
+	}
+	return v
+}
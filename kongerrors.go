@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/kataras/iris/v12"
+)
+
+// debug shows raw error codes and descriptions from Kong to users when enabled
+var debug = envBool("DEBUG", false)
+
+// kongErrorKeys maps Kong OAuth 2.0 error codes to the locale keys of their user-facing message and hint
+var kongErrorKeys = map[string]string{
+	"invalid_request":           "KongErrorInvalidRequest",
+	"invalid_client":            "KongErrorInvalidClient",
+	"unauthorized_client":       "KongErrorUnauthorizedClient",
+	"invalid_scope":             "KongErrorInvalidScope",
+	"unsupported_response_type": "KongErrorUnsupportedResponseType",
+	"invalid_provision_key":     "KongErrorInvalidProvisionKey",
+	"access_denied":             "KongErrorAccessDenied",
+	"server_error":              "KongErrorServerError",
+}
+
+// KongError is an OAuth 2.0 error returned by Kong
+type KongError struct {
+	Code        string
+	Description string
+
+	// RedirectURI returns the error to the client when Kong could validate the client's redirect URI
+	RedirectURI string
+}
+
+// Error returns the raw error code and description
+func (e *KongError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// Is reports whether target is ErrInvalidScope or ErrUnknownClient and Kong responded with the matching code
+func (e *KongError) Is(target error) bool {
+	switch target {
+	case ErrInvalidScope:
+		return e.Code == "invalid_scope"
+	case ErrUnknownClient:
+		return e.Code == "invalid_client"
+	}
+	return false
+}
+
+// viewKongError renders a localized, user-appropriate explanation of a Kong error
+//
+// The raw error code and description are only shown in debug mode.
+func viewKongError(ctx iris.Context, statusCode int, kongErr *KongError) {
+	if debug {
+		ctx.ViewData("CodeLabel", ctx.Tr("ErrorCode"))
+		ctx.ViewData("Code", kongErr.Code)
+		ctx.ViewData("Description", kongErr.Description)
+	}
+	viewError(ctx, statusCode, kongErrorKey(kongErr.Code))
+}
+
+// kongErrorKey returns the locale key for a Kong error code
+func kongErrorKey(code string) string {
+	key, ok := kongErrorKeys[code]
+	if !ok {
+		return "KongErrorUnknown"
+	}
+	return key
+}
+
+// viewError renders the localized message and hint with the given locale key
+func viewError(ctx iris.Context, statusCode int, key string) {
+	ctx.StatusCode(statusCode)
+	ctx.ViewData("Title", ctx.Tr("ErrorTitle"))
+	ctx.ViewData("Message", ctx.Tr(key))
+	ctx.ViewData("Hint", ctx.Tr(key+"Hint"))
+	ctx.View("error.html")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// oauth2Tokens is a page of Kong's OAuth 2.0 tokens
+type oauth2Tokens struct {
+	Data []kongAccessToken `json:"data"`
+	Next string            `json:"next"`
+}
+
+// revokeKongTokens deletes the access and refresh tokens Kong has issued to authenticatedUserID and returns the
+// number deleted
+func revokeKongTokens(ctx context.Context, authenticatedUserID string) (int, error) {
+	return revokeKongTokensWhere(ctx, func(token oauth2Token) bool {
+		return token.AuthenticatedUserID == authenticatedUserID
+	})
+}
+
+// revokeClientTokens deletes the tokens Kong has issued to authenticatedUserID for the client with the OAuth 2.0
+// credential credentialID and returns the number deleted
+func revokeClientTokens(ctx context.Context, authenticatedUserID, credentialID string) (int, error) {
+	return revokeKongTokensWhere(ctx, func(token oauth2Token) bool {
+		return token.AuthenticatedUserID == authenticatedUserID && token.Credential.ID == credentialID
+	})
+}
+
+// revokeKongTokensWhere deletes the tokens match returns true for and returns the number deleted
+func revokeKongTokensWhere(ctx context.Context, match func(token oauth2Token) bool) (int, error) {
+	revoked := 0
+	err := eachKongToken(ctx, func(token oauth2Token) error {
+		if token.ID == "" || !match(token) {
+			return nil
+		}
+		if err := deleteKongToken(ctx, token.ID); err != nil {
+			return err
+		}
+		revoked++
+		return nil
+	})
+	return revoked, err
+}
+
+// eachKongToken calls fn with every OAuth 2.0 token Kong has issued, stopping at the first error
+func eachKongToken(ctx context.Context, fn func(token oauth2Token) error) error {
+	return eachKongAccessToken(ctx, func(token kongAccessToken) error {
+		return fn(token.oauth2Token)
+	})
+}
+
+// eachKongAccessToken calls fn with Kong's full record of every OAuth 2.0 token it has issued, stopping at the first
+// error
+//
+// The Admin API cannot filter tokens by user, so every page of tokens is read.
+func eachKongAccessToken(ctx context.Context, fn func(token kongAccessToken) error) error {
+	next := "/oauth2_tokens?size=1000"
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+next, nil)
+		if err != nil {
+			return err
+		}
+		body, err := executeRequest(req)
+		if err != nil {
+			return wrapError(ErrKongUnavailable, "fetching OAuth 2.0 tokens", err)
+		}
+
+		page := oauth2Tokens{}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return wrapError(ErrKongUnavailable, "reading OAuth 2.0 tokens", err)
+		}
+		for _, token := range page.Data {
+			if err := fn(token); err != nil {
+				return err
+			}
+		}
+		next = page.Next
+	}
+	return nil
+}
+
+// rekeyKongTokens moves the tokens Kong has issued to oldUserID to newUserID and returns the number moved
+func rekeyKongTokens(ctx context.Context, oldUserID, newUserID string) (int, error) {
+	moved := 0
+	err := eachKongToken(ctx, func(token oauth2Token) error {
+		if token.ID == "" || token.AuthenticatedUserID != oldUserID {
+			return nil
+		}
+		data := url.Values{}
+		data.Set("authenticated_userid", newUserID)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, kongAdminEndpoint+"/oauth2_tokens/"+url.PathEscape(token.ID),
+			strings.NewReader(data.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if _, err := executeRequest(req); err != nil {
+			return wrapError(ErrKongUnavailable, "updating OAuth 2.0 token", err)
+		}
+		moved++
+		return nil
+	})
+	return moved, err
+}
+
+// userRefreshTokens returns Kong's records of the tokens issued to authenticatedUserID that have a refresh token,
+// most recently issued first
+func userRefreshTokens(ctx context.Context, authenticatedUserID string) ([]kongAccessToken, error) {
+	tokens := []kongAccessToken{}
+	err := eachKongAccessToken(ctx, func(token kongAccessToken) error {
+		if token.ID != "" && token.RefreshToken != "" && token.AuthenticatedUserID == authenticatedUserID {
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt > tokens[j].CreatedAt
+	})
+	return tokens, err
+}
+
+// errTokenFound stops eachKongToken once the token looked for is found
+var errTokenFound = errors.New("token found")
+
+// findKongRefreshToken returns Kong's record of the token with the given refresh token, or nil if there is none
+//
+// The Admin API can only look tokens up by their access token, so every page of tokens is read until it is found.
+func findKongRefreshToken(ctx context.Context, refreshToken string) (*oauth2Token, error) {
+	var found *oauth2Token
+	err := eachKongToken(ctx, func(token oauth2Token) error {
+		if token.ID == "" || subtle.ConstantTimeCompare([]byte(token.RefreshToken), []byte(refreshToken)) != 1 {
+			return nil
+		}
+		found = &token
+		return errTokenFound
+	})
+	if err != nil && err != errTokenFound {
+		return nil, err
+	}
+	return found, nil
+}
+
+// deleteKongToken deletes an access token, and its refresh token, from Kong
+func deleteKongToken(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, kongAdminEndpoint+"/oauth2_tokens/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	if _, err := executeRequest(req); err != nil {
+		return wrapError(ErrKongUnavailable, "deleting OAuth 2.0 token", err)
+	}
+	return nil
+}
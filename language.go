@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// supportedLanguages are the languages of the locales directory, the first being the default
+var supportedLanguages = []string{"en-US", "de-DE"}
+
+// languageNames are the names of the supported languages, in their own language
+var languageNames = map[string]string{"en-US": "English", "de-DE": "Deutsch"}
+
+// languageParam is the query parameter that overrides the language of a single page, for example for screenshots
+const languageParam = "lang"
+
+// translations translates locale keys into a given language; it is the application's I18n once it is created
+var translations interface {
+	Tr(lang, key string, args ...interface{}) string
+}
+
+// LanguageForm represents the language submitted on the account page
+type LanguageForm struct {
+	Language string
+}
+
+// languageOption is a language the user can choose on the account page
+type languageOption struct {
+	Code     string
+	Name     string
+	Selected bool
+}
+
+// matchLanguage returns the supported language matching a language tag, such as de or de-AT for de-DE, or an empty
+// string if none does
+func matchLanguage(tag string) string {
+	tag = strings.Replace(strings.TrimSpace(tag), "_", "-", -1)
+	if tag == "" {
+		return ""
+	}
+	for _, supported := range supportedLanguages {
+		if strings.EqualFold(supported, tag) {
+			return supported
+		}
+	}
+	base := strings.SplitN(tag, "-", 2)[0]
+	for _, supported := range supportedLanguages {
+		if strings.EqualFold(strings.SplitN(supported, "-", 2)[0], base) {
+			return supported
+		}
+	}
+	return ""
+}
+
+// requestLanguage chooses the language of a request's pages: the lang query parameter, then the language on the
+// profile of the user logged in; without either, the Accept-Language header decides
+func requestLanguage(ctx iris.Context) string {
+	if language := matchLanguage(ctx.URLParam(languageParam)); language != "" {
+		return language
+	}
+	return sess.Start(ctx).GetString("language")
+}
+
+// userTranslator returns a function translating locale keys into the language on the user's profile, or into the
+// request's language if they have none, for messages sent to the user outside of the request, such as emails
+func userTranslator(ctx iris.Context, user *User) func(string) string {
+	language := matchLanguage(user.Language)
+	if language == "" || translations == nil || matchLanguage(ctx.URLParam(languageParam)) != "" {
+		return func(key string) string { return translate(ctx, key) }
+	}
+	return func(key string) string {
+		if translated := translations.Tr(language, key); translated != "" {
+			return translated
+		}
+		return key
+	}
+}
+
+// getAccountLanguage returns the view where the user chooses the language of pages and emails
+func getAccountLanguage(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	options := []languageOption{}
+	for _, language := range supportedLanguages {
+		options = append(options, languageOption{Code: language, Name: languageNames[language], Selected: language == user.Language})
+	}
+	ctx.ViewData("Language", user.Language)
+	ctx.ViewData("Languages", options)
+	ctx.View("account-language.html")
+}
+
+// postAccountLanguage handles POST requests to change the user's preferred language
+//
+// An empty language clears the preference, so that the browser's Accept-Language header decides again.
+func postAccountLanguage(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := LanguageForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	language := matchLanguage(form.Language)
+	if form.Language != "" && language == "" {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please choose one of the languages listed.")
+		getAccountLanguage(ctx)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	user.Language = language
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	session.Set("language", language)
+
+	ctx.Redirect("/account/language", iris.StatusSeeOther)
+}
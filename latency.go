@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12/sessions"
+)
+
+var (
+	// sessionStoreDurations are the session database histograms, by operation
+	sessionStoreDurations = histogramsByLabel("session_store_duration_seconds", "Time taken by round trips to the session database, in seconds.",
+		"operation", "update_expiration", "set", "get", "decode", "visit", "len", "delete", "clear", "release")
+	// userStoreDurations are the user store histograms, by operation
+	userStoreDurations = histogramsByLabel("user_store_duration_seconds", "Time taken by queries of the user store and its consent grants, in seconds.",
+		"operation", "get", "list", "create", "save", "delete", "compact")
+
+	// templateRenderDurations holds the *Histogram of each template, registered the first time it is rendered
+	templateRenderDurations sync.Map
+)
+
+// histogramsByLabel registers the histograms of name for each value of the label, so that observations find them
+// without taking the registry's lock
+func histogramsByLabel(name, help, label string, values ...string) map[string]*Histogram {
+	histograms := make(map[string]*Histogram, len(values))
+	for _, value := range values {
+		histograms[value] = metrics.Histogram(name, help, label, value)
+	}
+	return histograms
+}
+
+// observeTemplateRender records how long a page or email template took to render
+func observeTemplateRender(template string, start time.Time) {
+	h, ok := templateRenderDurations.Load(template)
+	if !ok {
+		h, _ = templateRenderDurations.LoadOrStore(template, metrics.Histogram("template_render_duration_seconds",
+			"Time taken to render page and email templates, in seconds.", "template", template))
+	}
+	h.(*Histogram).ObserveSince(start)
+}
+
+// observeSessionStore records how long a round trip to the session database took
+func observeSessionStore(operation string, start time.Time) {
+	sessionStoreDurations[operation].ObserveSince(start)
+}
+
+// observeUserStore records how long a query of the user store, which holds the users' consent grants, took
+func observeUserStore(operation string, start time.Time) {
+	userStoreDurations[operation].ObserveSince(start)
+}
+
+// viewEngine is implemented by iris's view engines
+type viewEngine interface {
+	Name() string
+	Load() error
+	ExecuteWriter(w io.Writer, filename string, layout string, bindingData interface{}) error
+	Ext() string
+}
+
+// timedViewEngine is a view engine that records how long each template takes to render
+type timedViewEngine struct {
+	viewEngine
+}
+
+// ExecuteWriter renders a template
+func (e timedViewEngine) ExecuteWriter(w io.Writer, filename string, layout string, bindingData interface{}) error {
+	defer observeTemplateRender(filename, time.Now())
+	return e.viewEngine.ExecuteWriter(w, filename, layout, bindingData)
+}
+
+// timedSessionDatabase is a session database that records how long each round trip takes, by operation
+//
+// Acquiring a session and closing the database are passed to the wrapped database without being timed.
+type timedSessionDatabase struct {
+	sessions.Database
+}
+
+// OnUpdateExpiration updates the expiry of a session
+func (db timedSessionDatabase) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	defer observeSessionStore("update_expiration", time.Now())
+	return db.Database.OnUpdateExpiration(sid, newExpires)
+}
+
+// Set stores a value in a session
+func (db timedSessionDatabase) Set(sid string, key string, value interface{}, ttl time.Duration, immutable bool) error {
+	defer observeSessionStore("set", time.Now())
+	return db.Database.Set(sid, key, value, ttl, immutable)
+}
+
+// Get returns a value stored in a session
+func (db timedSessionDatabase) Get(sid string, key string) interface{} {
+	defer observeSessionStore("get", time.Now())
+	return db.Database.Get(sid, key)
+}
+
+// Decode decodes a value stored in a session into outPtr
+func (db timedSessionDatabase) Decode(sid, key string, outPtr interface{}) error {
+	defer observeSessionStore("decode", time.Now())
+	return db.Database.Decode(sid, key, outPtr)
+}
+
+// Visit calls cb with each value stored in a session
+func (db timedSessionDatabase) Visit(sid string, cb func(key string, value interface{})) error {
+	defer observeSessionStore("visit", time.Now())
+	return db.Database.Visit(sid, cb)
+}
+
+// Len returns the number of values stored in a session
+func (db timedSessionDatabase) Len(sid string) int {
+	defer observeSessionStore("len", time.Now())
+	return db.Database.Len(sid)
+}
+
+// Delete removes a value from a session
+func (db timedSessionDatabase) Delete(sid string, key string) bool {
+	defer observeSessionStore("delete", time.Now())
+	return db.Database.Delete(sid, key)
+}
+
+// Clear removes every value from a session
+func (db timedSessionDatabase) Clear(sid string) error {
+	defer observeSessionStore("clear", time.Now())
+	return db.Database.Clear(sid)
+}
+
+// Release ends a session
+func (db timedSessionDatabase) Release(sid string) error {
+	defer observeSessionStore("release", time.Now())
+	return db.Database.Release(sid)
+}
+
+// timedUserStore is a UserStore that records how long each query takes, by operation
+type timedUserStore struct {
+	UserStore
+}
+
+// Get returns the user with the username
+func (s timedUserStore) Get(username string) (*User, error) {
+	defer observeUserStore("get", time.Now())
+	return s.UserStore.Get(username)
+}
+
+// List returns every user
+func (s timedUserStore) List() ([]*User, error) {
+	defer observeUserStore("list", time.Now())
+	return s.UserStore.List()
+}
+
+// Create stores a new user
+func (s timedUserStore) Create(user *User) error {
+	defer observeUserStore("create", time.Now())
+	return s.UserStore.Create(user)
+}
+
+// Save stores changes to a user, such as the consent they have granted
+func (s timedUserStore) Save(user *User) error {
+	defer observeUserStore("save", time.Now())
+	return s.UserStore.Save(user)
+}
+
+// Delete removes a user
+func (s timedUserStore) Delete(username string) error {
+	defer observeUserStore("delete", time.Now())
+	return s.UserStore.Delete(username)
+}
+
+// Compact rewrites the store's file, if the wrapped store has one
+func (s timedUserStore) Compact() error {
+	c, ok := s.UserStore.(compactor)
+	if !ok {
+		return nil
+	}
+	defer observeUserStore("compact", time.Now())
+	return c.Compact()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapMaxMessageSize bounds the size of a message read from the directory
+const ldapMaxMessageSize = 1 << 20
+
+// BER tags of the LDAPv3 messages used to look up a user, from RFC 4511
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest          = 0x60
+	ldapBindResponse         = 0x61
+	ldapUnbindRequest        = 0x42
+	ldapSearchRequest        = 0x63
+	ldapSearchResultEntry    = 0x64
+	ldapSearchResultDone     = 0x65
+	ldapSearchResultRef      = 0x73
+	ldapSimpleAuthentication = 0x80
+	ldapEqualityMatch        = 0xa3
+
+	ldapScopeWholeSubtree = 2
+	ldapDerefNever        = 0
+	ldapResultSuccess     = 0
+)
+
+// ldapClient looks up directory entries with a simple bind, without the rest of LDAP
+type ldapClient struct {
+	url          string
+	bindDN       string
+	bindPassword string
+	timeout      time.Duration
+}
+
+// search returns the values of attrs of the single entry under baseDN whose filterAttribute equals value
+//
+// ErrUserNotFound is returned when no entry matches, and an error when more than one does.
+func (c ldapClient) search(baseDN, filterAttribute, value string, attrs []string) (map[string][]string, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	r := bufio.NewReader(conn)
+
+	bind := berTLV(ldapBindRequest, berConcat(
+		berInt(berInteger, 3),
+		berTLV(berOctetString, []byte(c.bindDN)),
+		berTLV(ldapSimpleAuthentication, []byte(c.bindPassword)),
+	))
+	if err := ldapWrite(conn, 1, bind); err != nil {
+		return nil, err
+	}
+	op, err := ldapRead(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := ldapResult(op, ldapBindResponse); err != nil {
+		return nil, fmt.Errorf("binding to directory: %w", err)
+	}
+
+	attributes := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		attributes[i] = berTLV(berOctetString, []byte(attr))
+	}
+	search := berTLV(ldapSearchRequest, berConcat(
+		berTLV(berOctetString, []byte(baseDN)),
+		berInt(berEnumerated, ldapScopeWholeSubtree),
+		berInt(berEnumerated, ldapDerefNever),
+		berInt(berInteger, 2),
+		berInt(berInteger, int(c.timeout.Seconds())),
+		[]byte{0x01, 0x01, 0x00},
+		berTLV(ldapEqualityMatch, berConcat(
+			berTLV(berOctetString, []byte(filterAttribute)),
+			berTLV(berOctetString, []byte(value)),
+		)),
+		berTLV(berSequence, berConcat(attributes...)),
+	))
+	if err := ldapWrite(conn, 2, search); err != nil {
+		return nil, err
+	}
+
+	var entries []map[string][]string
+	for {
+		op, err := ldapRead(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchResultEntry:
+			entry, err := ldapEntry(op.content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			continue
+		case ldapSearchResultRef:
+			continue
+		}
+		if err := ldapResult(op, ldapSearchResultDone); err != nil {
+			return nil, fmt.Errorf("searching directory: %w", err)
+		}
+		break
+	}
+	ldapWrite(conn, 3, []byte{ldapUnbindRequest, 0x00})
+
+	switch len(entries) {
+	case 0:
+		return nil, ErrUserNotFound
+	case 1:
+		return entries[0], nil
+	default:
+		return nil, fmt.Errorf("more than one directory entry has %s=%s", filterAttribute, value)
+	}
+}
+
+// dial connects to the directory, with TLS for ldaps URLs
+func (c ldapClient) dial() (net.Conn, error) {
+	uri, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: c.timeout}
+	switch uri.Scheme {
+	case "ldaps":
+		host := uri.Host
+		if uri.Port() == "" {
+			host = net.JoinHostPort(uri.Hostname(), "636")
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: uri.Hostname()})
+	case "ldap":
+		host := uri.Host
+		if uri.Port() == "" {
+			host = net.JoinHostPort(uri.Hostname(), "389")
+		}
+		return dialer.Dial("tcp", host)
+	}
+	return nil, fmt.Errorf("unsupported directory URL scheme %q", uri.Scheme)
+}
+
+// berElement is a decoded BER tag, length and value
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// ldapWrite sends a protocol operation in an LDAPMessage with the message ID
+func ldapWrite(w io.Writer, messageID int, op []byte) error {
+	_, err := w.Write(berTLV(berSequence, berConcat(berInt(berInteger, messageID), op)))
+	return err
+}
+
+// ldapRead reads an LDAPMessage with the message ID and returns its protocol operation
+func ldapRead(r *bufio.Reader, messageID int) (berElement, error) {
+	message, err := berRead(r)
+	if err != nil {
+		return berElement{}, err
+	}
+	if message.tag != berSequence {
+		return berElement{}, errors.New("malformed LDAP message")
+	}
+	elements, err := berParseAll(message.content)
+	if err != nil || len(elements) < 2 || elements[0].tag != berInteger {
+		return berElement{}, errors.New("malformed LDAP message")
+	}
+	if berIntValue(elements[0].content) != messageID {
+		return berElement{}, errors.New("unexpected LDAP message ID")
+	}
+	return elements[1], nil
+}
+
+// ldapResult returns an error unless op is an LDAPResult of the expected operation with a success result code
+func ldapResult(op berElement, tag byte) error {
+	if op.tag != tag {
+		return fmt.Errorf("unexpected LDAP operation 0x%02x", op.tag)
+	}
+	elements, err := berParseAll(op.content)
+	if err != nil || len(elements) < 3 || elements[0].tag != berEnumerated {
+		return errors.New("malformed LDAP result")
+	}
+	if code := berIntValue(elements[0].content); code != ldapResultSuccess {
+		return fmt.Errorf("LDAP result code %d: %s", code, elements[2].content)
+	}
+	return nil
+}
+
+// ldapEntry decodes the attributes of a SearchResultEntry
+func ldapEntry(content []byte) (map[string][]string, error) {
+	elements, err := berParseAll(content)
+	if err != nil || len(elements) != 2 || elements[1].tag != berSequence {
+		return nil, errors.New("malformed LDAP search result")
+	}
+	attributes, err := berParseAll(elements[1].content)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := map[string][]string{}
+	for _, attribute := range attributes {
+		parts, err := berParseAll(attribute.content)
+		if err != nil || len(parts) != 2 || parts[1].tag != berSet {
+			return nil, errors.New("malformed LDAP attribute")
+		}
+		values, err := berParseAll(parts[1].content)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, value := range values {
+			entry[name] = append(entry[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+// berTLV encodes a tag, the definite length of content and content
+func berTLV(tag byte, content []byte) []byte {
+	n := len(content)
+	encoded := []byte{tag}
+	if n < 0x80 {
+		encoded = append(encoded, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		encoded = append(append(encoded, 0x80|byte(len(length))), length...)
+	}
+	return append(encoded, content...)
+}
+
+// berInt encodes a non-negative integer or enumerated value
+func berInt(tag byte, v int) []byte {
+	content := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		content = append([]byte{byte(v)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berTLV(tag, content)
+}
+
+// berIntValue decodes a non-negative integer or enumerated value
+func berIntValue(content []byte) int {
+	v := 0
+	for _, b := range content {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// berConcat joins encoded elements into the content of a constructed element
+func berConcat(elements ...[]byte) []byte {
+	var content []byte
+	for _, element := range elements {
+		content = append(content, element...)
+	}
+	return content
+}
+
+// berRead reads one element from the directory's response stream
+func berRead(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		size := int(first &^ 0x80)
+		if size == 0 || size > 4 {
+			return berElement{}, errors.New("unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > ldapMaxMessageSize {
+		return berElement{}, errors.New("LDAP message too large")
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag: tag, content: content}, nil
+}
+
+// berParseAll decodes the consecutive elements of a constructed element's content
+func berParseAll(data []byte) ([]berElement, error) {
+	var elements []berElement
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return elements, nil
+		}
+		element, err := berRead(r)
+		if err != nil {
+			return nil, errors.New("malformed BER element")
+		}
+		elements = append(elements, element)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// listenAddrs are the addresses the server listens on. A host name is listened on at each of its addresses, so the
+// default listens on both 127.0.0.1 and ::1, while ":8080" listens on all IPv4 and IPv6 interfaces.
+var listenAddrs = envListDefault("LISTEN_ADDRS", []string{"localhost:8080"})
+
+var (
+	// tlsCertFile and tlsKeyFile enable the TLS listener when both are set
+	tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile  = os.Getenv("TLS_KEY_FILE")
+
+	// tlsClientCAFile is the PEM bundle of certificate authorities whose client certificates are accepted
+	tlsClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+)
+
+// errListenerClosed is returned by Accept once the listener is closed
+var errListenerClosed = errors.New("listener closed")
+
+// listen opens a listener on each of the addresses and combines them into one
+func listen(addrs []string) (net.Listener, error) {
+	listeners := []net.Listener{}
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, addr := range addrs {
+		expanded, err := expandListenAddr(addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		for _, a := range expanded {
+			l, err := net.Listen("tcp", a)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			log.Printf("listening on %s", l.Addr())
+			listeners = append(listeners, l)
+		}
+	}
+
+	var listener net.Listener = newMultiListener(listeners)
+	if len(listeners) == 1 {
+		listener = listeners[0]
+	}
+
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return listener, nil
+	}
+	config, err := tlsConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// tlsConfig returns the TLS listener's configuration, asking browsers for a client certificate when
+// TLS_CLIENT_CA_FILE is set
+func tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsClientCAFile != "" {
+		pem, err := ioutil.ReadFile(tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + tlsClientCAFile)
+		}
+		// A certificate is optional so that users without one can still log in with the form
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// expandListenAddr resolves the host name in addr to one address per IP, leaving literal and empty hosts untouched
+func expandListenAddr(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	seen := map[string]bool{}
+	for _, ip := range ips {
+		a := net.JoinHostPort(normalizeIP(ip).String(), port)
+		if !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+// multiListener accepts connections from several listeners
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newMultiListener starts accepting on each listener
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.serve(l)
+	}
+	return m
+}
+
+// serve forwards the listener's connections and errors until the multiListener is closed
+func (m *multiListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for the next connection on any of the listeners
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close closes all of the listeners
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// maxLoginHintLength bounds the login_hint clients may send, as it is kept in the session and shown on the login page
+const maxLoginHintLength = 255
+
+// loginHintMatches reports whether a client's login_hint names the user, by their username or email address
+func loginHintMatches(user *User, hint string) bool {
+	return hint == user.Username || (user.Email != "" && strings.EqualFold(hint, user.Email))
+}
+
+// requireHintedAccount sends the user to the login page when the client's login_hint names another account than
+// the one they are logged in with, and reports whether it has completed the response
+//
+// The login page is prefilled with the hint. When the hint names the logged in user there is no account to
+// choose, and the consent page is shown straight away. The consent request is resumed without the hint once the
+// user has logged in, with whichever account they chose.
+func requireHintedAccount(ctx iris.Context, consent ConsentRequest) bool {
+	if consent.LoginHint == "" || impersonating(ctx) {
+		return false
+	}
+
+	session := sess.Start(ctx)
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+	if loginHintMatches(user, consent.LoginHint) {
+		return false
+	}
+
+	setPendingConsent(session, consent)
+	audit(ctx, "consent.reauthenticate", map[string]string{"client_id": consent.ClientID, "login_hint": consent.LoginHint})
+	session.Set("reauthenticate", true)
+	ctx.Redirect("/login", iris.StatusSeeOther)
+	return true
+}
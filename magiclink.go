@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+const (
+	loginModePassword  = "password"
+	loginModeMagicLink = "magic_link"
+
+	magicLinkPurpose = "magic-link"
+)
+
+var (
+	loginMode    = envOrDefault("LOGIN_MODE", loginModePassword)
+	magicLinkTTL = envDuration("MAGIC_LINK_TTL", 15*time.Minute)
+)
+
+// magicLinkData is carried by a magic link: the user and the consent request that was pending when it was sent
+type magicLinkData struct {
+	Username     string `json:"sub"`
+	ClientID     string `json:"client_id,omitempty"`
+	ResponseType string `json:"response_type,omitempty"`
+	Scopes       string `json:"scopes,omitempty"`
+	RedirectURI  string `json:"redirect_uri,omitempty"`
+	State        string `json:"state,omitempty"`
+
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+	Nonce               string `json:"nonce,omitempty"`
+	ResponseMode        string `json:"response_mode,omitempty"`
+
+	AuthorizationDetails string `json:"authorization_details,omitempty"`
+	Resources            string `json:"resources,omitempty"`
+}
+
+// postLoginMagicLink emails a signed, single-use login link to the user with the given email address
+//
+// The same page is shown whether or not a user exists so that email addresses cannot be enumerated.
+func postLoginMagicLink(ctx iris.Context, email string) {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please enter a valid email address.")
+		getLogin(ctx)
+		return
+	}
+
+	user, err := findUserByEmail(address.Address)
+	if err == ErrUserNotFound && userStorePath == "" {
+		// As with password logins, the demo creates unknown users on their first login
+		user = &User{Username: address.Address, Email: address.Address}
+		err = users.Save(user)
+	}
+	if err != nil && err != ErrUserNotFound {
+		ctx.SetErr(err)
+		return
+	}
+
+	if user != nil {
+		session := sess.Start(ctx)
+		token, err := signToken(magicLinkPurpose, magicLinkTTL, magicLinkData{
+			Username:     user.Username,
+			ClientID:     session.GetString("clientID"),
+			ResponseType: session.GetString("responseType"),
+			Scopes:       session.GetString("scopes"),
+			RedirectURI:  session.GetString("redirectURI"),
+			State:        session.GetString("state"),
+
+			CodeChallenge:       session.GetString("codeChallenge"),
+			CodeChallengeMethod: session.GetString("codeChallengeMethod"),
+			Nonce:               session.GetString("nonce"),
+			ResponseMode:        session.GetString("responseMode"),
+
+			AuthorizationDetails: session.GetString("authorizationDetails"),
+			Resources:            session.GetString("resources"),
+		})
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+
+		link := publicURL + "/login/magic?token=" + url.QueryEscape(token)
+		if err := sendEmail(ctx, emailMagicLink, user, link, magicLinkTTL); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	ctx.ViewData("Email", address.Address)
+	ctx.View("magic-link-sent.html")
+}
+
+// getLoginMagic establishes the session when a magic link is followed
+//
+// The consent request stored in the link is resumed, so the link may be opened in a different browser to the one
+// the login was started from.
+func getLoginMagic(ctx iris.Context) {
+	data := magicLinkData{}
+	if _, err := verifySingleUseToken(magicLinkPurpose, ctx.URLParam("token"), &data); err != nil {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "This login link is invalid, has expired or has already been used.")
+		getLogin(ctx)
+		return
+	}
+
+	user, err := users.Get(data.Username)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Following the link proves that the user controls their email address
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		if err := users.Save(user); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	session := sess.Start(ctx)
+	if data.ClientID != "" {
+		session.Set("clientID", data.ClientID)
+		session.Set("responseType", data.ResponseType)
+		session.Set("scopes", data.Scopes)
+		session.Set("redirectURI", data.RedirectURI)
+		session.Set("state", data.State)
+		session.Set("codeChallenge", data.CodeChallenge)
+		session.Set("codeChallengeMethod", data.CodeChallengeMethod)
+		session.Set("nonce", data.Nonce)
+		session.Set("responseMode", data.ResponseMode)
+		session.Set("authorizationDetails", data.AuthorizationDetails)
+		session.Set("resources", data.Resources)
+	}
+
+	if requireSecondFactor(ctx, user) {
+		return
+	}
+
+	completeLogin(ctx, user)
+}
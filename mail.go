@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+var (
+	smtpAddr     = os.Getenv("SMTP_ADDR")
+	smtpUsername = os.Getenv("SMTP_USERNAME")
+	smtpPassword = os.Getenv("SMTP_PASSWORD")
+	mailFrom     = envOrDefault("MAIL_FROM", "consent-app@localhost")
+)
+
+// mailer delivers email to users, logging messages instead of sending them unless SMTP_ADDR is set
+var mailer = newMailer()
+
+// Message is an email with a plain text body and, optionally, an HTML alternative and attachments
+type Message struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to an email
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// newMailer returns an SMTP mailer if SMTP_ADDR is configured, otherwise a mailer that logs messages
+func newMailer() Mailer {
+	if smtpAddr == "" {
+		return logMailer{}
+	}
+	return smtpMailer{addr: smtpAddr, username: smtpUsername, password: smtpPassword, from: mailFrom}
+}
+
+// logMailer writes email to the log, allowing the demo to run without a mail server
+type logMailer struct{}
+
+// Send logs the message's plain text body and the names of its attachments
+func (logMailer) Send(msg Message) error {
+	log.Printf("email to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	for _, attachment := range msg.Attachments {
+		log.Printf("email to %s: attached %s (%d bytes)", msg.To, attachment.Filename, len(attachment.Content))
+	}
+	return nil
+}
+
+// smtpMailer sends email through an SMTP server
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+// Send sends the message through the SMTP server, authenticating if a username is configured
+//
+// Messages with an HTML body are sent as multipart/alternative, so that mail clients that do not show HTML show
+// the plain text body. Messages with attachments are sent as multipart/mixed around the body.
+func (m smtpMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+
+	// Header values must not contain line breaks, which would allow header injection
+	headerValue := strings.NewReplacer("\r", "", "\n", "").Replace
+	header := "From: " + headerValue(m.from) + "\r\n" +
+		"To: " + headerValue(msg.To) + "\r\n" +
+		"Subject: " + headerValue(msg.Subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n"
+
+	var body bytes.Buffer
+	contentType := "text/plain; charset=UTF-8"
+	if msg.HTML == "" {
+		body.WriteString(msg.Text)
+	} else {
+		parts := multipart.NewWriter(&body)
+		contentType = "multipart/alternative; boundary=" + parts.Boundary()
+		for _, part := range []struct{ contentType, content string }{
+			{"text/plain; charset=UTF-8", msg.Text},
+			{"text/html; charset=UTF-8", msg.HTML},
+		} {
+			w, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.contentType},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return err
+			}
+			qp := quotedprintable.NewWriter(w)
+			if _, err := qp.Write([]byte(part.content)); err != nil {
+				return err
+			}
+			if err := qp.Close(); err != nil {
+				return err
+			}
+		}
+		if err := parts.Close(); err != nil {
+			return err
+		}
+	}
+
+	if len(msg.Attachments) > 0 {
+		var mixed bytes.Buffer
+		parts := multipart.NewWriter(&mixed)
+		w, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(body.Bytes()); err != nil {
+			return err
+		}
+		for _, attachment := range msg.Attachments {
+			w, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {attachment.ContentType},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return err
+			}
+			encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+			for len(encoded) > 76 {
+				io.WriteString(w, encoded[:76]+"\r\n")
+				encoded = encoded[76:]
+			}
+			if _, err := io.WriteString(w, encoded+"\r\n"); err != nil {
+				return err
+			}
+		}
+		if err := parts.Close(); err != nil {
+			return err
+		}
+		contentType = "multipart/mixed; boundary=" + parts.Boundary()
+		body = mixed
+	}
+	header += "Content-Type: " + contentType + "\r\n"
+
+	data := append([]byte(header+"\r\n"), body.Bytes()...)
+	return smtp.SendMail(m.addr, auth, m.from, []string{headerValue(msg.To)}, data)
+}
@@ -12,12 +12,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +36,8 @@ var (
 	kongProxyEndpoint      = os.Getenv("KONG_PROXY_ENDPOINT")
 	apiPath                = os.Getenv("API_PATH")
 	provisionKey           = os.Getenv("PROVISION_KEY")
+	userStorePath          = os.Getenv("USER_STORE_PATH")
+	publicURL              = envOrDefault("PUBLIC_URL", "http://localhost:8080")
 	cookieNameForSessionID = "kongOAuthConsentApp"
 	sess                   = sessions.New(sessions.Config{Cookie: cookieNameForSessionID})
 	userAgent              = "kong-oauth2-consent-app"
@@ -38,20 +45,92 @@ var (
 
 // Credentials represents a set of user credentials for the consent application
 type Credentials struct {
-	Username string
-	Password string
+	Username   string
+	Password   string
+	Email      string
+	RememberMe bool
 }
 
+// The response types of the consent request: an authorization code, or an access token issued directly to the
+// browser with the implicit grant
+const (
+	responseTypeCode  = "code"
+	responseTypeToken = "token"
+)
+
 // ConsentRequest represents a request for user consent made by the client application
 type ConsentRequest struct {
 	ClientID     string
 	ResponseType string
 	Scopes       string
+	RedirectURI  string
+
+	// State is the client's opaque value, returned to it unchanged on the redirect as RFC 6749 requires
+	State string
+
+	// CodeChallenge and CodeChallengeMethod are forwarded to Kong for public clients using PKCE
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// Nonce is the OpenID Connect client's value, included unchanged in the ID token to bind it to the client's session
+	Nonce string
+
+	// LoginHint is the username or email address the client expects the user to log in with, if it knows it
+	LoginHint string
+
+	// ResponseMode is how the authorization response is returned to the client, such as form_post
+	ResponseMode string
+
+	// AuthorizationDetails are the client's RFC 9396 authorization details as JSON, such as a payment to approve
+	AuthorizationDetails string
+
+	// Resources are the space separated RFC 8707 resource indicators of the APIs the token is for
+	Resources string
+}
+
+// consentActionDeny is the value of the consent form's Action button that denies the request
+const consentActionDeny = "deny"
+
+// implicit reports whether the request is for the implicit grant, which returns the access token in the redirect
+// URI's fragment rather than an authorization code in its query
+func (c ConsentRequest) implicit() bool {
+	return c.ResponseType == responseTypeToken
+}
+
+// fragment reports whether the authorization response is returned in the redirect URI's fragment: for the implicit
+// grant, unless form_post is asked for, and for authorization codes with response_mode=fragment
+func (c ConsentRequest) fragment() bool {
+	mode := c.responseMode()
+	return mode == responseModeFragment || (c.implicit() && mode != responseModeFormPost)
+}
+
+// responseMode returns the response mode the authorization response is returned with, which for JARM response
+// modes is where the signed JWT is returned
+func (c ConsentRequest) responseMode() string {
+	if c.ResponseMode == responseModeJWT {
+		if c.implicit() {
+			return responseModeFragment
+		}
+		return responseModeQuery
+	}
+	if mode, ok := jwtResponseModes[c.ResponseMode]; ok {
+		return mode
+	}
+	return c.ResponseMode
+}
+
+// jwtResponse reports whether the authorization response is returned as a signed JWT, as JARM describes
+func (c ConsentRequest) jwtResponse() bool {
+	_, ok := jwtResponseModes[c.ResponseMode]
+	return ok || c.ResponseMode == responseModeJWT
 }
 
 // OAuth2Credential is a partial representation of Kong's OAuth 2.0 credential resource
 type OAuth2Credential struct {
-	ApplicationName string `json:"name"`
+	ID              string   `json:"id"`
+	ClientID        string   `json:"client_id"`
+	ApplicationName string   `json:"name"`
+	RedirectURIs    []string `json:"redirect_uris"`
 }
 
 // OAuth2Credentials is a partial representation of Kong's OAuth 2.0 credentials resource
@@ -61,104 +140,524 @@ type OAuth2Credentials struct {
 
 // AuthorizeResponse is a partial representation of the response from Kong's '/oauth2/authorize' endpoint
 type AuthorizeResponse struct {
-	RedirectURI string `json:"redirect_uri"`
+	RedirectURI      string `json:"redirect_uri"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 // main is the entrypoint for the consent application
 func main() {
+	if runningAsService() {
+		if err := startService(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := checkPasswordHashAlgorithm(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkFIPSMode(); err != nil {
+		log.Fatal(err)
+	}
+
+	// 'grafana-dashboard' prints a Grafana dashboard of the metrics exposed on '/metrics' instead of serving requests
+	if len(os.Args) > 1 && os.Args[1] == "grafana-dashboard" {
+		if err := writeGrafanaDashboard(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		if err := writePasswordHash(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// 'service' installs, uninstalls or reloads the configuration of the Windows service
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runServiceCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// For testing purposes only TLS certificate verification is disabled
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
+	// Send requests to Kong and other services through the configured outbound proxy, if any
+	proxy, err := outboundProxy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.DefaultTransport.(*http.Transport).Proxy = proxy
+
+	// Optionally resolve Kong's endpoints with static mappings, a DNS cache or a custom DNS server
+	if dialer := newCachingDialer(); dialer != nil {
+		http.DefaultTransport.(*http.Transport).DialContext = dialer.DialContext
+	}
+
+	// Store sessions, and the failed login counters, in a shared database when running several replicas
+	if err := loadSessionStore(); err != nil {
+		log.Fatal(err)
+	}
+	if sessionDB != nil {
+		sessionDB = timedSessionDatabase{sessionDB}
+		sess.UseDatabase(sessionDB)
+	}
+	loginAttempts = newLoginAttemptStore(sharedStore)
+
+	// Open the user store, which is held in memory for the demo unless a path is configured
+	store, err := openUserStore(userStorePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	users = timedUserStore{store}
+
+	// Open the client registry holding client branding and owners
+	registry, err := openClientStore(clientRegistryPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clients = registry
+
+	// Parse the templates of the emails sent to users
+	if err := loadEmailTemplates(emailTemplatesDir); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the rules that change the consent page's copy for combinations of scopes
+	rules, err := loadConsentCopyRules(consentCopyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	consentCopyRules = rules
+
+	// Load the policies limiting when, and from where, scopes may be granted
+	policies, err := loadConsentPolicies(consentPoliciesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	consentPolicies = policies
+
+	// Open the store of API activity received from Kong's HTTP Log plugin
+	activityStore, err := openActivityStore(httpLogPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	activities = activityStore
+
+	// Open the announcements shown on the login and consent pages
+	announcementStore, err := openAnnouncementStore(announcementsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	announcements = announcementStore
+
+	// Verify, compact or repair the stores instead of serving requests
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		remaining, err := runStoreCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if remaining > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := loadBreakGlassPasswordHash(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadKerberosKeytab(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkAuthWebhookURL(); err != nil {
+		log.Fatal(err)
+	}
+	if err := trustCACert(vaultClient, vaultCACert); err != nil {
+		log.Fatal(err)
+	}
+	if err := trustCACert(oidcClient, oidcCACert); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPasswordAuthenticator(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkNotificationRoutes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkAttributeSource(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadProviderSigningKey(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadIPReputationProvider(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSecurityTxt(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRemoteConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRegions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startDeliveries(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Populate the stores with users, clients, grants and events that are the same on every run, for demos
+	if seedDemoDataRequested() {
+		if err := seedDemoData(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Optionally prime the caches before accepting requests
+	if cacheWarmup {
+		warmCaches()
+	}
+
+	// Purge revoked grants once they can no longer be restored
+	go runGrantPurge()
+
+	// Email the compliance report to administrators, if it is scheduled
+	go runComplianceReports()
+
+	// Remove the refresh tokens of codes exchanged at Kong directly without offline access
+	go runOfflineAccessSweep()
+
+	app := newApp()
+
+	listener, err := listen(listenAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	control := newServerControl()
+	if runningAsService() {
+		if err := runService(app, listener, control); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Application started. Press CTRL+C to shut down, or send SIGHUP to reload the configuration.
+	notifySignals(control)
+	if err := serve(app, listener, control); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp creates the consent application with its views and routes registered
+func newApp() *iris.Application {
 	app := iris.New()
 
-	// Register html templates for views
-	app.RegisterView(iris.HTML("./templates", ".html"))
+	// Register html templates for views, timing how long each takes to render
+	app.RegisterView(timedViewEngine{iris.HTML("./templates", ".html")})
+
+	// Load translations of user-facing messages, chosen by the user's profile or the Accept-Language header
+	if err := app.I18n.Load("./locales/*/*.yml", supportedLanguages...); err != nil {
+		log.Fatal(err)
+	}
+	app.I18n.SetDefault(supportedLanguages[0])
+	app.I18n.ExtractFunc = requestLanguage
+	translations = app.I18n
+
+	// Serve static assets used by the views
+	app.HandleDir("/static", "./static")
+
+	// Give each request a correlation ID
+	app.Use(assignRequestID)
+
+	// Watermark every page outside production with the environment's label
+	app.Use(addEnvironment)
+
+	// Keep sessions in encrypted cookies, so that any region can serve them, when SESSION_STORE=cookie
+	app.Use(cookieSessions)
+
+	// Render the error page, or problem details, for handlers that fail
+	app.Use(renderErrors)
+
+	// End sessions that were invalidated after they were established
+	app.Use(revokeStaleSessions)
+
+	// Sign returning users back in with their remember-me token
+	app.Use(restoreRememberedSession)
+
+	// Audit and restrict sessions in which an administrator is impersonating a user
+	app.Use(guardImpersonation)
+
+	// Limit sessions of the emergency administrator account to the administrative pages
+	app.Use(restrictBreakGlass)
+
+	// Show the current announcements on the pages that include the banner
+	app.Use(addAnnouncements)
 
 	// Register routes
 	app.Get("/", getIndex)
-	app.Get("/consent", getConsent)
-	app.Post("/consent", postConsent)
-	app.Get("/login", getLogin)
-	app.Post("/login", postLogin)
+	app.Get("/consent", readFromPrimaryRegion, trackSLI(consentRenderSLI), checkIPReputation, getConsent)
+	app.Post("/consent", pinToPrimaryRegion, trackSLI(consentAuthorizationSLI), checkIPReputation, postConsent)
+	app.Get(consentLinkPath, checkIPReputation, getConsentLink)
+	app.Get("/login", checkIPReputation, getLogin)
+	app.Post("/login", checkIPReputation, postLogin)
+	app.Get("/login/magic", getLoginMagic)
+	app.Get("/login/oidc", getLoginOIDC)
+	app.Get(oidcCallbackPath, getLoginOIDCCallback)
+	app.Get("/register", getRegister)
+	app.Post("/register", postRegister)
+	app.Get("/forgot-password", getForgotPassword)
+	app.Post("/forgot-password", postForgotPassword)
+	app.Get("/reset-password", getResetPassword)
+	app.Post("/reset-password", postResetPassword)
+	app.Get("/login/break-glass", getLoginBreakGlass)
+	app.Post("/login/break-glass", postLoginBreakGlass)
+	app.Get("/login/badge", getLoginBadge)
+	app.Post("/login/badge", checkIPReputation, postLoginBadge)
+	app.Get("/login/sms", getLoginSMS)
+	app.Post("/login/sms", checkIPReputation, postLoginSMS)
+	app.Get("/login/sms/verify", getLoginSMSVerify)
+	app.Post("/login/sms/verify", postLoginSMSVerify)
+	app.Get("/login/totp", getLoginTOTP)
+	app.Post("/login/totp", postLoginTOTP)
+	app.Get("/verify-email", getVerifyEmail)
+	app.Get("/account/email", getAccountEmail)
+	app.Post("/account/email", postAccountEmail)
+	app.Get("/account/password", getAccountPassword)
+	app.Post("/account/password", postAccountPassword)
+	app.Get("/account/badge", getAccountBadge)
+	app.Post("/account/badge", postAccountBadge)
+	app.Get("/account/apps", readFromPrimaryRegion, getAccountApps)
+	app.Get("/account/app", readFromPrimaryRegion, getAccountApp)
+	app.Post("/account/app/revoke", pinToPrimaryRegion, postAccountAppRevoke)
+	app.Post("/account/app/restore", pinToPrimaryRegion, postAccountAppRestore)
+	app.Get("/account/tokens", getAccountTokens)
+	app.Post("/account/tokens/revoke", postAccountTokenRevoke)
+	app.Get("/account/language", getAccountLanguage)
+	app.Post("/account/language", postAccountLanguage)
+	app.Get("/account/remember", getAccountRemember)
+	app.Post("/account/remember", postAccountRemember)
+	app.Get("/account/totp", getAccountTOTP)
+	app.Post("/account/totp", postAccountTOTP)
+	app.Get("/login/webauthn", getLoginWebAuthn)
+	app.Get("/account/webauthn", getAccountWebAuthn)
+	app.Post("/webauthn/register/begin", postWebAuthnRegisterBegin)
+	app.Post("/webauthn/register/finish", postWebAuthnRegisterFinish)
+	app.Post("/webauthn/login/begin", postWebAuthnLoginBegin)
+	app.Post("/webauthn/login/finish", postWebAuthnLoginFinish)
+	app.Get("/login/webauthn/complete", getWebAuthnLoginComplete)
+	app.Get("/admin/impersonate", getAdminImpersonate)
+	app.Post("/admin/impersonate", postAdminImpersonate)
+	app.Post("/admin/impersonate/stop", postAdminImpersonateStop)
+	app.Get("/admin/emails", getAdminEmails)
+	app.Get("/admin/users/migrate", getAdminMigrateUser)
+	app.Post("/admin/users/migrate", postAdminMigrateUser)
+	app.Get("/admin/reports/compliance", getAdminComplianceReport)
+	app.Get("/admin/activity", getAdminActivity)
+	app.Get("/admin/announcements", getAdminAnnouncements)
+	app.Post("/admin/announcements", postAdminAnnouncements)
+	app.Post("/admin/announcements/delete", postAdminAnnouncementDelete)
+	app.Get(auditStreamPath, getAuditStream)
+	app.Get("/playground", getPlayground)
+	app.Post("/playground", postPlayground)
+	app.Post("/playground/exchange", postPlaygroundExchange)
+	app.Get("/developer", getDeveloper)
+	app.Get("/developer/preview", getDeveloperPreview)
+	app.Get("/developer/webhook", getDeveloperWebhook)
+	app.Post("/developer/webhook", postDeveloperWebhook)
 	app.Get("/logout", getLogout)
+	app.Get("/metrics", getMetrics)
+	app.Get("/version", getVersion)
+	app.Get(discoveryPath, getDiscovery)
+	app.Get(jwksPath, getJWKS)
+	app.Get(changePasswordPath, getChangePassword)
+	app.Get(securityTxtPath, getSecurityTxt)
+	app.Get(userinfoPath, getUserinfo)
+	app.Post(tokenPath, postToken)
+	app.Post("/kong/http-log", postKongHTTPLog)
+	app.Post(consentLinksPath, postConsentLink)
+	app.Post(consentCheckPath, postConsentCheck)
+	app.Post(introspectionPath, postIntrospect)
+	app.Post(revocationPath, postRevoke)
+	app.Post(registrationPath, postRegisterClient)
+	app.Get(scimUsersPath, requireSCIMToken, getSCIMUsers)
+	app.Post(scimUsersPath, requireSCIMToken, postSCIMUser)
+	app.Get(scimUsersPath+"/{id}", requireSCIMToken, getSCIMUser)
+	app.Put(scimUsersPath+"/{id}", requireSCIMToken, putSCIMUser)
+	app.Patch(scimUsersPath+"/{id}", requireSCIMToken, patchSCIMUser)
+	app.Delete(scimUsersPath+"/{id}", requireSCIMToken, deleteSCIMUser)
 
-	// Now listening on: http://localhost:8080
-	// Application started. Press CTRL+C to shut down.
-	app.Run(iris.Addr("localhost:8080"))
+	return app
 }
 
 // executeRequest executes an HTTP request and returns the response body
+//
+// Requests and responses are logged, with secrets redacted, when the request's context is from kongContext and
+// Kong logging is turned on.
 func executeRequest(req *http.Request) ([]byte, error) {
+	_, body, err := executeRequestStatus(req)
+	return body, err
+}
+
+// executeRequestStatus executes an HTTP request like executeRequest, also returning the response status code
+func executeRequestStatus(req *http.Request) (int, []byte, error) {
 	req.Header.Set("User-Agent", userAgent)
+	logKongRequest(req)
+	adminUsage.record(req)
 
 	httpClient := http.Client{
 		Timeout: time.Second * 2,
 	}
 
+	start := time.Now()
 	res, getErr := httpClient.Do(req)
 	if getErr != nil {
-		return nil, getErr
+		countKongRequest(req, time.Since(start), true)
+		return 0, nil, getErr
 	}
 
 	defer res.Body.Close()
 	body, readErr := ioutil.ReadAll(res.Body)
+	countKongRequest(req, time.Since(start), readErr != nil || res.StatusCode >= 500)
 	if readErr != nil {
-		return nil, readErr
+		return 0, nil, readErr
 	}
+	logKongResponse(req, res, body)
 
-	return body, nil
+	if res.StatusCode >= 500 {
+		return res.StatusCode, nil, errors.New(req.URL.Host + " responded " + res.Status)
+	}
+
+	return res.StatusCode, body, nil
 }
 
 // getApplicationName queries the OAuth 2.0 credentials on Kong to fetch the application name
-func getApplicationName(clientID string) (string, error) {
-	url := kongAdminEndpoint + "/oauth2?client_id=" + clientID
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func getApplicationName(ctx context.Context, clientID string) (string, error) {
+	credential, err := getOAuth2Credential(ctx, clientID)
 	if err != nil {
 		return "", err
 	}
+	return credential.ApplicationName, nil
+}
+
+// getOAuth2Credential queries the OAuth 2.0 credentials on Kong to fetch the client's registration
+//
+// Credentials are held in the client metadata cache to avoid an Admin API call on every consent request.
+func getOAuth2Credential(ctx context.Context, clientID string) (*OAuth2Credential, error) {
+	if credential, ok := clientCache.Get(clientID); ok {
+		return credential.(*OAuth2Credential), nil
+	}
+
+	endpoint := kongAdminEndpoint + "/oauth2?client_id=" + url.QueryEscape(clientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	body, exErr := executeRequest(req)
 	if exErr != nil {
-		return "", exErr
+		return nil, wrapError(ErrKongUnavailable, "fetching OAuth 2.0 credentials", exErr)
+	}
+
+	credential, err := decodeOAuth2Credential(body, clientID)
+	if err != nil {
+		return nil, err
+	}
+	size := len(clientID) + len(credential.ApplicationName)
+	for _, uri := range credential.RedirectURIs {
+		size += len(uri)
 	}
+	clientCache.Set(clientID, credential, int64(size))
 
+	return credential, nil
+}
+
+// decodeOAuth2Credential returns the client's registration from a response from Kong's '/oauth2' endpoint
+//
+// Only a credential with the client ID asked for is returned, so that a client ID Kong does not filter on as
+// expected cannot select another client's registration.
+func decodeOAuth2Credential(body []byte, clientID string) (*OAuth2Credential, error) {
 	creds := OAuth2Credentials{}
 	jsonErr := json.Unmarshal(body, &creds)
 	if jsonErr != nil {
-		return "", jsonErr
+		return nil, wrapError(ErrKongUnavailable, "reading OAuth 2.0 credentials", jsonErr)
 	}
-
-	return creds.Data[0].ApplicationName, nil
+	for i := range creds.Data {
+		if creds.Data[i].ClientID == clientID {
+			return &creds.Data[i], nil
+		}
+	}
+	return nil, wrapError(ErrUnknownClient, "client_id "+clientID, ErrClientNotFound)
 }
 
 // getRedirectURI queries Kong's '/oauth2/authorize' endpoint and returns the 'redirect_uri' property
-func getRedirectURI(consent ConsentRequest) (string, error) {
+//
+// The user is identified to Kong by authenticatedUserID, which resource servers receive as X-Authenticated-Userid.
+func getRedirectURI(ctx context.Context, consent ConsentRequest, authenticatedUserID string, attributes map[string]string) (string, error) {
 	authPath := kongProxyEndpoint + apiPath + "/oauth2/authorize"
 
 	data := url.Values{}
 	data.Set("client_id", consent.ClientID)
 	data.Add("response_type", consent.ResponseType)
 	data.Add("scope", strings.Replace(consent.Scopes, ",", " ", -1))
+	if consent.RedirectURI != "" {
+		data.Add("redirect_uri", consent.RedirectURI)
+	}
+	if consent.State != "" {
+		data.Add("state", consent.State)
+	}
+	// PKCE only protects the exchange of an authorization code
+	if consent.CodeChallenge != "" && !consent.implicit() {
+		data.Add("code_challenge", consent.CodeChallenge)
+		data.Add("code_challenge_method", consent.CodeChallengeMethod)
+	}
+	// Kong's OAuth 2.0 plugin ignores resource indicators, but plugins on the authorize route can restrict the
+	// token's audience with them
+	for _, resource := range splitResources(consent.Resources) {
+		data.Add("resource", resource)
+	}
 	data.Add("provision_key", provisionKey)
-	// This should be the ID that you use to identify the client in your system
-	data.Add("authenticated_userid", "client-userid")
+	data.Add("authenticated_userid", authenticatedUserID)
 
-	req, err := http.NewRequest(http.MethodPost, authPath, bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, authPath, bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		return "", err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	for name, values := range authorizeAttributeHeaders(attributes) {
+		req.Header[name] = values
+	}
 	body, exErr := executeRequest(req)
 	if exErr != nil {
-		return "", exErr
+		return "", wrapError(ErrKongUnavailable, "requesting authorization", exErr)
 	}
+	return decodeAuthorizeResponse(body)
+}
 
+// decodeAuthorizeResponse returns the redirect URI of a response from Kong's '/oauth2/authorize' endpoint, or the
+// error Kong refused the request with as a KongError
+func decodeAuthorizeResponse(body []byte) (string, error) {
 	response := AuthorizeResponse{}
 	jsonErr := json.Unmarshal(body, &response)
 	if jsonErr != nil {
-		return "", jsonErr
+		return "", wrapError(ErrKongUnavailable, "reading authorization response", jsonErr)
+	}
+
+	// Kong responds without a redirect URI when the error cannot be returned to the client,
+	// for example when the provision key is invalid
+	if response.RedirectURI == "" && response.Error != "" {
+		return "", &KongError{Code: response.Error, Description: response.ErrorDescription}
+	}
+	// Otherwise it responds 400 with the error in the redirect URI, to be returned to the client
+	code, description := response.Error, response.ErrorDescription
+	if code == "" {
+		code, description = redirectError(response.RedirectURI)
+	}
+	if code != "" {
+		return "", &KongError{Code: code, Description: description, RedirectURI: response.RedirectURI}
 	}
 
 	return response.RedirectURI, nil
@@ -169,47 +668,271 @@ func getIndex(ctx iris.Context) {
 	// To begin the OAuth 2.0 Authorization Code Grant flow the client application should redirect the user to
 	// the consent endpoint, passing client_id, response_type and scope parameters.
 	// For demonstration purposes we construct this URI and display it on the home page.
-	consentURI := "/consent?client_id=" + demoClientID + "&response_type=code&scopes=email%2Cphone%2Caddress"
+	// The requested scopes are those configured on Kong's OAuth 2.0 plugins when they can be fetched.
+	scopes := "email,phone,address"
+	if catalog, err := getScopeCatalog(kongContext(ctx)); err == nil && len(catalog) > 0 {
+		scopes = strings.Join(catalog, ",")
+	}
+	consentURI := "/consent?client_id=" + demoClientID + "&response_type=code&scopes=" + url.QueryEscape(scopes)
 	ctx.ViewData("consentURI", consentURI)
+	ctx.ViewData("Playground", len(playgroundPaths) > 0)
 	ctx.View("index.html")
 }
 
+// parseConsentRequest reads a consent request from the query parameters of the consent endpoint
+//
+// Scopes are sent comma separated as 'scopes', or space separated as 'scope' by OpenID Connect clients configured
+// from the discovery document.
+func parseConsentRequest(query url.Values) ConsentRequest {
+	scopes := query.Get("scopes")
+	if scopes == "" {
+		scopes = query.Get("scope")
+	}
+	// A login_hint too long to be a username or email address is ignored, as hints are optional
+	loginHint := query.Get("login_hint")
+	if len(loginHint) > maxLoginHintLength {
+		loginHint = ""
+	}
+	return ConsentRequest{
+		ClientID:     query.Get("client_id"),
+		ResponseType: query.Get("response_type"),
+		Scopes:       strings.Join(splitScopes(scopes), ","),
+		RedirectURI:  query.Get("redirect_uri"),
+		State:        query.Get("state"),
+
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+
+		Nonce: query.Get("nonce"),
+
+		LoginHint:    loginHint,
+		ResponseMode: query.Get("response_mode"),
+
+		AuthorizationDetails: query.Get("authorization_details"),
+		Resources:            joinResources(query["resource"]),
+	}
+}
+
 // getConsent returns the consent view on a GET request
 //
 // If the user is not authenticated they will be redirected to the login page.
-// If the user is authenticated they will be asked to authorize the client application.
+// If the user is authenticated they will be asked to authorize the client application. The consent page is shown
+// even when the user has already granted the scopes, as prompt=consent asks, unless the client sends prompt=none.
 func getConsent(ctx iris.Context) {
-	var (
-		clientID     = ctx.URLParam("client_id")
-		responseType = ctx.URLParam("response_type")
-		scopes       = ctx.URLParam("scopes")
-	)
+	// Clients may send the request as a signed request object, whose parameters are used instead of the query's
+	query, err := requestObjectParams(kongContext(ctx), ctx.Request().URL.Query())
+	if errors.Is(err, errInvalidRequestObject) {
+		log.Printf("consent: %v", err)
+		viewError(ctx, iris.StatusBadRequest, "RequestObjectInvalid")
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	consent := parseConsentRequest(query)
+	if !validCodeChallenge(consent) {
+		viewError(ctx, iris.StatusBadRequest, "CodeChallengeInvalid")
+		return
+	}
+	if len(consent.Nonce) > maxNonceLength {
+		viewError(ctx, iris.StatusBadRequest, "NonceInvalid")
+		return
+	}
+	nonceReused, err := nonceUsed(consent)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if nonceReused {
+		viewError(ctx, iris.StatusBadRequest, "NonceReused")
+		return
+	}
+	if !validResponseMode(consent) {
+		viewError(ctx, iris.StatusBadRequest, "ResponseModeInvalid")
+		return
+	}
+	if len(consent.AuthorizationDetails) > maxAuthorizationDetailsLength {
+		viewError(ctx, iris.StatusBadRequest, "AuthorizationDetailsInvalid")
+		return
+	}
+	if !validResources(consent) {
+		viewError(ctx, iris.StatusBadRequest, "ResourceInvalid")
+		return
+	}
+	prompt, ok := parsePrompt(query.Get("prompt"))
+	if !ok {
+		viewError(ctx, iris.StatusBadRequest, "PromptInvalid")
+		return
+	}
+
+	// Refuse redirect URIs that are not registered for the client before the user is asked to log in
+	if requireRegisteredRedirectURI(ctx, consent) {
+		return
+	}
+	if requireRegisteredResponseType(ctx, consent) {
+		return
+	}
 
 	session := sess.Start(ctx)
 
+	// In kiosk mode a login is only good for consent given shortly after it
+	if kioskMode && kioskSessionExpired(session) {
+		session.Clear()
+	}
+
+	// Sessions that have repeatedly approved and denied requests may have to wait before asking again
+	if requireConsentCooldown(ctx) {
+		return
+	}
+
+	// With prompt=none the client is answered without the user being shown any page
+	if containsString(prompt, promptNone) {
+		authorizeSilently(ctx, consent, query.Get("max_age"))
+		return
+	}
+
 	// If the user is not authenticated redirect to the login page
 	if auth, _ := session.GetBoolean("authenticated"); !auth {
-		session.Set("clientID", clientID)
-		session.Set("responseType", responseType)
-		session.Set("scopes", scopes)
+		setPendingConsent(session, consent)
 		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
 		return
 	}
 
-	// Retrieve the name of the client application registered with Kong
-	applicationName, err := getApplicationName(clientID)
+	// Optionally refuse consent until the user has verified their email address
+	if requireEmailVerification(ctx) {
+		return
+	}
+
+	// Users whose password has expired must choose a new one first
+	if requirePasswordChange(ctx, consent) {
+		return
+	}
+
+	// The client may name the account it expects with login_hint, which the user is asked to log in with
+	if requireHintedAccount(ctx, consent) {
+		return
+	}
+
+	// Consent links are for the user they were minted for only
+	if requireConsentLinkUser(ctx, consent) {
+		return
+	}
+
+	// The client may ask for the user to log in again with prompt=login, or within max_age seconds
+	if containsString(prompt, promptLogin) && requireLogin(ctx, consent) {
+		return
+	}
+	if requireFreshLogin(ctx, consent, query.Get("max_age")) {
+		return
+	}
+
+	// Sensitive scopes require a recent login, or a recently verified second factor
+	if requireStepUp(ctx, consent, splitScopes(consent.Scopes)) {
+		return
+	}
+
+	viewConsent(ctx, consent, false)
+}
+
+// viewConsent renders the consent view for a consent request
+//
+// In preview mode the view is shown to client developers as their users would see it, but cannot be submitted.
+func viewConsent(ctx iris.Context, consent ConsentRequest, preview bool) {
+	// Retrieve the client application registered with Kong
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
 	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
-		ctx.WriteString(err.Error())
+		ctx.SetErr(err)
+		return
+	}
+
+	// Refuse redirect URIs that are not registered before the user is asked for consent
+	if !consentRedirectURIAllowed(credential, consent.RedirectURI, preview) {
+		viewError(ctx, iris.StatusBadRequest, "RedirectURIInvalid")
+		return
+	}
+
+	// Refuse scopes that are not configured on Kong before the user is asked for consent
+	requestedScopes := splitScopes(consent.Scopes)
+	if err := checkScopes(kongContext(ctx), requestedScopes); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Refuse, or drop, scopes the client is not registered to request
+	if requestedScopes, err = checkClientScopes(consent.ClientID, requestedScopes); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	consent.Scopes = strings.Join(requestedScopes, ",")
+
+	// Hide, or refuse, scopes the user's roles do not entitle them to grant. Previews show every scope.
+	if !preview {
+		var ok bool
+		if requestedScopes, ok = restrictScopes(ctx, requestedScopes); !ok {
+			return
+		}
+		consent.Scopes = strings.Join(requestedScopes, ",")
+
+		// Refuse scopes consent policies do not allow from the user's network at this time
+		if requireConsentPolicies(ctx, consent, requestedScopes) {
+			return
+		}
+	}
+
+	// Retrieve the client's branding from the client registry
+	branding, err := getClientSettings(consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Authorization details are shown for approval as the client's templates describe them
+	details, done := requireAuthorizationDetails(ctx, consent, branding)
+	if done {
 		return
 	}
 
 	// Return the consent view
-	ctx.ViewData("ApplicationName", applicationName)
-	ctx.ViewData("ClientID", clientID)
-	ctx.ViewData("ResponseType", responseType)
-	ctx.ViewData("Scopes", scopes)
-	ctx.ViewData("RequestedScopes", strings.Split(scopes, ","))
+	ctx.ViewData("ApplicationName", credential.ApplicationName)
+	ctx.ViewData("ClientID", consent.ClientID)
+	ctx.ViewData("ResponseType", consent.ResponseType)
+	ctx.ViewData("Scopes", consent.Scopes)
+	ctx.ViewData("RedirectURI", consent.RedirectURI)
+	ctx.ViewData("State", consent.State)
+	ctx.ViewData("ImplicitGrant", consent.implicit())
+	ctx.ViewData("CodeChallenge", consent.CodeChallenge)
+	ctx.ViewData("CodeChallengeMethod", consent.CodeChallengeMethod)
+	ctx.ViewData("Nonce", consent.Nonce)
+	ctx.ViewData("ResponseMode", consent.ResponseMode)
+	ctx.ViewData("AuthorizationDetails", consent.AuthorizationDetails)
+	ctx.ViewData("Resources", consent.Resources)
+	// Offline access is approved with its own checkbox rather than listed with the other scopes
+	listedScopes, offlineAccess := withoutOfflineAccess(requestedScopes)
+	ctx.ViewData("RequestedScopes", describeScopes(ctx, listedScopes))
+	ctx.ViewData("OfflineAccess", offlineAccess && !consent.implicit())
+	ctx.ViewData("RequestedDetails", details)
+	ctx.ViewData("RequestedResources", describeResources(splitResources(consent.Resources)))
+	ctx.ViewData("Branding", branding)
+	ctx.ViewData("Attributes", sessionAttributes(ctx))
+	ctx.ViewData("Preview", preview)
+	ctx.ViewData("ConsentDisabled", preview || (impersonating(ctx) && !impersonationAllowConsent))
+	if kioskMode && !preview {
+		ctx.ViewData("KioskTimeout", int(kioskSessionTimeout.Seconds()))
+	}
+	if !preview {
+		viewCaptcha(ctx, consentCaptchaRequired(ctx))
+		countFlowStep(flowStepConsentForm)
+	}
+
+	// Rules for the requested combination of scopes may change the headline, add warnings or use another template
+	pageCopy := consentCopy(ctx, consent.ClientID, credential.ApplicationName, requestedScopes)
+	ctx.ViewData("Headline", pageCopy.Headline)
+	ctx.ViewData("Warnings", pageCopy.Warnings)
+	if pageCopy.Template != "" {
+		ctx.View(pageCopy.Template)
+		return
+	}
 	ctx.View("consent.html")
 }
 
@@ -220,18 +943,211 @@ func postConsent(ctx iris.Context) {
 	consent := ConsentRequest{}
 	err := ctx.ReadForm(&consent)
 	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
-		ctx.WriteString(err.Error())
+		ctx.SetErr(err)
+		return
+	}
+	if !validCodeChallenge(consent) {
+		viewError(ctx, iris.StatusBadRequest, "CodeChallengeInvalid")
+		return
+	}
+	if !validResponseMode(consent) {
+		viewError(ctx, iris.StatusBadRequest, "ResponseModeInvalid")
+		return
+	}
+	if !validResources(consent) {
+		viewError(ctx, iris.StatusBadRequest, "ResourceInvalid")
+		return
+	}
+	// The form may have been altered since the consent page was shown
+	if requireRegisteredResponseType(ctx, consent) {
 		return
 	}
 
+	// Rapidly repeated approvals and denials require a CAPTCHA, or a cooldown, before the next decision
+	if requireConsentCooldown(ctx) || requireConsentCaptcha(ctx, consent) {
+		return
+	}
+	if requireConsentLinkUser(ctx, consent) {
+		return
+	}
+	recordConsentDecision(ctx, consent.ClientID)
+
+	// Denying the request returns the user to the client without calling Kong
+	if ctx.FormValue("Action") == consentActionDeny {
+		denyConsent(ctx, consent)
+		return
+	}
+
+	// Consent is given by the authenticated user, who is identified to Kong
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		setPendingConsent(session, consent)
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if requireEmailVerification(ctx) {
+		return
+	}
+	if requirePasswordChange(ctx, consent) {
+		return
+	}
+
+	// Administrators impersonating a user may only view the consent page unless IMPERSONATION_ALLOW_CONSENT is set
+	if impersonating(ctx) && !impersonationAllowConsent {
+		viewError(ctx, iris.StatusForbidden, "ImpersonationReadOnly")
+		return
+	}
+
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	registeredURI, ok := matchRedirectURI(credential, consent.RedirectURI)
+	if !ok {
+		viewError(ctx, iris.StatusBadRequest, "RedirectURIInvalid")
+		return
+	}
+	requestedURI := consent.RedirectURI
+	consent.RedirectURI = registeredURI
+
+	// The scopes are checked against the client's registration and the user's roles again, as the form can be altered
+	scopes, err := checkClientScopes(consent.ClientID, splitScopes(consent.Scopes))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	scopes, ok = restrictScopes(ctx, scopes)
+	if !ok {
+		return
+	}
+	scopes = approveOfflineAccess(ctx, consent, scopes)
+	consent.Scopes = strings.Join(scopes, ",")
+	if requireConsentPolicies(ctx, consent, scopes) {
+		return
+	}
+
+	// The login may have become too old for step-up scopes since the consent page was shown
+	if requireStepUp(ctx, consent, scopes) {
+		return
+	}
+
+	// The authorization details are checked against the client's templates again, as the form can be altered
+	client, err := getClientSettings(consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if _, done := requireAuthorizationDetails(ctx, consent, client); done {
+		return
+	}
+
+	authorizeConsent(ctx, consent, user, credential, requestedURI, scopes)
+}
+
+// authorizeConsent requests an authorization code, or an access token, for the scopes the user consented to from
+// Kong and returns the user to the client
+//
+// The consent request's redirect URI is the registered URI it matched, and requestedURI the one the client sent.
+func authorizeConsent(ctx iris.Context, consent ConsentRequest, user *User, credential *OAuth2Credential, requestedURI string,
+	scopes []string) {
+	// A nonce is only good for one ID token, so that a replayed authorization request cannot mint another
+	if containsString(scopes, "openid") && consent.Nonce != "" {
+		fresh, err := useNonce(consent)
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		if !fresh {
+			viewError(ctx, iris.StatusBadRequest, "NonceReused")
+			return
+		}
+	}
+
 	// Call the '/oauth2/authorize' endpoint to request an authorization code. Kong will
 	// respond with either a 200 OK or 400 Bad request response code. In -both- cases,
 	// redirect the user to the URI returned in the redirect_url property.
-	redirectURI, err := getRedirectURI(consent)
+	redirectURI, err := getRedirectURI(kongContext(ctx), consent, authenticatedUserID(user), user.Attributes)
+	firstAuthorization := false
+	if err == nil {
+		countFlowStep(flowStepConsentGranted)
+		fields := map[string]string{"client_id": consent.ClientID, "scopes": consent.Scopes}
+		if consent.AuthorizationDetails != "" {
+			fields["authorization_details"] = consent.AuthorizationDetails
+		}
+		if consent.Resources != "" {
+			fields["resources"] = consent.Resources
+		}
+		audit(ctx, "consent.granted", fields)
+
+		// Remember the grant so that the user can review the app and its activity on their account
+		firstAuthorization = findGrant(user, consent.ClientID) == nil
+		recordGrant(user, consent.ClientID, scopes, time.Now())
+		err = users.Save(user)
+		endConsentLink(sess.Start(ctx), consent.ClientID)
+	}
+
+	// Shared terminals are logged out as soon as consent has been given, whatever the outcome
+	endKioskSession(ctx)
+
+	// Errors Kong can return to the client are sent back to it rather than shown to the user
+	var kongErr *KongError
+	if errors.As(err, &kongErr) && kongErr.RedirectURI != "" {
+		returnAuthorizeError(ctx, consent, requestedURI, credential, kongErr)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Loopback redirect URIs may use a different port to the registered URI sent to Kong
+	if requestedURI != consent.RedirectURI {
+		redirectURI = withRequestedPort(redirectURI, requestedURI)
+	}
+	redirectURI = withState(withResponseMode(redirectURI, consent), consent.State, consent.fragment())
+
+	// Clients asking for the openid scope are also given an ID token for the user
+	if containsString(scopes, "openid") {
+		redirectURI, err = issueIDToken(ctx, consent, user, scopes, redirectURI)
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+	if err := keepAuthorizationDetails(consent, redirectURI); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if err := recordAuthorizationCode(consent, redirectURI, time.Now()); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if redirectURI, err = withJWTResponse(redirectURI, consent); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	client, err := getClientSettings(consent.ClientID)
 	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
-		ctx.WriteString(err.Error())
+		ctx.SetErr(err)
+		return
+	}
+
+	// Tell the client the first time the user authorizes it, so that it can link the user's account
+	if firstAuthorization {
+		notifyFirstAuthorization(client, authenticatedUserID(user), scopes, time.Now())
+	}
+
+	// Custom scheme and app link redirect URIs return the user to a native app via an interstitial page, and
+	// form_post responses are posted to the client by a form
+	if viewClientReturn(ctx, consent, client, credential.ApplicationName, redirectURI) {
 		return
 	}
 
@@ -240,44 +1156,367 @@ func postConsent(ctx iris.Context) {
 	ctx.WriteString("redirect_uri: " + redirectURI)
 }
 
+// returnAuthorizeError redirects the user to the client with an error Kong refused the authorization request with
+//
+// The redirect carries the error and error_description parameters and the client's state, as RFC 6749 describes.
+func returnAuthorizeError(ctx iris.Context, consent ConsentRequest, requestedURI string, credential *OAuth2Credential,
+	kongErr *KongError) {
+	redirectURI := withError(withResponseMode(kongErr.RedirectURI, consent), kongErr.Code, kongErr.Description, consent.State,
+		consent.fragment())
+	if requestedURI != consent.RedirectURI {
+		redirectURI = withRequestedPort(redirectURI, requestedURI)
+	}
+	redirectURI, err := withJWTResponse(redirectURI, consent)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "consent.failed", map[string]string{"client_id": consent.ClientID, "error": kongErr.Code})
+
+	client, err := getClientSettings(consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if viewClientReturn(ctx, consent, client, credential.ApplicationName, redirectURI) {
+		return
+	}
+	ctx.Redirect(redirectURI, iris.StatusSeeOther)
+}
+
+// denyConsent returns the user to the client's redirect URI with an access_denied error and the client's state
+//
+// Kong is not called, as it has no way to deny a request. The redirect URI is still checked against the client's
+// registration so that the form cannot be used to redirect users elsewhere.
+func denyConsent(ctx iris.Context, consent ConsentRequest) {
+	// Administrators impersonating a user may not act for them unless IMPERSONATION_ALLOW_CONSENT is set
+	if impersonating(ctx) && !impersonationAllowConsent {
+		viewError(ctx, iris.StatusForbidden, "ImpersonationReadOnly")
+		return
+	}
+
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	redirectURI, ok := errorRedirectURI(credential, consent, "access_denied")
+	if !ok {
+		viewError(ctx, iris.StatusBadRequest, "RedirectURIInvalid")
+		return
+	}
+	if redirectURI, err = withJWTResponse(redirectURI, consent); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	countFlowStep(flowStepConsentDenied)
+	audit(ctx, "consent.denied", map[string]string{"client_id": consent.ClientID, "scopes": consent.Scopes})
+	endConsentLink(sess.Start(ctx), consent.ClientID)
+	endKioskSession(ctx)
+
+	client, err := getClientSettings(consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if viewClientReturn(ctx, consent, client, credential.ApplicationName, redirectURI) {
+		return
+	}
+
+	// For demonstration purposes the redirect URI is simply output, as it is when consent is given
+	ctx.WriteString("redirect_uri: " + redirectURI)
+}
+
+// errorRedirectURI returns the redirect URI that returns an RFC 6749 error to the client, or false if the request's
+// redirect URI is not registered for the client
+//
+// Errors for a client that does not send a redirect URI are returned to its only registered redirect URI.
+func errorRedirectURI(credential *OAuth2Credential, consent ConsentRequest, code string) (string, bool) {
+	registeredURI, ok := matchRedirectURI(credential, consent.RedirectURI)
+	if !ok {
+		return "", false
+	}
+	redirectURI := consent.RedirectURI
+	if redirectURI == "" {
+		if registeredURI == "" {
+			return "", false
+		}
+		redirectURI = registeredURI
+	}
+	return withError(redirectURI, code, "", consent.State, consent.fragment()), true
+}
+
 // getLogin returns the login view on a GET request
 func getLogin(ctx iris.Context) {
+	if clientCertLogin(ctx) || negotiateLogin(ctx) {
+		return
+	}
+
+	ctx.ViewData("Demo", userStorePath == "")
+	ctx.ViewData("MagicLink", loginMode == loginModeMagicLink)
+	ctx.ViewData("SMSLogin", smsLogin)
+	ctx.ViewData("BadgeLogin", badgeLogin)
+	if oidcIssuer != "" && !kioskMode {
+		ctx.ViewData("OIDC", oidcDisplayName)
+	}
+	ctx.ViewData("RememberMe", !kioskMode)
+	ctx.ViewData("LoginHint", sess.Start(ctx).GetString("loginHint"))
+
+	required, err := loginCaptchaRequired(ctx, ctx.FormValue("Username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	viewCaptcha(ctx, required)
+
+	if sess.Start(ctx).GetBooleanDefault("stepUp", false) {
+		ctx.ViewData("Notice", "The application is asking for sensitive permissions. Please login again to continue.")
+	} else if sess.Start(ctx).GetBooleanDefault("reauthenticate", false) {
+		ctx.ViewData("Notice", "The application is asking you to login again to continue.")
+	}
+
+	countFlowStep(flowStepLoginForm)
 	ctx.View("login.html")
 }
 
 // postLogin handles POST requests to the login endpoint
 //
-// On successful authentication the user is redirected to the consent page
+// On successful authentication the user is redirected to the consent page, or
+// to the security key or TOTP verification page if the user has enabled a second factor.
 func postLogin(ctx iris.Context) {
 	credentials := Credentials{}
 	err := ctx.ReadForm(&credentials)
 	if err != nil {
-		ctx.StatusCode(iris.StatusInternalServerError)
-		ctx.WriteString(err.Error())
+		ctx.SetErr(err)
 		return
 	}
 
-	// *** Authenticate the user here ***
-	// credentials.Username
-	// credentials.Password
+	if loginMode == loginModeMagicLink {
+		postLoginMagicLink(ctx, credentials.Email)
+		return
+	}
+
+	// Refuse attempts while the username or client address is delayed or locked out after failed logins, and
+	// otherwise reserve the attempt until the password has been checked
+	userKey, ipKey := loginAttemptKeys(ctx, credentials.Username)
+	attemptKeys := []loginAttemptKey{{userKey, loginLockoutUser}, {ipKey, loginLockoutIP}}
+	wait, err := reserveLoginAttempt(attemptKeys...)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		ctx.StatusCode(iris.StatusTooManyRequests)
+		ctx.ViewData("Error", "Too many failed login attempts. Please try again in "+strconv.Itoa(seconds)+" seconds.")
+		getLogin(ctx)
+		return
+	}
+	failed := false
+	defer func() {
+		if !failed {
+			releaseLoginAttempt(attemptKeys...)
+		}
+	}()
 
+	// Ask for a CAPTCHA after repeated failures, before the password is checked
+	required, err := loginCaptchaRequired(ctx, credentials.Username)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if required {
+		solved, err := verifyCaptcha(ctx)
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		if !solved {
+			ctx.StatusCode(iris.StatusBadRequest)
+			ctx.ViewData("Error", "Please complete the CAPTCHA.")
+			getLogin(ctx)
+			return
+		}
+	}
+
+	user, err := passwordAuthenticator.Authenticate(credentials, clientIPString(ctx))
+	if err == ErrInvalidCredentials {
+		failed = true
+		if err := failLoginAttempt(attemptKeys...); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "Invalid username or password.")
+		getLogin(ctx)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if err := loginAttempts.Delete(userKey); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Remember the choice to stay signed in until the second factor, if any, has been verified
+	sess.Start(ctx).Set("rememberMe", credentials.RememberMe && !kioskMode)
+
+	if requireSecondFactor(ctx, user) {
+		return
+	}
+
+	completeLogin(ctx, user)
+}
+
+// requireSecondFactor redirects to the second factor verification page if the user has enabled one
+//
+// It returns false if the user has no second factor and the login can be completed.
+func requireSecondFactor(ctx iris.Context, user *User) bool {
+	var verificationURL string
+	switch {
+	case len(user.WebAuthnCredentials) > 0:
+		verificationURL = "/login/webauthn"
+	case user.TOTPEnabled:
+		verificationURL = "/login/totp"
+	default:
+		return false
+	}
+
+	session := sess.Start(ctx)
+	session.Set("pendingUsername", user.Username)
+	ctx.Redirect(verificationURL, iris.StatusSeeOther)
+	return true
+}
+
+// completeLogin marks the session as authenticated and resumes the pending consent request
+func completeLogin(ctx iris.Context, user *User) {
+	if user.Disabled {
+		viewError(ctx, iris.StatusForbidden, "AccountDisabled")
+		return
+	}
+
+	consentURL := establishSession(ctx, user, true)
+
+	// Keep the user signed in on this browser if they asked to be
+	session := sess.Start(ctx)
+	if session.GetBooleanDefault("rememberMe", false) {
+		if err := issueRememberToken(ctx, user, ""); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+	session.Delete("rememberMe")
+
+	// Redirect to the consent page with status code 303 "See Other"
+	ctx.Redirect(consentURL, iris.StatusSeeOther)
+}
+
+// establishSession marks the session as authenticated and returns the URL of the pending consent request
+//
+// verified is false when the session is restored without the user proving who they are, such as from a
+// remember-me cookie, so that it does not count as a recent login for step-up scopes.
+func establishSession(ctx iris.Context, user *User, verified bool) string {
 	session := sess.Start(ctx)
+	now := time.Now().UnixNano()
 
 	// Set user as authenticated
+	session.Delete("pendingUsername")
 	session.Set("authenticated", true)
+	session.Set("username", user.Username)
+	session.Set("authenticatedAt", now)
+	session.Set("language", matchLanguage(user.Language))
+
+	// Record when the user last logged in and verified a second factor, for step-up scopes
+	session.Delete("verifiedAt")
+	session.Delete("secondFactorAt")
+	if verified {
+		session.Set("verifiedAt", now)
+		if session.GetBooleanDefault("secondFactorVerified", false) {
+			session.Set("secondFactorAt", now)
+		}
+	}
+	session.Delete("secondFactorVerified")
+	session.Delete("stepUp")
+	session.Delete("reauthenticate")
+	session.Delete("loginHint")
+	countFlowStep(flowStepAuthenticated)
+
+	// Refresh the user's attributes from the HR system or directory, if one is configured
+	enrichUser(user)
 
+	return pendingConsentURL(session)
+}
+
+// pendingConsentURL returns the URL of the consent request stored in the session
+func pendingConsentURL(session *sessions.Session) string {
 	consentURL := "/consent?client_id=" + session.GetString("clientID") +
 		"&response_type=" + session.GetString("responseType") +
 		"&scopes=" + session.GetString("scopes")
+	if redirectURI := session.GetString("redirectURI"); redirectURI != "" {
+		consentURL += "&redirect_uri=" + url.QueryEscape(redirectURI)
+	}
+	if state := session.GetString("state"); state != "" {
+		consentURL += "&state=" + url.QueryEscape(state)
+	}
+	if codeChallenge := session.GetString("codeChallenge"); codeChallenge != "" {
+		consentURL += "&code_challenge=" + url.QueryEscape(codeChallenge) +
+			"&code_challenge_method=" + url.QueryEscape(session.GetString("codeChallengeMethod"))
+	}
+	if nonce := session.GetString("nonce"); nonce != "" {
+		consentURL += "&nonce=" + url.QueryEscape(nonce)
+	}
+	if responseMode := session.GetString("responseMode"); responseMode != "" {
+		consentURL += "&response_mode=" + url.QueryEscape(responseMode)
+	}
+	if details := session.GetString("authorizationDetails"); details != "" {
+		consentURL += "&authorization_details=" + url.QueryEscape(details)
+	}
+	for _, resource := range splitResources(session.GetString("resources")) {
+		consentURL += "&resource=" + url.QueryEscape(resource)
+	}
+	return consentURL
+}
 
-	// Redirect to the consent page with status code 303 "See Other"
-	ctx.Redirect(consentURL, iris.StatusSeeOther)
+// revokeStaleSessions ends sessions established before the user's sessions were invalidated, for example by a
+// password reset, and sessions of users who were deleted or disabled
+//
+// Sessions of users an administrator has migrated to a new username are moved to it.
+func revokeStaleSessions(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); auth && !session.GetBooleanDefault("breakGlass", false) {
+		user, err := users.Get(session.GetString("username"))
+		if err == ErrUserNotFound && session.GetString("impersonator") == "" {
+			if user, err = findUserByPreviousUsername(session.GetString("username")); err == nil {
+				session.Set("username", user.Username)
+			}
+		}
+		if err == ErrUserNotFound || (err == nil && (user.Disabled || session.GetInt64Default("authenticatedAt", 0) < user.SessionsValidAfter)) {
+			session.Clear()
+			countSessionEnded("revoked")
+		}
+	}
+	ctx.Next()
 }
 
 // getLogout initiates a logout and redirect to the home page on a GET request
 func getLogout(ctx iris.Context) {
+	// Stop keeping the user signed in on this browser
+	if err := revokeRememberToken(ctx); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if impersonating(ctx) {
+		audit(ctx, "impersonation.stop", nil)
+	}
+
 	session := sess.Start(ctx)
 	// Clear the user's session
 	session.Clear()
+	countSessionEnded("logout")
 	ctx.Redirect("/", iris.StatusTemporaryRedirect)
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+)
+
+// requireFreshLogin sends the user back to the login page if they last proved who they are longer ago than the
+// client's max_age, in seconds, and reports whether it has completed the response
+//
+// As with OpenID Connect's max_age, the user's authentication time is when they last logged in by entering their
+// password or by other means; sessions restored from a remember-me cookie always log in again. The consent request
+// is resumed without max_age once they have.
+func requireFreshLogin(ctx iris.Context, consent ConsentRequest, maxAge string) bool {
+	if maxAge == "" || impersonating(ctx) {
+		return false
+	}
+	seconds, ok := parseMaxAge(maxAge)
+	if !ok {
+		viewError(ctx, iris.StatusBadRequest, "MaxAgeInvalid")
+		return true
+	}
+
+	session := sess.Start(ctx)
+	if loginFresh(session, seconds) {
+		return false
+	}
+
+	setPendingConsent(session, consent)
+	audit(ctx, "consent.reauthenticate", map[string]string{"client_id": consent.ClientID, "max_age": maxAge})
+	session.Set("reauthenticate", true)
+	ctx.Redirect("/login", iris.StatusSeeOther)
+	return true
+}
+
+// parseMaxAge returns the number of seconds of a max_age parameter, or false if it is not a valid number of seconds
+func parseMaxAge(maxAge string) (int64, bool) {
+	seconds, err := strconv.ParseInt(maxAge, 10, 64)
+	return seconds, err == nil && seconds >= 0
+}
+
+// loginFresh reports whether the user in the session proved who they are within the given number of seconds
+func loginFresh(session *sessions.Session, seconds int64) bool {
+	verifiedAt := session.GetInt64Default("verifiedAt", 0)
+	return verifiedAt != 0 && time.Since(time.Unix(0, verifiedAt)) <= time.Duration(seconds)*time.Second
+}
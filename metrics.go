@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// metrics is the registry of all metrics exposed by the consent application on '/metrics'
+var metrics = newRegistry(envOrDefault("METRICS_PREFIX", "consent_app"))
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	value uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add adds delta, which may be negative, to the gauge
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, updated) {
+			return
+		}
+	}
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of latency histograms
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Histogram is a metric counting observations, such as latencies, in buckets of cumulative upper bounds
+type Histogram struct {
+	count   uint64
+	sum     Gauge
+	buckets []float64
+	counts  []uint64
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			atomic.AddUint64(&h.counts[i], 1)
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.Add(v)
+}
+
+// ObserveSince adds the seconds elapsed since start to the histogram
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// writeTo writes the histogram's buckets, sum and count as the series of name with the label key/value pairs
+func (h *Histogram) writeTo(w io.Writer, name string, labels []string) (int64, error) {
+	bucket := func(le string) string {
+		return formatLabels(append(append([]string{}, labels...), "le", le))
+	}
+
+	var written int64
+	for i, bound := range h.buckets {
+		n, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucket(fmt.Sprint(bound)), atomic.LoadUint64(&h.counts[i]))
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	count := atomic.LoadUint64(&h.count)
+	n, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %g\n%s_count%s %d\n", name, bucket("+Inf"), count,
+		name, formatLabels(labels), h.sum.Value(), name, formatLabels(labels), count)
+	return written + int64(n), err
+}
+
+// metricSeries is a single time series of a metric family
+type metricSeries struct {
+	value  func() float64
+	metric interface{}
+	labels []string
+}
+
+// metricFamily is a named metric and its series, one for each set of label values
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]metricSeries
+}
+
+// Registry holds metric families and writes them in the Prometheus text exposition format
+type Registry struct {
+	prefix   string
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// newRegistry creates a registry whose metric names are prefixed with prefix
+func newRegistry(prefix string) *Registry {
+	return &Registry{prefix: prefix, families: map[string]*metricFamily{}}
+}
+
+// Counter returns the counter for name and the label key/value pairs, registering it if needed
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	if existing := r.register(name, help, "counter", labels, func() float64 { return float64(c.Value()) }, c); existing != nil {
+		return existing.(*Counter)
+	}
+	return c
+}
+
+// Gauge returns the gauge for name and the label key/value pairs, registering it if needed
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{}
+	if existing := r.register(name, help, "gauge", labels, g.Value, g); existing != nil {
+		return existing.(*Gauge)
+	}
+	return g
+}
+
+// Histogram returns the latency histogram for name and the label key/value pairs, registering it if needed
+func (r *Registry) Histogram(name, help string, labels ...string) *Histogram {
+	h := &Histogram{buckets: latencyBuckets, counts: make([]uint64, len(latencyBuckets))}
+	if existing := r.register(name, help, "histogram", labels, nil, h); existing != nil {
+		return existing.(*Histogram)
+	}
+	return h
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn when metrics are collected
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.register(name, help, "gauge", labels, fn, nil)
+}
+
+// Name returns the full name of the metric name, including the registry's prefix
+func (r *Registry) Name(name string) string {
+	if r.prefix == "" {
+		return name
+	}
+	return r.prefix + "_" + name
+}
+
+// register adds a series to the family name, returning the existing metric if the series is already registered
+func (r *Registry) register(name, help, kind string, labels []string, value func() float64, metric interface{}) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fullName := r.Name(name)
+	family, ok := r.families[fullName]
+	if !ok {
+		family = &metricFamily{name: fullName, help: help, kind: kind, series: map[string]metricSeries{}}
+		r.families[fullName] = family
+	}
+
+	key := formatLabels(labels)
+	if existing, ok := family.series[key]; ok {
+		return existing.metric
+	}
+	family.series[key] = metricSeries{value: value, metric: metric, labels: labels}
+	return nil
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var written int64
+	for _, name := range names {
+		family := r.families[name]
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+			if histogram, ok := series.metric.(*Histogram); ok {
+				n, err := histogram.writeTo(w, family.name, series.labels)
+				written += n
+				if err != nil {
+					return written, err
+				}
+				continue
+			}
+			n, err := fmt.Fprintf(w, "%s%s %g\n", family.name, key, series.value())
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// formatLabels renders label key/value pairs in the exposition format, e.g. {cache="clients"}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, labels[i]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// getMetrics returns all metrics in the Prometheus text exposition format on a GET request
+func getMetrics(ctx iris.Context) {
+	ctx.ContentType("text/plain; version=0.0.4")
+	metrics.WriteTo(ctx.ResponseWriter())
+}
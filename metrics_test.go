@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestHistogramExposition checks that histograms are written with cumulative buckets, a +Inf bucket equal to the
+// count, and their sum, in the Prometheus text exposition format
+func TestHistogramExposition(t *testing.T) {
+	registry := newRegistry("test")
+	h := registry.Histogram("render_seconds", "Time taken to render.", "template", "consent.html")
+	for _, v := range []float64{0.0003, 0.002, 0.002, 0.3, 3} {
+		h.Observe(v)
+	}
+
+	var out bytes.Buffer
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[0] != "# HELP test_render_seconds Time taken to render." || lines[1] != "# TYPE test_render_seconds histogram" {
+		t.Fatalf("unexpected header:\n%s", out.String())
+	}
+
+	want := map[string]string{
+		`test_render_seconds_bucket{template="consent.html",le="0.0005"}`: "1",
+		`test_render_seconds_bucket{template="consent.html",le="0.001"}`:  "1",
+		`test_render_seconds_bucket{template="consent.html",le="0.0025"}`: "3",
+		`test_render_seconds_bucket{template="consent.html",le="0.25"}`:   "3",
+		`test_render_seconds_bucket{template="consent.html",le="0.5"}`:    "4",
+		`test_render_seconds_bucket{template="consent.html",le="2.5"}`:    "4",
+		`test_render_seconds_bucket{template="consent.html",le="+Inf"}`:   "5",
+		`test_render_seconds_sum{template="consent.html"}`:                "3.3043",
+		`test_render_seconds_count{template="consent.html"}`:              "5",
+	}
+	previous := -1
+	buckets := 0
+	for _, line := range lines[2:] {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("malformed sample %q", line)
+		}
+		if value, ok := want[fields[0]]; ok {
+			if fields[1] != value {
+				t.Errorf("%s = %s, want %s", fields[0], fields[1], value)
+			}
+			delete(want, fields[0])
+		}
+		if !strings.Contains(fields[0], "_bucket{") {
+			continue
+		}
+		buckets++
+		count, err := strconv.Atoi(fields[1])
+		if err != nil || count < previous {
+			t.Errorf("bucket %s = %s is not cumulative after %d", fields[0], fields[1], previous)
+		}
+		previous = count
+	}
+	if buckets != len(latencyBuckets)+1 {
+		t.Errorf("%d buckets written, want %d", buckets, len(latencyBuckets)+1)
+	}
+	for sample := range want {
+		t.Errorf("%s was not written", sample)
+	}
+}
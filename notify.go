@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// notifySlackWebhookURL is a Slack incoming webhook that receives admin notifications, if set
+	notifySlackWebhookURL = os.Getenv("NOTIFY_SLACK_WEBHOOK_URL")
+	// notifyWebhookURL receives admin notifications as signed JSON, if set
+	notifyWebhookURL = os.Getenv("NOTIFY_WEBHOOK_URL")
+	// notifyWebhookSecret signs the notifications sent to NOTIFY_WEBHOOK_URL
+	notifyWebhookSecret = os.Getenv("NOTIFY_WEBHOOK_SECRET")
+	// notifyEmailTo are the email addresses that receive admin notifications
+	notifyEmailTo = envList("NOTIFY_EMAIL_TO")
+	// notifyTimeout is how long each channel has to accept a notification
+	notifyTimeout = envDuration("NOTIFY_TIMEOUT", 5*time.Second)
+)
+
+// The events administrators can be notified of
+const (
+	// eventLoginLockout is sent when a username or client address is locked out after repeated failed logins
+	eventLoginLockout = "login.lockout"
+	// eventJobFailed is sent when background work is abandoned, such as a client webhook delivery
+	eventJobFailed = "job.failed"
+	// eventBreakGlassLogin is sent for every attempt to log in to the emergency administrator account
+	eventBreakGlassLogin = "breakglass.login"
+)
+
+// notificationChannels are the configured channels by name
+var notificationChannels = newNotificationChannels()
+
+// notificationRoutes maps events to the names of the channels they are sent to, configured as a comma separated
+// list of event=channel1|channel2 entries. The "*" entry applies to events that are not listed, and without any
+// entries every event is sent to every channel.
+var notificationRoutes = parseNotificationRoutes(envList("NOTIFY_EVENTS"))
+
+// Notification is an alert for administrators
+type Notification struct {
+	Event  string            `json:"event"`
+	Title  string            `json:"title"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Time   string            `json:"time"`
+}
+
+// Text returns the notification as plain text, with its fields in alphabetical order
+func (n Notification) Text() string {
+	lines := []string{n.Title}
+	keys := make([]string, 0, len(n.Fields))
+	for key := range n.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+": "+n.Fields[key])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NotificationChannel delivers notifications to administrators
+type NotificationChannel interface {
+	Notify(n Notification) error
+}
+
+// newNotificationChannels returns the channels that are configured
+func newNotificationChannels() map[string]NotificationChannel {
+	client := newExternalHTTPClient(notifyTimeout)
+	channels := map[string]NotificationChannel{}
+	if len(notifyEmailTo) > 0 {
+		channels["email"] = emailChannel{to: notifyEmailTo}
+	}
+	if notifySlackWebhookURL != "" {
+		channels["slack"] = slackChannel{webhookURL: notifySlackWebhookURL, client: client}
+	}
+	if notifyWebhookURL != "" {
+		channels["webhook"] = webhookChannel{url: notifyWebhookURL, secret: notifyWebhookSecret, client: client}
+	}
+	return channels
+}
+
+// notify queues a notification of an event for the channels routed to it
+//
+// Security alerts are delivered ahead of other notifications. Failed deliveries are logged and counted but not
+// retried, so that a broken channel cannot hold up the delivery queue.
+func notify(event, title string, fields map[string]string) {
+	names, ok := notificationRoutes[event]
+	if !ok {
+		names, ok = notificationRoutes["*"]
+	}
+	if !ok && len(notificationRoutes) == 0 {
+		for name := range notificationChannels {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	priority := priorityNormal
+	if event == eventLoginLockout || event == eventBreakGlassLogin {
+		priority = priorityUrgent
+	}
+	n := Notification{Event: event, Title: title, Fields: fields, Time: time.Now().UTC().Format(time.RFC3339)}
+	for _, name := range names {
+		if _, ok := notificationChannels[name]; !ok {
+			continue
+		}
+		if err := enqueue(deliveryNotification, priority, notificationDelivery{Channel: name, Notification: n}); err != nil {
+			log.Printf("notification of %s to %s: %v", event, name, err)
+		}
+	}
+}
+
+// notificationDelivery is a notification queued for one channel
+type notificationDelivery struct {
+	Channel      string       `json:"channel"`
+	Notification Notification `json:"notification"`
+}
+
+// deliverNotification sends a queued notification to its channel
+func deliverNotification(payload json.RawMessage) error {
+	delivery := notificationDelivery{}
+	if err := json.Unmarshal(payload, &delivery); err != nil {
+		return err
+	}
+	channel, ok := notificationChannels[delivery.Channel]
+	if !ok {
+		return errors.New("notification channel " + delivery.Channel + " is not configured")
+	}
+	err := channel.Notify(delivery.Notification)
+	metrics.Counter("notifications_total", "Number of admin notifications sent, by channel and outcome.",
+		"channel", delivery.Channel, "outcome", deliveryOutcome(err)).Inc()
+	if err != nil {
+		return fmt.Errorf("notification of %s to %s: %w", delivery.Notification.Event, delivery.Channel, err)
+	}
+	return nil
+}
+
+// emailChannel emails notifications with the application's mailer
+type emailChannel struct {
+	to []string
+}
+
+// Notify emails the notification to each address
+func (c emailChannel) Notify(n Notification) error {
+	for _, to := range c.to {
+		if err := mailer.Send(Message{To: to, Subject: n.Title, Text: n.Text()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slackChannel posts notifications to a Slack incoming webhook
+type slackChannel struct {
+	webhookURL string
+	client     *http.Client
+}
+
+// Notify posts the notification's text as a Slack message
+func (c slackChannel) Notify(n Notification) error {
+	payload, err := json.Marshal(map[string]string{"text": n.Text()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return postNotification(c.client, req)
+}
+
+// webhookChannel posts notifications as JSON, signed in the same way as client webhook deliveries if it has a secret
+type webhookChannel struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Notify posts the notification as JSON
+func (c webhookChannel) Notify(n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Consent-Signature", "t="+timestamp+",v1="+signWebhookPayload(c.secret, timestamp, payload))
+	}
+	return postNotification(c.client, req)
+}
+
+// postNotification sends a notification request, failing unless the endpoint responds with a 2xx status
+func postNotification(client *http.Client, req *http.Request) error {
+	req.Header.Set("User-Agent", userAgent)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("notification endpoint responded " + res.Status)
+	}
+	return nil
+}
+
+// parseNotificationRoutes parses event=channel1|channel2 entries
+func parseNotificationRoutes(entries []string) map[string][]string {
+	routes := map[string][]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Printf("invalid notification route %q", entry)
+			continue
+		}
+		event := strings.TrimSpace(parts[0])
+		for _, name := range strings.Split(parts[1], "|") {
+			if name = strings.TrimSpace(name); name != "" {
+				routes[event] = append(routes[event], name)
+			}
+		}
+	}
+	return routes
+}
+
+// checkNotificationRoutes returns an error if NOTIFY_EVENTS routes an event to a channel that is not configured
+func checkNotificationRoutes() error {
+	for event, names := range notificationRoutes {
+		for _, name := range names {
+			if _, ok := notificationChannels[name]; !ok {
+				return fmt.Errorf("NOTIFY_EVENTS routes %s to the %s channel, which is not configured", event, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// scopeOfflineAccess is the OpenID Connect scope asking for a refresh token, which the user approves separately from
+// the other scopes
+const scopeOfflineAccess = "offline_access"
+
+var (
+	// offlineAccessRequired removes the refresh token from Kong, and from the /token response, for codes the user
+	// did not approve offline access for, as Kong issues a refresh token with every authorization code whatever its
+	// scopes
+	offlineAccessRequired = envBool("OFFLINE_ACCESS_REQUIRED", true)
+	// offlineAccessSweepInterval is how often the refresh tokens of codes exchanged at Kong's token endpoint directly,
+	// rather than at /token, are removed if they were not granted offline_access; 0 disables it
+	offlineAccessSweepInterval = envDuration("OFFLINE_ACCESS_SWEEP_INTERVAL", time.Minute)
+
+	refreshTokensRemoved = metrics.Counter("refresh_tokens_removed_total", "Number of refresh tokens removed from Kong because the user did not approve offline access.")
+)
+
+// offlineAccessPrefix is prepended to the keys of offline access approvals in the shared store
+const offlineAccessPrefix = "offline-access:"
+
+// withoutOfflineAccess returns the scopes without offline_access, and whether it was among them
+func withoutOfflineAccess(scopes []string) ([]string, bool) {
+	rest := make([]string, 0, len(scopes))
+	found := false
+	for _, scope := range scopes {
+		if scope == scopeOfflineAccess {
+			found = true
+			continue
+		}
+		rest = append(rest, scope)
+	}
+	return rest, found
+}
+
+// approveOfflineAccess returns the scopes granted on the consent form, without offline_access unless the user ticked
+// its checkbox
+//
+// The implicit grant has no refresh tokens, so offline access is never granted with it.
+func approveOfflineAccess(ctx iris.Context, consent ConsentRequest, scopes []string) []string {
+	rest, requested := withoutOfflineAccess(scopes)
+	if requested && !consent.implicit() && ctx.FormValue("OfflineAccess") == "true" {
+		return scopes
+	}
+	return rest
+}
+
+// recordOfflineAccess records that the user approved offline access with the authorization code remembered under
+// key, in the shared store so that the code can be exchanged on any replica while Kong accepts it
+func recordOfflineAccess(key string) error {
+	return sharedStore.Set(offlineAccessPrefix+key, "approved", kongAuthorizationCodeTTL)
+}
+
+// offlineAccessApproved reports whether the user approved offline access with the authorization code remembered
+// under key, and forgets the approval as the code can only be exchanged once; codes that were not issued through the
+// consent page, or have expired, were not approved
+func offlineAccessApproved(key string) (bool, error) {
+	_, approved, err := sharedStore.Take(offlineAccessPrefix + key)
+	return approved, err
+}
+
+// removeKongRefreshToken removes the refresh token from Kong's record of a token, looked up by its ID or access
+// token, leaving the access token valid
+func removeKongRefreshToken(ctx context.Context, token string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, kongAdminEndpoint+"/oauth2_tokens/"+url.PathEscape(token),
+		strings.NewReader(`{"refresh_token":null}`))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := executeRequest(req); err != nil {
+		return wrapError(ErrKongUnavailable, "removing refresh token", err)
+	}
+	refreshTokensRemoved.Inc()
+	return nil
+}
+
+// removeUnapprovedRefreshTokens removes the refresh tokens of Kong's tokens that were not granted offline_access and
+// returns the number removed
+func removeUnapprovedRefreshTokens(ctx context.Context) (int, error) {
+	removed := 0
+	err := eachKongAccessToken(ctx, func(token kongAccessToken) error {
+		if token.ID == "" || token.RefreshToken == "" {
+			return nil
+		}
+		if _, approved := withoutOfflineAccess(strings.Fields(token.Scope)); approved {
+			return nil
+		}
+		if err := removeKongRefreshToken(ctx, token.ID); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// runOfflineAccessSweep removes refresh tokens that were not granted offline_access every
+// OFFLINE_ACCESS_SWEEP_INTERVAL, for the lifetime of the application, when OFFLINE_ACCESS_REQUIRED is set
+func runOfflineAccessSweep() {
+	if !offlineAccessRequired || offlineAccessSweepInterval <= 0 {
+		return
+	}
+	for range time.Tick(offlineAccessSweepInterval) {
+		removed, err := removeUnapprovedRefreshTokens(context.Background())
+		if err != nil {
+			log.Printf("removing refresh tokens without offline access: %v", err)
+			notify(eventJobFailed, "Removing refresh tokens without offline access failed", map[string]string{"job": "offline_access_sweep", "error": err.Error()})
+			continue
+		}
+		if removed > 0 {
+			log.Printf("removed %d refresh tokens without offline access", removed)
+		}
+	}
+}
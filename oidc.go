@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	oidcIssuer       = strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	oidcClientID     = os.Getenv("OIDC_CLIENT_ID")
+	oidcClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	oidcScopes       = envListDefault("OIDC_SCOPES", []string{"openid", "profile", "email", "phone"})
+	oidcDisplayName  = envOrDefault("OIDC_DISPLAY_NAME", "single sign-on")
+	oidcTimeout      = envDuration("OIDC_TIMEOUT", 5*time.Second)
+	oidcCACert       = os.Getenv("OIDC_CA_CERT")
+
+	// Userinfo claims mapped to the attributes of users provisioned from the identity provider
+	oidcUsernameClaim = envOrDefault("OIDC_USERNAME_CLAIM", "preferred_username")
+	oidcUserIDClaim   = envOrDefault("OIDC_USERID_CLAIM", "sub")
+	oidcEmailClaim    = envOrDefault("OIDC_EMAIL_CLAIM", "email")
+	oidcPhoneClaim    = envOrDefault("OIDC_PHONE_CLAIM", "phone_number")
+	oidcRolesClaim    = os.Getenv("OIDC_ROLES_CLAIM")
+	oidcLocaleClaim   = envOrDefault("OIDC_LOCALE_CLAIM", "locale")
+)
+
+// oidcCallbackPath is where the identity provider returns the user, registered as PUBLIC_URL + oidcCallbackPath
+const oidcCallbackPath = "/login/oidc/callback"
+
+// oidcProviderMetadata is a partial representation of an OpenID Connect discovery document
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcTokenResponse is a partial representation of the identity provider's token response
+type oidcTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oidcIDTokenAlgorithms are the JWS algorithms ID tokens may be signed with
+var oidcIDTokenAlgorithms = []string{"RS256", "PS256", "ES256"}
+
+var (
+	// oidcClient sends requests to the identity provider, verifying its certificate against the system's certificate
+	// authorities or those in OIDC_CA_CERT
+	oidcClient = newExternalHTTPClient(oidcTimeout)
+
+	// oidcMetadata is the identity provider's discovery document, fetched on the first login
+	oidcMetadata   *oidcProviderMetadata
+	oidcMetadataMu sync.Mutex
+
+	// oidcKeys are the identity provider's signing keys, fetched on the first login and again when an ID token is
+	// signed with a key that is not among them
+	oidcKeys   []JSONWebKey
+	oidcKeysMu sync.Mutex
+)
+
+// oidcProvider returns the identity provider's discovery document, fetching it if it has not been yet
+func oidcProvider(ctx context.Context) (*oidcProviderMetadata, error) {
+	oidcMetadataMu.Lock()
+	defer oidcMetadataMu.Unlock()
+
+	if oidcMetadata != nil {
+		return oidcMetadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oidcIssuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &oidcProviderMetadata{}
+	if err := doOIDCRequest(req, metadata); err != nil {
+		return nil, fmt.Errorf("fetching OpenID Connect discovery document: %w", err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != oidcIssuer {
+		return nil, fmt.Errorf("OpenID Connect discovery document is for issuer %q, not %q", metadata.Issuer, oidcIssuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.UserinfoEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OpenID Connect discovery document is missing an endpoint")
+	}
+
+	oidcMetadata = metadata
+	return metadata, nil
+}
+
+// oidcKeySet returns the identity provider's signing keys, fetching them if they have not been yet or refresh is set
+func oidcKeySet(ctx context.Context, provider *oidcProviderMetadata, refresh bool) ([]JSONWebKey, error) {
+	oidcKeysMu.Lock()
+	defer oidcKeysMu.Unlock()
+
+	if oidcKeys != nil && !refresh {
+		return oidcKeys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	keySet := JSONWebKeySet{}
+	if err := doOIDCRequest(req, &keySet); err != nil {
+		return nil, fmt.Errorf("fetching OpenID Connect signing keys: %w", err)
+	}
+	if len(keySet.Keys) == 0 {
+		return nil, errors.New("OpenID Connect identity provider has no signing keys")
+	}
+
+	oidcKeys = keySet.Keys
+	return oidcKeys, nil
+}
+
+// doOIDCRequest sends a request to the identity provider and decodes its JSON response into v
+func doOIDCRequest(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Token errors are returned as 400 Bad Request with an error code in the body
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return errors.New(req.URL.Host + " responded " + res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// getLoginOIDC starts a login with the OpenID Connect identity provider
+//
+// The authorization code flow is used with PKCE, with the state, nonce and code verifier held in the session.
+func getLoginOIDC(ctx iris.Context) {
+	if oidcIssuer == "" || kioskMode {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	provider, err := oidcProvider(ctx.Request().Context())
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	state, err := randomOIDCValue()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	verifier, err := randomOIDCValue()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	nonce, err := randomOIDCValue()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	session := sess.Start(ctx)
+	session.Set("oidcState", state)
+	session.Set("oidcVerifier", verifier)
+	session.Set("oidcNonce", nonce)
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcClientID},
+		"redirect_uri":          {publicURL + oidcCallbackPath},
+		"scope":                 {strings.Join(oidcScopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	ctx.Redirect(provider.AuthorizationEndpoint+separator+query.Encode(), iris.StatusSeeOther)
+}
+
+// getLoginOIDCCallback completes a login with the OpenID Connect identity provider
+//
+// The user is identified by the ID token, whose signature, issuer, audience, expiry and nonce are verified, and their
+// other claims are fetched from the userinfo endpoint for the same subject. Users are provisioned on their first
+// login.
+func getLoginOIDCCallback(ctx iris.Context) {
+	if oidcIssuer == "" || kioskMode {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	session := sess.Start(ctx)
+	state := session.GetString("oidcState")
+	verifier := session.GetString("oidcVerifier")
+	nonce := session.GetString("oidcNonce")
+	session.Delete("oidcState")
+	session.Delete("oidcVerifier")
+	session.Delete("oidcNonce")
+
+	if state == "" || nonce == "" || subtle.ConstantTimeCompare([]byte(ctx.URLParam("state")), []byte(state)) != 1 {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Your login with "+oidcDisplayName+" has expired. Please try again.")
+		getLogin(ctx)
+		return
+	}
+	if code := ctx.URLParam("error"); code != "" {
+		log.Printf("oidc login from %s refused: %s %s", clientIPString(ctx), code, ctx.URLParam("error_description"))
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "Login with "+oidcDisplayName+" failed.")
+		getLogin(ctx)
+		return
+	}
+
+	claims, err := fetchOIDCClaims(ctx.Request().Context(), ctx.URLParam("code"), verifier, nonce)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	identity := FederatedIdentity{Issuer: oidcIssuer, Subject: claimString(claims, "sub")}
+	if identity.Subject == "" {
+		ctx.SetErr(errors.New("ID token has no sub claim"))
+		return
+	}
+	attributes := UserAttributes{
+		Email:         claimString(claims, oidcEmailClaim),
+		EmailVerified: claimBool(claims, "email_verified"),
+		Phone:         claimString(claims, oidcPhoneClaim),
+		Language:      claimString(claims, oidcLocaleClaim),
+	}
+	if oidcRolesClaim != "" {
+		attributes.Roles = claimStrings(claims, oidcRolesClaim)
+	}
+
+	user, err := provisionFederatedUser(identity, claimString(claims, oidcUsernameClaim), claimString(claims, oidcUserIDClaim), attributes)
+	if err == ErrUserExists {
+		ctx.StatusCode(iris.StatusConflict)
+		ctx.ViewData("Error", "An account with your "+oidcDisplayName+" username already exists. Please login with your password.")
+		getLogin(ctx)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if requireSecondFactor(ctx, user) {
+		return
+	}
+
+	completeLogin(ctx, user)
+}
+
+// fetchOIDCClaims exchanges an authorization code for an ID token and an access token, and returns the user's
+// userinfo claims once the ID token is verified and the userinfo is found to be for its subject
+func fetchOIDCClaims(ctx context.Context, code, verifier, nonce string) (map[string]interface{}, error) {
+	provider, err := oidcProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {publicURL + oidcCallbackPath},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+
+	token := oidcTokenResponse{}
+	if err := doOIDCRequest(req, &token); err != nil {
+		return nil, fmt.Errorf("exchanging OpenID Connect authorization code: %w", err)
+	}
+	if token.AccessToken == "" || token.IDToken == "" {
+		return nil, fmt.Errorf("exchanging OpenID Connect authorization code: %s %s", token.Error, token.ErrorDescription)
+	}
+
+	keys, err := oidcKeySet(ctx, provider, false)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := verifyOIDCIDToken(token.IDToken, provider.Issuer, keys, nonce, time.Now())
+	if err == errOIDCKeyNotFound {
+		// The identity provider may have rotated its keys since they were fetched
+		if keys, err = oidcKeySet(ctx, provider, true); err != nil {
+			return nil, err
+		}
+		idToken, err = verifyOIDCIDToken(token.IDToken, provider.Issuer, keys, nonce, time.Now())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("verifying OpenID Connect ID token: %w", err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, provider.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	claims := map[string]interface{}{}
+	if err := doOIDCRequest(req, &claims); err != nil {
+		return nil, fmt.Errorf("fetching OpenID Connect userinfo: %w", err)
+	}
+	// The userinfo response is only trusted for the subject of the verified ID token, as OpenID Connect Core
+	// section 5.3.2 requires
+	subject := claimString(idToken, "sub")
+	if subject == "" || claimString(claims, "sub") != subject {
+		return nil, errors.New("OpenID Connect userinfo is not for the subject of the ID token")
+	}
+	return claims, nil
+}
+
+// errOIDCKeyNotFound is returned for ID tokens whose signature does not match any of the identity provider's keys
+var errOIDCKeyNotFound = errors.New("its signature does not match any of the identity provider's keys")
+
+// verifyOIDCIDToken checks an ID token's signature against the identity provider's keys and returns its claims
+//
+// The ID token must be issued by issuer to this application's client ID, for the nonce sent with the login, and must
+// not have expired, as OpenID Connect Core section 3.1.3.7 describes.
+func verifyOIDCIDToken(idToken, issuer string, keys []JSONWebKey, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("it is not a signed JWT")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("reading its header: %v", err)
+	}
+	if !containsString(oidcIDTokenAlgorithms, header.Alg) {
+		return nil, fmt.Errorf("it is signed with %q rather than one of %s", header.Alg, strings.Join(oidcIDTokenAlgorithms, ", "))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("its signature is not base64url encoded")
+	}
+	if !verifyJWTSignature(parts, header.Alg, header.Kid, signature, keys) {
+		return nil, errOIDCKeyNotFound
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("reading its claims: %v", err)
+	}
+	if claims["iss"] != issuer {
+		return nil, errors.New("its issuer is not " + issuer)
+	}
+	if !audienceIncludes(claims["aud"], oidcClientID) {
+		return nil, errors.New("its audience is not " + oidcClientID)
+	}
+	if azp, ok := claims["azp"]; ok && azp != oidcClientID {
+		return nil, errors.New("it was not issued to " + oidcClientID)
+	}
+	exp, err := numericDate(claims["exp"])
+	if err != nil || !now.Before(exp) {
+		return nil, errors.New("it has expired or has no exp")
+	}
+	if subtle.ConstantTimeCompare([]byte(claimString(claims, "nonce")), []byte(nonce)) != 1 {
+		return nil, errors.New("its nonce does not match the login")
+	}
+	return claims, nil
+}
+
+// provisionFederatedUser returns the user who logs in with identity, creating them on their first login
+//
+// New users are named username, or the identity's subject if there is none, and keep userID as the
+// authenticated_userid sent to Kong even if their username or attributes change at the identity provider later.
+// An existing account with the same username is only linked to the identity if it was provisioned over SCIM with
+// the identity's subject as its externalId; otherwise ErrUserExists is returned.
+func provisionFederatedUser(identity FederatedIdentity, username, userID string, attributes UserAttributes) (*User, error) {
+	user, err := findUserByFederatedIdentity(identity)
+	if err == ErrUserNotFound {
+		if username == "" {
+			username = identity.Subject
+		}
+		if existing, err := users.Get(username); err == nil && existing.ExternalID != "" && existing.ExternalID == identity.Subject {
+			existing.FederatedIdentities = append(existing.FederatedIdentities, identity)
+			attributes.apply(existing)
+			if err := users.Save(existing); err != nil {
+				return nil, err
+			}
+			log.Printf("linked user %q to %s subject %q", existing.Username, identity.Issuer, identity.Subject)
+			return existing, nil
+		}
+		if userID == "" {
+			userID = identity.Subject
+		}
+		user = &User{Username: username, AuthenticatedUserID: userID, FederatedIdentities: []FederatedIdentity{identity}}
+		attributes.apply(user)
+		if err := users.Create(user); err != nil {
+			return nil, err
+		}
+		log.Printf("provisioned user %q for %s subject %q", user.Username, identity.Issuer, identity.Subject)
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if attributes.apply(user) {
+		if err := users.Save(user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// randomOIDCValue returns a random value for the state or PKCE code verifier of a login
+func randomOIDCValue() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// claimString returns the string value of a claim, or "" if it is missing or not a string
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// claimBool returns the boolean value of a claim, which some identity providers send as a string
+func claimBool(claims map[string]interface{}, name string) bool {
+	switch value := claims[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+// claimStrings returns the values of a claim holding a list of strings or a single string, or nil if it is missing
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// providerIssuer identifies this application as an OpenID provider to clients, PUBLIC_URL unless set
+	providerIssuer = strings.TrimSuffix(envOrDefault("PROVIDER_ISSUER", publicURL), "/")
+	// providerSigningKeyFile is the PEM RSA or P-256 private key that signs ID tokens; a key is generated at
+	// startup if unset, which invalidates every ID token on restart
+	providerSigningKeyFile = os.Getenv("PROVIDER_SIGNING_KEY_FILE")
+)
+
+// Paths of the OpenID provider endpoints served by this application
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+	jwksPath      = "/.well-known/jwks.json"
+	userinfoPath  = "/userinfo"
+)
+
+// providerSigningKey signs ID tokens; it is loaded or generated by loadProviderSigningKey
+var providerSigningKey *providerKey
+
+// providerKey is a private key with the key ID and JWS algorithm it is published with
+type providerKey struct {
+	key       crypto.Signer
+	id        string
+	algorithm string
+}
+
+// loadProviderSigningKey reads PROVIDER_SIGNING_KEY_FILE, or generates a key if it is not set
+func loadProviderSigningKey() error {
+	if providerSigningKeyFile == "" {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		log.Print("PROVIDER_SIGNING_KEY_FILE is not set: ID tokens are signed with a key generated at startup")
+		providerSigningKey, err = newProviderKey(key)
+		return err
+	}
+
+	data, err := ioutil.ReadFile(providerSigningKeyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("PROVIDER_SIGNING_KEY_FILE does not contain a PEM private key")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing PROVIDER_SIGNING_KEY_FILE: %w", err)
+	}
+	providerSigningKey, err = newProviderKey(key)
+	return err
+}
+
+// newProviderKey returns the signing key for an RSA key of at least 2048 bits, signing with RS256, or a P-256 key,
+// signing with ES256
+//
+// The key ID is derived from the public key, so that it only changes with the key.
+func newProviderKey(key interface{}) (*providerKey, error) {
+	k := &providerKey{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA signing keys must have at least 2048 bits")
+		}
+		k.key, k.algorithm = key, "RS256"
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("EC signing keys must use the P-256 curve")
+		}
+		k.key, k.algorithm = key, "ES256"
+	default:
+		return nil, errors.New("signing keys must be RSA or P-256 keys")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(k.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	k.id = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return k, nil
+}
+
+// jwk returns the public key as a JSON Web Key
+func (k *providerKey) jwk() map[string]string {
+	jwk := map[string]string{"kid": k.id, "use": "sig", "alg": k.algorithm}
+	encode := func(n *big.Int, size int) string {
+		return base64.RawURLEncoding.EncodeToString(paddedBytes(n, size))
+	}
+	switch public := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = encode(public.N, 0)
+		jwk["e"] = encode(big.NewInt(int64(public.E)), 0)
+	case *ecdsa.PublicKey:
+		jwk["kty"] = "EC"
+		jwk["crv"] = "P-256"
+		jwk["x"] = encode(public.X, 32)
+		jwk["y"] = encode(public.Y, 32)
+	}
+	return jwk
+}
+
+// paddedBytes returns the big-endian bytes of n, left padded with zeros to at least size bytes
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return b
+}
+
+// ProviderMetadata is the OpenID Connect discovery document describing this application as a provider
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+
+	AuthorizationSigningAlgValuesSupported []string `json:"authorization_signing_alg_values_supported"`
+
+	RevocationEndpoint                        string   `json:"revocation_endpoint"`
+	RevocationEndpointAuthMethodsSupported    []string `json:"revocation_endpoint_auth_methods_supported"`
+	IntrospectionEndpoint                     string   `json:"introspection_endpoint,omitempty"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported,omitempty"`
+	RegistrationEndpoint                      string   `json:"registration_endpoint,omitempty"`
+
+	RequestParameterSupported              bool     `json:"request_parameter_supported"`
+	RequestURIParameterSupported           bool     `json:"request_uri_parameter_supported"`
+	RequireRequestURIRegistration          bool     `json:"require_request_uri_registration"`
+	RequestObjectSigningAlgValuesSupported []string `json:"request_object_signing_alg_values_supported"`
+}
+
+// getDiscovery returns the OpenID Connect discovery document
+//
+// Clients are sent to the consent page to authorize, and exchange codes through the token endpoint, which forwards
+// to Kong's and adds the ID token.
+func getDiscovery(ctx iris.Context) {
+	metadata := ProviderMetadata{
+		Issuer:                            providerIssuer,
+		AuthorizationEndpoint:             providerIssuer + "/consent",
+		TokenEndpoint:                     providerIssuer + tokenPath,
+		UserinfoEndpoint:                  providerIssuer + userinfoPath,
+		JWKSURI:                           providerIssuer + jwksPath,
+		ResponseTypesSupported:            []string{responseTypeCode, responseTypeToken},
+		ResponseModesSupported:            supportedResponseModes,
+		GrantTypesSupported:               []string{"authorization_code", "implicit", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{providerSigningKey.algorithm},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "preferred_username", "email", "email_verified", "phone_number"},
+
+		AuthorizationSigningAlgValuesSupported: []string{providerSigningKey.algorithm},
+
+		RevocationEndpoint:                     providerIssuer + revocationPath,
+		RevocationEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+
+		RequestParameterSupported:              true,
+		RequestURIParameterSupported:           true,
+		RequireRequestURIRegistration:          true,
+		RequestObjectSigningAlgValuesSupported: requestObjectAlgorithms,
+	}
+	if len(introspectionClientIDs) > 0 {
+		metadata.IntrospectionEndpoint = providerIssuer + introspectionPath
+		metadata.IntrospectionEndpointAuthMethodsSupported = metadata.TokenEndpointAuthMethodsSupported
+	}
+	if len(registrationAccessTokens) > 0 {
+		metadata.RegistrationEndpoint = providerIssuer + registrationPath
+	}
+	// Kong's configured scopes are listed when they can be fetched
+	if catalog, err := getScopeCatalog(kongContext(ctx)); err == nil {
+		metadata.ScopesSupported = catalog
+	}
+
+	ctx.Header("Access-Control-Allow-Origin", "*")
+	ctx.JSON(metadata)
+}
+
+// getJWKS returns the public keys ID tokens are signed with
+func getJWKS(ctx iris.Context) {
+	ctx.Header("Access-Control-Allow-Origin", "*")
+	ctx.JSON(map[string]interface{}{"keys": []map[string]string{providerSigningKey.jwk()}})
+}
+
+// kongAccessToken is Kong's record of an access token, as returned by its Admin API
+type kongAccessToken struct {
+	oauth2Token
+	Scope     string `json:"scope"`
+	ExpiresIn int64  `json:"expires_in"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// getUserinfo returns the claims of the user an access token was issued for, limited to the token's scopes
+//
+// The token is looked up on Kong's Admin API on every request, rather than cached, so that revoked and expired
+// tokens are refused straight away. It must have been granted the openid scope.
+func getUserinfo(ctx iris.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	accessToken := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if accessToken == "" || accessToken == ctx.GetHeader("Authorization") {
+		ctx.Header("WWW-Authenticate", `Bearer realm="userinfo"`)
+		ctx.StatusCode(iris.StatusUnauthorized)
+		return
+	}
+
+	token, err := getKongAccessToken(kongContext(ctx), accessToken)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	scopes := strings.Fields(token.Scope)
+	expired := token.ExpiresIn > 0 && time.Unix(token.CreatedAt+token.ExpiresIn, 0).Before(time.Now())
+	if token.AuthenticatedUserID == "" || expired {
+		ctx.Header("WWW-Authenticate", `Bearer realm="userinfo", error="invalid_token"`)
+		ctx.StatusCode(iris.StatusUnauthorized)
+		return
+	}
+	if !containsString(scopes, "openid") {
+		ctx.Header("WWW-Authenticate", `Bearer realm="userinfo", error="insufficient_scope", scope="openid"`)
+		ctx.StatusCode(iris.StatusForbidden)
+		return
+	}
+
+	user, err := findUserByAuthenticatedUserID(token.AuthenticatedUserID)
+	if err == ErrUserNotFound || (err == nil && user.Disabled) {
+		ctx.Header("WWW-Authenticate", `Bearer realm="userinfo", error="invalid_token"`)
+		ctx.StatusCode(iris.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	ctx.JSON(userClaims(user, scopes))
+}
+
+// userClaims returns the standard claims of the user released by the scopes
+func userClaims(user *User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": authenticatedUserID(user)}
+	if containsString(scopes, "profile") {
+		claims["preferred_username"] = user.Username
+	}
+	if containsString(scopes, "email") && user.Email != "" {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	if containsString(scopes, "phone") && user.Phone != "" {
+		claims["phone_number"] = user.Phone
+	}
+	return claims
+}
+
+// getKongAccessToken fetches Kong's record of an access token; unknown tokens have no authenticated_userid
+func getKongAccessToken(ctx context.Context, accessToken string) (*kongAccessToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/oauth2_tokens/"+url.PathEscape(accessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := executeRequest(req)
+	if err != nil {
+		return nil, wrapError(ErrKongUnavailable, "fetching OAuth 2.0 token", err)
+	}
+	token := &kongAccessToken{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, wrapError(ErrKongUnavailable, "reading OAuth 2.0 token", err)
+	}
+	return token, nil
+}
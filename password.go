@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// ChangePasswordForm represents the passwords submitted on the change password page
+type ChangePasswordForm struct {
+	CurrentPassword string
+	Password        string
+	ConfirmPassword string
+}
+
+// getAccountPassword returns the change password view on a GET request
+func getAccountPassword(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	if session.GetBooleanDefault("passwordExpired", false) {
+		ctx.ViewData("Notice", "Your password has expired. Please choose a new password to continue.")
+	}
+	viewPasswordPolicy(ctx, nil)
+	ctx.View("account-password.html")
+}
+
+// postAccountPassword handles POST requests to the change password endpoint
+//
+// The user's other sessions are ended once the password has been changed. Users who were sent here because their
+// password expired return to the consent request they were making.
+func postAccountPassword(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := ChangePasswordForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if ok, _ := checkPassword(user.PasswordHash, form.CurrentPassword); !ok {
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "Your current password is incorrect.")
+		viewPasswordPolicy(ctx, nil)
+		ctx.View("account-password.html")
+		return
+	}
+	if problems := checkNewPassword(user, form.Password, form.ConfirmPassword); len(problems) > 0 {
+		ctx.StatusCode(iris.StatusBadRequest)
+		viewPasswordPolicy(ctx, problems)
+		ctx.View("account-password.html")
+		return
+	}
+
+	if err := setPassword(user, form.Password); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	now := time.Now().UnixNano()
+	user.RememberTokens = nil
+	user.SessionsValidAfter = now
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	session.Set("authenticatedAt", now)
+	ctx.RemoveCookie(rememberMeCookie)
+
+	if session.GetBooleanDefault("passwordExpired", false) {
+		session.Delete("passwordExpired")
+		ctx.Redirect(pendingConsentURL(session), iris.StatusSeeOther)
+		return
+	}
+
+	ctx.ViewData("Notice", "Your password has been changed.")
+	viewPasswordPolicy(ctx, nil)
+	ctx.View("account-password.html")
+}
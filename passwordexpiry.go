@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// passwordExpired reports whether the user's password is older than PASSWORD_MAX_AGE
+//
+// Users without a password, such as those who log in with an identity provider, are never asked to change it.
+func passwordExpired(user *User) bool {
+	maxAge := currentPasswordPolicy().MaxAge
+	if maxAge <= 0 || user.PasswordHash == "" || user.PasswordChangedAt == 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, user.PasswordChangedAt)) > maxAge
+}
+
+// requirePasswordChange sends the user in the session to the change password page if their password has expired,
+// and reports whether it has completed the response
+//
+// The consent request is resumed once the user has chosen a new password.
+func requirePasswordChange(ctx iris.Context, consent ConsentRequest) bool {
+	if currentPasswordPolicy().MaxAge <= 0 || impersonating(ctx) {
+		return false
+	}
+
+	session := sess.Start(ctx)
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+	if !passwordExpired(user) {
+		return false
+	}
+
+	setPendingConsent(session, consent)
+	audit(ctx, "password.expired", map[string]string{"client_id": consent.ClientID})
+	session.Set("passwordExpired", true)
+	ctx.Redirect("/account/password", iris.StatusSeeOther)
+	return true
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	passwordHashArgon2id = "argon2id"
+	passwordHashBcrypt   = "bcrypt"
+	passwordHashPBKDF2   = "pbkdf2-sha256"
+	passwordHashScrypt   = "scrypt"
+)
+
+var (
+	// passwordHashAlgorithm is the algorithm new password and PIN hashes are created with; FIPS builds default to the
+	// only approved one, PBKDF2
+	passwordHashAlgorithm = envOrDefault("PASSWORD_HASH", defaultPasswordHashAlgorithm())
+
+	// argon2Params are the Argon2id cost parameters; hashes created with other parameters are upgraded on login
+	argon2Params = Argon2Params{
+		Memory:      uint32(envInt("ARGON2_MEMORY", 64*1024)),
+		Iterations:  uint32(envInt("ARGON2_ITERATIONS", 3)),
+		Parallelism: uint8(envInt("ARGON2_PARALLELISM", 2)),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+
+	// bcryptCost is the cost of bcrypt hashes when PASSWORD_HASH is bcrypt
+	bcryptCost = envInt("BCRYPT_COST", bcrypt.DefaultCost)
+
+	// pbkdf2Iterations is the iteration count of PBKDF2-HMAC-SHA256 hashes when PASSWORD_HASH is pbkdf2-sha256
+	pbkdf2Iterations = envInt("PBKDF2_ITERATIONS", 600000)
+
+	// scryptParams are the scrypt cost parameters when PASSWORD_HASH is scrypt
+	scryptParams = ScryptParams{
+		N:          envInt("SCRYPT_N", 1<<15),
+		R:          envInt("SCRYPT_R", 8),
+		P:          envInt("SCRYPT_P", 1),
+		SaltLength: 16,
+		KeyLength:  32,
+	}
+)
+
+// Argon2Params are the parameters of an Argon2id hash, with memory in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// ScryptParams are the parameters of an scrypt hash; N is a power of two
+type ScryptParams struct {
+	N          int
+	R          int
+	P          int
+	SaltLength int
+	KeyLength  int
+}
+
+// legacySHASchemes are the LDAP-style SHA hash schemes accepted from imported user stores, and their hash functions
+var legacySHASchemes = map[string]func() hash.Hash{
+	"{SHA}":     sha1.New,
+	"{SSHA}":    sha1.New,
+	"{SHA256}":  sha256.New,
+	"{SSHA256}": sha256.New,
+	"{SHA512}":  sha512.New,
+	"{SSHA512}": sha512.New,
+}
+
+// defaultPasswordHashAlgorithm returns the algorithm new hashes are created with when PASSWORD_HASH is unset
+func defaultPasswordHashAlgorithm() string {
+	if fipsMode {
+		return passwordHashPBKDF2
+	}
+	return passwordHashArgon2id
+}
+
+// checkPasswordHashAlgorithm returns an error if PASSWORD_HASH is not a supported algorithm, or the configured scrypt
+// parameters cannot be used
+func checkPasswordHashAlgorithm() error {
+	switch passwordHashAlgorithm {
+	case passwordHashArgon2id, passwordHashBcrypt, passwordHashPBKDF2:
+		return nil
+	case passwordHashScrypt:
+		p := scryptParams
+		if p.N < 2 || p.N&(p.N-1) != 0 || p.R < 1 || p.P < 1 || uint64(p.R)*uint64(p.P) >= 1<<30 {
+			return errors.New("SCRYPT_N must be a power of two greater than 1, and SCRYPT_R and SCRYPT_P positive")
+		}
+		return nil
+	}
+	return fmt.Errorf("PASSWORD_HASH must be %s, %s, %s or %s", passwordHashArgon2id, passwordHashBcrypt, passwordHashScrypt, passwordHashPBKDF2)
+}
+
+// hashPassword returns a hash of password suitable for storing on a User
+//
+// Each hash is tagged with its algorithm and parameters, so that hashes created with another configuration can still
+// be checked, and replaced on login.
+func hashPassword(password string) (string, error) {
+	if passwordHashAlgorithm == passwordHashPBKDF2 {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := pbkdf2.Key([]byte(password), salt, pbkdf2Iterations, 32, sha256.New)
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", pbkdf2Iterations,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	if passwordHashAlgorithm == passwordHashScrypt {
+		p := scryptParams
+		salt := make([]byte, p.SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key, err := scrypt.Key([]byte(password), salt, p.N, p.R, p.P, p.KeyLength)
+		if err != nil {
+			return "", err
+		}
+		// The cost is encoded as log2(N), as passlib does
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", bits.TrailingZeros(uint(p.N)), p.R, p.P,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	if passwordHashAlgorithm == passwordHashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	p := argon2Params
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches hash, and whether the hash should be replaced because it was
+// created with a legacy algorithm or with parameters other than the configured ones
+//
+// Argon2id, bcrypt, scrypt and PBKDF2-HMAC-SHA256 hashes are accepted, as are {SHA}, {SSHA}, {SHA256}, {SSHA256}, {SHA512}
+// and {SSHA512} hashes imported from LDAP directories. FIPS builds only accept PBKDF2 hashes, so users with other
+// hashes reset their password.
+func checkPassword(hash, password string) (ok, rehash bool) {
+	switch {
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		iterations, ok := checkPBKDF2(hash, password)
+		return ok, passwordHashAlgorithm != passwordHashPBKDF2 || iterations != pbkdf2Iterations
+	case fipsMode:
+		return false, false
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, ok := checkArgon2id(hash, password)
+		return ok, passwordHashAlgorithm != passwordHashArgon2id || params != argon2Params
+	case strings.HasPrefix(hash, "$scrypt$"):
+		params, ok := checkScrypt(hash, password)
+		return ok, passwordHashAlgorithm != passwordHashScrypt || params != scryptParams
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return true, passwordHashAlgorithm != passwordHashBcrypt || err != nil || cost != bcryptCost
+	case strings.HasPrefix(hash, "{"):
+		ok := checkLegacySHA(hash, password)
+		return ok, ok
+	}
+	return false, false
+}
+
+// passwordHashName returns the algorithm a hash was created with, as PASSWORD_HASH names it, or "legacy" for the
+// LDAP-style SHA hashes
+func passwordHashName(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return passwordHashArgon2id
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		return passwordHashPBKDF2
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return passwordHashScrypt
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return passwordHashBcrypt
+	}
+	return "legacy"
+}
+
+// countPasswordRehash counts a hash replaced on login, by the algorithm it was created with, so that the progress of
+// a migration to another algorithm or cost can be followed
+func countPasswordRehash(hash string) {
+	metrics.Counter("password_rehashes_total", "Number of password and PIN hashes replaced on login, by the algorithm they were created with.",
+		"algorithm", passwordHashName(hash)).Inc()
+}
+
+// checkArgon2id verifies password against an encoded Argon2id hash and returns the hash's parameters
+func checkArgon2id(encoded, password string) (Argon2Params, bool) {
+	p := Argon2Params{}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, false
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	computed := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return p, subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// checkScrypt verifies password against an encoded scrypt hash and returns the hash's parameters
+func checkScrypt(encoded, password string) (ScryptParams, bool) {
+	p := ScryptParams{}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return p, false
+	}
+
+	var logN uint
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &p.R, &p.P); err != nil || logN < 1 || logN > 30 {
+		return p, false
+	}
+	p.N = 1 << logN
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return p, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return p, false
+	}
+	p.SaltLength = len(salt)
+	p.KeyLength = len(key)
+
+	computed, err := scrypt.Key([]byte(password), salt, p.N, p.R, p.P, p.KeyLength)
+	if err != nil {
+		return p, false
+	}
+	return p, subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// checkPBKDF2 verifies password against an encoded PBKDF2-HMAC-SHA256 hash and returns the hash's iteration count
+func checkPBKDF2(encoded, password string) (int, bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return 0, false
+	}
+
+	var iterations int
+	if _, err := fmt.Sscanf(parts[2], "i=%d", &iterations); err != nil || iterations < 1 {
+		return 0, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+
+	computed := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	return iterations, subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// checkLegacySHA verifies password against an LDAP-style {SHA} or salted {SSHA} hash
+func checkLegacySHA(encoded, password string) bool {
+	end := strings.IndexByte(encoded, '}')
+	if end < 0 {
+		return false
+	}
+	scheme := strings.ToUpper(encoded[:end+1])
+	newHash, ok := legacySHASchemes[scheme]
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded[end+1:])
+	if err != nil {
+		return false
+	}
+
+	h := newHash()
+	size := h.Size()
+	if len(decoded) < size || (!strings.HasPrefix(scheme, "{SS") && len(decoded) != size) {
+		return false
+	}
+	digest, salt := decoded[:size], decoded[size:]
+	h.Write([]byte(password))
+	h.Write(salt)
+	return subtle.ConstantTimeCompare(h.Sum(nil), digest) == 1
+}
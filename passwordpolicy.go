@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kataras/iris/v12"
+)
+
+// passwordPolicy is the policy enforced whenever a user chooses a password
+var passwordPolicy = PasswordPolicy{
+	MinLength:       envInt("PASSWORD_MIN_LENGTH", 8),
+	RequiredClasses: envList("PASSWORD_REQUIRED_CLASSES"),
+	BreachCheck:     envBool("PASSWORD_BREACH_CHECK", false),
+	BreachAPIURL:    envOrDefault("PASSWORD_BREACH_API_URL", "https://api.pwnedpasswords.com/range/"),
+	History:         envInt("PASSWORD_HISTORY", 0),
+	MaxAge:          envDuration("PASSWORD_MAX_AGE", 0),
+}
+
+// breachAPIClient sends range queries to the breach API
+var breachAPIClient = newExternalHTTPClient(5 * time.Second)
+
+// currentPasswordPolicy returns the password policy, which the remote configuration may change while running
+func currentPasswordPolicy() PasswordPolicy {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return passwordPolicy
+}
+
+// passwordClasses describes the character classes that a PasswordPolicy can require
+var passwordClasses = map[string]struct {
+	description string
+	matches     func(rune) bool
+}{
+	"lower":  {"a lowercase letter", unicode.IsLower},
+	"upper":  {"an uppercase letter", unicode.IsUpper},
+	"digit":  {"a digit", unicode.IsDigit},
+	"symbol": {"a symbol", func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r) }},
+}
+
+// PasswordPolicy is the set of rules a new password must satisfy
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// RequiredClasses are the character classes that must each appear: lower, upper, digit or symbol
+	RequiredClasses []string
+	// BreachCheck refuses passwords found in known data breaches
+	BreachCheck bool
+	// BreachAPIURL is a Pwned Passwords compatible range API, queried with the first five characters of the
+	// password's SHA-1 hash so that the password itself is never disclosed
+	BreachAPIURL string
+	// History is the number of recent passwords, including the current one, that may not be reused
+	History int
+	// MaxAge is how long a password can be used before it must be changed, or zero if passwords do not expire
+	MaxAge time.Duration
+}
+
+// Requirements returns user-facing descriptions of the policy's rules, for display next to password fields
+func (p PasswordPolicy) Requirements() []string {
+	requirements := []string{fmt.Sprintf("at least %d characters long", p.MinLength)}
+	for _, class := range p.RequiredClasses {
+		if c, ok := passwordClasses[class]; ok {
+			requirements = append(requirements, "contains "+c.description)
+		}
+	}
+	if p.BreachCheck {
+		requirements = append(requirements, "not found in a known data breach")
+	}
+	if p.History > 0 {
+		requirements = append(requirements, "not one of your recent passwords")
+	}
+	return requirements
+}
+
+// Check returns a user-facing message for each rule the password breaks
+//
+// The user is nil when checking the password of a new account. The breach check fails open: if the API cannot be
+// reached the error is logged and the password is accepted.
+func (p PasswordPolicy) Check(user *User, password string) []string {
+	var problems []string
+
+	if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Your password must be at least %d characters long.", p.MinLength))
+	}
+	for _, class := range p.RequiredClasses {
+		c, ok := passwordClasses[class]
+		if ok && strings.IndexFunc(password, c.matches) < 0 {
+			problems = append(problems, "Your password must contain "+c.description+".")
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if user != nil && p.History > 0 && reusesPassword(user, password) {
+		problems = append(problems, fmt.Sprintf("Your password must not be one of your last %d passwords.", p.History))
+	}
+
+	if p.BreachCheck {
+		breached, err := p.breached(password)
+		if err != nil {
+			log.Printf("checking password against %s: %v", p.BreachAPIURL, err)
+		}
+		if breached {
+			problems = append(problems, "This password has appeared in a data breach and cannot be used. Please choose another.")
+		}
+	}
+
+	return problems
+}
+
+// breached reports whether the password appears in the breach API's corpus using its k-anonymity range query
+func (p PasswordPolicy) breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequest(http.MethodGet, p.BreachAPIURL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides the number of matching suffixes from observers of the response size
+	req.Header.Set("Add-Padding", "true")
+
+	req.Header.Set("User-Agent", userAgent)
+
+	// The breach API is not Kong, so it is not sent through executeRequest, logged or counted as Kong traffic
+	res, err := breachAPIClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s responded %s", req.URL.Host, res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], suffix) {
+			continue
+		}
+		// Padding entries have a count of zero
+		return strings.TrimSpace(line[i+1:]) != "0", nil
+	}
+	return false, scanner.Err()
+}
+
+// reusesPassword reports whether password is the user's current password or one in their password history
+func reusesPassword(user *User, password string) bool {
+	for _, hash := range append([]string{user.PasswordHash}, user.PasswordHistory...) {
+		if ok, _ := checkPassword(hash, password); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNewPassword returns user-facing messages for a new password that breaks the policy or was not confirmed
+func checkNewPassword(user *User, password, confirmPassword string) []string {
+	if password != confirmPassword {
+		return []string{"The passwords do not match."}
+	}
+	return currentPasswordPolicy().Check(user, password)
+}
+
+// setPassword replaces the user's password, keeping previous hashes in the password history as the policy requires
+func setPassword(user *User, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	// The current hash is checked separately, so the history holds one fewer than the number of recent passwords
+	if user.PasswordHash != "" {
+		user.PasswordHistory = append([]string{user.PasswordHash}, user.PasswordHistory...)
+	}
+	if keep := currentPasswordPolicy().History - 1; len(user.PasswordHistory) > keep {
+		if keep < 0 {
+			keep = 0
+		}
+		user.PasswordHistory = user.PasswordHistory[:keep]
+	}
+	user.PasswordHash = hash
+	user.PasswordChangedAt = time.Now().UnixNano()
+	return nil
+}
+
+// viewPasswordPolicy adds the password requirements and any problems with a submitted password to the view data
+func viewPasswordPolicy(ctx iris.Context, problems []string) {
+	ctx.ViewData("PasswordRequirements", currentPasswordPolicy().Requirements())
+	ctx.ViewData("PasswordProblems", problems)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+const passwordResetPurpose = "password-reset"
+
+// passwordResetTTL is how long a password reset link remains valid
+var passwordResetTTL = envDuration("PASSWORD_RESET_TTL", time.Hour)
+
+// passwordResetData is carried by a password reset link
+//
+// The fingerprint of the password hash at the time the link was sent invalidates every outstanding link once the
+// password has been changed.
+type passwordResetData struct {
+	Username    string `json:"sub"`
+	Fingerprint string `json:"fpr"`
+}
+
+// PasswordResetForm represents the new password submitted on the password reset page
+type PasswordResetForm struct {
+	Token           string
+	Password        string
+	ConfirmPassword string
+}
+
+// passwordFingerprint returns a short digest of a password hash
+func passwordFingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// getForgotPassword returns the forgotten password view on a GET request
+func getForgotPassword(ctx iris.Context) {
+	ctx.View("forgot-password.html")
+}
+
+// postForgotPassword emails a signed, time-limited password reset link to the user with the given email address
+//
+// The same page is shown whether or not a user exists so that email addresses cannot be enumerated.
+func postForgotPassword(ctx iris.Context) {
+	credentials := Credentials{}
+	err := ctx.ReadForm(&credentials)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	address, err := mail.ParseAddress(credentials.Email)
+	if err != nil {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please enter a valid email address.")
+		ctx.View("forgot-password.html")
+		return
+	}
+
+	user, err := findUserByEmail(address.Address)
+	if err != nil && err != ErrUserNotFound {
+		ctx.SetErr(err)
+		return
+	}
+
+	if user != nil {
+		token, err := signToken(passwordResetPurpose, passwordResetTTL, passwordResetData{
+			Username:    user.Username,
+			Fingerprint: passwordFingerprint(user.PasswordHash),
+		})
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+
+		link := publicURL + "/reset-password?token=" + url.QueryEscape(token)
+		if err := sendEmail(ctx, emailPasswordReset, user, link, passwordResetTTL); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	ctx.ViewData("Email", address.Address)
+	ctx.View("forgot-password-sent.html")
+}
+
+// verifyPasswordReset returns the user a password reset token was issued to
+func verifyPasswordReset(token string, singleUse bool) (*User, error) {
+	data := passwordResetData{}
+	verify := verifyToken
+	if singleUse {
+		verify = verifySingleUseToken
+	}
+	if _, err := verify(passwordResetPurpose, token, &data); err != nil {
+		return nil, err
+	}
+
+	user, err := users.Get(data.Username)
+	if err == ErrUserNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data.Fingerprint != passwordFingerprint(user.PasswordHash) {
+		return nil, ErrUsedToken
+	}
+
+	return user, nil
+}
+
+// isTokenError reports whether err was caused by an invalid, expired or used token
+func isTokenError(err error) bool {
+	return err == ErrInvalidToken || err == ErrExpiredToken || err == ErrUsedToken
+}
+
+// getResetPassword returns the password reset view on a GET request
+func getResetPassword(ctx iris.Context) {
+	token := ctx.URLParam("token")
+	_, err := verifyPasswordReset(token, false)
+	if isTokenError(err) {
+		viewForgotPasswordError(ctx)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Token", token)
+	viewPasswordPolicy(ctx, nil)
+	ctx.View("reset-password.html")
+}
+
+// postResetPassword handles POST requests to the password reset endpoint
+//
+// The new password replaces the stored hash and every existing session of the user is invalidated.
+func postResetPassword(ctx iris.Context) {
+	form := PasswordResetForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// Check the new password before the single-use token is consumed so that the user can correct it
+	user, err := verifyPasswordReset(form.Token, false)
+	if isTokenError(err) {
+		viewForgotPasswordError(ctx)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if problems := checkNewPassword(user, form.Password, form.ConfirmPassword); len(problems) > 0 {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Token", form.Token)
+		viewPasswordPolicy(ctx, problems)
+		ctx.View("reset-password.html")
+		return
+	}
+
+	_, err = verifyPasswordReset(form.Token, true)
+	if isTokenError(err) {
+		viewForgotPasswordError(ctx)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if err := setPassword(user, form.Password); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	user.RememberTokens = nil
+	user.SessionsValidAfter = time.Now().UnixNano()
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// End the current session too, so the user logs in with the new password
+	sess.Start(ctx).Clear()
+
+	ctx.ViewData("Notice", "Your password has been changed. Please login with your new password.")
+	getLogin(ctx)
+}
+
+// viewForgotPasswordError re-renders the forgotten password view when a reset link cannot be used
+func viewForgotPasswordError(ctx iris.Context) {
+	ctx.StatusCode(iris.StatusBadRequest)
+	ctx.ViewData("Error", "This password reset link is invalid, has expired or has already been used. Please request a new one.")
+	ctx.View("forgot-password.html")
+}
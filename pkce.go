@@ -0,0 +1,19 @@
+package main
+
+import "regexp"
+
+// pkceMethodS256 is the code challenge method of PKCE, and the only one Kong's OAuth 2.0 plugin supports
+const pkceMethodS256 = "S256"
+
+// codeChallengePattern matches a base64url encoded SHA-256 code challenge, or a code verifier, as in RFC 7636
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// validCodeChallenge reports whether a consent request's PKCE parameters can be forwarded to Kong
+//
+// Both are optional, but a method without a challenge, or the plain method, is refused.
+func validCodeChallenge(consent ConsentRequest) bool {
+	if consent.CodeChallenge == "" {
+		return consent.CodeChallengeMethod == ""
+	}
+	return consent.CodeChallengeMethod == pkceMethodS256 && codeChallengePattern.MatchString(consent.CodeChallenge)
+}
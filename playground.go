@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/kataras/iris/v12"
+)
+
+// playgroundPaths are the Kong-protected API paths the playground calls with an access token, configured as
+// 'path=scope scope' or just a path; the playground is disabled if there are none
+var playgroundPaths = parsePlaygroundPaths(envList("PLAYGROUND_API_PATHS"))
+
+// playgroundPath is an API path of the playground and the scopes its route requires on Kong
+type playgroundPath struct {
+	Path   string
+	Scopes []string
+}
+
+// playgroundResult is the outcome of calling an API path of the playground with an access token
+type playgroundResult struct {
+	playgroundPath
+
+	// Granted reports whether the token has every scope the path requires
+	Granted bool
+	Status  int
+	Error   string
+}
+
+// PlaygroundExchangeForm represents the authorization code exchanged at the token endpoint in the playground
+type PlaygroundExchangeForm struct {
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+// playgroundExchange is the outcome of exchanging an authorization code in the playground
+type playgroundExchange struct {
+	Outcome     string
+	Status      int
+	Error       string
+	Explanation string
+	AccessToken string
+	Scope       string
+}
+
+// Allowed reports whether Kong let the request through to the API
+func (r playgroundResult) Allowed() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+// parsePlaygroundPaths parses the API paths of the playground, each with the space separated scopes it requires
+func parsePlaygroundPaths(values []string) []playgroundPath {
+	paths := []playgroundPath{}
+	for _, value := range values {
+		path, scopes := value, ""
+		if i := strings.IndexByte(value, '='); i >= 0 {
+			path, scopes = strings.TrimSpace(value[:i]), value[i+1:]
+		}
+		if !strings.HasPrefix(path, "/") {
+			log.Printf("invalid PLAYGROUND_API_PATHS entry %q, expected /path=scope scope", value)
+			continue
+		}
+		paths = append(paths, playgroundPath{Path: path, Scopes: splitScopes(scopes)})
+	}
+	return paths
+}
+
+// getPlayground returns the playground, where an access token can be tried against several API paths
+func getPlayground(ctx iris.Context) {
+	if len(playgroundPaths) == 0 {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.ViewData("Paths", playgroundPaths)
+	ctx.View("playground.html")
+}
+
+// postPlayground calls every API path of the playground with the submitted access token, concurrently, and shows
+// which Kong let through alongside the scopes each requires
+//
+// The token's scopes are fetched from Kong so that a path refused for a missing scope can be told apart from one
+// refused for another reason. The token is never echoed back to the page.
+func postPlayground(ctx iris.Context) {
+	if len(playgroundPaths) == 0 {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	accessToken := strings.TrimSpace(ctx.FormValue("AccessToken"))
+	if accessToken == "" {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please enter an access token.")
+		getPlayground(ctx)
+		return
+	}
+
+	var tokenScopes []string
+	token, err := getKongAccessToken(kongContext(ctx), accessToken)
+	if err != nil {
+		log.Printf("playground: %v", err)
+	} else if token.ID != "" {
+		tokenScopes = splitScopes(token.Scope)
+		ctx.ViewData("TokenScopes", tokenScopes)
+	}
+
+	results := make([]playgroundResult, len(playgroundPaths))
+	var wg sync.WaitGroup
+	for i, path := range playgroundPaths {
+		wg.Add(1)
+		go func(i int, path playgroundPath) {
+			defer wg.Done()
+			result := playgroundResult{playgroundPath: path, Granted: true}
+			for _, scope := range path.Scopes {
+				if !containsString(tokenScopes, scope) {
+					result.Granted = false
+				}
+			}
+
+			req, err := http.NewRequestWithContext(kongContext(ctx), http.MethodGet, kongProxyEndpoint+path.Path, nil)
+			if err == nil {
+				req.Header.Set("Authorization", "Bearer "+accessToken)
+				result.Status, _, err = executeRequestStatus(req)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results[i] = result
+		}(i, path)
+	}
+	wg.Wait()
+
+	ctx.ViewData("Results", results)
+	getPlayground(ctx)
+}
+
+// postPlaygroundExchange exchanges an authorization code at the token endpoint, as a client would, and explains
+// Kong's response
+//
+// Exchanging the same code again shows that codes are single use: Kong refuses replayed and expired codes with the
+// same error, and the playground tells them apart with what the consent page remembered of the code. The access
+// token of a successful exchange is shown, so that it can be tried against the API paths. The client secret is
+// never echoed back to the page.
+func postPlaygroundExchange(ctx iris.Context) {
+	if len(playgroundPaths) == 0 {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	form := PlaygroundExchangeForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	form.Code = strings.TrimSpace(form.Code)
+	ctx.ViewData("ExchangeForm", form)
+	if form.Code == "" || form.ClientID == "" {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please enter a client ID and an authorization code.")
+		getPlayground(ctx)
+		return
+	}
+
+	params := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {form.Code},
+		"client_id":     {form.ClientID},
+		"client_secret": {form.ClientSecret},
+	}
+	if form.RedirectURI != "" {
+		params.Set("redirect_uri", form.RedirectURI)
+	}
+	if form.CodeVerifier != "" {
+		params.Set("code_verifier", form.CodeVerifier)
+	}
+	status, response, outcome, err := forwardTokenRequest(kongContext(ctx), []byte(params.Encode()),
+		"application/x-www-form-urlencoded", "")
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	exchange := playgroundExchange{Outcome: outcome, Status: status, Explanation: describeCodeOutcome(form.Code, outcome)}
+	tokens := struct {
+		AccessToken      string `json:"access_token"`
+		Scope            string `json:"scope"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.Unmarshal(response, &tokens); err != nil {
+		log.Printf("playground: unexpected token response: %s", response)
+	}
+	exchange.AccessToken, exchange.Scope = tokens.AccessToken, tokens.Scope
+	exchange.Error = tokens.Error
+	if tokens.ErrorDescription != "" {
+		exchange.Error += ": " + tokens.ErrorDescription
+	}
+	if outcome == codeReplayed {
+		auditCodeReplay(ctx, form.ClientID)
+	}
+
+	ctx.ViewData("Exchange", exchange)
+	getPlayground(ctx)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// problemTypeBase prefixes the problem types returned by JSON endpoints. The types are stable identifiers that
+// clients can compare against; they are not meant to be dereferenced.
+const problemTypeBase = "urn:kong-oauth2-consent-app:problem:"
+
+// Problem types returned in problem details
+const (
+	problemInvalidRequest     = "invalid-request"
+	problemUnauthorized       = "unauthorized"
+	problemConflict           = "conflict"
+	problemKongError          = "kong-error"
+	problemKongUnavailable    = "kong-unavailable"
+	problemUnknownClient      = "unknown-client"
+	problemInvalidScope       = "invalid-scope"
+	problemStoreError         = "store-error"
+	problemInternalError      = "internal-error"
+	problemServiceUnavailable = "service-unavailable"
+)
+
+// problemTitles are the short, human-readable summaries of each problem type
+var problemTitles = map[string]string{
+	problemInvalidRequest:     "The request is invalid",
+	problemUnauthorized:       "Authentication failed or is required",
+	problemConflict:           "The request conflicts with existing data",
+	problemKongError:          "Kong refused the authorization request",
+	problemKongUnavailable:    "Kong is unavailable",
+	problemUnknownClient:      "The client application is not registered",
+	problemInvalidScope:       "A requested scope is not configured",
+	problemStoreError:         "The user store or client registry failed",
+	problemInternalError:      "An unexpected error occurred",
+	problemServiceUnavailable: "The service is temporarily unavailable",
+}
+
+// requestIDPattern matches request IDs accepted from trusted proxies
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// assignRequestID is middleware that gives each request a correlation ID, returned in the X-Request-ID header
+// and in problem details, and included when errors are logged
+//
+// An X-Request-ID set by a trusted proxy is kept so that the ID can be followed across services.
+func assignRequestID(ctx iris.Context) {
+	id := ctx.GetHeader("X-Request-ID")
+	if id == "" || !requestIDPattern.MatchString(id) || !fromTrustedProxy(ctx) {
+		id = newRequestID()
+	}
+	ctx.SetID(id)
+	ctx.Header("X-Request-ID", id)
+	ctx.Next()
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// fromTrustedProxy reports whether the request's connection comes from a trusted proxy
+func fromTrustedProxy(ctx iris.Context) bool {
+	ip := parseIP(ctx.Request().RemoteAddr)
+	return ip != nil && isTrustedProxy(ip)
+}
+
+// requestID returns the request's correlation ID
+func requestID(ctx iris.Context) string {
+	if id, ok := ctx.GetID().(string); ok {
+		return id
+	}
+	return ""
+}
+
+// wantsProblem reports whether the client expects a JSON response rather than a page
+func wantsProblem(ctx iris.Context) bool {
+	accept := ctx.GetHeader("Accept")
+	return strings.Contains(accept, "application/json") || strings.Contains(accept, "application/problem+json")
+}
+
+// viewProblem responds with RFC 7807 problem details of the given type
+func viewProblem(ctx iris.Context, status int, problemType, detail string) {
+	problem := iris.NewProblem().
+		Type(problemTypeBase+problemType).
+		Title(problemTitles[problemType]).
+		Status(status).
+		Key("correlation_id", requestID(ctx))
+	if detail != "" {
+		problem.Detail(detail)
+	}
+	ctx.Problem(problem)
+}
+
+// statusProblemType returns the problem type for errors that are only distinguished by their status code
+func statusProblemType(status int) string {
+	switch status {
+	case iris.StatusBadRequest:
+		return problemInvalidRequest
+	case iris.StatusUnauthorized, iris.StatusForbidden:
+		return problemUnauthorized
+	case iris.StatusConflict:
+		return problemConflict
+	case iris.StatusServiceUnavailable:
+		return problemServiceUnavailable
+	default:
+		return problemInternalError
+	}
+}
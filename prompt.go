@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// The values of OpenID Connect's prompt parameter the consent endpoint acts on
+const (
+	// promptNone asks for the request to be answered without showing the user any page
+	promptNone = "none"
+	// promptLogin asks for the user to log in again, even if they are already logged in
+	promptLogin = "login"
+	// promptConsent asks for the consent page to be shown, even if the user has already granted the scopes
+	promptConsent = "consent"
+	// promptSelectAccount asks for the user to choose an account, which is the one they are logged in with
+	promptSelectAccount = "select_account"
+)
+
+// parsePrompt returns the space separated values of the prompt parameter, or false if any is unknown or none is
+// combined with another value
+func parsePrompt(prompt string) ([]string, bool) {
+	values := strings.Fields(prompt)
+	for _, value := range values {
+		switch value {
+		case promptLogin, promptConsent, promptSelectAccount:
+		case promptNone:
+			if len(values) > 1 {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// requireLogin sends the user back to the login page for prompt=login, and reports whether it has completed the
+// response
+//
+// The consent request is resumed without prompt once they have logged in, so that they are only asked once.
+func requireLogin(ctx iris.Context, consent ConsentRequest) bool {
+	if impersonating(ctx) {
+		return false
+	}
+
+	session := sess.Start(ctx)
+	setPendingConsent(session, consent)
+	audit(ctx, "consent.reauthenticate", map[string]string{"client_id": consent.ClientID, "prompt": promptLogin})
+	session.Set("reauthenticate", true)
+	ctx.Redirect("/login", iris.StatusSeeOther)
+	return true
+}
+
+// authorizeSilently answers a consent request with prompt=none without showing the user any page
+//
+// The request is authorized if the user is logged in and has already granted the client every scope it asks for.
+// Otherwise the client is sent the OpenID Connect error for what the user would have been asked to do: log in
+// (login_required), grant the scopes (consent_required) or anything else (interaction_required).
+func authorizeSilently(ctx iris.Context, consent ConsentRequest, maxAge string) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		returnPromptError(ctx, consent, "login_required")
+		return
+	}
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if consent.LoginHint != "" && !impersonating(ctx) && !loginHintMatches(user, consent.LoginHint) {
+		returnPromptError(ctx, consent, "login_required")
+		return
+	}
+	if impersonating(ctx) && !impersonationAllowConsent {
+		returnPromptError(ctx, consent, "interaction_required")
+		return
+	}
+	if verifiedEmailRequired() && (user.Email == "" || !user.EmailVerified) {
+		returnPromptError(ctx, consent, "interaction_required")
+		return
+	}
+	if !impersonating(ctx) && passwordExpired(user) {
+		returnPromptError(ctx, consent, "interaction_required")
+		return
+	}
+	if maxAge != "" && !impersonating(ctx) {
+		seconds, ok := parseMaxAge(maxAge)
+		if !ok {
+			viewError(ctx, iris.StatusBadRequest, "MaxAgeInvalid")
+			return
+		}
+		if !loginFresh(session, seconds) {
+			returnPromptError(ctx, consent, "login_required")
+			return
+		}
+	}
+
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	registeredURI, ok := matchRedirectURI(credential, consent.RedirectURI)
+	if !ok {
+		viewError(ctx, iris.StatusBadRequest, "RedirectURIInvalid")
+		return
+	}
+
+	scopes := splitScopes(consent.Scopes)
+	if err := checkScopes(kongContext(ctx), scopes); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	scopes, err = checkClientScopes(consent.ClientID, scopes)
+	if errors.Is(err, ErrInvalidScope) {
+		returnPromptError(ctx, consent, "invalid_scope")
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if len(scopeRoles) > 0 {
+		var denied []string
+		if scopes, denied = entitledScopes(user, scopes); len(denied) > 0 && scopeRoleAction == scopeRoleActionRefuse {
+			returnPromptError(ctx, consent, "access_denied")
+			return
+		}
+	}
+	reloadMu.RLock()
+	policies := consentPolicies
+	reloadMu.RUnlock()
+	if len(violatedConsentPolicies(policies, consent.ClientID, scopes, clientIP(ctx), time.Now())) > 0 {
+		returnPromptError(ctx, consent, "access_denied")
+		return
+	}
+	if requiresStepUp(scopes) && !impersonating(ctx) {
+		hasSecondFactor := len(user.WebAuthnCredentials) > 0 || user.TOTPEnabled
+		if !hasSecondFactor && stepUpRequireSecondFactor {
+			returnPromptError(ctx, consent, "interaction_required")
+			return
+		}
+		if !stepUpVerified(session, user) {
+			returnPromptError(ctx, consent, "login_required")
+			return
+		}
+	}
+
+	// Only scopes the user has already granted the client, and not revoked, are given without asking. Authorization
+	// details are never granted for good, so each request for them is approved by the user.
+	if len(ungrantedScopes(user, consent.ClientID, scopes)) > 0 || consent.AuthorizationDetails != "" {
+		returnPromptError(ctx, consent, "consent_required")
+		return
+	}
+
+	requestedURI := consent.RedirectURI
+	consent.RedirectURI = registeredURI
+	consent.Scopes = strings.Join(scopes, ",")
+	authorizeConsent(ctx, consent, user, credential, requestedURI, scopes)
+}
+
+// returnPromptError redirects the user to the client with the error a prompt=none request failed with
+//
+// Redirect URIs that are not registered for the client are refused with an error page, as any other request's.
+func returnPromptError(ctx iris.Context, consent ConsentRequest, code string) {
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	redirectURI, ok := errorRedirectURI(credential, consent, code)
+	if !ok {
+		viewError(ctx, iris.StatusBadRequest, "RedirectURIInvalid")
+		return
+	}
+	if redirectURI, err = withJWTResponse(redirectURI, consent); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	audit(ctx, "consent.failed", map[string]string{"client_id": consent.ClientID, "error": code, "prompt": promptNone})
+
+	client, err := getClientSettings(consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if viewClientReturn(ctx, consent, client, credential.ApplicationName, redirectURI) {
+		return
+	}
+	ctx.Redirect(redirectURI, iris.StatusSeeOther)
+}
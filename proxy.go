@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	outboundProxyURL      = os.Getenv("OUTBOUND_PROXY_URL")
+	outboundProxyUsername = os.Getenv("OUTBOUND_PROXY_USERNAME")
+	outboundProxyPassword = os.Getenv("OUTBOUND_PROXY_PASSWORD")
+	outboundNoProxy       = os.Getenv("OUTBOUND_NO_PROXY")
+)
+
+// outboundProxy returns the proxy function for requests to Kong and other outbound services
+//
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored unless overridden by OUTBOUND_PROXY_URL and OUTBOUND_NO_PROXY.
+// Proxy credentials may be given in the proxy URL or, to keep them out of it, with OUTBOUND_PROXY_USERNAME and
+// OUTBOUND_PROXY_PASSWORD.
+func outboundProxy() (func(*http.Request) (*url.URL, error), error) {
+	config := httpproxy.FromEnvironment()
+	if outboundProxyURL != "" {
+		config.HTTPProxy = outboundProxyURL
+		config.HTTPSProxy = outboundProxyURL
+	}
+	if outboundNoProxy != "" {
+		config.NoProxy = outboundNoProxy
+	}
+
+	// Validate the proxy URLs up front rather than failing on the first request
+	for _, proxy := range []string{config.HTTPProxy, config.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		if _, err := url.Parse(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		proxy, err := proxyFunc(req.URL)
+		if err != nil || proxy == nil {
+			return proxy, err
+		}
+		if outboundProxyUsername != "" {
+			proxy.User = url.UserPassword(outboundProxyUsername, outboundProxyPassword)
+		}
+		return proxy, nil
+	}, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// keyedLimiter rate limits events separately for each key, such as a badge number or client IP address
+type keyedLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*keyedLimiterEntry
+	sweep    time.Time
+}
+
+// keyedLimiterEntry is the limiter for a single key and when it was last used
+type keyedLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newKeyedLimiter creates a limiter allowing burst events per key, replenished at perMinute events a minute
+func newKeyedLimiter(perMinute, burst int) *keyedLimiter {
+	return &keyedLimiter{
+		limit:    rate.Limit(float64(perMinute) / 60),
+		burst:    burst,
+		limiters: map[string]*keyedLimiterEntry{},
+	}
+}
+
+// Allow reports whether an event for key may happen now
+func (l *keyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.removeIdle(now)
+
+	entry, ok := l.limiters[key]
+	if !ok {
+		entry = &keyedLimiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// removeIdle forgets keys whose limiters have fully replenished, at most once a minute; the caller must hold the lock
+func (l *keyedLimiter) removeIdle(now time.Time) {
+	if now.Sub(l.sweep) < time.Minute {
+		return
+	}
+	l.sweep = now
+
+	idle := time.Minute
+	if l.limit > 0 {
+		idle += time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	}
+	for key, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) > idle {
+			delete(l.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"html/template"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// requireHTTPSRedirectURIs refuses plain HTTP redirect URIs, other than the loopback redirect URIs of native apps
+var requireHTTPSRedirectURIs = envBool("REQUIRE_HTTPS_REDIRECT_URIS", false)
+
+var redirectURIRefusals = metrics.Counter("redirect_uri_refusals_total", "Number of consent requests refused for a redirect URI not registered for the client.")
+
+// unsafeRedirectSchemes are URI schemes that must never be used to return a user to a client application
+var unsafeRedirectSchemes = map[string]bool{
+	"javascript": true,
+	"data":       true,
+	"vbscript":   true,
+	"file":       true,
+	"blob":       true,
+	"about":      true,
+}
+
+// matchRedirectURI returns the registered redirect URI of a client matching the redirect URI it requested
+//
+// An empty redirect URI matches the client's only registered redirect URI, and does not match for clients with
+// several, which must say which one they want as RFC 6749 section 3.1.2.3 requires. Loopback redirect URIs used by
+// native apps match a registered loopback URI on any port, as described in RFC 8252. When HTTPS redirect URIs are
+// required, plain HTTP is only allowed for loopback redirect URIs.
+func matchRedirectURI(credential *OAuth2Credential, redirectURI string) (string, bool) {
+	if redirectURI == "" {
+		switch len(credential.RedirectURIs) {
+		case 0:
+			return "", true
+		case 1:
+			return credential.RedirectURIs[0], true
+		}
+		return "", false
+	}
+
+	uri, err := url.Parse(redirectURI)
+	if err != nil || uri.Scheme == "" || uri.Fragment != "" || unsafeRedirectSchemes[strings.ToLower(uri.Scheme)] {
+		return "", false
+	}
+
+	loopback := isLoopbackRedirect(uri)
+	if requireHTTPSRedirectURIs && uri.Scheme == "http" && !loopback {
+		return "", false
+	}
+
+	for _, registered := range credential.RedirectURIs {
+		if redirectURI == registered {
+			return registered, true
+		}
+		if !loopback {
+			continue
+		}
+		if candidate, err := url.Parse(registered); err == nil && isLoopbackRedirect(candidate) &&
+			candidate.Hostname() == uri.Hostname() && candidate.EscapedPath() == uri.EscapedPath() &&
+			candidate.RawQuery == uri.RawQuery {
+			return registered, true
+		}
+	}
+	return "", false
+}
+
+// consentRedirectURIAllowed reports whether the consent page may be shown for a request with the redirect URI
+//
+// Previews of the consent page from the developer portal are sent nowhere, so they have no redirect URI and are
+// shown even for clients with several registered redirect URIs.
+func consentRedirectURIAllowed(credential *OAuth2Credential, redirectURI string, preview bool) bool {
+	if preview {
+		return true
+	}
+	_, ok := matchRedirectURI(credential, redirectURI)
+	return ok
+}
+
+// isLoopbackRedirect reports whether uri is an RFC 8252 loopback redirect URI, 'http' with a loopback IP literal
+//
+// The name 'localhost' is not treated as loopback as it may resolve to a non-loopback interface.
+func isLoopbackRedirect(uri *url.URL) bool {
+	if uri.Scheme != "http" {
+		return false
+	}
+	ip := net.ParseIP(uri.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireRegisteredRedirectURI refuses a consent request whose redirect URI is not registered for the client, or that
+// does not name one of the client's several redirect URIs, and reports whether it has completed the response
+//
+// It is checked before the user is asked to log in, so that a request that could only send the authorization code to
+// a URI the client does not own never gets as far as a login or consent page.
+func requireRegisteredRedirectURI(ctx iris.Context, consent ConsentRequest) bool {
+	credential, err := getOAuth2Credential(kongContext(ctx), consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+	if _, ok := matchRedirectURI(credential, consent.RedirectURI); ok {
+		return false
+	}
+
+	audit(ctx, "consent.redirect_uri_refused", map[string]string{"client_id": consent.ClientID, "redirect_uri": consent.RedirectURI})
+	redirectURIRefusals.Inc()
+	if consent.RedirectURI == "" {
+		viewError(ctx, iris.StatusBadRequest, "RedirectURIRequired")
+		return true
+	}
+	viewError(ctx, iris.StatusBadRequest, "RedirectURIInvalid")
+	return true
+}
+
+// withRequestedPort returns redirectURI with the port of the loopback redirect URI the client requested
+//
+// Kong only accepts registered redirect URIs, so it is called with the registered loopback URI and the port the
+// native app is listening on is restored in the URI it returns.
+func withRequestedPort(redirectURI, requested string) string {
+	requestedURI, err := url.Parse(requested)
+	if err != nil || !isLoopbackRedirect(requestedURI) {
+		return redirectURI
+	}
+	uri, err := url.Parse(redirectURI)
+	if err != nil || !isLoopbackRedirect(uri) {
+		return redirectURI
+	}
+
+	uri.Host = requestedURI.Host
+	return uri.String()
+}
+
+// withState adds the client's state to a redirect URI returned by Kong if Kong has not included it
+//
+// The implicit grant returns its parameters in the fragment rather than the query, and the state with them.
+func withState(redirectURI, state string, fragment bool) string {
+	if state == "" {
+		return redirectURI
+	}
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	params := uri.Query()
+	if fragment {
+		if params, err = url.ParseQuery(uri.Fragment); err != nil {
+			return redirectURI
+		}
+	}
+	if params.Get("state") != "" {
+		return redirectURI
+	}
+	params.Set("state", state)
+	if fragment {
+		uri.Fragment = ""
+		return uri.String() + "#" + params.Encode()
+	}
+	uri.RawQuery = params.Encode()
+	return uri.String()
+}
+
+// withError returns a redirect URI with an RFC 6749 error response, such as access_denied, and the client's state
+//
+// Errors for the implicit grant are returned in the fragment, like its successful responses. Any error already in
+// the redirect URI is replaced.
+func withError(redirectURI, code, description, state string, fragment bool) string {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	params := uri.Query()
+	if fragment {
+		params = url.Values{}
+		uri.Fragment = ""
+	}
+	params.Set("error", code)
+	params.Del("error_description")
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if fragment {
+		return withState(uri.String()+"#"+params.Encode(), state, true)
+	}
+	uri.RawQuery = params.Encode()
+	return withState(uri.String(), state, false)
+}
+
+// redirectError returns the RFC 6749 error and its description from a redirect URI's query or fragment, if any
+func redirectError(redirectURI string) (code, description string) {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", ""
+	}
+	params := uri.Query()
+	if params.Get("error") == "" {
+		if params, err = url.ParseQuery(uri.Fragment); err != nil {
+			return "", ""
+		}
+	}
+	return params.Get("error"), params.Get("error_description")
+}
+
+// isAppRedirect reports whether a redirect URI returns the user to a native app rather than a website
+//
+// Custom scheme URIs such as 'com.example.app:/callback' always open an app. HTTPS URIs open an app when they are
+// registered as Android App Links or iOS Universal Links in the client registry.
+func isAppRedirect(client *ClientSettings, redirectURI string) bool {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(uri.Scheme) {
+	case "http", "https":
+	default:
+		return !unsafeRedirectSchemes[strings.ToLower(uri.Scheme)]
+	}
+
+	uri.RawQuery = ""
+	uri.Fragment = ""
+	for _, link := range client.AppLinks {
+		if uri.String() == link {
+			return true
+		}
+	}
+	return false
+}
+
+// viewAppRedirect renders the interstitial page that returns the user to a native app
+//
+// The page attempts to open the app immediately and offers a button in case the browser blocks the navigation.
+// When there is no app to return to, for example because consent was given on a different device from the app,
+// the authorization code is shown so the user can enter it manually. Denied and failed requests return the user with an error.
+func viewAppRedirect(ctx iris.Context, applicationName, redirectURI string) {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("ApplicationName", applicationName)
+	// The redirect URI was validated against the client registration and checked for unsafe schemes, so it is
+	// marked as safe for html/template, which would otherwise replace custom schemes.
+	ctx.ViewData("RedirectURI", template.URL(redirectURI))
+	// Access tokens from the implicit grant, in the fragment, are never shown
+	ctx.ViewData("Code", uri.Query().Get("code"))
+	code, _ := redirectError(redirectURI)
+	ctx.ViewData("ErrorCode", code)
+	ctx.View("app-redirect.html")
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+// TestConsentRedirectURIAllowedPreview checks that the developer portal's preview, which has no redirect URI, is shown
+// for a client with several registered redirect URIs, while consent requests without one are refused
+func TestConsentRedirectURIAllowedPreview(t *testing.T) {
+	credential := &OAuth2Credential{RedirectURIs: []string{"https://client.example.com/callback", "https://client.example.com/other"}}
+
+	if !consentRedirectURIAllowed(credential, "", true) {
+		t.Error("the preview of a client with several redirect URIs was refused")
+	}
+	if consentRedirectURIAllowed(credential, "", false) {
+		t.Error("a consent request without redirect_uri was allowed for a client with several redirect URIs")
+	}
+	if !consentRedirectURIAllowed(credential, "https://client.example.com/other", false) {
+		t.Error("a consent request for a registered redirect URI was refused")
+	}
+	if consentRedirectURIAllowed(credential, "https://attacker.example.com/", false) {
+		t.Error("a consent request for an unregistered redirect URI was allowed")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kataras/golog"
+	"github.com/kataras/iris/v12/sessions"
+)
+
+var (
+	// sessionRedisAddr is the host:port of the Redis server sessions are kept in when SESSION_STORE is redis
+	sessionRedisAddr     = envOrDefault("SESSION_REDIS_ADDR", "127.0.0.1:6379")
+	sessionRedisPassword = os.Getenv("SESSION_REDIS_PASSWORD")
+	sessionRedisDatabase = envInt("SESSION_REDIS_DATABASE", 0)
+	// sessionRedisPrefix is prepended to the Redis keys of sessions, so that several applications can share a server
+	sessionRedisPrefix  = envOrDefault("SESSION_REDIS_PREFIX", "kong-oauth2-consent-app:")
+	sessionRedisTLS     = envBool("SESSION_REDIS_TLS", false)
+	sessionRedisTimeout = envDuration("SESSION_REDIS_TIMEOUT", 2*time.Second)
+)
+
+// newRedisClient returns a client for the Redis server configured with SESSION_REDIS_ADDR
+func newRedisClient() *redis.Client {
+	options := &redis.Options{
+		Addr:         sessionRedisAddr,
+		Password:     sessionRedisPassword,
+		DB:           sessionRedisDatabase,
+		DialTimeout:  sessionRedisTimeout,
+		ReadTimeout:  sessionRedisTimeout,
+		WriteTimeout: sessionRedisTimeout,
+	}
+	if sessionRedisTLS {
+		host, _, _ := net.SplitHostPort(sessionRedisAddr)
+		options.TLSConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	return redis.NewClient(options)
+}
+
+// redisSessionIDField is a field every session hash holds, so that empty sessions exist until they expire
+const redisSessionIDField = "_sid"
+
+// redisSessionDatabase is an iris session database keeping each session in a Redis hash that expires with it, so
+// that every replica shares the sessions
+//
+// Values are encoded with iris's session transcoder, JSON by default. Sessions without an expiry of their own end
+// after SESSION_IDLE_TIMEOUT without a request. Like iris's own session databases, values do not expire on their
+// own; the ttl passed to Set is ignored.
+type redisSessionDatabase struct {
+	client *redis.Client
+	prefix string
+}
+
+// openRedisSessionDatabase connects to the Redis server configured with SESSION_REDIS_ADDR
+func openRedisSessionDatabase() (*redisSessionDatabase, error) {
+	db := &redisSessionDatabase{client: newRedisClient(), prefix: sessionRedisPrefix}
+	if err := db.client.Ping(context.Background()).Err(); err != nil {
+		db.client.Close()
+		return nil, fmt.Errorf("connecting to the session database at %s: %w", sessionRedisAddr, err)
+	}
+	return db, nil
+}
+
+// key returns the Redis key of a session
+func (db *redisSessionDatabase) key(sid string) string {
+	return db.prefix + sid
+}
+
+// SetLogger is called by iris with its logger; errors are logged with the standard logger like the rest of the
+// application instead
+func (db *redisSessionDatabase) SetLogger(*golog.Logger) {}
+
+// Acquire creates the session if it does not exist yet, and otherwise returns when it expires
+func (db *redisSessionDatabase) Acquire(sid string, expires time.Duration) sessions.LifeTime {
+	ctx := context.Background()
+	key := db.key(sid)
+	idle := expires <= 0
+	if idle {
+		expires = sessionIdleTimeout
+	}
+
+	ttl, err := db.client.PTTL(ctx, key).Result()
+	if err != nil {
+		log.Printf("acquiring session: %v", err)
+		return sessions.LifeTime{}
+	}
+	// PTTL is -2 for keys that do not exist, which are created, and -1 for keys without an expiry
+	if ttl == -2 {
+		if err := db.client.HSet(ctx, key, redisSessionIDField, sid).Err(); err != nil {
+			log.Printf("creating session: %v", err)
+			return sessions.LifeTime{}
+		}
+	}
+	if ttl < 0 || idle {
+		if err := db.OnUpdateExpiration(sid, expires); err != nil {
+			log.Printf("setting session expiry: %v", err)
+		}
+		return sessions.LifeTime{}
+	}
+	return sessions.LifeTime{Time: time.Now().Add(ttl)}
+}
+
+// OnUpdateExpiration changes when the session expires
+func (db *redisSessionDatabase) OnUpdateExpiration(sid string, newExpires time.Duration) error {
+	if newExpires <= 0 {
+		newExpires = sessionIdleTimeout
+	}
+	return db.client.PExpire(context.Background(), db.key(sid), newExpires).Err()
+}
+
+// Set stores a value in the session
+func (db *redisSessionDatabase) Set(sid string, key string, value interface{}, _ time.Duration, _ bool) error {
+	encoded, err := sessions.DefaultTranscoder.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return db.client.HSet(context.Background(), db.key(sid), key, encoded).Err()
+}
+
+// Get returns a value of the session, or nil if it has none
+func (db *redisSessionDatabase) Get(sid string, key string) interface{} {
+	var value interface{}
+	if err := db.Decode(sid, key, &value); err != nil {
+		return nil
+	}
+	return value
+}
+
+// Decode decodes a value of the session into outPtr
+func (db *redisSessionDatabase) Decode(sid, key string, outPtr interface{}) error {
+	encoded, err := db.client.HGet(context.Background(), db.key(sid), key).Bytes()
+	if err == redis.Nil {
+		return fmt.Errorf("session has no value %q", key)
+	}
+	if err != nil {
+		return err
+	}
+	return sessions.DefaultTranscoder.Unmarshal(encoded, outPtr)
+}
+
+// Visit calls cb with each value of the session
+func (db *redisSessionDatabase) Visit(sid string, cb func(key string, value interface{})) error {
+	fields, err := db.client.HGetAll(context.Background(), db.key(sid)).Result()
+	if err != nil {
+		return err
+	}
+	for key, encoded := range fields {
+		if key == redisSessionIDField {
+			continue
+		}
+		var value interface{}
+		if err := sessions.DefaultTranscoder.Unmarshal([]byte(encoded), &value); err != nil {
+			return err
+		}
+		cb(key, value)
+	}
+	return nil
+}
+
+// Len returns the number of values in the session
+func (db *redisSessionDatabase) Len(sid string) int {
+	n := 0
+	db.Visit(sid, func(string, interface{}) { n++ })
+	return n
+}
+
+// Delete removes a value from the session and reports whether it had one
+func (db *redisSessionDatabase) Delete(sid string, key string) bool {
+	n, err := db.client.HDel(context.Background(), db.key(sid), key).Result()
+	if err != nil {
+		log.Printf("deleting session value: %v", err)
+	}
+	return n > 0
+}
+
+// Clear removes every value from the session, keeping the session itself
+func (db *redisSessionDatabase) Clear(sid string) error {
+	ctx := context.Background()
+	keys, err := db.client.HKeys(ctx, db.key(sid)).Result()
+	if err != nil {
+		return err
+	}
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != redisSessionIDField {
+			fields = append(fields, key)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return db.client.HDel(ctx, db.key(sid), fields...).Err()
+}
+
+// Release removes the session
+func (db *redisSessionDatabase) Release(sid string) error {
+	return db.client.Del(context.Background(), db.key(sid)).Err()
+}
+
+// Close closes the connections to Redis
+func (db *redisSessionDatabase) Close() error {
+	return db.client.Close()
+}
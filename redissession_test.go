@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// TestRedisSessionDatabase checks that sessions are created with the idle timeout, that their values round trip and
+// that clearing a session keeps it
+func TestRedisSessionDatabase(t *testing.T) {
+	server := miniredis.RunT(t)
+	db := &redisSessionDatabase{client: redis.NewClient(&redis.Options{Addr: server.Addr()}), prefix: "test:"}
+	defer db.Close()
+
+	if lifetime := db.Acquire("sid", 0); !lifetime.IsZero() {
+		t.Fatalf("new session acquired with lifetime %v", lifetime.Time)
+	}
+	if ttl := server.TTL("test:sid"); ttl != sessionIdleTimeout {
+		t.Fatalf("new session expires after %v, expected %v", ttl, sessionIdleTimeout)
+	}
+
+	if err := db.Set("sid", "username", "alice", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if value := db.Get("sid", "username"); value != "alice" {
+		t.Fatalf("value read as %#v", value)
+	}
+	if n := db.Len("sid"); n != 1 {
+		t.Fatalf("session has %d values, expected 1", n)
+	}
+
+	if lifetime := db.Acquire("sid", time.Hour); lifetime.IsZero() {
+		t.Fatal("existing session acquired without a lifetime")
+	}
+	if err := db.Clear("sid"); err != nil {
+		t.Fatal(err)
+	}
+	if value := db.Get("sid", "username"); value != nil {
+		t.Fatalf("value read as %#v after the session was cleared", value)
+	}
+	if !server.Exists("test:sid") {
+		t.Fatal("the session was removed when it was cleared")
+	}
+	if err := db.Release("sid"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("test:sid") {
+		t.Fatal("the session remains after it was released")
+	}
+}
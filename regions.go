@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// currentRegion names the region this replica runs in, for multi-region deployments
+	currentRegion = os.Getenv("REGION")
+	// primaryRegion names the region whose user store takes the writes of consent decisions; the stores of other
+	// regions are expected to be replicas of it
+	primaryRegion = os.Getenv("PRIMARY_REGION")
+	// primaryRegionURL is the public URL of the primary region, that other regions send consent decisions to
+	primaryRegionURL = strings.TrimSuffix(os.Getenv("PRIMARY_REGION_URL"), "/")
+	// replicationLag is how long a write in the primary region may take to reach the other regions
+	replicationLag = envDuration("REPLICATION_LAG", 5*time.Second)
+
+	regionRedirects = metrics.Counter("primary_region_redirects_total", "Number of requests sent to the primary region.")
+)
+
+// consentWrittenAtKey is the session value recording when the user's consent decisions were last written, in Unix
+// nanoseconds, so that other regions do not read them before they are replicated
+const consentWrittenAtKey = "consentWrittenAt"
+
+// loadRegions checks the multi-region configuration
+func loadRegions() error {
+	if primaryRegion == "" || inPrimaryRegion() {
+		return nil
+	}
+	if currentRegion == "" {
+		return errors.New("PRIMARY_REGION requires REGION")
+	}
+	if primaryRegionURL == "" {
+		return errors.New("PRIMARY_REGION requires PRIMARY_REGION_URL outside the primary region")
+	}
+	// The primary region can only continue sessions it can read
+	if sessionStore != sessionStoreCookie {
+		return errors.New("PRIMARY_REGION requires SESSION_STORE=cookie outside the primary region")
+	}
+	return nil
+}
+
+// inPrimaryRegion reports whether this replica may write consent decisions: it runs in the primary region, or no
+// primary region is configured
+func inPrimaryRegion() bool {
+	return primaryRegion == "" || currentRegion == primaryRegion
+}
+
+// pinToPrimaryRegion is middleware for the routes that write consent decisions, sending them to the primary region
+// from other regions
+//
+// The request is redirected with 307 Temporary Redirect, so that the browser sends the form again to the primary
+// region, which reads the session from its cookie. In the primary region, the time of the write is kept in the
+// session for readFromPrimaryRegion.
+func pinToPrimaryRegion(ctx iris.Context) {
+	if !inPrimaryRegion() {
+		redirectToPrimaryRegion(ctx)
+		return
+	}
+	if primaryRegion != "" {
+		sess.Start(ctx).Set(consentWrittenAtKey, time.Now().UnixNano())
+	}
+	ctx.Next()
+}
+
+// readFromPrimaryRegion is middleware for the routes that read consent decisions, sending them to the primary region
+// from other regions while the user's last decision may not have been replicated yet
+func readFromPrimaryRegion(ctx iris.Context) {
+	if !inPrimaryRegion() {
+		written := sess.Start(ctx).GetInt64Default(consentWrittenAtKey, 0)
+		if written > 0 && time.Since(time.Unix(0, written)) < replicationLag {
+			redirectToPrimaryRegion(ctx)
+			return
+		}
+	}
+	ctx.Next()
+}
+
+// redirectToPrimaryRegion sends the request to the same path and query in the primary region
+func redirectToPrimaryRegion(ctx iris.Context) {
+	regionRedirects.Inc()
+	ctx.Redirect(primaryRegionURL+ctx.Request().URL.RequestURI(), iris.StatusTemporaryRedirect)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// usernamePattern matches the usernames accepted on registration
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,32}$`)
+
+// RegistrationForm represents the details submitted on the registration page
+type RegistrationForm struct {
+	Username        string
+	Email           string
+	Phone           string
+	Password        string
+	ConfirmPassword string
+}
+
+// validate normalizes the submitted details and returns a user-facing message describing the first problem found
+func (form *RegistrationForm) validate() string {
+	form.Username = strings.TrimSpace(form.Username)
+	form.Email = strings.TrimSpace(form.Email)
+	form.Phone = strings.TrimSpace(form.Phone)
+
+	if !usernamePattern.MatchString(form.Username) {
+		return "Usernames must be 3 to 32 letters, digits, dots, dashes or underscores."
+	}
+	if form.Email != "" {
+		address, err := mail.ParseAddress(form.Email)
+		if err != nil || address.Address != form.Email {
+			return "Please enter a valid email address."
+		}
+	}
+	if form.Phone != "" {
+		phone, ok := normalizePhone(form.Phone)
+		if !ok {
+			return "Please enter your phone number in international format, for example +44 20 7946 0000."
+		}
+		form.Phone = phone
+	}
+	return ""
+}
+
+// getRegister returns the registration view on a GET request
+func getRegister(ctx iris.Context) {
+	viewPasswordPolicy(ctx, nil)
+	viewCaptcha(ctx, captcha != nil)
+	ctx.View("register.html")
+}
+
+// postRegister handles POST requests to the registration endpoint
+//
+// The new user is saved to the user store and logged in, resuming any pending consent request.
+// Usernames, email addresses and phone numbers must not already belong to another user.
+func postRegister(ctx iris.Context) {
+	form := RegistrationForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if captcha != nil {
+		solved, err := verifyCaptcha(ctx)
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		if !solved {
+			viewRegisterError(ctx, iris.StatusBadRequest, form, "Please complete the CAPTCHA.", nil)
+			return
+		}
+	}
+
+	if message := form.validate(); message != "" {
+		viewRegisterError(ctx, iris.StatusBadRequest, form, message, nil)
+		return
+	}
+	if problems := checkNewPassword(nil, form.Password, form.ConfirmPassword); len(problems) > 0 {
+		viewRegisterError(ctx, iris.StatusBadRequest, form, "", problems)
+		return
+	}
+
+	if form.Email != "" {
+		if _, err := findUserByEmail(form.Email); err != ErrUserNotFound {
+			viewRegisterError(ctx, iris.StatusConflict, form, "An account with this email address already exists.", nil)
+			return
+		}
+	}
+	if form.Phone != "" {
+		if _, err := findUserByPhone(form.Phone); err != ErrUserNotFound {
+			viewRegisterError(ctx, iris.StatusConflict, form, "An account with this phone number already exists.", nil)
+			return
+		}
+	}
+
+	user := &User{Username: form.Username, Email: form.Email, Phone: form.Phone}
+	if err := setPassword(user, form.Password); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	err = users.Create(user)
+	if err == ErrUserExists {
+		viewRegisterError(ctx, iris.StatusConflict, form, "This username is already taken.", nil)
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	// A failure to send the verification email does not undo the registration; the user can request another link
+	if user.Email != "" {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			log.Printf("sending verification email to %s: %v", user.Username, err)
+		}
+	}
+
+	completeLogin(ctx, user)
+}
+
+// viewRegisterError re-renders the registration view with an error or password problems, keeping the details
+// entered so far
+func viewRegisterError(ctx iris.Context, statusCode int, form RegistrationForm, message string, problems []string) {
+	ctx.StatusCode(statusCode)
+	ctx.ViewData("Error", message)
+	viewPasswordPolicy(ctx, problems)
+	viewCaptcha(ctx, captcha != nil)
+	ctx.ViewData("Username", form.Username)
+	ctx.ViewData("Email", form.Email)
+	ctx.ViewData("Phone", form.Phone)
+	ctx.View("register.html")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// registrationPath is the path of the dynamic client registration endpoint; /register is the user sign up page
+const registrationPath = "/connect/register"
+
+var (
+	// registrationAccessTokens are the initial access tokens that allow clients to register; the endpoint is not
+	// served if there are none
+	registrationAccessTokens = envList("REGISTRATION_ACCESS_TOKENS")
+	// registrationConsumer is the Kong consumer, by username or ID, that the credentials of registered clients are
+	// created on
+	registrationConsumer = envOrDefault("REGISTRATION_CONSUMER", "dynamic-clients")
+
+	clientsRegistered = metrics.Counter("clients_registered_total", "Number of clients registered with dynamic client registration.")
+)
+
+// The errors of RFC 7591 section 3.2.2, sent in problem details as error and error_description
+const (
+	registrationInvalidRedirectURI    = "invalid_redirect_uri"
+	registrationInvalidClientMetadata = "invalid_client_metadata"
+)
+
+// ClientMetadata is the RFC 7591 client metadata a client registers with, and that is returned to it with its
+// credentials
+type ClientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+
+	// JWKS are the keys the client signs request objects with, which it may publish at RequestURIs
+	JWKS        *JSONWebKeySet `json:"jwks,omitempty"`
+	RequestURIs []string       `json:"request_uris,omitempty"`
+}
+
+// ClientRegistration is the response to a successful registration
+type ClientRegistration struct {
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret"`
+	ClientIDIssuedAt      int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+	ClientMetadata
+}
+
+// registeredCredential is Kong's response to creating an OAuth 2.0 credential
+type registeredCredential struct {
+	ID           string `json:"id"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// postRegisterClient registers a client from its metadata, as RFC 7591 dynamic client registration
+//
+// Clients present one of REGISTRATION_ACCESS_TOKENS as a bearer token. An OAuth 2.0 credential is created on Kong
+// for the REGISTRATION_CONSUMER, and its client_id and client_secret are returned with the metadata as registered,
+// including the defaults filled in. The client's logo, the scopes it may request, and the keys and request_uris of its
+// request objects are kept in the client registry.
+func postRegisterClient(ctx iris.Context) {
+	if len(registrationAccessTokens) == 0 {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.Header("Cache-Control", "no-store")
+	if !validRegistrationAccessToken(strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")) {
+		ctx.Header("WWW-Authenticate", `Bearer realm="registration"`)
+		viewProblem(ctx, iris.StatusUnauthorized, problemUnauthorized, "")
+		return
+	}
+
+	metadata := ClientMetadata{}
+	if err := ctx.ReadJSON(&metadata); err != nil {
+		viewRegistrationError(ctx, registrationInvalidClientMetadata, "The body must be a JSON client metadata document.")
+		return
+	}
+	if code, description := checkClientMetadata(ctx, &metadata); code != "" {
+		viewRegistrationError(ctx, code, description)
+		return
+	}
+
+	credential, err := createOAuth2Credential(kongContext(ctx), metadata)
+	if err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	client := &ClientSettings{
+		ClientID:                credential.ClientID,
+		LogoURI:                 metadata.LogoURI,
+		AllowedScopes:           strings.Fields(metadata.Scope),
+		JWKS:                    metadata.JWKS,
+		RequestURIs:             metadata.RequestURIs,
+		GrantTypes:              metadata.GrantTypes,
+		ResponseTypes:           metadata.ResponseTypes,
+		TokenEndpointAuthMethod: metadata.TokenEndpointAuthMethod,
+	}
+	if err := clients.Save(client); err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	audit(ctx, "client.registered", map[string]string{"client_id": credential.ClientID, "name": metadata.ClientName})
+	clientsRegistered.Inc()
+
+	ctx.StatusCode(iris.StatusCreated)
+	ctx.JSON(ClientRegistration{
+		ClientID:         credential.ClientID,
+		ClientSecret:     credential.ClientSecret,
+		ClientIDIssuedAt: credential.CreatedAt,
+		ClientMetadata:   metadata,
+	})
+}
+
+// validRegistrationAccessToken reports whether token is one of REGISTRATION_ACCESS_TOKENS
+func validRegistrationAccessToken(token string) bool {
+	valid := false
+	for _, accessToken := range registrationAccessTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(accessToken)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// viewRegistrationError responds with problem details carrying an RFC 7591 error code and description
+func viewRegistrationError(ctx iris.Context, code, description string) {
+	problem := iris.NewProblem().
+		Type(problemTypeBase+problemInvalidRequest).
+		Title(problemTitles[problemInvalidRequest]).
+		Status(iris.StatusBadRequest).
+		Detail(description).
+		Key("correlation_id", requestID(ctx)).
+		Key("error", code).
+		Key("error_description", description)
+	ctx.Problem(problem)
+}
+
+// checkClientMetadata fills in the defaults of the client metadata and returns the RFC 7591 error code and
+// description of the first problem with it, or "" if it can be registered
+func checkClientMetadata(ctx iris.Context, metadata *ClientMetadata) (string, string) {
+	if len(metadata.RedirectURIs) == 0 {
+		return registrationInvalidRedirectURI, "redirect_uris is required."
+	}
+	for _, redirectURI := range metadata.RedirectURIs {
+		if problem := redirectURIProblem(redirectURI); problem != "" {
+			return registrationInvalidRedirectURI, problem
+		}
+	}
+
+	if len(metadata.GrantTypes) == 0 {
+		metadata.GrantTypes = []string{"authorization_code"}
+	}
+	if len(metadata.ResponseTypes) == 0 {
+		metadata.ResponseTypes = []string{responseTypeCode}
+	}
+	if metadata.TokenEndpointAuthMethod == "" {
+		metadata.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	for _, grantType := range metadata.GrantTypes {
+		if !containsString([]string{"authorization_code", "implicit", "refresh_token"}, grantType) {
+			return registrationInvalidClientMetadata, "The grant type " + grantType + " is not supported."
+		}
+	}
+	for _, responseType := range metadata.ResponseTypes {
+		// Each response type needs the grant type it is used with, as RFC 7591 section 2.1 describes
+		grantType := map[string]string{responseTypeCode: "authorization_code", responseTypeToken: "implicit"}[responseType]
+		if grantType == "" {
+			return registrationInvalidClientMetadata, "The response type " + responseType + " is not supported."
+		}
+		if !containsString(metadata.GrantTypes, grantType) {
+			return registrationInvalidClientMetadata, "The response type " + responseType + " requires the " + grantType + " grant type."
+		}
+	}
+	if !containsString([]string{"client_secret_basic", "client_secret_post"}, metadata.TokenEndpointAuthMethod) {
+		return registrationInvalidClientMetadata, "The token endpoint authentication method " + metadata.TokenEndpointAuthMethod + " is not supported."
+	}
+
+	if metadata.Scope != "" {
+		// Scopes are checked against Kong's configured scopes when they can be fetched
+		if catalog, err := getScopeCatalog(kongContext(ctx)); err == nil && len(catalog) > 0 {
+			for _, scope := range strings.Fields(metadata.Scope) {
+				if !containsString(catalog, scope) {
+					return registrationInvalidClientMetadata, "The scope " + scope + " is not configured."
+				}
+			}
+		}
+	}
+	if metadata.LogoURI != "" {
+		if uri, err := url.Parse(metadata.LogoURI); err != nil || uri.Scheme != "https" || uri.Host == "" {
+			return registrationInvalidClientMetadata, "logo_uri must be an https URL."
+		}
+	}
+
+	if metadata.JWKS != nil {
+		for _, key := range metadata.JWKS.Keys {
+			if _, err := key.publicKey(); err != nil {
+				return registrationInvalidClientMetadata, "jwks: " + err.Error() + "."
+			}
+		}
+	}
+	for _, requestURI := range metadata.RequestURIs {
+		if uri, err := url.Parse(requestURI); err != nil || uri.Scheme != "https" || uri.Host == "" {
+			return registrationInvalidClientMetadata, "request_uris must be https URLs."
+		}
+	}
+
+	metadata.ClientName = strings.TrimSpace(metadata.ClientName)
+	if metadata.ClientName == "" {
+		// Kong requires a name, which is shown on the consent page
+		uri, _ := url.Parse(metadata.RedirectURIs[0])
+		metadata.ClientName = uri.Host
+		if metadata.ClientName == "" {
+			metadata.ClientName = uri.Scheme
+		}
+	}
+	return "", ""
+}
+
+// redirectURIProblem returns a description of why a redirect URI cannot be registered, or "" if it can
+func redirectURIProblem(redirectURI string) string {
+	uri, err := url.Parse(redirectURI)
+	if err != nil || uri.Scheme == "" {
+		return "The redirect URI " + redirectURI + " is not an absolute URI."
+	}
+	if uri.Fragment != "" {
+		return "The redirect URI " + redirectURI + " must not have a fragment."
+	}
+	if unsafeRedirectSchemes[strings.ToLower(uri.Scheme)] {
+		return "The redirect URI " + redirectURI + " uses a scheme that is not allowed."
+	}
+	if requireHTTPSRedirectURIs && uri.Scheme == "http" && !isLoopbackRedirect(uri) {
+		return "The redirect URI " + redirectURI + " must use https."
+	}
+	return ""
+}
+
+// createOAuth2Credential creates an OAuth 2.0 credential on Kong for the REGISTRATION_CONSUMER
+func createOAuth2Credential(ctx context.Context, metadata ClientMetadata) (*registeredCredential, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":          metadata.ClientName,
+		"redirect_uris": metadata.RedirectURIs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		kongAdminEndpoint+"/consumers/"+url.PathEscape(registrationConsumer)+"/oauth2", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	status, body, err := executeRequestStatus(req)
+	if err != nil {
+		return nil, wrapError(ErrKongUnavailable, "creating OAuth 2.0 credential", err)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("creating OAuth 2.0 credential: the REGISTRATION_CONSUMER %s does not exist on Kong", registrationConsumer)
+	}
+	if status != http.StatusCreated {
+		return nil, fmt.Errorf("creating OAuth 2.0 credential: Kong responded %d: %s", status, body)
+	}
+
+	credential := &registeredCredential{}
+	if err := json.Unmarshal(body, credential); err != nil || credential.ClientID == "" {
+		return nil, wrapError(ErrKongUnavailable, "reading OAuth 2.0 credential", fmt.Errorf("unexpected response: %s", body))
+	}
+	if credential.CreatedAt == 0 {
+		credential.CreatedAt = time.Now().Unix()
+	}
+	return credential, nil
+}
+
+// requireRegisteredResponseType refuses consent requests with a response type the client did not register, and
+// reports whether it did
+func requireRegisteredResponseType(ctx iris.Context, consent ConsentRequest) bool {
+	client, err := getClientSettings(consent.ClientID)
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+	if len(client.ResponseTypes) == 0 || containsString(client.ResponseTypes, consent.ResponseType) {
+		return false
+	}
+
+	audit(ctx, "consent.response_type_refused", map[string]string{"client_id": consent.ClientID, "response_type": consent.ResponseType})
+	viewError(ctx, iris.StatusBadRequest, "ResponseTypeNotAllowed")
+	return true
+}
+
+// registeredTokenRequestError returns the RFC 6749 error code and description of a token request with a grant type
+// or client authentication method the client did not register, or "" if it is passed to Kong
+func registeredTokenRequestError(req *http.Request, form url.Values) (string, string, error) {
+	clientID, _, basic := req.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+	} else {
+		clientID = form.Get("client_id")
+	}
+	if clientID == "" {
+		return "", "", nil
+	}
+	client, err := getClientSettings(clientID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if grantType := form.Get("grant_type"); len(client.GrantTypes) > 0 && !containsString(client.GrantTypes, grantType) {
+		return "unauthorized_client", "The client is not registered for the " + grantType + " grant type.", nil
+	}
+	switch client.TokenEndpointAuthMethod {
+	case "client_secret_basic":
+		if !basic {
+			return "invalid_client", "The client is registered to authenticate with HTTP Basic authentication.", nil
+		}
+	case "client_secret_post":
+		if basic || form.Get("client_secret") == "" {
+			return "invalid_client", "The client is registered to authenticate with client_secret in the request body.", nil
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// rememberMeCookie is the cookie holding a remember-me token, separate from the session cookie
+const rememberMeCookie = "kongOAuthConsentAppRemember"
+
+// rememberMeTTL is how long a user stays signed in after choosing "keep me signed in"
+var rememberMeTTL = envDuration("REMEMBER_ME_TTL", 30*24*time.Hour)
+
+// RememberToken is a remember-me token issued to one of the user's browsers
+//
+// The token is split into a selector, which identifies it, and a validator, of which only a hash is stored.
+type RememberToken struct {
+	Selector      string `json:"selector"`
+	ValidatorHash string `json:"validator_hash"`
+	Created       int64  `json:"created"`
+	LastUsed      int64  `json:"last_used"`
+	Expires       int64  `json:"expires"`
+	UserAgent     string `json:"user_agent,omitempty"`
+}
+
+// rememberedBrowser describes a remember-me token on the account page
+type rememberedBrowser struct {
+	Selector  string
+	UserAgent string
+	Created   string
+	LastUsed  string
+	Current   bool
+}
+
+// RememberTokenForm represents the token revoked on the account page, or all tokens if empty
+type RememberTokenForm struct {
+	Selector string
+}
+
+// randomTokenPart returns a random base64url encoded value
+func randomTokenPart() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRememberValidator hashes a validator for storage on the user
+func hashRememberValidator(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRememberToken adds a remember-me token with a new validator to the user and sets the cookie
+//
+// An existing selector is kept when a token is rotated, so that the account page keeps listing one entry per browser.
+func issueRememberToken(ctx iris.Context, user *User, selector string) error {
+	validator, err := randomTokenPart()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	token := RememberToken{
+		Selector:      selector,
+		ValidatorHash: hashRememberValidator(validator),
+		Created:       now.Unix(),
+		LastUsed:      now.Unix(),
+		Expires:       now.Add(rememberMeTTL).Unix(),
+		UserAgent:     ctx.GetHeader("User-Agent"),
+	}
+	if token.Selector == "" {
+		if token.Selector, err = randomTokenPart(); err != nil {
+			return err
+		}
+	}
+
+	tokens := []RememberToken{}
+	for _, existing := range user.RememberTokens {
+		if existing.Selector == token.Selector {
+			token.Created = existing.Created
+		} else if existing.Expires > now.Unix() {
+			tokens = append(tokens, existing)
+		}
+	}
+	user.RememberTokens = append(tokens, token)
+	if err := users.Save(user); err != nil {
+		return err
+	}
+
+	ctx.SetCookie(&http.Cookie{
+		Name:     rememberMeCookie,
+		Value:    token.Selector + ":" + validator,
+		Path:     "/",
+		Expires:  time.Unix(token.Expires, 0),
+		HttpOnly: true,
+		Secure:   ctx.Request().TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// findUserByRememberSelector returns the user holding the remember-me token with the given selector
+func findUserByRememberSelector(selector string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		for _, token := range user.RememberTokens {
+			if token.Selector == selector {
+				return user, nil
+			}
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// useRememberToken verifies the remember-me cookie and returns its user, rotating the token
+//
+// A known selector with the wrong validator suggests the cookie was stolen and used after the browser it was issued
+// to rotated it, so all of the user's remember-me tokens are revoked. The token is revoked if the user has been
+// disabled or their sessions have been invalidated since it was issued, as their sessions are.
+func useRememberToken(ctx iris.Context, cookie string) (*User, error) {
+	i := strings.IndexByte(cookie, ':')
+	if i < 0 {
+		return nil, ErrInvalidToken
+	}
+	selector, validator := cookie[:i], cookie[i+1:]
+
+	user, err := findUserByRememberSelector(selector)
+	if err == ErrUserNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range user.RememberTokens {
+		if token.Selector != selector {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token.ValidatorHash), []byte(hashRememberValidator(validator))) != 1 {
+			user.RememberTokens = nil
+			if err := users.Save(user); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidToken
+		}
+		if time.Now().Unix() > token.Expires {
+			return nil, ErrExpiredToken
+		}
+		// Tokens of disabled users, and tokens issued before the user's sessions were invalidated, are revoked
+		if user.Disabled || token.Created < time.Unix(0, user.SessionsValidAfter).Unix() {
+			removeRememberTokens(user, selector)
+			if err := users.Save(user); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidToken
+		}
+	}
+
+	return user, issueRememberToken(ctx, user, selector)
+}
+
+// revokeRememberToken removes the remember-me token in the request's cookie, if any, and the cookie itself
+func revokeRememberToken(ctx iris.Context) error {
+	cookie := ctx.GetCookie(rememberMeCookie)
+	if cookie == "" {
+		return nil
+	}
+	ctx.RemoveCookie(rememberMeCookie)
+
+	selector := strings.SplitN(cookie, ":", 2)[0]
+	user, err := findUserByRememberSelector(selector)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	removeRememberTokens(user, selector)
+	return users.Save(user)
+}
+
+// removeRememberTokens removes the token with the given selector from the user, or all tokens if it is empty
+func removeRememberTokens(user *User, selector string) {
+	tokens := []RememberToken{}
+	for _, token := range user.RememberTokens {
+		if selector != "" && token.Selector != selector {
+			tokens = append(tokens, token)
+		}
+	}
+	user.RememberTokens = tokens
+}
+
+// restoreRememberedSession re-establishes the session of a returning user with a valid remember-me cookie
+func restoreRememberedSession(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth && !kioskMode {
+		if cookie := ctx.GetCookie(rememberMeCookie); cookie != "" {
+			user, err := useRememberToken(ctx, cookie)
+			if err == nil {
+				establishSession(ctx, user, false)
+			} else {
+				ctx.RemoveCookie(rememberMeCookie)
+			}
+		}
+	}
+	ctx.Next()
+}
+
+// getAccountRemember returns the view listing the browsers the user is kept signed in on
+func getAccountRemember(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	viewAccountRemember(ctx, user)
+}
+
+// viewAccountRemember renders the user's unexpired remember-me tokens
+func viewAccountRemember(ctx iris.Context, user *User) {
+	now := time.Now().Unix()
+	current := strings.SplitN(ctx.GetCookie(rememberMeCookie), ":", 2)[0]
+
+	browsers := []rememberedBrowser{}
+	for _, token := range user.RememberTokens {
+		if token.Expires <= now {
+			continue
+		}
+		browsers = append(browsers, rememberedBrowser{
+			Selector:  token.Selector,
+			UserAgent: token.UserAgent,
+			Created:   time.Unix(token.Created, 0).UTC().Format(time.RFC1123),
+			LastUsed:  time.Unix(token.LastUsed, 0).UTC().Format(time.RFC1123),
+			Current:   token.Selector == current,
+		})
+	}
+
+	ctx.ViewData("Browsers", browsers)
+	ctx.View("account-remember.html")
+}
+
+// postAccountRemember handles POST requests to revoke one or all of the user's remember-me tokens
+func postAccountRemember(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := RememberTokenForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	removeRememberTokens(user, form.Selector)
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Notice", "Signed out of the selected browsers.")
+	viewAccountRemember(ctx, user)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// configProviderName is the remote configuration backend: etcd or consul
+	configProviderName = os.Getenv("CONFIG_PROVIDER")
+	// configEndpoint is the address of the backend, such as http://127.0.0.1:2379 or http://127.0.0.1:8500
+	configEndpoint = strings.TrimSuffix(os.Getenv("CONFIG_ENDPOINT"), "/")
+	// configPrefix is the key prefix of the settings, each stored under the name of its environment variable
+	configPrefix = envOrDefault("CONFIG_PREFIX", "kong-oauth2-consent-app/")
+	// configToken is sent as the etcd authentication token or the Consul ACL token
+	configToken = os.Getenv("CONFIG_TOKEN")
+
+	remoteConfigUpdates = metrics.Counter("remote_config_updates_total", "Number of changes read from the remote configuration.", "result", "applied")
+	remoteConfigErrors  = metrics.Counter("remote_config_updates_total", "Number of changes read from the remote configuration.", "result", "rejected")
+)
+
+// remoteConfigRetry bounds the wait before watching the remote configuration again after an error
+const remoteConfigRetry = time.Minute
+
+// dynamicConfig is the configuration that the remote configuration can change while the application is running.
+// Everything else, such as addresses, keys and stores, is bootstrap configuration read only from the environment.
+type dynamicConfig struct {
+	emailTheme           EmailTheme
+	passwordPolicy       PasswordPolicy
+	consentCopyRules     []ConsentCopyRule
+	requireVerifiedEmail bool
+}
+
+var (
+	// localConfig is the dynamic configuration of the environment and files, which remote settings override and
+	// which is restored when a remote setting is deleted
+	localConfig dynamicConfig
+	// remoteSettings are the settings last applied from the remote configuration, or nil without one
+	remoteSettings map[string]string
+)
+
+// dynamicSettings change the dynamic configuration to the value of a remote setting, named after the environment
+// variable it overrides
+var dynamicSettings = map[string]func(config *dynamicConfig, value string) error{
+	"EMAIL_BRAND_NAME":    func(config *dynamicConfig, value string) error { config.emailTheme.Name = value; return nil },
+	"EMAIL_LOGO_URL":      func(config *dynamicConfig, value string) error { config.emailTheme.LogoURL = value; return nil },
+	"EMAIL_PRIMARY_COLOR": func(config *dynamicConfig, value string) error { config.emailTheme.PrimaryColor = value; return nil },
+	"EMAIL_FOOTER":        func(config *dynamicConfig, value string) error { config.emailTheme.Footer = value; return nil },
+	"PASSWORD_MIN_LENGTH": func(config *dynamicConfig, value string) (err error) {
+		config.passwordPolicy.MinLength, err = strconv.Atoi(value)
+		return err
+	},
+	"PASSWORD_REQUIRED_CLASSES": func(config *dynamicConfig, value string) error {
+		classes := []string{}
+		for _, class := range strings.Split(value, ",") {
+			if class = strings.TrimSpace(class); class == "" {
+				continue
+			}
+			if _, ok := passwordClasses[class]; !ok {
+				return fmt.Errorf("unknown character class %q, expected lower, upper, digit or symbol", class)
+			}
+			classes = append(classes, class)
+		}
+		config.passwordPolicy.RequiredClasses = classes
+		return nil
+	},
+	"PASSWORD_BREACH_CHECK": func(config *dynamicConfig, value string) (err error) {
+		config.passwordPolicy.BreachCheck, err = strconv.ParseBool(value)
+		return err
+	},
+	"PASSWORD_HISTORY": func(config *dynamicConfig, value string) (err error) {
+		config.passwordPolicy.History, err = strconv.Atoi(value)
+		return err
+	},
+	"PASSWORD_MAX_AGE": func(config *dynamicConfig, value string) (err error) {
+		config.passwordPolicy.MaxAge, err = time.ParseDuration(value)
+		return err
+	},
+	"REQUIRE_VERIFIED_EMAIL": func(config *dynamicConfig, value string) (err error) {
+		config.requireVerifiedEmail, err = strconv.ParseBool(value)
+		return err
+	},
+	// CONSENT_COPY_RULES holds the rules themselves, in the JSON format of the CONSENT_COPY_PATH file
+	"CONSENT_COPY_RULES": func(config *dynamicConfig, value string) (err error) {
+		config.consentCopyRules, err = parseConsentCopyRules([]byte(value))
+		return err
+	},
+}
+
+// configBackend reads the settings under CONFIG_PREFIX from a remote configuration store
+type configBackend interface {
+	// Watch waits until the settings change after the given index, or reads them straight away if the index is
+	// zero, and returns them with the index to watch from next
+	Watch(ctx context.Context, index uint64) (map[string]string, uint64, error)
+}
+
+// loadRemoteConfig applies the settings of the remote configuration named by CONFIG_PROVIDER, then watches it for
+// changes for as long as the application runs
+//
+// The application starts with its local configuration if the backend cannot be reached, and applies the remote
+// settings once it can.
+func loadRemoteConfig() error {
+	var backend configBackend
+	switch configProviderName {
+	case "":
+		return nil
+	case "etcd":
+		backend = &etcdConfig{endpoint: configEndpoint, prefix: configPrefix, token: configToken, client: newExternalHTTPClient(0)}
+	case "consul":
+		backend = &consulConfig{endpoint: configEndpoint, prefix: configPrefix, token: configToken, client: newExternalHTTPClient(0)}
+	default:
+		return fmt.Errorf("unknown CONFIG_PROVIDER %q, expected etcd or consul", configProviderName)
+	}
+	if configEndpoint == "" {
+		return fmt.Errorf("CONFIG_PROVIDER=%s requires CONFIG_ENDPOINT", configProviderName)
+	}
+
+	reloadMu.Lock()
+	localConfig = dynamicConfig{
+		emailTheme:           emailTheme,
+		passwordPolicy:       passwordPolicy,
+		consentCopyRules:     consentCopyRules,
+		requireVerifiedEmail: requireVerifiedEmail,
+	}
+	reloadMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	settings, index, err := backend.Watch(ctx, 0)
+	if err != nil {
+		log.Printf("reading the remote configuration, starting with the local configuration: %v", err)
+	} else {
+		updateRemoteConfig(settings)
+	}
+
+	go watchRemoteConfig(backend, index)
+	return nil
+}
+
+// watchRemoteConfig applies each change to the remote configuration, backing off while the backend fails
+func watchRemoteConfig(backend configBackend, index uint64) {
+	retry := time.Second
+	for {
+		settings, next, err := backend.Watch(context.Background(), index)
+		if err != nil {
+			log.Printf("watching the remote configuration: %v", err)
+			time.Sleep(retry)
+			if retry *= 2; retry > remoteConfigRetry {
+				retry = remoteConfigRetry
+			}
+			continue
+		}
+		retry = time.Second
+		if index == 0 || next != index {
+			updateRemoteConfig(settings)
+		}
+		index = next
+	}
+}
+
+// updateRemoteConfig applies the remote settings, logging and keeping the current configuration if any is invalid
+func updateRemoteConfig(settings map[string]string) {
+	reloadMu.Lock()
+	err := applyRemoteSettings(settings)
+	reloadMu.Unlock()
+	if err != nil {
+		remoteConfigErrors.Inc()
+		log.Printf("remote configuration rejected, keeping the current configuration: %v", err)
+		return
+	}
+	remoteConfigUpdates.Inc()
+	log.Print("remote configuration applied")
+}
+
+// applyRemoteSettings replaces the dynamic configuration with the local configuration overridden by the settings,
+// changing nothing if any is invalid. Settings that are not dynamic are logged and ignored.
+//
+// The caller must hold reloadMu for writing.
+func applyRemoteSettings(settings map[string]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	config := localConfig
+	for _, name := range names {
+		apply, ok := dynamicSettings[name]
+		if !ok {
+			log.Printf("ignoring remote setting %s, which can only be set in the environment", name)
+			continue
+		}
+		if err := apply(&config, strings.TrimSpace(settings[name])); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	emailTheme = config.emailTheme
+	passwordPolicy = config.passwordPolicy
+	consentCopyRules = config.consentCopyRules
+	requireVerifiedEmail = config.requireVerifiedEmail
+	remoteSettings = settings
+	return nil
+}
+
+// settingName returns the name of the setting stored under key, or an empty string if the key is outside prefix
+func settingName(prefix, key string) string {
+	if !strings.HasPrefix(key, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(key, prefix)
+}
+
+// consulConfig reads the settings from the Consul KV store, watching them with blocking queries
+type consulConfig struct {
+	endpoint string
+	prefix   string
+	token    string
+	client   *http.Client
+}
+
+// Watch implements configBackend with a blocking query on the prefix, which returns when the index changes or
+// after five minutes
+func (c *consulConfig) Watch(ctx context.Context, index uint64) (map[string]string, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", "5m")
+	}
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+"/v1/kv/"+c.prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, index, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, index, errors.New("consul response has no X-Consul-Index")
+	}
+	// Consul's index can go backwards, for example after a snapshot is restored, and then watching starts over
+	if next < index {
+		next = 0
+	}
+
+	settings := map[string]string{}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return settings, next, nil
+	case http.StatusOK:
+	default:
+		return nil, index, fmt.Errorf("consul responded %s", resp.Status)
+	}
+
+	var entries []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+	for _, entry := range entries {
+		if name := settingName(c.prefix, entry.Key); name != "" {
+			settings[name] = string(entry.Value)
+		}
+	}
+	return settings, next, nil
+}
+
+// etcdConfig reads the settings from etcd through its v3 JSON gateway, watching them for changes
+type etcdConfig struct {
+	endpoint string
+	prefix   string
+	token    string
+	client   *http.Client
+}
+
+// etcdKeyValue is a key and value of an etcd range response, both base64 encoded
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// etcdHeader is the header of etcd responses; the gateway encodes 64-bit integers as strings
+type etcdHeader struct {
+	Revision uint64 `json:"revision,string"`
+}
+
+// Watch implements configBackend, reading the settings at once if index is zero and otherwise after a watch on the
+// prefix, started at the revision after index, reports a change
+func (c *etcdConfig) Watch(ctx context.Context, index uint64) (map[string]string, uint64, error) {
+	if index > 0 {
+		if err := c.waitForChange(ctx, index+1); err != nil {
+			return nil, index, err
+		}
+	}
+
+	var result struct {
+		Header etcdHeader     `json:"header"`
+		KVs    []etcdKeyValue `json:"kvs"`
+	}
+	resp, err := c.post(ctx, "/v3/kv/range", map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(c.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(c.prefix)),
+	})
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, index, err
+	}
+
+	settings := map[string]string{}
+	for _, kv := range result.KVs {
+		if name := settingName(c.prefix, string(kv.Key)); name != "" {
+			settings[name] = string(kv.Value)
+		}
+	}
+	return settings, result.Header.Revision, nil
+}
+
+// waitForChange watches the prefix from revision until an event is received
+func (c *etcdConfig) waitForChange(ctx context.Context, revision uint64) error {
+	resp, err := c.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            base64.StdEncoding.EncodeToString([]byte(c.prefix)),
+			"range_end":      base64.StdEncoding.EncodeToString(prefixEnd(c.prefix)),
+			"start_revision": strconv.FormatUint(revision, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+				Reason   string            `json:"cancel_reason"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+		switch {
+		case message.Error != nil:
+			return fmt.Errorf("etcd watch failed: %s", message.Error.Message)
+		case message.Result.Canceled:
+			// A compacted start revision cancels the watch; reading the settings again catches up
+			log.Printf("etcd watch canceled: %s", message.Result.Reason)
+			return nil
+		case len(message.Result.Events) > 0:
+			return nil
+		}
+	}
+}
+
+// post sends a JSON request to the etcd gateway and checks that it succeeded
+func (c *etcdConfig) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd responded %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// prefixEnd returns the end of the etcd range of keys starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
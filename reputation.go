@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	ipReputationProviderName  = os.Getenv("IP_REPUTATION_PROVIDER")
+	ipReputationBlocklistPath = os.Getenv("IP_REPUTATION_BLOCKLIST_FILE")
+	ipReputationDNSBLZones    = envList("IP_REPUTATION_DNSBL_ZONES")
+	ipReputationURL           = os.Getenv("IP_REPUTATION_URL")
+	ipReputationToken         = os.Getenv("IP_REPUTATION_TOKEN")
+
+	// ipReputationAction is what is done with requests from listed addresses: log, challenge or block
+	ipReputationAction = envOrDefault("IP_REPUTATION_ACTION", reputationActionLog)
+
+	ipReputationListed = metrics.Counter("ip_reputation_listed_total", "Number of login and consent requests from addresses listed by the IP reputation provider.")
+)
+
+// The actions taken on login and consent requests from listed addresses
+const (
+	// reputationActionLog audits the request and lets it continue
+	reputationActionLog = "log"
+	// reputationActionChallenge requires a CAPTCHA to log in and to consent
+	reputationActionChallenge = "challenge"
+	// reputationActionBlock refuses the request
+	reputationActionBlock = "block"
+)
+
+// ipReputationVerdicts holds the verdicts of the IP reputation provider by address; failed lookups are not cached
+var ipReputationVerdicts = newCache("ip_reputation",
+	envInt("IP_REPUTATION_CACHE_MAX_ENTRIES", 10000),
+	0,
+	envDuration("IP_REPUTATION_CACHE_TTL", time.Hour))
+
+// ipReputation looks up the reputation of client addresses, or is nil when IP_REPUTATION_PROVIDER is unset
+var ipReputation ReputationProvider
+
+// ReputationProvider looks up whether a client address is known for abuse
+type ReputationProvider interface {
+	// Lookup returns the verdict on the address
+	Lookup(ctx context.Context, ip net.IP) (ReputationVerdict, error)
+}
+
+// ReputationVerdict is a reputation provider's verdict on an address
+type ReputationVerdict struct {
+	Listed bool   `json:"listed"`
+	Reason string `json:"reason"`
+}
+
+// loadIPReputationProvider configures the provider named by IP_REPUTATION_PROVIDER: blocklist, dnsbl or http
+func loadIPReputationProvider() error {
+	switch ipReputationAction {
+	case reputationActionLog, reputationActionBlock:
+	case reputationActionChallenge:
+		if ipReputationProviderName != "" && captcha == nil {
+			return errors.New("IP_REPUTATION_ACTION=challenge requires a CAPTCHA_PROVIDER")
+		}
+	default:
+		return fmt.Errorf("unknown IP_REPUTATION_ACTION %q, expected log, challenge or block", ipReputationAction)
+	}
+
+	switch ipReputationProviderName {
+	case "":
+		return nil
+	case "blocklist":
+		provider, err := loadBlocklist(ipReputationBlocklistPath)
+		if err != nil {
+			return err
+		}
+		ipReputation = provider
+	case "dnsbl":
+		if len(ipReputationDNSBLZones) == 0 {
+			return errors.New("IP_REPUTATION_PROVIDER=dnsbl requires IP_REPUTATION_DNSBL_ZONES")
+		}
+		ipReputation = dnsblReputation{zones: ipReputationDNSBLZones, resolver: net.DefaultResolver}
+	case "http":
+		if ipReputationURL == "" {
+			return errors.New("IP_REPUTATION_PROVIDER=http requires IP_REPUTATION_URL")
+		}
+		ipReputation = &httpReputation{
+			url:    ipReputationURL,
+			token:  ipReputationToken,
+			client: newExternalHTTPClient(5 * time.Second),
+		}
+	default:
+		return fmt.Errorf("unknown IP_REPUTATION_PROVIDER %q, expected blocklist, dnsbl or http", ipReputationProviderName)
+	}
+	return nil
+}
+
+// blocklistReputation lists the addresses and networks of a local file
+type blocklistReputation struct {
+	networks []*net.IPNet
+}
+
+// loadBlocklist reads a blocklist file of addresses and networks in CIDR notation, one per line, ignoring blank
+// lines and comments starting with '#'
+func loadBlocklist(path string) (*blocklistReputation, error) {
+	if path == "" {
+		return nil, errors.New("IP_REPUTATION_PROVIDER=blocklist requires IP_REPUTATION_BLOCKLIST_FILE")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return &blocklistReputation{networks: parseCIDRs(entries)}, nil
+}
+
+// Lookup reports whether the address belongs to a network of the blocklist
+func (b *blocklistReputation) Lookup(ctx context.Context, ip net.IP) (ReputationVerdict, error) {
+	for _, network := range b.networks {
+		if network.Contains(ip) {
+			return ReputationVerdict{Listed: true, Reason: "blocklist " + network.String()}, nil
+		}
+	}
+	return ReputationVerdict{}, nil
+}
+
+// dnsblReputation looks addresses up in DNS-based blocklists, such as those of Spamhaus
+type dnsblReputation struct {
+	zones    []string
+	resolver *net.Resolver
+}
+
+// Lookup reports whether the address is listed in any of the zones
+//
+// An address is listed when its reversed name in the zone resolves, to a 127.0.0.0/8 address by convention;
+// NXDOMAIN means it is not listed.
+func (d dnsblReputation) Lookup(ctx context.Context, ip net.IP) (ReputationVerdict, error) {
+	name := dnsblName(ip)
+	for _, zone := range d.zones {
+		addresses, err := d.resolver.LookupHost(ctx, name+"."+zone)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+		if err != nil {
+			return ReputationVerdict{}, err
+		}
+		for _, address := range addresses {
+			if listed := net.ParseIP(address); listed != nil && listed.IsLoopback() {
+				return ReputationVerdict{Listed: true, Reason: zone + " " + address}, nil
+			}
+		}
+	}
+	return ReputationVerdict{}, nil
+}
+
+// dnsblName returns the name an address is looked up by in a DNS blocklist: its octets, or the nibbles of an IPv6
+// address, in reverse order
+func dnsblName(ip net.IP) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip4[i])))
+		}
+		return strings.Join(labels, ".")
+	}
+	ip6 := ip.To16()
+	for i := len(ip6) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatInt(int64(ip6[i]&0xf), 16), strconv.FormatInt(int64(ip6[i]>>4), 16))
+	}
+	return strings.Join(labels, ".")
+}
+
+// httpReputation asks an HTTP service for its verdict on addresses
+type httpReputation struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Lookup sends a GET request with the address in the 'ip' query parameter, with IP_REPUTATION_TOKEN as a bearer
+// token if set, and expects a JSON ReputationVerdict in response
+func (h *httpReputation) Lookup(ctx context.Context, ip net.IP) (ReputationVerdict, error) {
+	verdict := ReputationVerdict{}
+	uri, err := url.Parse(h.url)
+	if err != nil {
+		return verdict, err
+	}
+	query := uri.Query()
+	query.Set("ip", ip.String())
+	uri.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return verdict, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return verdict, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return verdict, fmt.Errorf("IP reputation service responded %s", res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&verdict)
+	return verdict, err
+}
+
+// clientReputation returns the verdict on the client's address, from the cache if it has been looked up recently
+//
+// Addresses whose lookup fails are treated as not listed, so that an unavailable provider does not stop users
+// logging in.
+func clientReputation(ctx iris.Context) ReputationVerdict {
+	ip := clientIP(ctx)
+	if ipReputation == nil || ip == nil {
+		return ReputationVerdict{}
+	}
+
+	key := ip.String()
+	if verdict, ok := ipReputationVerdicts.Get(key); ok {
+		return verdict.(ReputationVerdict)
+	}
+	verdict, err := ipReputation.Lookup(ctx.Request().Context(), ip)
+	if err != nil {
+		log.Printf("IP reputation lookup of %s: %v", key, err)
+		return ReputationVerdict{}
+	}
+	ipReputationVerdicts.Set(key, verdict, int64(len(key)+len(verdict.Reason)))
+	return verdict
+}
+
+// reputationChallenge reports whether the client must solve a CAPTCHA because its address is listed
+func reputationChallenge(ctx iris.Context) bool {
+	return ipReputationAction == reputationActionChallenge && clientReputation(ctx).Listed
+}
+
+// checkIPReputation audits login and consent requests from listed addresses, and refuses them if
+// IP_REPUTATION_ACTION is block
+func checkIPReputation(ctx iris.Context) {
+	verdict := clientReputation(ctx)
+	if verdict.Listed {
+		ipReputationListed.Inc()
+		audit(ctx, "ip_reputation.listed", map[string]string{"reason": verdict.Reason, "action": ipReputationAction})
+		if ipReputationAction == reputationActionBlock {
+			viewError(ctx, iris.StatusForbidden, "IPBlocked")
+			return
+		}
+	}
+	ctx.Next()
+}
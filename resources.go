@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+// resourceIndicators are the APIs clients may name as the resource of a token, each configured as 'uri=name' or
+// just a URI; any absolute URI is accepted if there are none
+var resourceIndicators = parseResourceIndicators(envList("RESOURCE_INDICATORS"))
+
+// maxResources bounds the number of resource parameters of a request, as they are kept in the session
+const maxResources = 10
+
+// resourceDescription describes a resource indicator on the consent page
+type resourceDescription struct {
+	URI  string
+	Name string
+}
+
+// parseResourceIndicators parses the configured resource indicators and their names
+func parseResourceIndicators(values []string) []resourceDescription {
+	resources := []resourceDescription{}
+	for _, value := range values {
+		uri, name := value, ""
+		if i := strings.LastIndexByte(value, '='); i >= 0 && !strings.Contains(value[:i], "?") {
+			uri, name = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+		}
+		if !validResourceURI(uri) {
+			log.Printf("invalid RESOURCE_INDICATORS entry %q, expected an absolute URI without a fragment", value)
+			continue
+		}
+		resources = append(resources, resourceDescription{URI: uri, Name: name})
+	}
+	return resources
+}
+
+// validResourceURI reports whether uri is an absolute URI without a fragment, as RFC 8707 requires of resources
+func validResourceURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	return err == nil && parsed.IsAbs() && parsed.Host != "" && !strings.ContainsAny(uri, "# \t\r\n")
+}
+
+// joinResources returns the resource parameters of a request space separated, without repeats
+func joinResources(values []string) string {
+	resources := []string{}
+	for _, value := range values {
+		if value != "" && !containsString(resources, value) {
+			resources = append(resources, value)
+		}
+	}
+	return strings.Join(resources, " ")
+}
+
+// splitResources returns the space separated resources of a consent request
+func splitResources(resources string) []string {
+	return strings.Fields(resources)
+}
+
+// validResources reports whether the request's resources are absolute URIs, and configured resource indicators if
+// any are configured
+func validResources(consent ConsentRequest) bool {
+	resources := splitResources(consent.Resources)
+	if len(resources) > maxResources {
+		return false
+	}
+	for _, resource := range resources {
+		if !validResourceURI(resource) {
+			return false
+		}
+		if len(resourceIndicators) > 0 && findResourceIndicator(resource) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// findResourceIndicator returns the configured resource indicator for a URI, or nil
+func findResourceIndicator(uri string) *resourceDescription {
+	for i := range resourceIndicators {
+		if resourceIndicators[i].URI == uri {
+			return &resourceIndicators[i]
+		}
+	}
+	return nil
+}
+
+// describeResources returns the resources as they are shown on the consent page, named by their configuration or
+// by their host
+func describeResources(resources []string) []resourceDescription {
+	described := []resourceDescription{}
+	for _, resource := range resources {
+		if indicator := findResourceIndicator(resource); indicator != nil && indicator.Name != "" {
+			described = append(described, *indicator)
+			continue
+		}
+		name := resource
+		if uri, err := url.Parse(resource); err == nil {
+			name = uri.Host + strings.TrimSuffix(uri.Path, "/")
+		}
+		described = append(described, resourceDescription{URI: resource, Name: name})
+	}
+	return described
+}
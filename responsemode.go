@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/kataras/iris/v12"
+)
+
+// The response modes clients can ask for the authorization response to be returned with
+const (
+	// responseModeQuery returns the response in the redirect URI's query, the default for authorization codes
+	responseModeQuery = "query"
+	// responseModeFragment returns the response in the redirect URI's fragment, the default for the implicit grant
+	responseModeFragment = "fragment"
+	// responseModeFormPost returns the response in an automatically submitted HTML form, as OAuth 2.0 Form Post
+	// Response Mode describes, rather than in the redirect URI
+	responseModeFormPost = "form_post"
+	// responseModeJWT returns the response as a signed JWT, as JARM describes, in the query for authorization codes
+	// and in the fragment for the implicit grant
+	responseModeJWT = "jwt"
+)
+
+// jwtResponseModes are the JARM response modes naming where the signed JWT is returned, by that response mode
+var jwtResponseModes = map[string]string{
+	responseModeQuery + ".jwt":    responseModeQuery,
+	responseModeFragment + ".jwt": responseModeFragment,
+	responseModeFormPost + ".jwt": responseModeFormPost,
+}
+
+// supportedResponseModes lists the response modes in the discovery document
+var supportedResponseModes = []string{responseModeQuery, responseModeFragment, responseModeFormPost, responseModeJWT,
+	responseModeQuery + ".jwt", responseModeFragment + ".jwt", responseModeFormPost + ".jwt"}
+
+// authorizationResponseParams are the parameters of authorization responses, which form_post moves from the
+// redirect URI into the form, and response_mode=fragment into the fragment
+var authorizationResponseParams = map[string]bool{
+	"code": true, "state": true, "error": true, "error_description": true, "error_uri": true, "access_token": true,
+	"token_type": true, "expires_in": true, "scope": true, "id_token": true, "iss": true,
+}
+
+// formPostField is a field of the form returning an authorization response
+type formPostField struct {
+	Name  string
+	Value string
+}
+
+// validResponseMode reports whether the request's response_mode, if any, is supported for its response_type
+//
+// Access tokens of the implicit grant are never returned in the query, where they would be sent to the client's
+// server and kept in its logs.
+func validResponseMode(consent ConsentRequest) bool {
+	switch consent.responseMode() {
+	case "", responseModeFragment, responseModeFormPost:
+		return true
+	case responseModeQuery:
+		return !consent.implicit()
+	}
+	return false
+}
+
+// withResponseMode moves the authorization response in Kong's redirect URI from the query to the fragment for
+// authorization codes requested with response_mode=fragment
+//
+// Kong always returns codes in the query and access tokens in the fragment, which are the other response modes.
+func withResponseMode(redirectURI string, consent ConsentRequest) string {
+	if consent.responseMode() != responseModeFragment || consent.implicit() {
+		return redirectURI
+	}
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	params := uri.Query()
+	response := url.Values{}
+	for name, values := range params {
+		if authorizationResponseParams[name] {
+			response[name] = values
+			params.Del(name)
+		}
+	}
+	uri.RawQuery = params.Encode()
+	uri.Fragment = ""
+	return uri.String() + "#" + response.Encode()
+}
+
+// viewClientReturn renders the page that returns the user to the client when the authorization response is not
+// returned with a redirect, and reports whether it has
+//
+// With response_mode=form_post the response is posted to the client by a form that submits itself. Redirect URIs
+// of native apps are returned to with the interstitial page of viewAppRedirect.
+func viewClientReturn(ctx iris.Context, consent ConsentRequest, client *ClientSettings, applicationName, redirectURI string) bool {
+	if consent.responseMode() == responseModeFormPost {
+		viewFormPost(ctx, redirectURI)
+		return true
+	}
+	if isAppRedirect(client, redirectURI) {
+		viewAppRedirect(ctx, applicationName, redirectURI)
+		return true
+	}
+	return false
+}
+
+// viewFormPost renders the form that posts the authorization response in redirectURI's query and fragment to the
+// redirect URI without them
+func viewFormPost(ctx iris.Context, redirectURI string) {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	params := uri.Query()
+	fragment, err := url.ParseQuery(uri.Fragment)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	response := url.Values{}
+	for name, values := range params {
+		if authorizationResponseParams[name] {
+			response[name] = values
+			params.Del(name)
+		}
+	}
+	for name, values := range fragment {
+		response[name] = values
+	}
+	uri.RawQuery = params.Encode()
+	uri.Fragment = ""
+
+	fields := []formPostField{}
+	for name, values := range response {
+		for _, value := range values {
+			fields = append(fields, formPostField{Name: name, Value: value})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+
+	// The response is not cached, as it may carry an access token
+	ctx.Header("Cache-Control", "no-store")
+	ctx.ViewData("Action", uri.String())
+	ctx.ViewData("Fields", fields)
+	ctx.View("form-post.html")
+}
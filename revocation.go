@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// revocationPath is the path of the token revocation endpoint
+const revocationPath = "/revoke"
+
+var tokensRevoked = metrics.Counter("tokens_revoked_total", "Number of tokens revoked by client applications.")
+
+// postRevoke revokes an access or refresh token at the request of the client it was issued to, as RFC 7009 token
+// revocation
+//
+// Clients authenticate with their Kong OAuth 2.0 credential. Kong keeps an access token and its refresh token as one
+// record, so revoking either deletes both. Unknown tokens are answered as revoked, as the RFC requires, while tokens
+// of other clients are refused. A token_type_hint of refresh_token looks the refresh token up first; refresh tokens
+// are found by reading every token from Kong's Admin API, so they take longer to revoke than access tokens.
+func postRevoke(ctx iris.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	clientID, ok := authenticateClient(ctx, "revocation")
+	if !ok {
+		return
+	}
+
+	value := strings.TrimSpace(ctx.PostValue("token"))
+	if value == "" {
+		viewProblem(ctx, iris.StatusBadRequest, problemInvalidRequest, "token is required.")
+		return
+	}
+
+	token, err := findTokenToRevoke(ctx, value, ctx.PostValue("token_type_hint"))
+	if err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	if token == nil {
+		ctx.StatusCode(iris.StatusOK)
+		return
+	}
+
+	owner, err := getCredentialClientID(kongContext(ctx), token.Credential.ID)
+	if err != nil && !errors.Is(err, ErrUnknownClient) {
+		failWithProblem(ctx, err)
+		return
+	}
+	if owner != clientID {
+		audit(ctx, "token.revocation_refused", map[string]string{"client_id": clientID})
+		viewProblem(ctx, iris.StatusForbidden, problemUnauthorized, "The token was not issued to the client.")
+		return
+	}
+
+	if err := deleteKongToken(kongContext(ctx), token.ID); err != nil {
+		failWithProblem(ctx, err)
+		return
+	}
+	audit(ctx, "token.revoked", map[string]string{"client_id": clientID, "subject": token.AuthenticatedUserID})
+	tokensRevoked.Inc()
+	ctx.StatusCode(iris.StatusOK)
+}
+
+// findTokenToRevoke returns Kong's record of an access or refresh token, looking it up as the hinted type first, or
+// nil if Kong has no such token
+func findTokenToRevoke(ctx iris.Context, value, hint string) (*oauth2Token, error) {
+	findAccessToken := func() (*oauth2Token, error) {
+		token, err := getKongAccessToken(kongContext(ctx), value)
+		if err != nil || token.ID == "" {
+			return nil, err
+		}
+		return &token.oauth2Token, nil
+	}
+	findRefreshToken := func() (*oauth2Token, error) {
+		return findKongRefreshToken(kongContext(ctx), value)
+	}
+
+	lookups := []func() (*oauth2Token, error){findAccessToken, findRefreshToken}
+	if hint == "refresh_token" {
+		lookups = []func() (*oauth2Token, error){findRefreshToken, findAccessToken}
+	}
+	for _, lookup := range lookups {
+		if token, err := lookup(); err != nil || token != nil {
+			return token, err
+		}
+	}
+	return nil, nil
+}
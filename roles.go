@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+const (
+	scopeRoleActionHide   = "hide"
+	scopeRoleActionRefuse = "refuse"
+)
+
+var (
+	// scopeRoles maps restricted scopes to the roles entitled to grant them, configured as a comma separated list
+	// of scope=role1|role2 entries. Scopes that are not listed can be granted by every user.
+	scopeRoles = parseScopeRoles(envList("SCOPE_ROLES"))
+
+	// scopeRoleAction is what happens when a user is asked for scopes they are not entitled to grant: "hide"
+	// removes them from the request, "refuse" shows an error instead of the consent page
+	scopeRoleAction = envOrDefault("SCOPE_ROLE_ACTION", scopeRoleActionHide)
+)
+
+// parseScopeRoles parses scope=role1|role2 entries
+func parseScopeRoles(entries []string) map[string][]string {
+	mapping := map[string][]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Printf("invalid scope role mapping %q", entry)
+			continue
+		}
+		scope := strings.TrimSpace(parts[0])
+		for _, role := range strings.Split(parts[1], "|") {
+			if role = strings.TrimSpace(role); role != "" {
+				mapping[scope] = append(mapping[scope], role)
+			}
+		}
+	}
+	return mapping
+}
+
+// hasRole reports whether the user has any of the roles
+func hasRole(user *User, roles []string) bool {
+	if user == nil {
+		return false
+	}
+	for _, role := range roles {
+		for _, userRole := range user.Roles {
+			if userRole == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// entitledScopes splits scopes into those the user is entitled to grant and those they are not
+func entitledScopes(user *User, scopes []string) (entitled, denied []string) {
+	for _, scope := range scopes {
+		if roles, restricted := scopeRoles[scope]; restricted && !hasRole(user, roles) {
+			denied = append(denied, scope)
+			continue
+		}
+		entitled = append(entitled, scope)
+	}
+	return entitled, denied
+}
+
+// restrictScopes returns the requested scopes the logged in user is entitled to grant
+//
+// In refuse mode an error is rendered instead if any scope is denied, and false is returned.
+func restrictScopes(ctx iris.Context, scopes []string) ([]string, bool) {
+	if len(scopeRoles) == 0 {
+		return scopes, true
+	}
+
+	user, err := users.Get(sess.Start(ctx).GetString("username"))
+	if err != nil && err != ErrUserNotFound {
+		ctx.SetErr(err)
+		return nil, false
+	}
+
+	entitled, denied := entitledScopes(user, scopes)
+	if len(denied) > 0 && scopeRoleAction == scopeRoleActionRefuse {
+		viewError(ctx, iris.StatusForbidden, "ScopeNotEntitled")
+		return nil, false
+	}
+	return entitled, true
+}
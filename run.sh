@@ -5,5 +5,10 @@ export KONG_PROXY_ENDPOINT="https://localhost:8443"
 export API_PATH="/myapi"
 export PROVISION_KEY="uKRXEw1RyKdHlZ6S7q6edY97zHZpZnro"
 export DEMO_CLIENT_ID="y9FTvz0ovdczj3oxZf4NKkKUm0MMu4ii"
+# export USER_STORE_PATH="users.json"
+# export CLIENT_REGISTRY_PATH="clients.json"
+# export SIGNING_KEY="change-me"
+# export LOGIN_MODE="magic_link"
+# export SMTP_ADDR="localhost:25"
 
-go run main.go
\ No newline at end of file
+go run .
\ No newline at end of file
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// scimToken authenticates identity providers to the SCIM endpoint, which is disabled if it is unset
+var scimToken = os.Getenv("SCIM_TOKEN")
+
+// SCIM 2.0 schema URNs (RFC 7643 and RFC 7644)
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// scimUsersPath is the SCIM endpoint of the user resource type
+const scimUsersPath = "/scim/v2/Users"
+
+// scimUser is the SCIM representation of a user
+//
+// The username is the user's id, as it is the key of the user store, so users cannot be renamed over SCIM.
+type scimUser struct {
+	Schemas      []string    `json:"schemas"`
+	ID           string      `json:"id,omitempty"`
+	ExternalID   string      `json:"externalId,omitempty"`
+	UserName     string      `json:"userName"`
+	Active       *bool       `json:"active,omitempty"`
+	Password     string      `json:"password,omitempty"`
+	Emails       []scimValue `json:"emails,omitempty"`
+	PhoneNumbers []scimValue `json:"phoneNumbers,omitempty"`
+	Roles        []scimValue `json:"roles,omitempty"`
+	Meta         *scimMeta   `json:"meta,omitempty"`
+
+	PreferredLanguage string `json:"preferredLanguage,omitempty"`
+}
+
+// scimValue is a value of a multi-valued SCIM attribute
+type scimValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// scimMeta is the metadata of a SCIM resource
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+// scimPatch is a SCIM PATCH request
+type scimPatch struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimAttributes maps the lower case names of the supported user attributes to their names, as SCIM attribute names
+// are case insensitive
+var scimAttributes = map[string]string{
+	"username":          "userName",
+	"externalid":        "externalId",
+	"active":            "active",
+	"password":          "password",
+	"emails":            "emails",
+	"phonenumbers":      "phoneNumbers",
+	"roles":             "roles",
+	"preferredlanguage": "preferredLanguage",
+}
+
+var (
+	// scimFilterPattern matches the equality filters identity providers use to look users up before creating them
+	scimFilterPattern = regexp.MustCompile(`(?i)^\s*(userName|externalId)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+	// scimValuePathPattern matches PATCH paths that set the value of one type of email address or phone number
+	scimValuePathPattern = regexp.MustCompile(`(?i)^(emails|phoneNumbers)\[type eq "([^"]*)"\]\.value$`)
+)
+
+// requireSCIMToken is middleware that authenticates requests to the SCIM endpoint with SCIM_TOKEN as a bearer token
+func requireSCIMToken(ctx iris.Context) {
+	if scimToken == "" {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(scimToken)) != 1 {
+		ctx.Header("WWW-Authenticate", `Bearer realm="scim"`)
+		scimError(ctx, iris.StatusUnauthorized, "", "A valid bearer token is required.")
+		return
+	}
+	ctx.Next()
+}
+
+// getSCIMUsers lists users, optionally filtered by userName or externalId
+func getSCIMUsers(ctx iris.Context) {
+	var attribute, value string
+	if filter := ctx.URLParam("filter"); filter != "" {
+		match := scimFilterPattern.FindStringSubmatch(filter)
+		if match == nil {
+			scimError(ctx, iris.StatusBadRequest, "invalidFilter", "Only userName and externalId eq filters are supported.")
+			return
+		}
+		attribute = strings.ToLower(match[1])
+		unquoted, err := strconv.Unquote(`"` + match[2] + `"`)
+		if err != nil {
+			scimError(ctx, iris.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		value = unquoted
+	}
+	startIndex := ctx.URLParamIntDefault("startIndex", 1)
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count := ctx.URLParamIntDefault("count", 100)
+	if count < 0 {
+		count = 0
+	}
+
+	all, err := users.List()
+	if err != nil {
+		scimFail(ctx, err)
+		return
+	}
+	matched := []*User{}
+	for _, user := range all {
+		switch {
+		case attribute == "username" && user.Username != value,
+			attribute == "externalid" && user.ExternalID != value:
+			continue
+		}
+		matched = append(matched, user)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Username < matched[j].Username })
+
+	resources := []scimUser{}
+	for i := startIndex - 1; i < len(matched) && len(resources) < count; i++ {
+		resources = append(resources, scimUserResource(matched[i]))
+	}
+	writeSCIM(ctx, iris.StatusOK, iris.Map{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(matched),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// getSCIMUser returns a user
+func getSCIMUser(ctx iris.Context) {
+	user, ok := loadSCIMUser(ctx)
+	if !ok {
+		return
+	}
+	writeSCIM(ctx, iris.StatusOK, scimUserResource(user))
+}
+
+// postSCIMUser provisions a user
+//
+// Provisioned users log in with the identity provider, or with a password if one is sent, and are identified to
+// Kong by their username.
+func postSCIMUser(ctx iris.Context) {
+	resource := scimUser{}
+	if err := ctx.ReadJSON(&resource); err != nil {
+		scimError(ctx, iris.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if resource.UserName == "" {
+		scimError(ctx, iris.StatusBadRequest, "invalidValue", "userName is required.")
+		return
+	}
+
+	user := &User{Username: resource.UserName}
+	if problems := applySCIMUser(user, resource); len(problems) > 0 {
+		scimError(ctx, iris.StatusBadRequest, "invalidValue", strings.Join(problems, " "))
+		return
+	}
+	err := users.Create(user)
+	if err == ErrUserExists {
+		scimError(ctx, iris.StatusConflict, "uniqueness", "A user with this userName already exists.")
+		return
+	}
+	if err != nil {
+		scimFail(ctx, err)
+		return
+	}
+
+	audit(ctx, "scim.provisioned", map[string]string{"actor": "scim", "subject": user.Username})
+	ctx.Header("Location", scimUserLocation(user))
+	writeSCIM(ctx, iris.StatusCreated, scimUserResource(user))
+}
+
+// putSCIMUser replaces a user's attributes
+func putSCIMUser(ctx iris.Context) {
+	user, ok := loadSCIMUser(ctx)
+	if !ok {
+		return
+	}
+	resource := scimUser{}
+	if err := ctx.ReadJSON(&resource); err != nil {
+		scimError(ctx, iris.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	updateSCIMUser(ctx, user, resource)
+}
+
+// patchSCIMUser modifies a user's attributes
+//
+// Operations on the supported attributes are applied to the user's SCIM representation, which then replaces the
+// user's attributes as with PUT. Operations on attributes the application does not keep are ignored.
+func patchSCIMUser(ctx iris.Context) {
+	user, ok := loadSCIMUser(ctx)
+	if !ok {
+		return
+	}
+	patch := scimPatch{}
+	if err := ctx.ReadJSON(&patch); err != nil {
+		scimError(ctx, iris.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+
+	encoded, err := json.Marshal(scimUserResource(user))
+	if err != nil {
+		scimFail(ctx, err)
+		return
+	}
+	attributes := map[string]interface{}{}
+	if err := json.Unmarshal(encoded, &attributes); err != nil {
+		scimFail(ctx, err)
+		return
+	}
+
+	for _, operation := range patch.Operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			scimError(ctx, iris.StatusBadRequest, "invalidSyntax", "Unsupported operation "+strconv.Quote(operation.Op)+".")
+			return
+		}
+		var value interface{}
+		if len(operation.Value) > 0 {
+			if err := json.Unmarshal(operation.Value, &value); err != nil {
+				scimError(ctx, iris.StatusBadRequest, "invalidSyntax", err.Error())
+				return
+			}
+		}
+
+		switch match := scimValuePathPattern.FindStringSubmatch(operation.Path); {
+		case match != nil:
+			// A value path such as emails[type eq "work"].value sets the user's only email address or phone number
+			name := scimAttributes[strings.ToLower(match[1])]
+			if op == "remove" {
+				delete(attributes, name)
+			} else {
+				attributes[name] = []interface{}{map[string]interface{}{"value": value, "type": match[2], "primary": true}}
+			}
+		case operation.Path != "":
+			if name, ok := scimAttributes[strings.ToLower(operation.Path)]; ok {
+				if op == "remove" {
+					delete(attributes, name)
+				} else {
+					attributes[name] = value
+				}
+			}
+		default:
+			// Without a path the value is an object of the attributes to set
+			values, ok := value.(map[string]interface{})
+			if !ok || op == "remove" {
+				scimError(ctx, iris.StatusBadRequest, "noTarget", "The operation needs a path or an object value.")
+				return
+			}
+			for key, v := range values {
+				if name, ok := scimAttributes[strings.ToLower(key)]; ok {
+					attributes[name] = v
+				}
+			}
+		}
+	}
+
+	// Some identity providers send active as the string "True" or "False"
+	if active, ok := attributes["active"].(string); ok {
+		attributes["active"] = strings.EqualFold(active, "true")
+	}
+
+	resource := scimUser{}
+	encoded, err = json.Marshal(attributes)
+	if err == nil {
+		err = json.Unmarshal(encoded, &resource)
+	}
+	if err != nil {
+		scimError(ctx, iris.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	updateSCIMUser(ctx, user, resource)
+}
+
+// deleteSCIMUser deprovisions a user, revoking their tokens on Kong and removing their account
+func deleteSCIMUser(ctx iris.Context) {
+	user, ok := loadSCIMUser(ctx)
+	if !ok {
+		return
+	}
+
+	if err := deprovisionUser(kongContext(ctx), user); err != nil {
+		scimFail(ctx, err)
+		return
+	}
+	if err := users.Delete(user.Username); err != nil && err != ErrUserNotFound {
+		scimFail(ctx, err)
+		return
+	}
+
+	audit(ctx, "scim.deleted", map[string]string{"actor": "scim", "subject": user.Username})
+	ctx.StatusCode(iris.StatusNoContent)
+}
+
+// updateSCIMUser replaces the user's attributes with those of resource and responds with the updated user
+//
+// Users who are deactivated are deprovisioned: their tokens on Kong are revoked and their sessions ended.
+func updateSCIMUser(ctx iris.Context, user *User, resource scimUser) {
+	if resource.UserName != "" && resource.UserName != user.Username {
+		scimError(ctx, iris.StatusBadRequest, "mutability", "userName cannot be changed.")
+		return
+	}
+
+	wasActive := !user.Disabled
+	if problems := applySCIMUser(user, resource); len(problems) > 0 {
+		scimError(ctx, iris.StatusBadRequest, "invalidValue", strings.Join(problems, " "))
+		return
+	}
+	if wasActive && user.Disabled {
+		if err := deprovisionUser(kongContext(ctx), user); err != nil {
+			scimFail(ctx, err)
+			return
+		}
+	}
+	if err := users.Save(user); err != nil {
+		scimFail(ctx, err)
+		return
+	}
+
+	event := "scim.updated"
+	switch {
+	case wasActive && user.Disabled:
+		event = "scim.deactivated"
+	case !wasActive && !user.Disabled:
+		event = "scim.reactivated"
+	}
+	audit(ctx, event, map[string]string{"actor": "scim", "subject": user.Username})
+	writeSCIM(ctx, iris.StatusOK, scimUserResource(user))
+}
+
+// applySCIMUser copies the attributes of resource to user and returns problems with a password that breaks the
+// password policy
+//
+// Email addresses are managed by the identity provider, so they are trusted as verified.
+func applySCIMUser(user *User, resource scimUser) []string {
+	// Identity providers that sync passwords may send the current password again
+	if ok, _ := checkPassword(user.PasswordHash, resource.Password); resource.Password != "" && !ok {
+		if problems := currentPasswordPolicy().Check(user, resource.Password); len(problems) > 0 {
+			return problems
+		}
+		if err := setPassword(user, resource.Password); err != nil {
+			return []string{err.Error()}
+		}
+	}
+
+	user.ExternalID = resource.ExternalID
+	user.Disabled = resource.Active != nil && !*resource.Active
+	if email := primarySCIMValue(resource.Emails); email != user.Email {
+		user.Email = email
+		user.EmailVerified = email != ""
+	}
+	user.Phone = primarySCIMValue(resource.PhoneNumbers)
+	user.Roles = nil
+	for _, role := range resource.Roles {
+		if role.Value != "" {
+			user.Roles = append(user.Roles, role.Value)
+		}
+	}
+	// The preferred language only fills in a language the user has not chosen themselves
+	if language := matchLanguage(resource.PreferredLanguage); language != "" && user.Language == "" {
+		user.Language = language
+	}
+	return nil
+}
+
+// deprovisionUser revokes the user's tokens on Kong and ends their sessions
+func deprovisionUser(ctx context.Context, user *User) error {
+	revoked, err := revokeKongTokens(ctx, authenticatedUserID(user))
+	if err != nil {
+		return err
+	}
+	log.Printf("deprovisioned user %q, revoking %d tokens", user.Username, revoked)
+
+	user.SessionsValidAfter = time.Now().UnixNano()
+	user.RememberTokens = nil
+	return nil
+}
+
+// scimUserResource returns the SCIM representation of a user
+func scimUserResource(user *User) scimUser {
+	active := !user.Disabled
+	resource := scimUser{
+		Schemas:    []string{scimUserSchema},
+		ID:         user.Username,
+		ExternalID: user.ExternalID,
+		UserName:   user.Username,
+		Active:     &active,
+		Meta:       &scimMeta{ResourceType: "User", Location: scimUserLocation(user)},
+	}
+	if user.Email != "" {
+		resource.Emails = []scimValue{{Value: user.Email, Type: "work", Primary: true}}
+	}
+	if user.Phone != "" {
+		resource.PhoneNumbers = []scimValue{{Value: user.Phone, Type: "mobile", Primary: true}}
+	}
+	for _, role := range user.Roles {
+		resource.Roles = append(resource.Roles, scimValue{Value: role})
+	}
+	resource.PreferredLanguage = user.Language
+	return resource
+}
+
+// scimUserLocation returns the URL of a user's SCIM resource
+func scimUserLocation(user *User) string {
+	return publicURL + scimUsersPath + "/" + url.PathEscape(user.Username)
+}
+
+// primarySCIMValue returns the primary value of a multi-valued attribute, or the first value if none is primary
+func primarySCIMValue(values []scimValue) string {
+	for _, value := range values {
+		if value.Primary {
+			return value.Value
+		}
+	}
+	if len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+// loadSCIMUser returns the user identified by the request's path, responding 404 Not Found if there is none
+func loadSCIMUser(ctx iris.Context) (*User, bool) {
+	user, err := users.Get(ctx.Params().Get("id"))
+	if err == ErrUserNotFound {
+		scimError(ctx, iris.StatusNotFound, "", "User not found.")
+		return nil, false
+	}
+	if err != nil {
+		scimFail(ctx, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// writeSCIM responds with a SCIM resource or message
+func writeSCIM(ctx iris.Context, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		scimFail(ctx, err)
+		return
+	}
+	ctx.ContentType("application/scim+json")
+	ctx.StatusCode(status)
+	ctx.Write(body)
+}
+
+// scimError responds with a SCIM error message
+func scimError(ctx iris.Context, status int, scimType, detail string) {
+	message := iris.Map{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		message["scimType"] = scimType
+	}
+	writeSCIM(ctx, status, message)
+}
+
+// scimFail responds with a SCIM error message for a request that failed with err, which is logged and counted like
+// the errors of other handlers
+func scimFail(ctx iris.Context, err error) {
+	status, _, problemType := errorResponse(err)
+	metrics.Counter("errors_total", "Number of requests that failed with an error, by problem type.", "type", problemType).Inc()
+	log.Printf("%s %s [%s]: %v", ctx.Method(), ctx.Path(), requestID(ctx), err)
+
+	message := iris.Map{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  problemTitles[problemType] + " (correlation ID " + requestID(ctx) + ")",
+	}
+	body, _ := json.Marshal(message)
+	ctx.ContentType("application/scim+json")
+	ctx.StatusCode(status)
+	ctx.Write(body)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kataras/iris/v12"
+)
+
+// scopeCache holds the catalog of scopes configured on Kong's OAuth 2.0 plugins
+var scopeCache = newCache("scope_registry",
+	envInt("SCOPE_CACHE_MAX_ENTRIES", 100),
+	int64(envInt("SCOPE_CACHE_MAX_BYTES", 1<<20)),
+	envDuration("SCOPE_CACHE_TTL", 5*time.Minute))
+
+// scopeCatalogKey is the scope cache key of the catalog of all OAuth 2.0 plugins
+const scopeCatalogKey = "oauth2"
+
+const (
+	clientScopeActionRefuse = "refuse"
+	clientScopeActionTrim   = "trim"
+)
+
+// clientScopeAction is what happens when a client asks for scopes that are not among the allowed_scopes registered
+// for it: "refuse" shows an error instead of the consent page, "trim" removes them from the request
+var clientScopeAction = envOrDefault("CLIENT_SCOPE_ACTION", clientScopeActionRefuse)
+
+// OAuth2Plugin is a partial representation of Kong's plugin resource
+type OAuth2Plugin struct {
+	Name   string `json:"name"`
+	Config struct {
+		Scopes []string `json:"scopes"`
+	} `json:"config"`
+}
+
+// OAuth2Plugins is a partial representation of Kong's plugins resource
+type OAuth2Plugins struct {
+	Data []OAuth2Plugin `json:"data"`
+}
+
+// getScopeCatalog queries the plugins on Kong and returns the scopes configured on OAuth 2.0 plugins
+func getScopeCatalog(ctx context.Context) ([]string, error) {
+	if scopes, ok := scopeCache.Get(scopeCatalogKey); ok {
+		return scopes.([]string), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kongAdminEndpoint+"/plugins?size=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, exErr := executeRequest(req)
+	if exErr != nil {
+		return nil, wrapError(ErrKongUnavailable, "fetching plugins", exErr)
+	}
+
+	scopes, err := decodeScopeCatalog(body)
+	if err != nil {
+		return nil, err
+	}
+
+	scopeCache.Set(scopeCatalogKey, scopes, int64(len(scopeCatalogKey)+len(strings.Join(scopes, ","))))
+
+	return scopes, nil
+}
+
+// decodeScopeCatalog returns the scopes configured on the OAuth 2.0 plugins in a response from Kong's '/plugins'
+// endpoint, without duplicates
+func decodeScopeCatalog(body []byte) ([]string, error) {
+	plugins := OAuth2Plugins{}
+	jsonErr := json.Unmarshal(body, &plugins)
+	if jsonErr != nil {
+		return nil, wrapError(ErrKongUnavailable, "reading plugins", jsonErr)
+	}
+
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, plugin := range plugins.Data {
+		if plugin.Name != "oauth2" {
+			continue
+		}
+		for _, scope := range plugin.Config.Scopes {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// splitScopes splits a list of scopes separated by commas or white space, dropping empty and repeated scopes
+func splitScopes(scopes string) []string {
+	split := []string{}
+	seen := map[string]bool{}
+	for _, scope := range strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if !seen[scope] {
+			seen[scope] = true
+			split = append(split, scope)
+		}
+	}
+	return split
+}
+
+// checkScopes returns an error matching ErrInvalidScope if any of the scopes is not configured on Kong
+//
+// Scopes are not checked when the catalog cannot be fetched; Kong still refuses unknown scopes when the user
+// consents.
+func checkScopes(ctx context.Context, scopes []string) error {
+	catalog, err := getScopeCatalog(ctx)
+	if err != nil || len(catalog) == 0 {
+		return nil
+	}
+
+	configured := map[string]bool{}
+	for _, scope := range catalog {
+		configured[scope] = true
+	}
+	for _, scope := range scopes {
+		if scope != "" && !configured[scope] {
+			return wrapError(ErrInvalidScope, "scope "+scope, errors.New("not configured on Kong"))
+		}
+	}
+	return nil
+}
+
+// checkClientScopes returns the scopes the client is allowed to request, or an error matching ErrInvalidScope if it
+// asks for others and CLIENT_SCOPE_ACTION is refuse
+//
+// Clients without allowed_scopes in the client registry may request any scope configured on Kong.
+func checkClientScopes(clientID string, scopes []string) ([]string, error) {
+	client, err := getClientSettings(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(client.AllowedScopes) == 0 {
+		return scopes, nil
+	}
+
+	allowed := []string{}
+	for _, scope := range scopes {
+		if containsString(client.AllowedScopes, scope) {
+			allowed = append(allowed, scope)
+			continue
+		}
+		if clientScopeAction != clientScopeActionTrim {
+			return nil, wrapError(ErrInvalidScope, "scope "+scope, errors.New("not allowed for client "+clientID))
+		}
+	}
+	return allowed, nil
+}
+
+// ScopeDescription is a requested scope with the user-facing description of the access it grants
+type ScopeDescription struct {
+	Name        string
+	Description string
+}
+
+// describeScopes returns the localized description of each scope, falling back to the scope's name
+//
+// Descriptions are configured in the locales directory under the key 'Scope_' followed by the scope name.
+func describeScopes(ctx iris.Context, scopes []string) []ScopeDescription {
+	descriptions := make([]ScopeDescription, 0, len(scopes))
+	for _, scope := range scopes {
+		if scope == "" {
+			continue
+		}
+		key := "Scope_" + scope
+		description := ctx.Tr(key)
+		if description == "" || description == key {
+			description = scope
+		}
+		descriptions = append(descriptions, ScopeDescription{Name: scope, Description: description})
+	}
+	return descriptions
+}
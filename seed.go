@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// seedDemoDataFlag starts the application with the demo data seeded into its stores
+const seedDemoDataFlag = "--seed-demo-data"
+
+// seedDemoTime pins the time the demo data is dated from, as RFC 3339, so that it is the same on every run; the
+// start of the current day, in UTC, if unset
+var seedDemoTime = os.Getenv("SEED_DEMO_TIME")
+
+// demoPassword is the password of every demo user
+const demoPassword = "demo"
+
+// demoClients are the client applications of the demo data
+//
+// They are only added to the client registry; register OAuth 2.0 credentials with the same client_id on Kong to
+// authorize them.
+var demoClients = []ClientSettings{
+	{ClientID: "demo-photos", Owners: []string{"alice"}, LogoURI: "https://demo.example.com/photos.png", PrimaryColor: "#1a73e8"},
+	{ClientID: "demo-calendar", Owners: []string{"alice"}, PrimaryColor: "#0b8043"},
+	{ClientID: "demo-fitness", Owners: []string{"bob"}, PrimaryColor: "#e37400"},
+}
+
+// demoUser is a user of the demo data, with their grants dated relative to the seed time
+type demoUser struct {
+	user   User
+	grants []demoGrant
+}
+
+// demoGrant is a grant of the demo data, given and revoked the given time before the seed time
+type demoGrant struct {
+	clientID string
+	scopes   []string
+	granted  time.Duration
+	revoked  time.Duration
+}
+
+// demoUsers are the users of the demo data: an administrator, a user with several grants, one with none and a
+// disabled user
+var demoUsers = []demoUser{
+	{
+		user: User{Username: "alice", Email: "alice@example.com", EmailVerified: true, Roles: []string{adminRole},
+			AuthenticatedUserID: "demo-user-0001", Attributes: map[string]string{"department": "Engineering"}},
+		grants: []demoGrant{
+			{clientID: "demo-photos", scopes: []string{"openid", "profile", "email"}, granted: 400 * 24 * time.Hour},
+			{clientID: "demo-calendar", scopes: []string{"email", "phone"}, granted: 30 * 24 * time.Hour},
+		},
+	},
+	{
+		user: User{Username: "bob", Email: "bob@example.com", EmailVerified: true, Phone: "+15555550100",
+			AuthenticatedUserID: "demo-user-0002", Attributes: map[string]string{"department": "Sales"}},
+		grants: []demoGrant{
+			{clientID: "demo-photos", scopes: []string{"email"}, granted: 90 * 24 * time.Hour},
+			{clientID: "demo-fitness", scopes: []string{"profile", "address"}, granted: 10 * 24 * time.Hour, revoked: time.Hour},
+		},
+	},
+	{user: User{Username: "carol", Email: "carol@example.com", AuthenticatedUserID: "demo-user-0003"}},
+	{user: User{Username: "dave", Email: "dave@example.com", EmailVerified: true, AuthenticatedUserID: "demo-user-0004", Disabled: true}},
+}
+
+// demoAuditEvents are the audit events of the demo data, recorded the given time before the seed time
+var demoAuditEvents = []struct {
+	ago    time.Duration
+	event  string
+	actor  string
+	fields map[string]string
+}{
+	{400 * 24 * time.Hour, "consent.granted", "alice", map[string]string{"client_id": "demo-photos", "scopes": "openid,profile,email"}},
+	{90 * 24 * time.Hour, "consent.granted", "bob", map[string]string{"client_id": "demo-photos", "scopes": "email"}},
+	{30 * 24 * time.Hour, "consent.granted", "alice", map[string]string{"client_id": "demo-calendar", "scopes": "email,phone"}},
+	{10 * 24 * time.Hour, "consent.granted", "bob", map[string]string{"client_id": "demo-fitness", "scopes": "profile,address"}},
+	{5 * 24 * time.Hour, "consent.denied", "carol", map[string]string{"client_id": "demo-fitness", "scopes": "profile,address"}},
+	{2 * 24 * time.Hour, "consent.failed", "carol", map[string]string{"client_id": "demo-calendar", "error": "invalid_scope"}},
+	{26 * time.Hour, "impersonation.start", "alice", map[string]string{"subject": "bob"}},
+	{25 * time.Hour, "impersonation.stop", "alice", map[string]string{"subject": "bob"}},
+	{time.Hour, "grant.revoked", "bob", map[string]string{"client_id": "demo-fitness"}},
+}
+
+// seedDemoDataRequested reports whether the application was started with --seed-demo-data
+func seedDemoDataRequested() bool {
+	return containsString(os.Args[1:], seedDemoDataFlag)
+}
+
+// demoSeedTime returns the time the demo data is dated from
+func demoSeedTime() (time.Time, error) {
+	if seedDemoTime == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour), nil
+	}
+	return time.Parse(time.RFC3339, seedDemoTime)
+}
+
+// seedDemoData adds the demo users, clients, grants, API activity and audit events to the stores
+//
+// The demo records have stable IDs and are replaced on every run, so that seeding is repeatable. Audit events are
+// only appended the first time, as the audit log cannot be rewritten.
+func seedDemoData() error {
+	now, err := demoSeedTime()
+	if err != nil {
+		return fmt.Errorf("SEED_DEMO_TIME: %w", err)
+	}
+	passwordHash, err := hashPassword(demoPassword)
+	if err != nil {
+		return err
+	}
+
+	for i := range demoClients {
+		client := demoClients[i]
+		if err := clients.Save(&client); err != nil {
+			return err
+		}
+	}
+
+	firstRun := false
+	demoUserIDs := map[string]bool{}
+	for _, demo := range demoUsers {
+		if _, err := users.Get(demo.user.Username); err == ErrUserNotFound {
+			firstRun = true
+		}
+		user := copyUser(demo.user)
+		user.PasswordHash = passwordHash
+		user.PasswordChangedAt = now.UnixNano()
+		for _, grant := range demo.grants {
+			seeded := Grant{
+				ClientID:    grant.clientID,
+				Scopes:      grant.scopes,
+				Granted:     now.Add(-grant.granted).Unix(),
+				LastGranted: now.Add(-grant.granted).Unix(),
+			}
+			if grant.revoked > 0 {
+				seeded.RevokedAt = now.Add(-grant.revoked).Unix()
+			}
+			user.Grants = append(user.Grants, seeded)
+		}
+		if err := users.Save(user); err != nil {
+			return err
+		}
+		demoUserIDs[user.AuthenticatedUserID] = true
+	}
+
+	// The demo users' activity is replaced rather than added to
+	if _, err := activities.Remove(func(record activityRecord) bool { return demoUserIDs[record.AuthenticatedUserID] }); err != nil {
+		return err
+	}
+	if err := activities.Add(demoActivity(now)); err != nil {
+		return err
+	}
+
+	if firstRun {
+		for i, event := range demoAuditEvents {
+			entry := map[string]string{
+				"time":       now.Add(-event.ago).Format(time.RFC3339Nano),
+				"event":      event.event,
+				"actor":      event.actor,
+				"client_ip":  "192.0.2.10",
+				"request_id": fmt.Sprintf("demo-request-%04d", i+1),
+			}
+			for key, value := range event.fields {
+				entry[key] = value
+			}
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			auditLog.write(line)
+		}
+	}
+
+	log.Printf("seeded demo data dated %s; the demo users log in with the password %q", now.Format(time.RFC3339), demoPassword)
+	return nil
+}
+
+// demoActivity returns the API requests made with the demo grants over the day before the seed time
+func demoActivity(now time.Time) []activityRecord {
+	requests := []struct {
+		userID   string
+		clientID string
+		method   string
+		path     string
+		status   int
+	}{
+		{"demo-user-0001", "demo-photos", "GET", "/myapi/albums", 200},
+		{"demo-user-0001", "demo-photos", "GET", "/myapi/albums/42/photos", 200},
+		{"demo-user-0001", "demo-photos", "POST", "/myapi/albums/42/photos", 201},
+		{"demo-user-0001", "demo-calendar", "GET", "/myapi/events", 200},
+		{"demo-user-0002", "demo-photos", "GET", "/myapi/profile", 200},
+		{"demo-user-0002", "demo-photos", "DELETE", "/myapi/albums/7", 403},
+	}
+	records := make([]activityRecord, 0, len(requests))
+	for i, request := range requests {
+		records = append(records, activityRecord{
+			AuthenticatedUserID: request.userID,
+			ClientID:            request.clientID,
+			APIActivity: APIActivity{
+				Time:     now.Add(-time.Duration(len(requests)-i) * time.Hour),
+				Method:   request.method,
+				Path:     request.path,
+				Status:   request.status,
+				ClientIP: fmt.Sprintf("198.51.100.%d", 10+i),
+			},
+		})
+	}
+	return records
+}
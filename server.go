@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+// shutdownTimeout is how long requests in progress are given to complete when the server shuts down
+var shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+
+// reloadMu guards the configuration that is replaced when it is reloaded
+var reloadMu sync.RWMutex
+
+// serverControl carries requests to reload the configuration or shut down to the running server
+//
+// Requests come from signals, or from the service control manager on Windows, so that the server behaves the same
+// however it is run.
+type serverControl struct {
+	reload   chan struct{}
+	shutdown chan struct{}
+}
+
+// newServerControl returns a serverControl with no requests pending
+func newServerControl() *serverControl {
+	return &serverControl{reload: make(chan struct{}, 1), shutdown: make(chan struct{}, 1)}
+}
+
+// requestReload asks the server to reload its configuration, unless a reload is already pending
+func (c *serverControl) requestReload() {
+	select {
+	case c.reload <- struct{}{}:
+	default:
+	}
+}
+
+// requestShutdown asks the server to shut down, unless a shutdown is already pending
+func (c *serverControl) requestShutdown() {
+	select {
+	case c.shutdown <- struct{}{}:
+	default:
+	}
+}
+
+// serve runs the application on the listener until a shutdown is requested, reloading the configuration on request
+//
+// On shutdown the listener is closed and requests in progress are given shutdownTimeout to complete. The deliveries
+// still queued are then spilled to disk.
+func serve(app *iris.Application, listener net.Listener, control *serverControl) error {
+	go func() {
+		for {
+			select {
+			case <-control.reload:
+				if err := reloadConfig(); err != nil {
+					log.Printf("reloading configuration: %v", err)
+					continue
+				}
+				log.Print("configuration reloaded")
+			case <-control.shutdown:
+				log.Print("shutting down")
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+				if err := app.Shutdown(ctx); err != nil {
+					log.Printf("shutting down: %v", err)
+				}
+				return
+			}
+		}
+	}()
+
+	err := app.Run(iris.Listener(listener), iris.WithoutInterruptHandler, iris.WithoutServerError(iris.ErrServerClosed))
+	deliveries.close()
+	return err
+}
+
+// reloadConfig reads the email templates, consent copy rules and consent policies again, keeping the current ones if
+// any is invalid
+func reloadConfig() error {
+	rules, err := loadConsentCopyRules(consentCopyPath)
+	if err != nil {
+		return err
+	}
+	policies, err := loadConsentPolicies(consentPoliciesPath)
+	if err != nil {
+		return err
+	}
+	if err := loadEmailTemplates(emailTemplatesDir); err != nil {
+		return err
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	consentPolicies = policies
+	if remoteSettings != nil {
+		// The remote configuration may override the reloaded rules
+		localConfig.consentCopyRules = rules
+		return applyRemoteSettings(remoteSettings)
+	}
+	consentCopyRules = rules
+	return nil
+}
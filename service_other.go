@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/kataras/iris/v12"
+)
+
+// errNotWindows is returned by the service subcommand on other operating systems
+var errNotWindows = errors.New("the service subcommand is only supported on Windows")
+
+// runningAsService reports whether the process was started by the Windows service control manager
+func runningAsService() bool {
+	return false
+}
+
+// startService prepares the process to run as a Windows service
+func startService() error {
+	return errNotWindows
+}
+
+// runService serves requests as a Windows service
+func runService(app *iris.Application, listener net.Listener, control *serverControl) error {
+	return errNotWindows
+}
+
+// runServiceCommand installs, uninstalls or reloads the configuration of the Windows service
+func runServiceCommand(args []string) error {
+	return errNotWindows
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the application is installed under with the Windows service control manager
+var serviceName = envOrDefault("SERVICE_NAME", "kong-oauth2-consent-app")
+
+// runningAsService reports whether the process was started by the Windows service control manager
+func runningAsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// startService prepares the process to run as a service before the configuration is loaded
+//
+// Services start in the system directory, so relative paths such as the templates are resolved from the directory of
+// the executable instead, and the log is written to the Windows event log.
+func startService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		return err
+	}
+	events, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(eventLogWriter{events})
+	return nil
+}
+
+// eventLogWriter writes each log message as an informational event
+type eventLogWriter struct {
+	events *eventlog.Log
+}
+
+// Write writes p to the event log
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.events.Info(1, strings.TrimSpace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// consentService runs the server under the Windows service control manager
+type consentService struct {
+	app      *iris.Application
+	listener net.Listener
+	control  *serverControl
+}
+
+// Execute serves requests until the service is stopped, and reloads the configuration on a parameter change
+func (s *consentService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan error, 1)
+	go func() { done <- serve(s.app, s.listener, s.control) }()
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case err := <-done:
+			status <- svc.Status{State: svc.StopPending}
+			if err != nil {
+				log.Print(err)
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				s.control.requestShutdown()
+			case svc.ParamChange:
+				s.control.requestReload()
+				status <- svc.Status{State: svc.Running, Accepts: accepted}
+			}
+		}
+	}
+}
+
+// runService serves requests on the listener as a Windows service until the service is stopped
+func runService(app *iris.Application, listener net.Listener, control *serverControl) error {
+	return svc.Run(serviceName, &consentService{app: app, listener: listener, control: control})
+}
+
+// runServiceCommand installs, uninstalls or reloads the configuration of the Windows service
+func runServiceCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: service install|uninstall|reload")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "Kong OAuth 2.0 consent application",
+			Description: "Serves the login and consent pages of Kong's OAuth 2.0 plugin.",
+			StartType:   mgr.StartAutomatic,
+		})
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return err
+		}
+		log.Printf("installed service %s running %s", serviceName, exe)
+		return nil
+
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			return err
+		}
+		log.Printf("uninstalled service %s", serviceName)
+		return nil
+
+	case "reload":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+		}
+		defer s.Close()
+		_, err = s.Control(svc.ParamChange)
+		return err
+
+	default:
+		return fmt.Errorf("unknown service operation %q: use install, uninstall or reload", args[0])
+	}
+}
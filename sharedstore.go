@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// sharedStore holds the short-lived state every replica must see, such as failed login counters and used nonces
+//
+// It is held in memory until loadSessionStore replaces it with a store in the session database's Redis server when
+// SESSION_STORE is redis.
+var sharedStore SharedStore = newMemoryStore()
+
+// SharedStore holds string values that expire, with the atomic operations needed to share them between replicas
+type SharedStore interface {
+	// Get returns the value stored under key, and whether there is one
+	Get(key string) (string, bool, error)
+	// Set stores value under key for ttl
+	Set(key, value string, ttl time.Duration) error
+	// Add stores value under key for ttl unless the key already holds a value, and reports whether it was stored
+	Add(key, value string, ttl time.Duration) (bool, error)
+	// Take removes the value stored under key and returns it, so that only one caller can have it
+	Take(key string) (string, bool, error)
+	// Delete removes the value stored under key
+	Delete(key string) error
+	// Update replaces the value stored under key with the one update returns, and for how long it is kept, unless
+	// update returns false; no other update of the key happens in between
+	//
+	// update is given the value stored under key and whether there is one, and may be called again if the key is
+	// changed by another replica meanwhile.
+	Update(key string, update func(value string, ok bool) (string, time.Duration, bool)) error
+}
+
+// memoryStore is a SharedStore for a single replica
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// memoryEntry is a value held in a memoryStore and when it expires
+type memoryEntry struct {
+	value   string
+	expires time.Time
+}
+
+// newMemoryStore returns an empty memoryStore
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: map[string]memoryEntry{}}
+}
+
+// get returns the value stored under key if it has not expired; the lock must be held
+func (s *memoryStore) get(key string, now time.Time) (string, bool) {
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		delete(s.entries, key)
+		return "", false
+	}
+	return entry.value, true
+}
+
+// set stores the value under key, removing expired values as it goes; the lock must be held
+func (s *memoryStore) set(key, value string, ttl time.Duration, now time.Time) {
+	for k, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+}
+
+// Get returns the value stored under key, and whether there is one
+func (s *memoryStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.get(key, time.Now())
+	return value, ok, nil
+}
+
+// Set stores value under key for ttl
+func (s *memoryStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(key, value, ttl, time.Now())
+	return nil
+}
+
+// Add stores value under key for ttl unless the key already holds a value, and reports whether it was stored
+func (s *memoryStore) Add(key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := s.get(key, now); ok {
+		return false, nil
+	}
+	s.set(key, value, ttl, now)
+	return true, nil
+}
+
+// Take removes the value stored under key and returns it
+func (s *memoryStore) Take(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.get(key, time.Now())
+	delete(s.entries, key)
+	return value, ok, nil
+}
+
+// Delete removes the value stored under key
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// Update replaces the value stored under key with the one update returns, holding the lock throughout
+func (s *memoryStore) Update(key string, update func(value string, ok bool) (string, time.Duration, bool)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	value, ok := s.get(key, now)
+	if value, ttl, write := update(value, ok); write {
+		s.set(key, value, ttl, now)
+	}
+	return nil
+}
+
+// redisUpdateAttempts is how many times an update of a key in Redis is tried while other replicas change the key
+const redisUpdateAttempts = 10
+
+// redisStore is a SharedStore in Redis, where each value is a key that Redis expires on its own
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// Get returns the value stored under key, and whether there is one
+func (s *redisStore) Get(key string) (string, bool, error) {
+	value, err := s.client.Get(context.Background(), s.prefix+key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+// Set stores value under key for ttl
+func (s *redisStore) Set(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.Delete(key)
+	}
+	return s.client.Set(context.Background(), s.prefix+key, value, ttl).Err()
+}
+
+// Add stores value under key for ttl unless the key already holds a value, and reports whether it was stored
+func (s *redisStore) Add(key, value string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		_, ok, err := s.Get(key)
+		return !ok, err
+	}
+	return s.client.SetNX(context.Background(), s.prefix+key, value, ttl).Result()
+}
+
+// Take removes the value stored under key and returns it, reading and deleting it in one transaction
+func (s *redisStore) Take(key string) (string, bool, error) {
+	ctx := context.Background()
+	var get *redis.StringCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, s.prefix+key)
+		pipe.Del(ctx, s.prefix+key)
+		return nil
+	})
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return get.Val(), true, nil
+}
+
+// Delete removes the value stored under key
+func (s *redisStore) Delete(key string) error {
+	return s.client.Del(context.Background(), s.prefix+key).Err()
+}
+
+// Update replaces the value stored under key with the one update returns, watching the key so that the new value is
+// only stored if no other replica changed it meanwhile, and trying again if one did
+func (s *redisStore) Update(key string, update func(value string, ok bool) (string, time.Duration, bool)) error {
+	ctx := context.Background()
+	key = s.prefix + key
+	for i := 0; i < redisUpdateAttempts; i++ {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			value, ttl, write := update(value, err == nil)
+			if !write {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if ttl <= 0 {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, value, ttl)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errors.New("redis: " + key + " changed by other replicas throughout the update")
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals requests a shutdown on SIGINT or SIGTERM and a reload of the configuration on SIGHUP
+func notifySignals(control *serverControl) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				control.requestReload()
+			} else {
+				control.requestShutdown()
+			}
+		}
+	}()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals requests a shutdown on CTRL+C or CTRL+BREAK, or when the console is closed or the user logs off
+//
+// Windows has no SIGHUP, so the configuration of a server run from a console is reloaded by restarting it, and that
+// of the service with 'service reload'.
+func notifySignals(control *serverControl) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			control.requestShutdown()
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// sloWindow is the period SLOs are measured over, exposed as a label for alerting rules
+	sloWindow = envOrDefault("SLO_WINDOW", "30d")
+
+	// consentAuthorizationSLI counts consent submissions, which are good if the authorization completes without a
+	// server error within SLO_CONSENT_AUTHORIZATION_THRESHOLD
+	consentAuthorizationSLI = newSLI("consent_authorization",
+		"Consent submissions that completed the authorization within the latency threshold.",
+		envFloat("SLO_CONSENT_AUTHORIZATION_TARGET", 0.99),
+		envDuration("SLO_CONSENT_AUTHORIZATION_THRESHOLD", 3*time.Second))
+
+	// consentRenderSLI counts consent page requests, which are good if the page renders without a server error
+	consentRenderSLI = newSLI("consent_render",
+		"Consent page requests that rendered without a server error.",
+		envFloat("SLO_CONSENT_RENDER_TARGET", 0.999), 0)
+)
+
+// SLI counts the events of a service level indicator and how many of them were good
+type SLI struct {
+	threshold time.Duration
+	total     *Counter
+	good      *Counter
+}
+
+// newSLI registers the counters of an SLI and a gauge of its objective, labelled with the SLI's name, target,
+// latency threshold and window so that alerting rules can be written once for every SLI
+func newSLI(name, help string, target float64, threshold time.Duration) *SLI {
+	thresholdLabel := "none"
+	if threshold > 0 {
+		thresholdLabel = threshold.String()
+	}
+	labels := []string{
+		"sli", name,
+		"objective", strconv.FormatFloat(target, 'f', -1, 64),
+		"threshold", thresholdLabel,
+		"window", sloWindow,
+	}
+	metrics.GaugeFunc("slo_objective", "Target ratio of good to total events of the SLI.", func() float64 { return target }, labels...)
+	return &SLI{
+		threshold: threshold,
+		total:     metrics.Counter("sli_events_total", "Number of events counted by the SLI. "+help, labels...),
+		good:      metrics.Counter("sli_good_events_total", "Number of good events counted by the SLI. "+help, labels...),
+	}
+}
+
+// Record counts an event that took elapsed and did or did not fail with a server error
+func (s *SLI) Record(elapsed time.Duration, failed bool) {
+	s.total.Inc()
+	if !failed && (s.threshold == 0 || elapsed <= s.threshold) {
+		s.good.Inc()
+	}
+}
+
+// trackSLI is middleware that records the handlers it wraps in the SLI
+//
+// A request fails if its handler responds with a 5xx status code or with an error that maps to one.
+func trackSLI(sli *SLI) iris.Handler {
+	return func(ctx iris.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		status := ctx.GetStatusCode()
+		if err := ctx.GetErr(); err != nil {
+			status, _, _ = errorResponse(err)
+		}
+		sli.Record(time.Since(start), status >= 500)
+	}
+}
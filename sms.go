@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	smsLogin           = envBool("SMS_LOGIN", false)
+	smsCodeTTL         = envDuration("SMS_CODE_TTL", 5*time.Minute)
+	smsCodeMaxAttempts = envInt("SMS_CODE_MAX_ATTEMPTS", 5)
+	smsWebhookURL      = os.Getenv("SMS_WEBHOOK_URL")
+	smsWebhookToken    = os.Getenv("SMS_WEBHOOK_TOKEN")
+)
+
+// smsSender delivers one-time codes, logging them instead of sending them unless SMS_WEBHOOK_URL is set
+var smsSender = newSMSSender()
+
+// phonePattern matches a phone number in international format once separators are removed
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// SMSSender sends text messages
+type SMSSender interface {
+	Send(to, message string) error
+}
+
+// SMSLoginForm represents the phone number and code submitted on the SMS login pages
+type SMSLoginForm struct {
+	Phone string
+	Code  string
+}
+
+// newSMSSender returns a webhook sender if SMS_WEBHOOK_URL is configured, otherwise a sender that logs messages
+func newSMSSender() SMSSender {
+	if smsWebhookURL == "" {
+		return logSMSSender{}
+	}
+	return webhookSMSSender{url: smsWebhookURL, token: smsWebhookToken, client: newExternalHTTPClient(5 * time.Second)}
+}
+
+// logSMSSender writes text messages to the log, allowing the demo to run without an SMS gateway
+type logSMSSender struct{}
+
+// Send logs the message
+func (logSMSSender) Send(to, message string) error {
+	log.Printf("sms to %s: %s", to, message)
+	return nil
+}
+
+// webhookSMSSender posts text messages as JSON to an SMS gateway
+type webhookSMSSender struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Send posts {"to": ..., "message": ...} to the gateway, with a bearer token if one is configured
+func (s webhookSMSSender) Send(to, message string) error {
+	payload, err := json.Marshal(map[string]string{"to": to, "message": message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// normalizePhone removes common separators from a phone number and checks it is in international format
+func normalizePhone(phone string) (string, bool) {
+	phone = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(phone)
+	return phone, phonePattern.MatchString(phone)
+}
+
+// generateSMSCode returns a random six digit code
+func generateSMSCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashSMSCode hashes a code for storage in the session
+func hashSMSCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// findUserByPhone returns the user with the given phone number
+func findUserByPhone(phone string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		if user.Phone != "" && user.Phone == phone {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// getLoginSMS returns the phone number entry view on a GET request
+func getLoginSMS(ctx iris.Context) {
+	if !smsLogin {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.View("sms-login.html")
+}
+
+// postLoginSMS sends a one-time code to the user with the submitted phone number
+//
+// The code is stored hashed in the session with its expiry and the number of verification attempts.
+// The verification page is shown whether or not a user exists so that phone numbers cannot be enumerated.
+func postLoginSMS(ctx iris.Context) {
+	if !smsLogin {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+
+	form := SMSLoginForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	phone, ok := normalizePhone(form.Phone)
+	if !ok {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", "Please enter your phone number in international format, for example +44 20 7946 0000.")
+		ctx.View("sms-login.html")
+		return
+	}
+
+	user, err := findUserByPhone(phone)
+	if err == ErrUserNotFound && userStorePath == "" {
+		// As with password logins, the demo creates unknown users on their first login
+		user = &User{Username: phone, Phone: phone}
+		err = users.Save(user)
+	}
+	if err != nil && err != ErrUserNotFound {
+		ctx.SetErr(err)
+		return
+	}
+
+	code, err := generateSMSCode()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	session := sess.Start(ctx)
+	session.Set("smsCodeHash", hashSMSCode(code))
+	session.Set("smsCodeExpires", time.Now().Add(smsCodeTTL).Unix())
+	session.Set("smsCodeAttempts", 0)
+	session.Delete("smsUsername")
+
+	if user != nil {
+		session.Set("smsUsername", user.Username)
+		message := "Your login code is " + code + ". It expires in " + smsCodeTTL.String() + "."
+		if err := smsSender.Send(user.Phone, message); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	ctx.Redirect("/login/sms/verify", iris.StatusSeeOther)
+}
+
+// getLoginSMSVerify returns the code verification view on a GET request
+func getLoginSMSVerify(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if !smsLogin || session.GetString("smsCodeHash") == "" {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+	ctx.View("sms-verify.html")
+}
+
+// postLoginSMSVerify checks the submitted code and completes the login
+//
+// A code is invalidated once it expires or after SMS_CODE_MAX_ATTEMPTS incorrect attempts.
+func postLoginSMSVerify(ctx iris.Context) {
+	session := sess.Start(ctx)
+	codeHash := session.GetString("smsCodeHash")
+	if !smsLogin || codeHash == "" {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := SMSLoginForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	expires := session.GetInt64Default("smsCodeExpires", 0)
+	attempts := session.GetIntDefault("smsCodeAttempts", 0) + 1
+	session.Set("smsCodeAttempts", attempts)
+
+	if time.Now().Unix() > expires || attempts > smsCodeMaxAttempts {
+		session.Delete("smsCodeHash")
+		session.Delete("smsUsername")
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "Your code has expired or too many incorrect codes were entered. Please request a new code.")
+		ctx.View("sms-login.html")
+		return
+	}
+
+	username := session.GetString("smsUsername")
+	valid := subtle.ConstantTimeCompare([]byte(hashSMSCode(strings.TrimSpace(form.Code))), []byte(codeHash)) == 1
+	if !valid || username == "" {
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "The code you entered is invalid.")
+		ctx.View("sms-verify.html")
+		return
+	}
+
+	session.Delete("smsCodeHash")
+	session.Delete("smsUsername")
+
+	user, err := users.Get(username)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	if requireSecondFactor(ctx, user) {
+		return
+	}
+
+	completeLogin(ctx, user)
+}
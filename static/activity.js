@@ -0,0 +1,34 @@
+// Live activity feed for the admin dashboard.
+// Audit events are read from the activity stream, filtered with the page's query parameters, and shown newest first.
+
+function streamActivity() {
+    var feed = document.getElementById('activity');
+    var status = document.getElementById('activity-status');
+    var source = new EventSource('/admin/events/stream' + window.location.search);
+
+    source.onopen = function () {
+        status.textContent = 'Connected. New events appear below as they happen.';
+    };
+    source.onerror = function () {
+        status.textContent = 'Disconnected. Reconnecting...';
+    };
+    source.addEventListener('audit', function (message) {
+        var event = JSON.parse(message.data);
+        var fields = Object.keys(event).sort().filter(function (key) {
+            return key !== 'event' && key !== 'time';
+        }).map(function (key) {
+            return key + ': ' + event[key];
+        });
+
+        var item = document.createElement('li');
+        var title = document.createElement('b');
+        title.textContent = event.event;
+        var details = document.createElement('small');
+        details.textContent = fields.join(', ');
+        item.appendChild(title);
+        item.appendChild(document.createTextNode(' ' + event.time));
+        item.appendChild(document.createElement('br'));
+        item.appendChild(details);
+        feed.insertBefore(item, feed.firstChild);
+    });
+}
@@ -0,0 +1,96 @@
+// WebAuthn ceremonies for the consent application.
+// Binary values are exchanged with the server as unpadded base64url strings.
+
+function bufferFromBase64url(value) {
+    var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    var binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+    return Uint8Array.from(binary, function (c) { return c.charCodeAt(0); }).buffer;
+}
+
+function base64urlFromBuffer(buffer) {
+    var binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function postJSON(url, body) {
+    return fetch(url, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json', 'Accept': 'application/json'},
+        credentials: 'same-origin',
+        body: JSON.stringify(body || {})
+    }).then(function (response) {
+        return response.json().then(function (json) {
+            if (!response.ok) {
+                throw new Error(json.detail || json.title || response.statusText);
+            }
+            return json;
+        });
+    });
+}
+
+function showWebAuthnError(err) {
+    var element = document.getElementById('webauthn-error');
+    if (element) {
+        element.textContent = err.message;
+    }
+}
+
+function webauthnRegister() {
+    return postJSON('/webauthn/register/begin').then(function (options) {
+        options.challenge = bufferFromBase64url(options.challenge);
+        options.user.id = bufferFromBase64url(options.user.id);
+        options.excludeCredentials.forEach(function (credential) {
+            credential.id = bufferFromBase64url(credential.id);
+        });
+        return navigator.credentials.create({publicKey: options});
+    }).then(function (credential) {
+        return postJSON('/webauthn/register/finish', {
+            id: credential.id,
+            type: credential.type,
+            response: {
+                clientDataJSON: base64urlFromBuffer(credential.response.clientDataJSON),
+                attestationObject: base64urlFromBuffer(credential.response.attestationObject)
+            }
+        });
+    }).then(function (result) {
+        window.location = result.redirect;
+    }).catch(showWebAuthnError);
+}
+
+function webauthnLogin(mediation) {
+    return postJSON('/webauthn/login/begin').then(function (options) {
+        options.challenge = bufferFromBase64url(options.challenge);
+        options.allowCredentials.forEach(function (credential) {
+            credential.id = bufferFromBase64url(credential.id);
+        });
+        var request = {publicKey: options};
+        if (mediation) {
+            request.mediation = mediation;
+        }
+        return navigator.credentials.get(request);
+    }).then(function (credential) {
+        return postJSON('/webauthn/login/finish', {
+            id: credential.id,
+            type: credential.type,
+            response: {
+                clientDataJSON: base64urlFromBuffer(credential.response.clientDataJSON),
+                authenticatorData: base64urlFromBuffer(credential.response.authenticatorData),
+                signature: base64urlFromBuffer(credential.response.signature)
+            }
+        });
+    }).then(function (result) {
+        window.location = result.redirect;
+    }).catch(showWebAuthnError);
+}
+
+// Offer passkeys in the username field's autofill when the browser supports conditional mediation
+function webauthnConditionalLogin() {
+    if (!window.PublicKeyCredential || !PublicKeyCredential.isConditionalMediationAvailable) {
+        return;
+    }
+    PublicKeyCredential.isConditionalMediationAvailable().then(function (available) {
+        if (available) {
+            webauthnLogin('conditional');
+        }
+    });
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/sessions"
+)
+
+var (
+	// stepUpScopes are the scopes that may only be granted shortly after the user has proven who they are
+	stepUpScopes = envList("STEP_UP_SCOPES")
+	// stepUpMaxAge is how recent the user's login must be to grant a step-up scope
+	stepUpMaxAge = envDuration("STEP_UP_MAX_AGE", 5*time.Minute)
+	// stepUpRequireSecondFactor refuses step-up scopes to users who have not enrolled a second factor
+	stepUpRequireSecondFactor = envBool("STEP_UP_REQUIRE_SECOND_FACTOR", false)
+)
+
+// requiresStepUp reports whether any of the scopes is a step-up scope
+func requiresStepUp(scopes []string) bool {
+	for _, scope := range scopes {
+		for _, stepUp := range stepUpScopes {
+			if scope == stepUp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireStepUp asks the user to prove who they are again before granting step-up scopes, and reports whether
+// it has completed the response
+//
+// Users with a second factor must have verified it within STEP_UP_MAX_AGE and are sent to its verification page.
+// Other users must have entered their password, or logged in by other means, within STEP_UP_MAX_AGE and are
+// sent back to the login page. Sessions restored from a remember-me cookie are never recent.
+func requireStepUp(ctx iris.Context, consent ConsentRequest, scopes []string) bool {
+	if impersonating(ctx) || !requiresStepUp(scopes) {
+		return false
+	}
+
+	session := sess.Start(ctx)
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return true
+	}
+
+	hasSecondFactor := len(user.WebAuthnCredentials) > 0 || user.TOTPEnabled
+	if !hasSecondFactor && stepUpRequireSecondFactor {
+		viewError(ctx, iris.StatusForbidden, "StepUpSecondFactorRequired")
+		return true
+	}
+
+	if stepUpVerified(session, user) {
+		return false
+	}
+
+	// Return to the consent request once the user has logged in again
+	setPendingConsent(session, consent)
+	audit(ctx, "stepup.required", map[string]string{"client_id": consent.ClientID, "scopes": consent.Scopes})
+
+	if requireSecondFactor(ctx, user) {
+		return true
+	}
+	session.Set("stepUp", true)
+	ctx.Redirect("/login", iris.StatusSeeOther)
+	return true
+}
+
+// stepUpVerified reports whether the user in the session has proven who they are within STEP_UP_MAX_AGE, with
+// their second factor if they have one
+func stepUpVerified(session *sessions.Session, user *User) bool {
+	verifiedAt := session.GetInt64Default("verifiedAt", 0)
+	if len(user.WebAuthnCredentials) > 0 || user.TOTPEnabled {
+		verifiedAt = session.GetInt64Default("secondFactorAt", 0)
+	}
+	return time.Since(time.Unix(0, verifiedAt)) <= stepUpMaxAge
+}
+
+// setPendingConsent stores the consent request the user is asked to log in for in the session
+func setPendingConsent(session *sessions.Session, consent ConsentRequest) {
+	session.Set("clientID", consent.ClientID)
+	session.Set("responseType", consent.ResponseType)
+	session.Set("scopes", consent.Scopes)
+	session.Set("redirectURI", consent.RedirectURI)
+	session.Set("state", consent.State)
+	session.Set("codeChallenge", consent.CodeChallenge)
+	session.Set("codeChallengeMethod", consent.CodeChallengeMethod)
+	session.Set("nonce", consent.Nonce)
+	session.Set("loginHint", consent.LoginHint)
+	session.Set("responseMode", consent.ResponseMode)
+	session.Set("authorizationDetails", consent.AuthorizationDetails)
+	session.Set("resources", consent.Resources)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// The operations of the store subcommand
+const (
+	storeVerify  = "verify"
+	storeCompact = "compact"
+	storeRepair  = "repair"
+)
+
+// storeFinding is a record that breaks the integrity of the stores, and how to repair it if it can be
+type storeFinding struct {
+	Store   string
+	Subject string
+	Problem string
+	repair  func() error
+}
+
+// compactor is implemented by stores whose files can be rewritten from the records held in memory
+type compactor interface {
+	Compact() error
+}
+
+// runStoreCommand runs a store maintenance operation on the opened stores, reporting to w, and returns the number
+// of problems that remain
+//
+// verify reports records that refer to users, clients or tokens that no longer exist, compact drops expired
+// records and rewrites the store files, and repair fixes the problems verify reports where it can.
+func runStoreCommand(args []string, w io.Writer) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("usage: store verify|compact|repair")
+	}
+	ctx := backgroundKongContext("store")
+
+	switch args[0] {
+	case storeVerify, storeRepair:
+		findings, err := verifyStores(ctx, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		remaining := 0
+		for _, finding := range findings {
+			status := "found"
+			if args[0] == storeRepair {
+				status = "not repairable"
+				if finding.repair != nil {
+					if err := finding.repair(); err != nil {
+						return remaining, fmt.Errorf("repairing %s %s: %w", finding.Store, finding.Subject, err)
+					}
+					status = "repaired"
+				}
+			}
+			if status != "repaired" {
+				remaining++
+			}
+			fmt.Fprintf(w, "%-16s %-10s %s: %s\n", status, finding.Store, finding.Subject, finding.Problem)
+		}
+		if sessionDB == nil {
+			fmt.Fprintln(w, "sessions are held in memory by the running application and are checked on every request")
+		}
+		fmt.Fprintf(w, "%d problems found, %d remaining\n", len(findings), remaining)
+		return remaining, nil
+
+	case storeCompact:
+		return 0, compactStores(w, time.Now())
+
+	default:
+		return 0, fmt.Errorf("unknown store operation %q: use verify, compact or repair", args[0])
+	}
+}
+
+// verifyStores checks the references between users, the client registry, API activity and Kong's tokens
+//
+// A client is only reported missing when Kong confirms it has no OAuth 2.0 credential, and Kong being unavailable
+// fails verification, so that repairs never remove records because of an outage.
+func verifyStores(ctx context.Context, now time.Time) ([]storeFinding, error) {
+	allUsers, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(allUsers, func(i, j int) bool { return allUsers[i].Username < allUsers[j].Username })
+	usersByID := map[string]*User{}
+	usersByName := map[string]*User{}
+	for _, user := range allUsers {
+		usersByName[user.Username] = user
+	}
+
+	registered := map[string]bool{}
+	clientRegistered := func(clientID string) (bool, error) {
+		if ok, checked := registered[clientID]; checked {
+			return ok, nil
+		}
+		_, err := getOAuth2Credential(ctx, clientID)
+		if err != nil && !errors.Is(err, ErrUnknownClient) {
+			return false, err
+		}
+		registered[clientID] = err == nil
+		return err == nil, nil
+	}
+
+	var findings []storeFinding
+	identities := map[FederatedIdentity]string{}
+	for _, user := range allUsers {
+		username := user.Username
+
+		id := authenticatedUserID(user)
+		if other, ok := usersByID[id]; ok {
+			findings = append(findings, storeFinding{Store: "users", Subject: username,
+				Problem: "authenticated_userid " + id + " is also used by " + other.Username})
+		} else {
+			usersByID[id] = user
+		}
+
+		for _, identity := range user.FederatedIdentities {
+			if other, ok := identities[identity]; ok && other != username {
+				findings = append(findings, storeFinding{Store: "users", Subject: username,
+					Problem: "identity " + identity.Subject + " at " + identity.Issuer + " is also linked to " + other})
+			}
+			identities[identity] = username
+		}
+
+		seen := map[string]bool{}
+		for _, grant := range user.Grants {
+			clientID := grant.ClientID
+			if seen[clientID] {
+				findings = append(findings, storeFinding{Store: "users", Subject: username,
+					Problem: "more than one grant to client " + clientID,
+					repair:  func() error { return updateStoredUser(username, mergeGrants) }})
+				continue
+			}
+			seen[clientID] = true
+
+			ok, err := clientRegistered(clientID)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				findings = append(findings, storeFinding{Store: "users", Subject: username,
+					Problem: "grant to client " + clientID + ", which is not registered with Kong",
+					repair: func() error {
+						return updateStoredUser(username, func(user *User) { removeGrant(user, clientID) })
+					}})
+			}
+		}
+
+		if expired := expiredRememberTokens(user, now); expired > 0 {
+			findings = append(findings, storeFinding{Store: "users", Subject: username,
+				Problem: fmt.Sprintf("%d expired remember-me tokens", expired),
+				repair: func() error {
+					return updateStoredUser(username, func(user *User) { dropExpiredRememberTokens(user, now) })
+				}})
+		}
+		if user.Disabled && len(user.RememberTokens) > 0 {
+			findings = append(findings, storeFinding{Store: "users", Subject: username,
+				Problem: "disabled user has remember-me tokens",
+				repair:  func() error { return updateStoredUser(username, func(user *User) { user.RememberTokens = nil }) }})
+		}
+	}
+
+	allClients, err := clients.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(allClients, func(i, j int) bool { return allClients[i].ClientID < allClients[j].ClientID })
+	for _, client := range allClients {
+		clientID := client.ClientID
+		ok, err := clientRegistered(clientID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			findings = append(findings, storeFinding{Store: "clients", Subject: clientID,
+				Problem: "settings for a client that is not registered with Kong",
+				repair:  func() error { return clients.Delete(clientID) }})
+			continue
+		}
+		for _, owner := range client.Owners {
+			if _, ok := usersByName[owner]; !ok {
+				owner := owner
+				findings = append(findings, storeFinding{Store: "clients", Subject: clientID,
+					Problem: "owner " + owner + " is not a user",
+					repair:  func() error { return removeClientOwner(clientID, owner) }})
+			}
+		}
+	}
+
+	orphaned := map[string]int{}
+	for _, record := range activities.Records() {
+		if _, ok := usersByID[record.AuthenticatedUserID]; !ok {
+			orphaned[record.AuthenticatedUserID]++
+		}
+	}
+	for _, id := range sortedKeys(orphaned) {
+		id := id
+		findings = append(findings, storeFinding{Store: "activity", Subject: id,
+			Problem: fmt.Sprintf("%d API requests of a user who does not exist", orphaned[id]),
+			repair: func() error {
+				_, err := activities.Remove(func(record activityRecord) bool { return record.AuthenticatedUserID == id })
+				return err
+			}})
+	}
+
+	if kongAdminEndpoint != "" {
+		err := eachKongToken(ctx, func(token oauth2Token) error {
+			if token.AuthenticatedUserID == "" || token.ID == "" {
+				return nil
+			}
+			tokenID := token.ID
+			user, ok := usersByID[token.AuthenticatedUserID]
+			switch {
+			case !ok:
+				findings = append(findings, storeFinding{Store: "kong", Subject: tokenID,
+					Problem: "token of authenticated_userid " + token.AuthenticatedUserID + ", who is not a user",
+					repair:  func() error { return deleteKongToken(ctx, tokenID) }})
+			case user.Disabled:
+				findings = append(findings, storeFinding{Store: "kong", Subject: tokenID,
+					Problem: "token of disabled user " + user.Username,
+					repair:  func() error { return deleteKongToken(ctx, tokenID) }})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return findings, nil
+}
+
+// compactStores drops expired records and rewrites the files of the stores
+func compactStores(w io.Writer, now time.Time) error {
+	allUsers, err := users.List()
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for _, user := range allUsers {
+		if expired := expiredRememberTokens(user, now); expired > 0 {
+			dropExpiredRememberTokens(user, now)
+			if err := users.Save(user); err != nil {
+				return err
+			}
+			dropped += expired
+		}
+	}
+	fmt.Fprintf(w, "users: dropped %d expired remember-me tokens\n", dropped)
+
+	purged, err := purgeRevokedGrants(now)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "users: purged %d revoked grants past their undo window\n", purged)
+
+	before := len(activities.Records())
+	if err := activities.Compact(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "activity: dropped %d expired API requests\n", before-len(activities.Records()))
+
+	for name, store := range map[string]interface{}{"users": users, "clients": clients} {
+		if c, ok := store.(compactor); ok {
+			if err := c.Compact(); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s: rewritten\n", name)
+		}
+	}
+	return nil
+}
+
+// updateStoredUser applies update to the stored user and saves them
+func updateStoredUser(username string, update func(user *User)) error {
+	user, err := users.Get(username)
+	if err != nil {
+		return err
+	}
+	update(user)
+	return users.Save(user)
+}
+
+// mergeGrants combines the user's grants to the same client into one
+func mergeGrants(user *User) {
+	var merged []Grant
+	for _, grant := range user.Grants {
+		existing := -1
+		for i := range merged {
+			if merged[i].ClientID == grant.ClientID {
+				existing = i
+			}
+		}
+		if existing < 0 {
+			merged = append(merged, grant)
+			continue
+		}
+		if grant.Granted < merged[existing].Granted {
+			merged[existing].Granted = grant.Granted
+		}
+		if grant.LastGranted > merged[existing].LastGranted {
+			merged[existing].LastGranted = grant.LastGranted
+		}
+		for _, scope := range grant.Scopes {
+			if !containsString(merged[existing].Scopes, scope) {
+				merged[existing].Scopes = append(merged[existing].Scopes, scope)
+			}
+		}
+		sort.Strings(merged[existing].Scopes)
+	}
+	user.Grants = merged
+}
+
+// expiredRememberTokens returns the number of the user's remember-me tokens that have expired
+func expiredRememberTokens(user *User, now time.Time) int {
+	expired := 0
+	for _, token := range user.RememberTokens {
+		if token.Expires <= now.Unix() {
+			expired++
+		}
+	}
+	return expired
+}
+
+// dropExpiredRememberTokens removes the user's remember-me tokens that have expired
+func dropExpiredRememberTokens(user *User, now time.Time) {
+	kept := user.RememberTokens[:0]
+	for _, token := range user.RememberTokens {
+		if token.Expires > now.Unix() {
+			kept = append(kept, token)
+		}
+	}
+	user.RememberTokens = kept
+}
+
+// removeClientOwner removes an owner from the client's settings
+func removeClientOwner(clientID, owner string) error {
+	client, err := clients.Get(clientID)
+	if err != nil {
+		return err
+	}
+	owners := client.Owners[:0]
+	for _, o := range client.Owners {
+		if o != owner {
+			owners = append(owners, o)
+		}
+	}
+	client.Owners = owners
+	return clients.Save(client)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update rewrites the golden files from the templates instead of comparing against them:
+//
+//	go test -run TestTemplates -update
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenDir holds the expected rendering of each template case
+const goldenDir = "testdata/golden"
+
+// templateLocales are the locales localized cases are rendered in
+var templateLocales = []string{"en-US", "de-DE"}
+
+// templateTime is the fixed time shown in the view models, so that renderings do not change from run to run
+var templateTime = time.Date(2024, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+// templateCase is a view model rendered with a template
+//
+// Localized cases are rendered once for each locale, with the view model built from the locale's messages as the
+// handlers build it with ctx.Tr.
+type templateCase struct {
+	name      string
+	template  string
+	localized bool
+	data      func(tr func(string) string) map[string]interface{}
+}
+
+// scopeDescriptions describes the scopes in the locale, as describeScopes does
+func scopeDescriptions(tr func(string) string, scopes ...string) []ScopeDescription {
+	descriptions := []ScopeDescription{}
+	for _, scope := range scopes {
+		descriptions = append(descriptions, ScopeDescription{Name: scope, Description: tr("Scope_" + scope)})
+	}
+	return descriptions
+}
+
+// consentData is the view model of getConsent for a client asking for the scopes
+func consentData(tr func(string) string, scopes ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"ApplicationName": "Test Client Application",
+		"ClientID":        "client-id",
+		"ResponseType":    responseTypeCode,
+		"Scopes":          strings.Join(scopes, ","),
+		"RedirectURI":     "http://some-domain/endpoint/",
+		"State":           "af0ifjsldkj",
+		"RequestedScopes": scopeDescriptions(tr, scopes...),
+		"Branding":        &ClientSettings{ClientID: "client-id"},
+	}
+}
+
+// paymentClient has a template for the payment initiation authorization details of RFC 9396
+var paymentClient = &ClientSettings{ClientID: "client-id", AuthorizationDetailsTypes: []AuthorizationDetailsType{{
+	Type:  "payment_initiation",
+	Label: "Payment",
+	Fields: []AuthorizationDetailsField{
+		{Name: "instructedAmount.amount", Label: "Amount", Required: true, Pattern: `[0-9]+(\.[0-9]{2})?`},
+		{Name: "instructedAmount.currency", Label: "Currency", Required: true, Pattern: `[A-Z]{3}`},
+		{Name: "creditorName", Label: "Payee"},
+		{Name: "creditorAccount.iban", Label: "Account"},
+		{Name: "locations"},
+	},
+}}}
+
+// paymentDetails are authorization details for a payment of paymentClient
+const paymentDetails = `[{"type":"payment_initiation","locations":["https://example.com/payments"],` +
+	`"instructedAmount":{"currency":"EUR","amount":"123.50"},"creditorName":"Merchant A",` +
+	`"creditorAccount":{"iban":"DE02100100109307118603"}}]`
+
+// errorData is the view model of viewError for the locale key
+func errorData(tr func(string) string, key string) map[string]interface{} {
+	return map[string]interface{}{
+		"Title":   tr("ErrorTitle"),
+		"Message": tr(key),
+		"Hint":    tr(key + "Hint"),
+	}
+}
+
+// withViewData returns data with the extra view data added
+func withViewData(data map[string]interface{}, extra map[string]interface{}) map[string]interface{} {
+	for key, value := range extra {
+		data[key] = value
+	}
+	return data
+}
+
+// untranslated builds view models that do not depend on the locale
+func untranslated(data map[string]interface{}) func(func(string) string) map[string]interface{} {
+	return func(func(string) string) map[string]interface{} { return data }
+}
+
+var (
+	passwordRequirements = []string{"at least 12 characters", "a digit"}
+	captchaWidget        = CaptchaWidget{ScriptURL: "https://captcha.example.com/api.js", Class: "h-captcha", SiteKey: "site-key"}
+	impersonation        = Impersonation{Admin: "admin", User: "user", Expires: templateTime}
+)
+
+// templateCases covers every template, and the permutations of each view model that change what users see
+var templateCases = []templateCase{
+	// The consent page, with no, one and many scopes, branding and each of its notices
+	{name: "consent-no-scopes", template: "consent.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return consentData(tr)
+	}},
+	{name: "consent-one-scope", template: "consent.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return consentData(tr, "email")
+	}},
+	{name: "consent-offline-access", template: "consent.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "openid", "email"), map[string]interface{}{"Scopes": "openid,email,offline_access", "OfflineAccess": true})
+	}},
+	{name: "consent-many-scopes", template: "consent.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "openid", "profile", "email", "phone", "address", "offline_access", "unknown"),
+			map[string]interface{}{"Nonce": "n-0S6_WzA2Mj"})
+	}},
+	{name: "consent-branded", template: "consent.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email"), map[string]interface{}{
+			"Branding": &ClientSettings{ClientID: "client-id", LogoURI: "https://app.example.com/logo.png", PrimaryColor: "#336699"},
+			"Headline": "Connect Test Client Application",
+			"Warnings": []string{"Test Client Application can read your email while you are not using it."},
+		})
+	}},
+	{name: "consent-implicit", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email"), map[string]interface{}{"ResponseType": responseTypeToken, "ImplicitGrant": true})
+	}},
+	{name: "consent-pkce-kiosk", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email"), map[string]interface{}{
+			"CodeChallenge":       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+			"CodeChallengeMethod": "S256",
+			"KioskTimeout":        120,
+		})
+	}},
+	{name: "consent-captcha", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email"), map[string]interface{}{"Error": "Please complete the CAPTCHA.", "Captcha": captchaWidget})
+	}},
+	{name: "consent-form-post", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "openid", "email"), map[string]interface{}{"ResponseMode": responseModeFormPost})
+	}},
+	{name: "consent-authorization-details", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		details, _ := describeAuthorizationDetails(paymentClient, paymentDetails)
+		return withViewData(consentData(tr, "email"), map[string]interface{}{"AuthorizationDetails": paymentDetails, "RequestedDetails": details})
+	}},
+	{name: "consent-resources", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		resources := []string{"https://api.example.com/payments", "https://files.example.com/"}
+		return withViewData(consentData(tr, "email"), map[string]interface{}{
+			"Resources":          strings.Join(resources, " "),
+			"RequestedResources": describeResources(resources),
+		})
+	}},
+	{name: "consent-preview", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email", "phone"), map[string]interface{}{"Preview": true, "ConsentDisabled": true})
+	}},
+	{name: "consent-impersonating", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email"), map[string]interface{}{"Impersonation": impersonation, "ConsentDisabled": true})
+	}},
+	{name: "consent-escaping", template: "consent.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(consentData(tr, "email"), map[string]interface{}{
+			"ApplicationName": `<script>alert("name")</script>`,
+			"State":           `"><script>alert("state")</script>`,
+			"Branding":        &ClientSettings{LogoURI: `javascript:alert("logo")`, PrimaryColor: `red;background:url(x)`},
+		})
+	}},
+
+	// Error pages, localized, with and without the debug details
+	{name: "error-kong-invalid-scope", template: "error.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return errorData(tr, "KongErrorInvalidScope")
+	}},
+	{name: "error-kong-unknown", template: "error.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return errorData(tr, "KongErrorUnknown")
+	}},
+	{name: "consent-policy-denied", template: "consent-policy-denied.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(errorData(tr, "ConsentPolicyDenied"), map[string]interface{}{
+			"Violations": []ConsentPolicyViolation{
+				{Scopes: scopeDescriptions(tr, "address"), Explanation: tr("ConsentPolicyNetworkAndTime") + " Mon, Tue, Wed, Thu, Fri 09:00-17:00 (Europe/Berlin)"},
+				{Scopes: scopeDescriptions(tr, "email", "phone"), Explanation: tr("ConsentPolicyNetwork")},
+			},
+		})
+	}},
+	{name: "error-debug", template: "error.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(errorData(tr, "KongErrorInvalidRequest"), map[string]interface{}{
+			"CodeLabel":   tr("ErrorCode"),
+			"Code":        "invalid_request",
+			"Description": "Invalid redirect_uri that does not match with any redirect_uri created with the application",
+		})
+	}},
+	{name: "error-impersonating", template: "error.html", data: func(tr func(string) string) map[string]interface{} {
+		return withViewData(errorData(tr, "KongErrorAccessDenied"), map[string]interface{}{"Impersonation": impersonation})
+	}},
+
+	{name: "login", template: "login.html", data: untranslated(map[string]interface{}{"Demo": true, "RememberMe": true})},
+	{name: "login-error", template: "login.html", data: untranslated(map[string]interface{}{
+		"Error": "Invalid username or password.", "RememberMe": true, "Captcha": captchaWidget,
+	})},
+	{name: "login-methods", template: "login.html", data: untranslated(map[string]interface{}{
+		"Notice":     "The application is asking for sensitive permissions. Please login again to continue.",
+		"BadgeLogin": true, "SMSLogin": true, "OIDC": "Example SSO",
+	})},
+	{name: "login-hint", template: "login.html", data: untranslated(map[string]interface{}{
+		"Notice": "The application is asking you to login again to continue.", "LoginHint": "alice@example.com", "RememberMe": true,
+	})},
+	{name: "login-announcement", template: "login.html", data: untranslated(map[string]interface{}{
+		"Announcements": []Announcement{{Level: announcementWarning, Message: "Sign in will be unavailable on Saturday from 02:00 to 04:00 UTC."}},
+	})},
+	{name: "login-environment", template: "login.html", data: untranslated(map[string]interface{}{
+		"Environment": newEnvironment("staging", "", ""),
+	})},
+	{name: "login-magic-link", template: "login.html", data: untranslated(map[string]interface{}{"MagicLink": true})},
+
+	{name: "account-app", template: "account-app.html", localized: true, data: func(tr func(string) string) map[string]interface{} {
+		return map[string]interface{}{
+			"App": grantedApp{
+				ClientID:        "client-id",
+				ApplicationName: "Test Client Application",
+				Scopes:          scopeDescriptions(tr, "email", "phone"),
+				Granted:         templateTime.Format(time.RFC1123),
+				LastGranted:     templateTime.Format(time.RFC1123),
+			},
+			"ActivityEnabled": true,
+			"Activity": []APIActivity{
+				{Time: templateTime, Method: "GET", Path: "/myapi/profile", Status: 200, ClientIP: "192.0.2.1"},
+				{Time: templateTime, Method: "POST", Path: "/myapi/messages", Status: 403, ClientIP: "2001:db8::1"},
+			},
+		}
+	}},
+	{name: "account-app-activity-unavailable", template: "account-app.html", data: func(tr func(string) string) map[string]interface{} {
+		return map[string]interface{}{
+			"App":                 grantedApp{ClientID: "client-id", ApplicationName: "Test Client Application", Scopes: scopeDescriptions(tr, "email")},
+			"ActivityEnabled":     true,
+			"ActivityUnavailable": true,
+		}
+	}},
+	{name: "account-apps", template: "account-apps.html", data: untranslated(map[string]interface{}{
+		"Notice": "Access has been removed.",
+		"Apps": []grantedApp{
+			{ClientID: "client-id", ApplicationName: "Test Client Application", Granted: templateTime.Format(time.RFC1123), LastGranted: templateTime.Format(time.RFC1123)},
+		},
+		"RevokedApps": []grantedApp{
+			{ClientID: "other-client", ApplicationName: "Other Application", UndoUntil: templateTime.Format(time.RFC1123)},
+		},
+	})},
+	{name: "account-apps-empty", template: "account-apps.html", data: untranslated(map[string]interface{}{
+		"Apps": []grantedApp{}, "RevokedApps": []grantedApp{},
+	})},
+	{name: "account-email", template: "account-email.html", data: untranslated(map[string]interface{}{
+		"Email": "user@example.com", "EmailVerified": false, "Notice": "A verification email has been sent.",
+	})},
+	{name: "account-language", template: "account-language.html", data: untranslated(map[string]interface{}{
+		"Language": "de-DE",
+		"Languages": []languageOption{
+			{Code: "en-US", Name: "English"},
+			{Code: "de-DE", Name: "Deutsch", Selected: true},
+		},
+	})},
+	{name: "account-password", template: "account-password.html", data: untranslated(map[string]interface{}{
+		"PasswordRequirements": passwordRequirements,
+		"PasswordProblems":     []string{"Your password must contain a digit."},
+	})},
+	{name: "account-remember", template: "account-remember.html", data: untranslated(map[string]interface{}{
+		"Browsers": []rememberedBrowser{
+			{Selector: "selector", UserAgent: "Mozilla/5.0", Created: templateTime.Format(time.RFC1123), LastUsed: templateTime.Format(time.RFC1123), Current: true},
+		},
+	})},
+	{name: "account-tokens", template: "account-tokens.html", data: untranslated(map[string]interface{}{
+		"Tokens": []issuedToken{
+			{ID: "token-id", ClientID: "client-id", ApplicationName: "Test Client Application", Scopes: []ScopeDescription{{Name: "email", Description: "Read your email address"}, {Name: "phone", Description: "Read your phone number"}}, Issued: templateTime.Format(time.RFC1123)},
+			{ID: "other-token-id", Issued: templateTime.Format(time.RFC1123)},
+		},
+		"Notice": "Other Application was signed out. It will need to ask you again to use your account.",
+	})},
+	{name: "account-tokens-empty", template: "account-tokens.html", data: untranslated(map[string]interface{}{"Tokens": []issuedToken{}})},
+	{name: "admin-activity", template: "admin-activity.html", data: untranslated(map[string]interface{}{
+		"ClientID": "client-id", "User": "", "Event": "grant.*,token.revoked",
+	})},
+	{name: "admin-announcements", template: "admin-announcements.html", data: untranslated(map[string]interface{}{
+		"Now": templateTime, "Levels": announcementLevels, "Languages": supportedLanguages,
+		"Error": "Please enter a message.",
+		"List": []Announcement{
+			{ID: "maintenance", Level: announcementWarning, Message: "Sign in will be unavailable on Saturday from 02:00 to 04:00 UTC.",
+				Starts: templateTime.Add(-time.Hour), Ends: templateTime.Add(72 * time.Hour)},
+			{ID: "wartung", Level: announcementInfo, Message: "Neue Anmeldeseite ab Montag.", Locales: []string{"de-DE"},
+				Starts: templateTime.Add(24 * time.Hour)},
+		},
+	})},
+	{name: "admin-announcements-empty", template: "admin-announcements.html", data: untranslated(map[string]interface{}{
+		"Now": templateTime, "Levels": announcementLevels, "Languages": supportedLanguages, "List": []Announcement{},
+	})},
+	{name: "announcement-banner", template: "announcement-banner.html", data: untranslated(map[string]interface{}{
+		"Announcements": []Announcement{
+			{Level: announcementCritical, Message: "Reset your password if you reused it on example.org."},
+			{Level: announcementInfo, Message: "Sign in will be unavailable on Saturday."},
+		},
+	})},
+	{name: "environment-banner", template: "environment-banner.html", data: untranslated(map[string]interface{}{
+		"Environment": &Environment{Label: "DEV", Color: "#38761d"},
+	})},
+	{name: "admin-emails", template: "admin-emails.html", data: untranslated(map[string]interface{}{
+		"Emails": []emailPreview{{Name: "verify_email", Subject: "Verify your email address", Text: "Open the link.", HTML: `<p>Open the <a href="#">link</a>.</p>`}},
+	})},
+	{name: "admin-impersonate", template: "admin-impersonate.html", data: untranslated(map[string]interface{}{"Error": "No such user."})},
+	{name: "admin-migrate-user", template: "admin-migrate-user.html", data: untranslated(map[string]interface{}{"Notice": "The user has been migrated."})},
+	{name: "app-redirect", template: "app-redirect.html", data: untranslated(map[string]interface{}{
+		"ApplicationName": "Test Client Application", "RedirectURI": "com.example.app:/oauth2/callback?code=abc", "Code": "abc",
+	})},
+	{name: "app-redirect-denied", template: "app-redirect.html", data: untranslated(map[string]interface{}{
+		"ApplicationName": "Test Client Application", "RedirectURI": "com.example.app:/oauth2/callback?error=access_denied", "ErrorCode": "access_denied",
+	})},
+	{name: "app-redirect-failed", template: "app-redirect.html", data: untranslated(map[string]interface{}{
+		"ApplicationName": "Test Client Application", "RedirectURI": "com.example.app:/oauth2/callback?error=invalid_scope", "ErrorCode": "invalid_scope",
+	})},
+	{name: "badge-enroll", template: "badge-enroll.html", data: untranslated(map[string]interface{}{"Badge": "12345", "Notice": "Your badge has been enrolled."})},
+	{name: "badge-login", template: "badge-login.html", data: untranslated(map[string]interface{}{"Error": "Unknown badge."})},
+	{name: "break-glass-login", template: "break-glass-login.html", data: untranslated(map[string]interface{}{"Error": "Invalid credentials."})},
+	{name: "developer", template: "developer.html", data: untranslated(map[string]interface{}{
+		"Clients": []string{"client-id", "other-client"}, "Scopes": "email,phone,address",
+	})},
+	{name: "developer-webhook", template: "developer-webhook.html", data: untranslated(map[string]interface{}{
+		"ClientID": "client-id", "URL": "https://app.example.com/webhook", "Secret": "secret", "Notice": "The webhook has been saved.",
+	})},
+	{name: "form-post", template: "form-post.html", data: untranslated(map[string]interface{}{
+		"Action": "https://app.example.com/callback?tenant=1",
+		"Fields": []formPostField{{Name: "code", Value: "abc"}, {Name: "state", Value: `"><script>alert("state")</script>`}},
+	})},
+	{name: "forgot-password", template: "forgot-password.html", data: untranslated(map[string]interface{}{"Error": "Enter your email address."})},
+	{name: "forgot-password-sent", template: "forgot-password-sent.html", data: untranslated(map[string]interface{}{"Email": "user@example.com"})},
+	{name: "impersonation-banner", template: "impersonation-banner.html", data: untranslated(map[string]interface{}{"Impersonation": impersonation})},
+	{name: "index", template: "index.html", data: untranslated(map[string]interface{}{"Playground": true})},
+	{name: "magic-link-sent", template: "magic-link-sent.html", data: untranslated(map[string]interface{}{"Email": "user@example.com"})},
+	{name: "playground", template: "playground.html", data: untranslated(map[string]interface{}{
+		"Paths": []playgroundPath{{Path: "/myapi/profile", Scopes: []string{"profile"}}, {Path: "/myapi/status"}},
+	})},
+	{name: "playground-results", template: "playground.html", data: untranslated(map[string]interface{}{
+		"Paths":       []playgroundPath{{Path: "/myapi/profile", Scopes: []string{"profile"}}, {Path: "/myapi/email", Scopes: []string{"email", "phone"}}},
+		"TokenScopes": []string{"email", "phone"},
+		"Results": []playgroundResult{
+			{playgroundPath: playgroundPath{Path: "/myapi/profile", Scopes: []string{"profile"}}, Status: 403},
+			{playgroundPath: playgroundPath{Path: "/myapi/email", Scopes: []string{"email", "phone"}}, Granted: true, Status: 200},
+			{playgroundPath: playgroundPath{Path: "/myapi/status"}, Granted: true, Error: "kong:8000 responded 502 Bad Gateway"},
+		},
+	})},
+	{name: "playground-exchanged", template: "playground.html", data: untranslated(map[string]interface{}{
+		"Paths":        []playgroundPath{{Path: "/myapi/profile", Scopes: []string{"profile"}}},
+		"ExchangeForm": PlaygroundExchangeForm{ClientID: "client", Code: "code", RedirectURI: "https://client.example.com/callback"},
+		"Exchange": playgroundExchange{Outcome: codeExchanged, Status: 200, AccessToken: "token", Scope: "profile",
+			Explanation: "Kong exchanged the code for tokens and deleted it, so it cannot be exchanged again."},
+	})},
+	{name: "playground-replayed", template: "playground.html", data: untranslated(map[string]interface{}{
+		"Paths":        []playgroundPath{{Path: "/myapi/profile", Scopes: []string{"profile"}}},
+		"ExchangeForm": PlaygroundExchangeForm{ClientID: "client", Code: "code"},
+		"Exchange": playgroundExchange{Outcome: codeReplayed, Status: 400, Error: "invalid_request: Invalid code",
+			Explanation: "The code was already exchanged at Mon, 02 Jan 2006 15:04:05 UTC."},
+	})},
+	{name: "register", template: "register.html", data: untranslated(map[string]interface{}{
+		"Username": "user", "Email": "user@example.com", "Phone": "+15555550100",
+		"Error":                "That username is taken.",
+		"PasswordRequirements": passwordRequirements,
+		"Captcha":              captchaWidget,
+	})},
+	{name: "reset-password", template: "reset-password.html", data: untranslated(map[string]interface{}{
+		"Token": "token", "PasswordRequirements": passwordRequirements, "PasswordProblems": []string{"Your password must be at least 12 characters long."},
+	})},
+	{name: "sms-login", template: "sms-login.html", data: untranslated(map[string]interface{}{"Error": "Unknown phone number."})},
+	{name: "sms-verify", template: "sms-verify.html", data: untranslated(map[string]interface{}{"Error": "Invalid code."})},
+	{name: "totp", template: "totp.html", data: untranslated(map[string]interface{}{"Error": "Invalid code."})},
+	{name: "totp-enroll", template: "totp-enroll.html", data: untranslated(map[string]interface{}{
+		"Secret": "JBSWY3DPEHPK3PXP", "QRCode": template.URL("data:image/png;base64,iVBORw0KGgo="),
+	})},
+	{name: "totp-enroll-replacing", template: "totp-enroll.html", data: untranslated(map[string]interface{}{
+		"Secret": "JBSWY3DPEHPK3PXP", "QRCode": template.URL("data:image/png;base64,iVBORw0KGgo="), "Replacing": true,
+	})},
+	{name: "totp-recovery", template: "totp-recovery.html", data: untranslated(map[string]interface{}{
+		"RecoveryCodes": []string{"aaaa-bbbb", "cccc-dddd"},
+	})},
+	{name: "verify-email", template: "verify-email.html", data: untranslated(map[string]interface{}{"Email": "user@example.com"})},
+	{name: "verify-email-required", template: "verify-email-required.html", data: untranslated(map[string]interface{}{"Email": "user@example.com"})},
+	{name: "webauthn-login", template: "webauthn-login.html", data: untranslated(map[string]interface{}{"TOTPEnabled": true})},
+	{name: "webauthn-register", template: "webauthn-register.html", data: untranslated(map[string]interface{}{
+		"Credentials": []WebAuthnCredential{{ID: "credential-id"}},
+	})},
+	{name: "webauthn-register-empty", template: "webauthn-register.html", data: untranslated(map[string]interface{}{})},
+}
+
+// loadLocale reads the messages of a locale, which are flat key: "value" entries
+func loadLocale(t *testing.T, locale string) func(string) string {
+	files, err := filepath.Glob(filepath.Join("locales", locale, "*.yml"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no messages for locale %s", locale)
+	}
+	messages := map[string]string{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) != 2 {
+				t.Fatalf("%s: unexpected line %q", file, line)
+			}
+			value, err := strconv.Unquote(parts[1])
+			if err != nil {
+				t.Fatalf("%s: unexpected value %q", file, parts[1])
+			}
+			messages[parts[0]] = value
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Missing keys are shown as the key, as ctx.Tr does
+	return func(key string) string {
+		if message, ok := messages[key]; ok {
+			return message
+		}
+		return key
+	}
+}
+
+// TestTemplates renders every template case and compares it with its golden file
+func TestTemplates(t *testing.T) {
+	templates, err := template.ParseGlob("templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translations := map[string]func(string) string{}
+	for _, locale := range templateLocales {
+		translations[locale] = loadLocale(t, locale)
+	}
+
+	for _, c := range templateCases {
+		locales := []string{""}
+		if c.localized {
+			locales = templateLocales
+		}
+		for _, locale := range locales {
+			name, tr := c.name, translations[templateLocales[0]]
+			if locale != "" {
+				name, tr = name+"."+locale, translations[locale]
+			}
+
+			t.Run(name, func(t *testing.T) {
+				var rendered bytes.Buffer
+				if err := templates.ExecuteTemplate(&rendered, c.template, c.data(tr)); err != nil {
+					t.Fatal(err)
+				}
+				golden := filepath.Join(goldenDir, name+".html")
+				if *update {
+					if err := os.MkdirAll(goldenDir, 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := ioutil.WriteFile(golden, rendered.Bytes(), 0644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				expected, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v; run go test -run TestTemplates -update to create it", err)
+				}
+				if !bytes.Equal(rendered.Bytes(), expected) {
+					t.Errorf("rendering differs from %s at line %d; run go test -run TestTemplates -update if the change is intended",
+						golden, firstDifferentLine(rendered.Bytes(), expected))
+				}
+			})
+		}
+	}
+}
+
+// TestTemplatesCovered checks that every template has a case, so that new templates get golden files
+func TestTemplatesCovered(t *testing.T) {
+	files, err := filepath.Glob("templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered := map[string]bool{}
+	for _, c := range templateCases {
+		covered[c.template] = true
+	}
+	for _, file := range files {
+		if !covered[filepath.Base(file)] {
+			t.Errorf("%s has no template case", file)
+		}
+	}
+}
+
+// TestTemplatesGoldenFilesUsed checks that golden files are removed with their cases
+func TestTemplatesGoldenFilesUsed(t *testing.T) {
+	names := map[string]bool{}
+	for _, c := range templateCases {
+		if !c.localized {
+			names[c.name+".html"] = true
+			continue
+		}
+		for _, locale := range templateLocales {
+			names[c.name+"."+locale+".html"] = true
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(goldenDir, "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !names[filepath.Base(file)] {
+			t.Errorf("%s has no template case", file)
+		}
+	}
+}
+
+// firstDifferentLine returns the number of the first line that differs between a and b
+func firstDifferentLine(a, b []byte) int {
+	linesA, linesB := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+	for i := range linesA {
+		if i >= len(linesB) || linesA[i] != linesB[i] {
+			return i + 1
+		}
+	}
+	return len(linesA) + 1
+}
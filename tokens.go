@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned when a signed token is malformed, forged or issued for another purpose
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned when a signed token has expired
+	ErrExpiredToken = errors.New("token has expired")
+	// ErrUsedToken is returned when a single-use token has already been used
+	ErrUsedToken = errors.New("token has already been used")
+)
+
+// signingKey signs the tokens embedded in links sent to users
+var signingKey = loadSigningKey()
+
+// usedTokens records the IDs of single-use tokens until they expire
+var usedTokens = &tokenLedger{used: map[string]time.Time{}}
+
+// tokenClaims is the signed payload of a token
+type tokenClaims struct {
+	Purpose string          `json:"pur"`
+	ID      string          `json:"jti"`
+	Expires int64           `json:"exp"`
+	Data    json.RawMessage `json:"dat,omitempty"`
+}
+
+// loadSigningKey returns the key configured by SIGNING_KEY, or a random key if it is unset
+func loadSigningKey() []byte {
+	if key := os.Getenv("SIGNING_KEY"); key != "" {
+		return []byte(key)
+	}
+
+	log.Print("SIGNING_KEY is not set, links sent to users will not survive a restart")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// signToken returns a token for purpose carrying data, valid for ttl
+func signToken(purpose string, ttl time.Duration, data interface{}) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	claims := tokenClaims{
+		Purpose: purpose,
+		ID:      base64.RawURLEncoding.EncodeToString(id),
+		Expires: time.Now().Add(ttl).Unix(),
+	}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+		claims.Data = raw
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(encoded)), nil
+}
+
+// verifyToken checks the signature, purpose and expiry of token and decodes its data into v
+func verifyToken(purpose, token string, v interface{}) (tokenClaims, error) {
+	claims := tokenClaims{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, tokenSignature(parts[0])) {
+		return claims, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Purpose != purpose {
+		return claims, ErrInvalidToken
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, ErrExpiredToken
+	}
+
+	if v != nil && claims.Data != nil {
+		if err := json.Unmarshal(claims.Data, v); err != nil {
+			return claims, ErrInvalidToken
+		}
+	}
+	return claims, nil
+}
+
+// verifySingleUseToken verifies token as verifyToken does and marks it as used
+func verifySingleUseToken(purpose, token string, v interface{}) (tokenClaims, error) {
+	claims, err := verifyToken(purpose, token, v)
+	if err != nil {
+		return claims, err
+	}
+	if !usedTokens.use(claims.ID, time.Unix(claims.Expires, 0)) {
+		return claims, ErrUsedToken
+	}
+	return claims, nil
+}
+
+// tokenSignature returns the HMAC-SHA256 of an encoded payload
+func tokenSignature(encoded string) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// tokenLedger records used token IDs until they expire
+type tokenLedger struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// use records id as used, returning false if it has already been used
+func (l *tokenLedger) use(id string, expires time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for usedID, usedExpires := range l.used {
+		if now.After(usedExpires) {
+			delete(l.used, usedID)
+		}
+	}
+
+	if _, ok := l.used[id]; ok {
+		return false
+	}
+	l.used[id] = expires
+	return true
+}
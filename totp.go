@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer            = "Kong OAuth 2.0 Consent App"
+	totpPeriod            = 30
+	totpSkew              = 1
+	recoveryCodeCount     = 10
+	recoveryCodeByteCount = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpLockoutThreshold is how many wrong codes may be entered for a username before it must log in with its password
+// again and is locked out for LOGIN_LOCKOUT_DURATION
+var totpLockoutThreshold = envInt("TOTP_LOCKOUT_THRESHOLD", 5)
+
+// The outcomes of a code entered on the TOTP verification page
+const (
+	totpAccepted = iota
+	totpRejected
+	totpDelayed
+	totpLockedOut
+)
+
+// TOTPForm represents the code submitted on the TOTP verification and enrollment pages
+type TOTPForm struct {
+	Code string
+	// CurrentCode is a code from the authenticator app, or a recovery code, being replaced
+	CurrentCode string
+}
+
+// generateTOTPSecret returns a new random base32 encoded TOTP secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpCode computes the RFC 6238 one-time password for a secret and time step counter
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// verifyTOTP checks a code against the secret, allowing for clock skew of one time step
+//
+// The matching time step counter is returned so that a code cannot be used twice.
+// Codes for a counter at or before lastCounter are rejected.
+func verifyTOTP(secret, code string, lastCounter int64, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI used by authenticator apps to enroll a secret
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// generateRecoveryCodes returns a set of single-use recovery codes and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeByteCount)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode consumes a matching recovery code from the user, returning false if none matched
+func useRecoveryCode(user *User, code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// totpAttemptKey returns the counter key of the codes entered for a username
+//
+// The codes are counted apart from the password, whose counter a correct password resets, so that logging in with the
+// password again does not allow more guesses.
+func totpAttemptKey(username string) string {
+	return "totp:" + username
+}
+
+// attemptTOTP checks a TOTP or recovery code entered by the user, counting wrong codes with the failed login counters
+//
+// Codes are refused without being checked for a delay after each wrong code, returning totpDelayed and how long is
+// left, and for LOGIN_LOCKOUT_DURATION once TOTP_LOCKOUT_THRESHOLD wrong codes have been entered, returning
+// totpLockedOut. Accepted codes are consumed from the user, who must then be saved.
+func attemptTOTP(user *User, code string, now time.Time) (int, time.Duration, error) {
+	key := totpAttemptKey(user.Username)
+	if locked, err := totpLocked(key, now); err != nil || locked {
+		return totpLockedOut, 0, err
+	}
+	attemptKey := loginAttemptKey{key, totpLockoutThreshold}
+	wait, err := reserveLoginAttempt(attemptKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	if wait > 0 {
+		return totpDelayed, wait, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if counter, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPCounter, now); ok {
+		user.TOTPCounter = counter
+	} else if !useRecoveryCode(user, code) {
+		if err := failLoginAttempt(attemptKey); err != nil {
+			return 0, 0, err
+		}
+		if locked, err := totpLocked(key, now); err != nil || locked {
+			return totpLockedOut, 0, err
+		}
+		return totpRejected, 0, nil
+	}
+	return totpAccepted, 0, loginAttempts.Delete(key)
+}
+
+// totpLocked reports whether the codes of a username are locked out
+func totpLocked(key string, now time.Time) (bool, error) {
+	failures, err := loginAttempts.Get(key)
+	return failures.LockedUntil > now.UnixNano(), err
+}
+
+// getLoginTOTP returns the TOTP verification view on a GET request
+func getLoginTOTP(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if session.GetString("pendingUsername") == "" {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	ctx.View("totp.html")
+}
+
+// postLoginTOTP handles POST requests to the TOTP verification endpoint
+//
+// A valid TOTP or recovery code completes the login started by postLogin. After too many wrong codes the pending
+// login is abandoned, so that the user must enter their password again.
+func postLoginTOTP(ctx iris.Context) {
+	session := sess.Start(ctx)
+	username := session.GetString("pendingUsername")
+	if username == "" {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	form := TOTPForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user, err := users.Get(username)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	outcome, wait, err := attemptTOTP(user, form.Code, time.Now())
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	switch outcome {
+	case totpLockedOut:
+		session.Delete("pendingUsername")
+		ctx.StatusCode(iris.StatusTooManyRequests)
+		ctx.ViewData("Error", "Too many invalid codes. Please log in again later.")
+		getLogin(ctx)
+		return
+	case totpDelayed:
+		seconds := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(seconds))
+		ctx.StatusCode(iris.StatusTooManyRequests)
+		ctx.ViewData("Error", "Too many invalid codes. Please try again in "+strconv.Itoa(seconds)+" seconds.")
+		ctx.View("totp.html")
+		return
+	case totpRejected:
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "The code you entered is invalid.")
+		ctx.View("totp.html")
+		return
+	}
+
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	session.Set("secondFactorVerified", true)
+	completeLogin(ctx, user)
+}
+
+// getAccountTOTP returns the TOTP enrollment view on a GET request
+//
+// A new secret is generated and held in the session until the user confirms it with a valid code.
+func getAccountTOTP(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	session.Set("totpSecret", secret)
+
+	viewTOTPEnroll(ctx, user, secret)
+}
+
+// viewTOTPEnroll renders the enrollment view with a QR code for the secret, asking users who already use TOTP for
+// a code from their current authenticator app too
+func viewTOTPEnroll(ctx iris.Context, user *User, secret string) {
+	png, err := qrcode.Encode(totpURI(user.Username, secret), qrcode.Medium, 256)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Replacing", user.TOTPEnabled)
+	ctx.ViewData("Secret", secret)
+	ctx.ViewData("QRCode", template.URL("data:image/png;base64,"+base64.StdEncoding.EncodeToString(png)))
+	ctx.View("totp-enroll.html")
+}
+
+// postAccountTOTP handles POST requests to the TOTP enrollment endpoint
+//
+// On confirmation of the pending secret, TOTP is enabled for the user and recovery codes are issued. Users who
+// already use TOTP must also enter a code from their current authenticator app, or a recovery code, so that a session
+// left signed in cannot replace their second factor; wrong codes are counted as at login.
+func postAccountTOTP(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	secret := session.GetString("totpSecret")
+	if secret == "" {
+		ctx.Redirect("/account/totp", iris.StatusSeeOther)
+		return
+	}
+
+	form := TOTPForm{}
+	err := ctx.ReadForm(&form)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	now := time.Now()
+	counter, ok := verifyTOTP(secret, strings.TrimSpace(form.Code), 0, now)
+	if !ok {
+		ctx.StatusCode(iris.StatusUnauthorized)
+		ctx.ViewData("Error", "The code you entered is invalid.")
+		viewTOTPEnroll(ctx, user, secret)
+		return
+	}
+
+	if user.TOTPEnabled {
+		outcome, wait, err := attemptTOTP(user, form.CurrentCode, now)
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		switch outcome {
+		case totpLockedOut:
+			ctx.StatusCode(iris.StatusTooManyRequests)
+			ctx.ViewData("Error", "Too many invalid codes. Please try again later.")
+			viewTOTPEnroll(ctx, user, secret)
+			return
+		case totpDelayed:
+			seconds := int(math.Ceil(wait.Seconds()))
+			ctx.Header("Retry-After", strconv.Itoa(seconds))
+			ctx.StatusCode(iris.StatusTooManyRequests)
+			ctx.ViewData("Error", "Too many invalid codes. Please try again in "+strconv.Itoa(seconds)+" seconds.")
+			viewTOTPEnroll(ctx, user, secret)
+			return
+		case totpRejected:
+			ctx.StatusCode(iris.StatusUnauthorized)
+			ctx.ViewData("Error", "The code from your current authenticator app is invalid.")
+			viewTOTPEnroll(ctx, user, secret)
+			return
+		}
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPSecret = secret
+	user.TOTPCounter = counter
+	user.RecoveryCodes = hashes
+	if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	session.Delete("totpSecret")
+
+	// Recovery codes are only stored hashed so this is the one time they can be shown
+	ctx.ViewData("RecoveryCodes", codes)
+	ctx.View("totp-recovery.html")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAttemptTOTPLocksOut checks that wrong codes are delayed, that the username is locked out after
+// TOTP_LOCKOUT_THRESHOLD of them even for a correct code, and that a correct code resets the count
+func TestAttemptTOTPLocksOut(t *testing.T) {
+	defer func(store LoginAttemptStore, base time.Duration) {
+		loginAttempts, loginDelayBase = store, base
+	}(loginAttempts, loginDelayBase)
+	loginAttempts = newLoginAttemptStore(newMemoryStore())
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	valid, err := totpCode(secret, now.Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "alice", TOTPEnabled: true, TOTPSecret: secret}
+
+	loginDelayBase = time.Minute
+	if outcome, _, err := attemptTOTP(user, "not-a-code", now); err != nil || outcome != totpRejected {
+		t.Fatalf("wrong code: outcome %d, %v", outcome, err)
+	}
+	if outcome, wait, err := attemptTOTP(user, valid, now); err != nil || outcome != totpDelayed || wait <= 0 {
+		t.Fatalf("code straight after a wrong one: outcome %d, wait %v, %v", outcome, wait, err)
+	}
+
+	loginDelayBase = 0
+	if outcome, _, err := attemptTOTP(user, valid, now); err != nil || outcome != totpAccepted {
+		t.Fatalf("correct code: outcome %d, %v", outcome, err)
+	}
+	if failures, _ := loginAttempts.Get(totpAttemptKey("alice")); failures.Count != 0 {
+		t.Fatalf("%d wrong codes still counted after a correct code", failures.Count)
+	}
+
+	for i := 1; i < totpLockoutThreshold; i++ {
+		if outcome, _, err := attemptTOTP(user, "not-a-code", now); err != nil || outcome != totpRejected {
+			t.Fatalf("wrong code %d: outcome %d, %v", i, outcome, err)
+		}
+	}
+	if outcome, _, err := attemptTOTP(user, "not-a-code", now); err != nil || outcome != totpLockedOut {
+		t.Fatalf("wrong code %d: outcome %d, %v", totpLockoutThreshold, outcome, err)
+	}
+	user.TOTPCounter = 0
+	if outcome, _, err := attemptTOTP(user, valid, now); err != nil || outcome != totpLockedOut {
+		t.Fatalf("correct code after the lockout: outcome %d, %v", outcome, err)
+	}
+}
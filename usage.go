@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	usageLogURL   = os.Getenv("USAGE_LOG_URL")
+	usageLogToken = os.Getenv("USAGE_LOG_TOKEN")
+	// usageLimit is the number of recent API requests shown on the app detail page
+	usageLimit = envInt("USAGE_LIMIT", 20)
+)
+
+// usageSource provides the API activity shown on the app detail page, or nil if activity is not shown
+var usageSource = newUsageSource()
+
+// APIActivity is a request to an API made with a token issued for a user's grant
+type APIActivity struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	ClientIP string    `json:"client_ip,omitempty"`
+}
+
+// UsageSource looks up the API requests made with the tokens of a user's grant to a client
+type UsageSource interface {
+	// Recent returns at most limit of the most recent requests, newest first
+	Recent(ctx context.Context, authenticatedUserID, clientID string, limit int) ([]APIActivity, error)
+}
+
+// newUsageSource returns a source querying the log endpoint if USAGE_LOG_URL is configured, otherwise the activity
+// store if the HTTP Log receiver is enabled
+func newUsageSource() UsageSource {
+	if usageLogURL == "" {
+		if httpLogToken != "" {
+			return storeUsageSource{}
+		}
+		return nil
+	}
+	return httpUsageSource{
+		url:    usageLogURL,
+		token:  usageLogToken,
+		client: newExternalHTTPClient(5 * time.Second),
+	}
+}
+
+// httpUsageSource queries an endpoint in front of Kong's request logs
+//
+// The endpoint is sent GET requests with authenticated_userid, client_id and limit query parameters and responds
+// 200 OK with {"data": [{"time": "2006-01-02T15:04:05Z", "method": "GET", "path": "/...", "status": 200,
+// "client_ip": "..."}]}, newest first.
+type httpUsageSource struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// usageResponse is the log endpoint's response
+type usageResponse struct {
+	Data []APIActivity `json:"data"`
+}
+
+// Recent queries the log endpoint for the grant's requests
+func (s httpUsageSource) Recent(ctx context.Context, authenticatedUserID, clientID string, limit int) ([]APIActivity, error) {
+	query := url.Values{
+		"authenticated_userid": {authenticatedUserID},
+		"client_id":            {clientID},
+		"limit":                {strconv.Itoa(limit)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("usage log endpoint responded " + res.Status)
+	}
+
+	response := usageResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if len(response.Data) > limit {
+		response.Data = response.Data[:limit]
+	}
+	return response.Data, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+// What happens to the user's Kong tokens when their authenticated_userid changes
+const (
+	migrateTokensMove   = "move"
+	migrateTokensRevoke = "revoke"
+)
+
+// UserMigrationForm represents a change of a user's identity keys submitted by an administrator
+type UserMigrationForm struct {
+	Username               string
+	NewUsername            string
+	NewAuthenticatedUserID string
+	Issuer                 string
+	NewSubject             string
+	Tokens                 string
+	Reason                 string
+}
+
+// getAdminMigrateUser returns the user migration view on a GET request
+func getAdminMigrateUser(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	ctx.View("admin-migrate-user.html")
+}
+
+// postAdminMigrateUser changes a user's username, authenticated_userid or identity provider subject
+//
+// The user keeps their grants, second factors and other settings. Client registry owners, API activity and, unless
+// the administrator asks for them to be revoked, Kong's tokens are moved to the new keys, and the user's sessions
+// follow them to the new username. The old username stays reserved.
+func postAdminMigrateUser(ctx iris.Context) {
+	admin, err := currentAdmin(ctx)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	if admin == nil {
+		ctx.StatusCode(iris.StatusForbidden)
+		ctx.WriteString("You are not an administrator.")
+		return
+	}
+
+	form := UserMigrationForm{}
+	if err := ctx.ReadForm(&form); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+	form.Username = strings.TrimSpace(form.Username)
+	form.NewUsername = strings.TrimSpace(form.NewUsername)
+	form.NewAuthenticatedUserID = strings.TrimSpace(form.NewAuthenticatedUserID)
+	form.Issuer = strings.TrimSpace(form.Issuer)
+	form.NewSubject = strings.TrimSpace(form.NewSubject)
+	form.Reason = strings.TrimSpace(form.Reason)
+
+	fail := func(message string) {
+		ctx.StatusCode(iris.StatusBadRequest)
+		ctx.ViewData("Error", message)
+		ctx.View("admin-migrate-user.html")
+	}
+	if form.Reason == "" {
+		fail("Please give a reason, such as a support ticket number.")
+		return
+	}
+	if (form.Issuer == "") != (form.NewSubject == "") {
+		fail("Enter both the identity provider's issuer and the new subject, or neither.")
+		return
+	}
+	if form.Tokens != migrateTokensMove && form.Tokens != migrateTokensRevoke {
+		form.Tokens = migrateTokensMove
+	}
+
+	user, err := users.Get(form.Username)
+	if err == ErrUserNotFound {
+		fail("That user does not exist.")
+		return
+	}
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	oldUsername := user.Username
+	oldUserID := authenticatedUserID(user)
+	renamed := form.NewUsername != "" && form.NewUsername != oldUsername
+
+	// The authenticated_userid defaults to the username, so it is kept explicitly when only the username changes
+	if form.NewAuthenticatedUserID != "" {
+		user.AuthenticatedUserID = form.NewAuthenticatedUserID
+	} else if renamed && user.AuthenticatedUserID == "" {
+		user.AuthenticatedUserID = oldUserID
+	}
+	newUserID := authenticatedUserID(user)
+	if newUserID != oldUserID {
+		all, err := users.List()
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		for _, other := range all {
+			if other.Username != oldUsername && authenticatedUserID(other) == newUserID {
+				fail("Another user already has that authenticated_userid.")
+				return
+			}
+		}
+	}
+
+	if form.Issuer != "" {
+		linked := false
+		for i := range user.FederatedIdentities {
+			if user.FederatedIdentities[i].Issuer == form.Issuer {
+				user.FederatedIdentities[i].Subject = form.NewSubject
+				linked = true
+			}
+		}
+		if !linked {
+			user.FederatedIdentities = append(user.FederatedIdentities, FederatedIdentity{Issuer: form.Issuer, Subject: form.NewSubject})
+		}
+	}
+
+	if renamed {
+		user.Username = form.NewUsername
+		user.PreviousUsernames = append(user.PreviousUsernames, oldUsername)
+		if err := users.Create(user); err == ErrUserExists {
+			fail("A user with the new username already exists.")
+			return
+		} else if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		if err := users.Delete(oldUsername); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		if err := renameClientOwner(oldUsername, user.Username); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	} else if err := users.Save(user); err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	tokens := 0
+	if newUserID != oldUserID {
+		if err := activities.Rekey(oldUserID, newUserID); err != nil {
+			ctx.SetErr(err)
+			return
+		}
+		if form.Tokens == migrateTokensRevoke {
+			tokens, err = revokeKongTokens(kongContext(ctx), oldUserID)
+		} else {
+			tokens, err = rekeyKongTokens(kongContext(ctx), oldUserID, newUserID)
+		}
+		if err != nil {
+			ctx.SetErr(err)
+			return
+		}
+	}
+
+	audit(ctx, "user.migrated", map[string]string{
+		"subject":                  oldUsername,
+		"username":                 user.Username,
+		"authenticated_userid":     newUserID,
+		"old_authenticated_userid": oldUserID,
+		"issuer":                   form.Issuer,
+		"tokens":                   form.Tokens,
+		"token_count":              strconv.Itoa(tokens),
+		"reason":                   form.Reason,
+	})
+
+	ctx.ViewData("Notice", "The user "+oldUsername+" was migrated to "+user.Username+" with authenticated_userid "+newUserID+".")
+	ctx.View("admin-migrate-user.html")
+}
+
+// renameClientOwner replaces a username in the owners of every client in the registry
+func renameClientOwner(oldUsername, newUsername string) error {
+	all, err := clients.List()
+	if err != nil {
+		return err
+	}
+	for _, client := range all {
+		changed := false
+		for i, owner := range client.Owners {
+			if owner == oldUsername {
+				client.Owners[i] = newUsername
+				changed = true
+			}
+		}
+		if changed {
+			if err := clients.Save(client); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned by a UserStore when no user exists with the requested username
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidCredentials is returned when a username and password combination cannot be verified
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUserExists is returned by a UserStore when creating a user whose username is taken
+	ErrUserExists = errors.New("user already exists")
+)
+
+// users is the user store of the consent application, held in memory unless a USER_STORE_PATH is configured
+var users UserStore = &fileUserStore{users: map[string]User{}}
+
+// User represents a user account of the consent application
+type User struct {
+	Username      string   `json:"username"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Phone         string   `json:"phone,omitempty"`
+	PasswordHash  string   `json:"password_hash"`
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPCounter   int64    `json:"totp_counter,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	WebAuthnUserID      string               `json:"webauthn_user_id,omitempty"`
+	WebAuthnCredentials []WebAuthnCredential `json:"webauthn_credentials,omitempty"`
+
+	BadgeNumber string `json:"badge_number,omitempty"`
+	PINHash     string `json:"pin_hash,omitempty"`
+
+	// PasswordHistory holds the hashes of previous passwords, most recent first, when reuse is restricted
+	PasswordHistory []string `json:"password_history,omitempty"`
+	// PasswordChangedAt is when the password was last set, in Unix nanoseconds, for PASSWORD_MAX_AGE
+	PasswordChangedAt int64 `json:"password_changed_at,omitempty"`
+
+	// RememberTokens are the user's remember-me tokens, one for each browser they are kept signed in on
+	RememberTokens []RememberToken `json:"remember_tokens,omitempty"`
+
+	// Roles entitle the user to grant scopes restricted by SCOPE_ROLES
+	Roles []string `json:"roles,omitempty"`
+
+	// FederatedIdentities are the identity provider accounts the user logs in with
+	FederatedIdentities []FederatedIdentity `json:"federated_identities,omitempty"`
+
+	// Grants are the client applications the user has given consent to
+	Grants []Grant `json:"grants,omitempty"`
+
+	// AuthenticatedUserID is sent to Kong as the authenticated_userid of the user's tokens, the username if empty
+	AuthenticatedUserID string `json:"authenticated_userid,omitempty"`
+
+	// SessionsValidAfter invalidates sessions established before this time, in Unix nanoseconds
+	SessionsValidAfter int64 `json:"sessions_valid_after,omitempty"`
+
+	// Disabled users cannot log in, for example after being deprovisioned by an identity provider
+	Disabled bool `json:"disabled,omitempty"`
+
+	// ExternalID is the identifier of the user at the identity provider that provisions them over SCIM
+	ExternalID string `json:"external_id,omitempty"`
+
+	// PreviousUsernames are the usernames the user had before an administrator migrated them, most recent last
+	PreviousUsernames []string `json:"previous_usernames,omitempty"`
+
+	// Attributes are read from the HR system or directory configured for enrichment each time the user logs in
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Language is the user's preferred language for pages and emails, such as de-DE, overriding Accept-Language
+	Language string `json:"language,omitempty"`
+}
+
+// FederatedIdentity is an account of a user at an identity provider
+type FederatedIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+// UserStore persists the user accounts of the consent application
+type UserStore interface {
+	Get(username string) (*User, error)
+	List() ([]*User, error)
+	Create(user *User) error
+	Save(user *User) error
+	Delete(username string) error
+}
+
+// fileUserStore is a UserStore held in memory and optionally persisted to a JSON file
+type fileUserStore struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// openUserStore opens the user store at path, or an in-memory store if path is empty
+func openUserStore(path string) (UserStore, error) {
+	store := &fileUserStore{path: path, users: map[string]User{}}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, wrapError(ErrStore, "reading user store", err)
+	}
+
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, wrapError(ErrStore, "parsing user store", err)
+	}
+	for _, user := range users {
+		store.users[user.Username] = user
+	}
+
+	return store, nil
+}
+
+// Get returns a copy of the user with the given username
+func (s *fileUserStore) Get(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// List returns a copy of every user in the store
+func (s *fileUserStore) List() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		list = append(list, copyUser(user))
+	}
+	return list, nil
+}
+
+// copyUser returns a copy of user that shares no slices with the stored value
+func copyUser(user User) *User {
+	user.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	user.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	user.WebAuthnCredentials = append([]WebAuthnCredential(nil), user.WebAuthnCredentials...)
+	user.RememberTokens = append([]RememberToken(nil), user.RememberTokens...)
+	user.Roles = append([]string(nil), user.Roles...)
+	user.FederatedIdentities = append([]FederatedIdentity(nil), user.FederatedIdentities...)
+	user.Grants = append([]Grant(nil), user.Grants...)
+	user.PreviousUsernames = append([]string(nil), user.PreviousUsernames...)
+	if user.Attributes != nil {
+		attributes := make(map[string]string, len(user.Attributes))
+		for name, value := range user.Attributes {
+			attributes[name] = value
+		}
+		user.Attributes = attributes
+	}
+	return &user
+}
+
+// Create adds a new user and writes the store to disk, failing if the username is taken
+//
+// The previous usernames of migrated users stay taken, so that their sessions cannot be moved to another user.
+func (s *fileUserStore) Create(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.Username]; ok {
+		return ErrUserExists
+	}
+	for _, existing := range s.users {
+		if containsString(existing.PreviousUsernames, user.Username) {
+			return ErrUserExists
+		}
+	}
+	s.users[user.Username] = *user
+	return s.flush()
+}
+
+// Save creates or replaces a user and writes the store to disk
+func (s *fileUserStore) Save(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[user.Username] = *user
+	return s.flush()
+}
+
+// Delete removes a user and writes the store to disk
+func (s *fileUserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, username)
+	return s.flush()
+}
+
+// Compact rewrites the store's file from the users held in memory
+func (s *fileUserStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+// flush writes all users to the store's file; the caller must hold the write lock
+func (s *fileUserStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return wrapError(ErrStore, "encoding user store", err)
+	}
+
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		return wrapError(ErrStore, "writing user store", err)
+	}
+	return nil
+}
+
+// authenticate verifies a username and password against the user store
+//
+// Without a USER_STORE_PATH the application runs as a demo and unknown users are created on their first login.
+func authenticate(credentials Credentials) (*User, error) {
+	user, err := users.Get(credentials.Username)
+	if err == ErrUserNotFound && userStorePath == "" && credentials.Username != "" {
+		hash, hashErr := hashPassword(credentials.Password)
+		if hashErr != nil {
+			return nil, hashErr
+		}
+		user = &User{Username: credentials.Username, PasswordHash: hash, PasswordChangedAt: time.Now().UnixNano()}
+		return user, users.Save(user)
+	}
+	if err == ErrUserNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, rehash := checkPassword(user.PasswordHash, credentials.Password)
+	if !ok || user.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Legacy hashes, and hashes created with another algorithm or cost, are replaced with one created with the
+	// configured algorithm now the password is known
+	if rehash {
+		hash, err := hashPassword(credentials.Password)
+		if err != nil {
+			return nil, err
+		}
+		countPasswordRehash(user.PasswordHash)
+		user.PasswordHash = hash
+	}
+	// Passwords set before their age was tracked start ageing from the next login, rather than expiring at once
+	if rehash || user.PasswordChangedAt == 0 {
+		if user.PasswordChangedAt == 0 {
+			user.PasswordChangedAt = time.Now().UnixNano()
+		}
+		if err := users.Save(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// findUserByPreviousUsername returns the user who was migrated from username
+func findUserByPreviousUsername(username string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		if containsString(user.PreviousUsernames, username) {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// findUserByEmail returns the user with the given email address
+func findUserByEmail(email string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		if user.Email != "" && strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// findUserByAuthenticatedUserID returns the user Kong's tokens identify by the given authenticated_userid
+func findUserByAuthenticatedUserID(id string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		if authenticatedUserID(user) == id {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// findUserByFederatedIdentity returns the user who logs in with the given identity provider account
+func findUserByFederatedIdentity(identity FederatedIdentity) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		for _, linked := range user.FederatedIdentities {
+			if linked == identity {
+				return user, nil
+			}
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// authenticatedUserID returns the ID Kong identifies the user's tokens by
+func authenticatedUserID(user *User) string {
+	if user.AuthenticatedUserID != "" {
+		return user.AuthenticatedUserID
+	}
+	return user.Username
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// vaultAddr is the address of the HashiCorp Vault server that verifies passwords, if set
+	vaultAddr = strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	// vaultAuthMount is the path the userpass or LDAP auth method is mounted at
+	vaultAuthMount = strings.Trim(envOrDefault("VAULT_AUTH_MOUNT", "userpass"), "/")
+	// vaultNamespace is the Vault Enterprise namespace of the auth method
+	vaultNamespace = os.Getenv("VAULT_NAMESPACE")
+	// vaultPolicyRoles copies the Vault policies of the user's token, other than "default", to their roles
+	vaultPolicyRoles = envBool("VAULT_POLICY_ROLES", false)
+	// vaultTimeout is how long Vault has to respond to each request
+	vaultTimeout = envDuration("VAULT_TIMEOUT", 5*time.Second)
+	// vaultCACert is a PEM file of the certificate authorities trusted to issue Vault's certificate, instead of the
+	// system's
+	vaultCACert = os.Getenv("VAULT_CACERT")
+
+	// vaultClient sends logins and token revocations to Vault, verifying its certificate
+	vaultClient = newExternalHTTPClient(vaultTimeout)
+)
+
+// vaultPasswordAuthenticator verifies usernames and passwords with Vault's userpass or LDAP auth method
+//
+// A successful login issues a Vault token, which the authenticator revokes straight away as it has no use for it.
+// Users are added to the user store on their first login without a password hash.
+type vaultPasswordAuthenticator struct {
+	addr   string
+	mount  string
+	client *http.Client
+}
+
+// vaultLoginResponse is a partial representation of Vault's response to a login
+type vaultLoginResponse struct {
+	Auth struct {
+		ClientToken string            `json:"client_token"`
+		Policies    []string          `json:"policies"`
+		Metadata    map[string]string `json:"metadata"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// Authenticate logs in to the auth method with the credentials and returns the user they belong to
+func (a vaultPasswordAuthenticator) Authenticate(credentials Credentials, clientIP string) (*User, error) {
+	if credentials.Username == "" || credentials.Password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	payload, err := json.Marshal(map[string]string{"password": credentials.Password})
+	if err != nil {
+		return nil, err
+	}
+	loginURL := a.addr + "/v1/auth/" + a.mount + "/login/" + url.PathEscape(credentials.Username)
+	req, err := http.NewRequest(http.MethodPost, loginURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response := vaultLoginResponse{}
+	res, err := a.do(req, &response)
+	if err != nil {
+		return nil, err
+	}
+	// Vault refuses wrong usernames and passwords with 400 Bad Request
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, errors.New("vault responded " + res.Status + ": " + strings.Join(response.Errors, "; "))
+	}
+	if response.Auth.ClientToken == "" {
+		return nil, errors.New("vault login returned no token")
+	}
+	a.revoke(response.Auth.ClientToken)
+
+	// The userpass and LDAP methods return the canonical username, which may differ in case
+	username := response.Auth.Metadata["username"]
+	if username == "" {
+		username = credentials.Username
+	}
+	attributes := UserAttributes{}
+	if vaultPolicyRoles {
+		attributes.Roles = []string{}
+		for _, policy := range response.Auth.Policies {
+			if policy != "default" {
+				attributes.Roles = append(attributes.Roles, policy)
+			}
+		}
+	}
+	return syncExternalUser(username, attributes)
+}
+
+// revoke revokes the token issued for a login
+func (a vaultPasswordAuthenticator) revoke(token string) {
+	req, err := http.NewRequest(http.MethodPost, a.addr+"/v1/auth/token/revoke-self", nil)
+	if err != nil {
+		log.Printf("vault: revoking login token: %v", err)
+		return
+	}
+	req.Header.Set("X-Vault-Token", token)
+	res, err := a.do(req, nil)
+	if err != nil {
+		log.Printf("vault: revoking login token: %v", err)
+		return
+	}
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		log.Printf("vault: revoking login token: vault responded %s", res.Status)
+	}
+}
+
+// do sends a request to Vault and decodes its JSON response into v, if it is not nil
+func (a vaultPasswordAuthenticator) do(req *http.Request, v interface{}) (*http.Response, error) {
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if vaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", vaultNamespace)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if v != nil && res.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil && res.StatusCode == http.StatusOK {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/kataras/iris/v12"
+)
+
+// version is the application's version, set when building with -ldflags "-X main.version=..."
+var version = "dev"
+
+// The cryptographic modules the application can be built with
+const (
+	cryptoModuleStandard = "go"
+	cryptoModuleBoring   = "boringcrypto"
+)
+
+// VersionInfo describes the build of the running application
+type VersionInfo struct {
+	Version      string `json:"version"`
+	GoVersion    string `json:"go_version"`
+	Platform     string `json:"platform"`
+	CryptoModule string `json:"crypto_module"`
+	FIPS         bool   `json:"fips"`
+}
+
+// getVersion returns the version, platform and cryptographic module of the running application
+//
+// fips is only true when a FIPS build is running on the BoringCrypto module, so that deployments can verify it.
+func getVersion(ctx iris.Context) {
+	module := cryptoModule()
+	ctx.JSON(VersionInfo{
+		Version:      version,
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		CryptoModule: module,
+		FIPS:         fipsMode && module == cryptoModuleBoring,
+	})
+}
+
+// checkFIPSMode returns an error if a FIPS build is not running on the BoringCrypto module, or is configured to
+// create password hashes with an algorithm that is not approved
+func checkFIPSMode() error {
+	if !fipsMode {
+		return nil
+	}
+	if cryptoModule() != cryptoModuleBoring {
+		return errors.New("built with the fips tag but the BoringCrypto module is not enabled: build with GOEXPERIMENT=boringcrypto")
+	}
+	if passwordHashAlgorithm != passwordHashPBKDF2 {
+		return fmt.Errorf("PASSWORD_HASH must be %s in a FIPS build", passwordHashPBKDF2)
+	}
+	return nil
+}
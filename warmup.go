@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	cacheWarmup          = envBool("CACHE_WARMUP", false)
+	cacheWarmupClientIDs = envList("CACHE_WARMUP_CLIENT_IDS")
+)
+
+// warmCaches pre-fetches client metadata and the scope catalog from Kong so that the first
+// requests after a deploy do not pay for cold-cache Admin API calls
+//
+// The demo client and any clients listed in CACHE_WARMUP_CLIENT_IDS are fetched concurrently.
+// Failures are logged and do not prevent startup; the caches fill on demand instead.
+func warmCaches() {
+	start := time.Now()
+
+	clientIDs := cacheWarmupClientIDs
+	if demoClientID != "" {
+		clientIDs = append([]string{demoClientID}, clientIDs...)
+	}
+
+	var wg sync.WaitGroup
+	for _, clientID := range clientIDs {
+		wg.Add(1)
+		go func(clientID string) {
+			defer wg.Done()
+			if _, err := getApplicationName(backgroundKongContext("warmup"), clientID); err != nil {
+				log.Printf("cache warm-up failed for client %s: %v", clientID, err)
+				notify(eventJobFailed, "Cache warm-up failed", map[string]string{"job": "warmup", "client_id": clientID, "error": err.Error()})
+			}
+		}(clientID)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := getScopeCatalog(backgroundKongContext("warmup")); err != nil {
+			log.Printf("cache warm-up failed for scope catalog: %v", err)
+			notify(eventJobFailed, "Cache warm-up failed", map[string]string{"job": "warmup", "error": err.Error()})
+		}
+	}()
+
+	wg.Wait()
+	log.Printf("cache warm-up of %d clients and the scope catalog took %s", len(clientIDs), time.Since(start))
+}
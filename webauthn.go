@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	webAuthnRPID   = envOrDefault("WEBAUTHN_RP_ID", "localhost")
+	webAuthnOrigin = envOrDefault("WEBAUTHN_ORIGIN", publicURL)
+)
+
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authDataFlagUserPresent  = 0x01
+	authDataFlagUserVerified = 0x04
+	authDataFlagAttested     = 0x40
+)
+
+var (
+	errWebAuthnChallenge  = errors.New("webauthn: challenge does not match")
+	errWebAuthnOrigin     = errors.New("webauthn: origin does not match")
+	errWebAuthnType       = errors.New("webauthn: unexpected client data type")
+	errWebAuthnRPID       = errors.New("webauthn: relying party ID does not match")
+	errWebAuthnPresence   = errors.New("webauthn: user presence was not confirmed")
+	errWebAuthnVerified   = errors.New("webauthn: user verification was not performed")
+	errWebAuthnAuthData   = errors.New("webauthn: malformed authenticator data")
+	errWebAuthnKey        = errors.New("webauthn: unsupported credential public key")
+	errWebAuthnSignature  = errors.New("webauthn: invalid signature")
+	errWebAuthnSignCount  = errors.New("webauthn: signature counter did not increase, the authenticator may be cloned")
+	errWebAuthnCredential = errors.New("webauthn: unknown credential")
+)
+
+var webAuthnEncoding = base64.RawURLEncoding
+
+// WebAuthnCredential is a public key credential registered by a user
+type WebAuthnCredential struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	SignCount uint32 `json:"sign_count"`
+}
+
+// webAuthnResponse is a PublicKeyCredential serialized by the browser, with binary fields base64url encoded
+type webAuthnResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+// webAuthnClientData is the subset of the CollectedClientData dictionary verified by the relying party
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// webAuthnAuthData is parsed authenticator data
+type webAuthnAuthData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// newWebAuthnChallenge returns a random challenge, base64url encoded
+func newWebAuthnChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	return webAuthnEncoding.EncodeToString(challenge), nil
+}
+
+// verifyClientData checks the client data against the expected ceremony type and challenge
+func verifyClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	clientData := webAuthnClientData{}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return err
+	}
+	if clientData.Type != ceremony {
+		return errWebAuthnType
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(challenge)) != 1 {
+		return errWebAuthnChallenge
+	}
+	if clientData.Origin != webAuthnOrigin {
+		return errWebAuthnOrigin
+	}
+	return nil
+}
+
+// parseAuthData parses authenticator data, including the attested credential data if present
+func parseAuthData(data []byte) (webAuthnAuthData, error) {
+	authData := webAuthnAuthData{}
+	if len(data) < 37 {
+		return authData, errWebAuthnAuthData
+	}
+
+	authData.RPIDHash = data[:32]
+	authData.Flags = data[32]
+	authData.SignCount = binary.BigEndian.Uint32(data[33:37])
+
+	if authData.Flags&authDataFlagAttested == 0 {
+		return authData, nil
+	}
+
+	// Attested credential data: AAGUID (16), credential ID length (2), credential ID, COSE public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authData, errWebAuthnAuthData
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return authData, errWebAuthnAuthData
+	}
+	authData.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, keyLen, err := decodeCBOR(rest)
+	if err != nil {
+		return authData, err
+	}
+	authData.PublicKey = rest[:keyLen]
+
+	return authData, nil
+}
+
+// verifyAuthData checks the relying party ID hash and the user presence and verification flags
+func verifyAuthData(authData webAuthnAuthData, requireVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(webAuthnRPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errWebAuthnRPID
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 {
+		return errWebAuthnPresence
+	}
+	if requireVerification && authData.Flags&authDataFlagUserVerified == 0 {
+		return errWebAuthnVerified
+	}
+	return nil
+}
+
+// parseCOSEKey converts a COSE encoded ES256 or RS256 public key into a crypto.PublicKey
+func parseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errWebAuthnKey
+	}
+
+	switch key[int64(3)] {
+	case int64(coseAlgES256):
+		x, xOK := key[int64(-2)].([]byte)
+		y, yOK := key[int64(-3)].([]byte)
+		if key[int64(1)] != int64(2) || key[int64(-1)] != int64(1) || !xOK || !yOK {
+			return nil, errWebAuthnKey
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errWebAuthnKey
+		}
+		return pub, nil
+	case int64(coseAlgRS256):
+		n, nOK := key[int64(-1)].([]byte)
+		e, eOK := key[int64(-2)].([]byte)
+		if key[int64(1)] != int64(3) || !nOK || !eOK || len(e) > 4 {
+			return nil, errWebAuthnKey
+		}
+		// Exponents below 3 make signatures trivial to forge
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.E < 3 {
+			return nil, errWebAuthnKey
+		}
+		return pub, nil
+	}
+
+	return nil, errWebAuthnKey
+}
+
+// verifyWebAuthnSignature verifies an assertion signature over the authenticator data and client data hash
+func verifyWebAuthnSignature(publicKey []byte, authData, clientDataJSON, signature []byte) error {
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+	return errWebAuthnSignature
+}
+
+// verifyRegistration verifies a registration response and returns the new credential
+func verifyRegistration(response webAuthnResponse, challenge string) (WebAuthnCredential, error) {
+	clientDataJSON, err := webAuthnEncoding.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if err := verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	attestationObject, err := webAuthnEncoding.DecodeString(response.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return WebAuthnCredential{}, errWebAuthnAuthData
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return WebAuthnCredential{}, errWebAuthnAuthData
+	}
+
+	// Attestation statements are not verified; the consent application accepts any authenticator
+	authData, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if err := verifyAuthData(authData, false); err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.CredentialID == nil {
+		return WebAuthnCredential{}, errWebAuthnAuthData
+	}
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return WebAuthnCredential{
+		ID:        webAuthnEncoding.EncodeToString(authData.CredentialID),
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+	}, nil
+}
+
+// verifyAssertion verifies an assertion response against the user's registered credential
+//
+// On success the credential's signature counter is updated on the user.
+func verifyAssertion(response webAuthnResponse, challenge string, user *User, requireVerification bool) error {
+	var credential *WebAuthnCredential
+	for i := range user.WebAuthnCredentials {
+		if user.WebAuthnCredentials[i].ID == response.ID {
+			credential = &user.WebAuthnCredentials[i]
+		}
+	}
+	if credential == nil {
+		return errWebAuthnCredential
+	}
+
+	clientDataJSON, err := webAuthnEncoding.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return err
+	}
+	if err := verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return err
+	}
+
+	rawAuthData, err := webAuthnEncoding.DecodeString(response.Response.AuthenticatorData)
+	if err != nil {
+		return err
+	}
+	authData, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return err
+	}
+	if err := verifyAuthData(authData, requireVerification); err != nil {
+		return err
+	}
+
+	signature, err := webAuthnEncoding.DecodeString(response.Response.Signature)
+	if err != nil {
+		return err
+	}
+	if err := verifyWebAuthnSignature(credential.PublicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		return err
+	}
+
+	// Authenticators that do not implement a counter always report zero
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return errWebAuthnSignCount
+	}
+	credential.SignCount = authData.SignCount
+
+	return nil
+}
+
+// findUserByCredential returns the user that registered the credential with the given ID
+func findUserByCredential(credentialID string) (*User, error) {
+	all, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range all {
+		for _, credential := range user.WebAuthnCredentials {
+			if credential.ID == credentialID {
+				return user, nil
+			}
+		}
+	}
+	return nil, errWebAuthnCredential
+}
+
+// webAuthnError responds to a WebAuthn ceremony request with problem details
+//
+// Internal errors are logged and their details are only included in debug mode.
+func webAuthnError(ctx iris.Context, statusCode int, err error) {
+	if statusCode != iris.StatusInternalServerError {
+		viewProblem(ctx, statusCode, statusProblemType(statusCode), err.Error())
+		return
+	}
+
+	statusCode, _, problemType := errorResponse(err)
+	log.Printf("%s %s [%s]: %v", ctx.Method(), ctx.Path(), requestID(ctx), err)
+	detail := ""
+	if debug {
+		detail = err.Error()
+	}
+	viewProblem(ctx, statusCode, problemType, detail)
+}
+
+// getAccountWebAuthn returns the security key management view on a GET request
+func getAccountWebAuthn(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("Credentials", user.WebAuthnCredentials)
+	ctx.View("webauthn-register.html")
+}
+
+// postWebAuthnRegisterBegin returns the credential creation options for registering a new credential
+func postWebAuthnRegisterBegin(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		webAuthnError(ctx, iris.StatusUnauthorized, errors.New("not logged in"))
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		webAuthnError(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+
+	// The user handle is random so that it does not reveal the username to the authenticator
+	if user.WebAuthnUserID == "" {
+		if user.WebAuthnUserID, err = newWebAuthnChallenge(); err != nil {
+			webAuthnError(ctx, iris.StatusInternalServerError, err)
+			return
+		}
+		if err := users.Save(user); err != nil {
+			webAuthnError(ctx, iris.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		webAuthnError(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+	session.Set("webauthnChallenge", challenge)
+
+	exclude := []iris.Map{}
+	for _, credential := range user.WebAuthnCredentials {
+		exclude = append(exclude, iris.Map{"type": "public-key", "id": credential.ID})
+	}
+
+	ctx.JSON(iris.Map{
+		"challenge": challenge,
+		"rp":        iris.Map{"id": webAuthnRPID, "name": totpIssuer},
+		"user":      iris.Map{"id": user.WebAuthnUserID, "name": user.Username, "displayName": user.Username},
+		"pubKeyCredParams": []iris.Map{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"excludeCredentials": exclude,
+		"authenticatorSelection": iris.Map{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+	})
+}
+
+// postWebAuthnRegisterFinish verifies a registration response and stores the new credential on the user
+func postWebAuthnRegisterFinish(ctx iris.Context) {
+	session := sess.Start(ctx)
+	if auth, _ := session.GetBoolean("authenticated"); !auth {
+		webAuthnError(ctx, iris.StatusUnauthorized, errors.New("not logged in"))
+		return
+	}
+
+	challenge := session.GetString("webauthnChallenge")
+	session.Delete("webauthnChallenge")
+
+	response := webAuthnResponse{}
+	if err := ctx.ReadJSON(&response); err != nil {
+		webAuthnError(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	credential, err := verifyRegistration(response, challenge)
+	if err != nil {
+		webAuthnError(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := findUserByCredential(credential.ID); err == nil {
+		webAuthnError(ctx, iris.StatusConflict, errors.New("webauthn: credential is already registered"))
+		return
+	}
+
+	user, err := users.Get(session.GetString("username"))
+	if err != nil {
+		webAuthnError(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+	user.WebAuthnCredentials = append(user.WebAuthnCredentials, credential)
+	if err := users.Save(user); err != nil {
+		webAuthnError(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.JSON(iris.Map{"redirect": "/account/webauthn"})
+}
+
+// getLoginWebAuthn returns the security key verification view when WebAuthn is used as a second factor
+func getLoginWebAuthn(ctx iris.Context) {
+	session := sess.Start(ctx)
+	username := session.GetString("pendingUsername")
+	if username == "" {
+		ctx.Redirect("/login", iris.StatusTemporaryRedirect)
+		return
+	}
+
+	user, err := users.Get(username)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	ctx.ViewData("TOTPEnabled", user.TOTPEnabled)
+	ctx.View("webauthn-login.html")
+}
+
+// postWebAuthnLoginBegin returns the credential request options for an assertion
+//
+// After password verification only the pending user's credentials are allowed. Otherwise the
+// request is for a passwordless login with a discoverable credential, such as a passkey.
+func postWebAuthnLoginBegin(ctx iris.Context) {
+	session := sess.Start(ctx)
+
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		webAuthnError(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+	session.Set("webauthnChallenge", challenge)
+
+	allow := []iris.Map{}
+	if username := session.GetString("pendingUsername"); username != "" {
+		user, err := users.Get(username)
+		if err != nil {
+			webAuthnError(ctx, iris.StatusInternalServerError, err)
+			return
+		}
+		for _, credential := range user.WebAuthnCredentials {
+			allow = append(allow, iris.Map{"type": "public-key", "id": credential.ID})
+		}
+	}
+
+	ctx.JSON(iris.Map{
+		"challenge":        challenge,
+		"rpId":             webAuthnRPID,
+		"allowCredentials": allow,
+		"userVerification": "preferred",
+	})
+}
+
+// postWebAuthnLoginFinish verifies an assertion and sends the browser on to complete the login
+//
+// The login is completed by getWebAuthnLoginComplete, which the browser navigates to, so that it goes through
+// completeLogin like every other login and its pages can be shown.
+func postWebAuthnLoginFinish(ctx iris.Context) {
+	session := sess.Start(ctx)
+	challenge := session.GetString("webauthnChallenge")
+	session.Delete("webauthnChallenge")
+
+	response := webAuthnResponse{}
+	if err := ctx.ReadJSON(&response); err != nil {
+		webAuthnError(ctx, iris.StatusBadRequest, err)
+		return
+	}
+
+	user, err := findUserByCredential(response.ID)
+	if err != nil {
+		webAuthnError(ctx, iris.StatusUnauthorized, err)
+		return
+	}
+
+	// As a second factor the credential must belong to the user who entered their password.
+	// A passwordless login replaces both factors so user verification is required.
+	pending := session.GetString("pendingUsername")
+	if pending != "" && pending != user.Username {
+		webAuthnError(ctx, iris.StatusUnauthorized, errWebAuthnCredential)
+		return
+	}
+
+	if err := verifyAssertion(response, challenge, user, pending == ""); err != nil {
+		webAuthnError(ctx, iris.StatusUnauthorized, err)
+		return
+	}
+	if err := users.Save(user); err != nil {
+		webAuthnError(ctx, iris.StatusInternalServerError, err)
+		return
+	}
+
+	// A security key counts as a second factor for step-up scopes, with or without a password
+	session.Set("secondFactorVerified", true)
+	session.Set("webauthnVerifiedUsername", user.Username)
+	ctx.JSON(iris.Map{"redirect": "/login/webauthn/complete"})
+}
+
+// getWebAuthnLoginComplete completes a login verified by postWebAuthnLoginFinish
+func getWebAuthnLoginComplete(ctx iris.Context) {
+	session := sess.Start(ctx)
+	username := session.GetString("webauthnVerifiedUsername")
+	session.Delete("webauthnVerifiedUsername")
+	if username == "" {
+		ctx.Redirect("/login", iris.StatusSeeOther)
+		return
+	}
+
+	user, err := users.Get(username)
+	if err != nil {
+		ctx.SetErr(err)
+		return
+	}
+
+	completeLogin(ctx, user)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// coseES256Key encodes an ECDSA P-256 public key as a COSE key
+func coseES256Key(key *ecdsa.PublicKey) []byte {
+	encoded := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	encoded = append(encoded, paddedBytes(key.X, 32)...)
+	encoded = append(encoded, 0x22, 0x58, 0x20)
+	return append(encoded, paddedBytes(key.Y, 32)...)
+}
+
+// coseRS256Key encodes an RSA public key with a 2048 bit modulus and the given exponent bytes as a COSE key
+func coseRS256Key(modulus, exponent []byte) []byte {
+	encoded := []byte{0xa4, 0x01, 0x03, 0x03, 0x39, 0x01, 0x00, 0x20, 0x59, 0x01, 0x00}
+	encoded = append(encoded, modulus...)
+	encoded = append(encoded, 0x21, 0x40|byte(len(exponent)))
+	return append(encoded, exponent...)
+}
+
+// webAuthnAssertion describes the assertion an authenticator signs in a test
+type webAuthnAssertion struct {
+	rpID      string
+	origin    string
+	flags     byte
+	signCount uint32
+}
+
+// signAssertion returns an assertion response for the credential, signed with key
+func signAssertion(t *testing.T, key *ecdsa.PrivateKey, credentialID, challenge string, a webAuthnAssertion) webAuthnResponse {
+	clientDataJSON, err := json.Marshal(webAuthnClientData{Type: "webauthn.get", Challenge: challenge, Origin: a.origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	authData := append(rpIDHash[:], a.flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], a.signCount)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := webAuthnResponse{ID: credentialID, Type: "public-key"}
+	response.Response.ClientDataJSON = webAuthnEncoding.EncodeToString(clientDataJSON)
+	response.Response.AuthenticatorData = webAuthnEncoding.EncodeToString(authData)
+	response.Response.Signature = webAuthnEncoding.EncodeToString(signature)
+	return response
+}
+
+// TestVerifyAssertionRefusals checks that assertions are refused for another origin or relying party, without user
+// presence, or with a signature counter that did not increase
+func TestVerifyAssertionRefusals(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := webAuthnAssertion{rpID: webAuthnRPID, origin: webAuthnOrigin, flags: authDataFlagUserPresent, signCount: 6}
+
+	tests := []struct {
+		name      string
+		assertion func(a webAuthnAssertion) webAuthnAssertion
+		err       error
+	}{
+		{"another origin", func(a webAuthnAssertion) webAuthnAssertion { a.origin = "https://evil.example.com"; return a }, errWebAuthnOrigin},
+		{"another relying party", func(a webAuthnAssertion) webAuthnAssertion { a.rpID = "evil.example.com"; return a }, errWebAuthnRPID},
+		{"no user presence", func(a webAuthnAssertion) webAuthnAssertion { a.flags = authDataFlagUserVerified; return a }, errWebAuthnPresence},
+		{"same sign count", func(a webAuthnAssertion) webAuthnAssertion { a.signCount = 5; return a }, errWebAuthnSignCount},
+		{"lower sign count", func(a webAuthnAssertion) webAuthnAssertion { a.signCount = 4; return a }, errWebAuthnSignCount},
+		{"counter reset", func(a webAuthnAssertion) webAuthnAssertion { a.signCount = 0; return a }, errWebAuthnSignCount},
+	}
+	for _, test := range tests {
+		user := &User{WebAuthnCredentials: []WebAuthnCredential{{ID: "credential-id", PublicKey: coseES256Key(&key.PublicKey), SignCount: 5}}}
+		response := signAssertion(t, key, "credential-id", challenge, test.assertion(valid))
+		if err := verifyAssertion(response, challenge, user, false); !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, expected %v", test.name, err, test.err)
+		}
+		if user.WebAuthnCredentials[0].SignCount != 5 {
+			t.Errorf("%s: sign count updated to %d", test.name, user.WebAuthnCredentials[0].SignCount)
+		}
+	}
+
+	user := &User{WebAuthnCredentials: []WebAuthnCredential{{ID: "credential-id", PublicKey: coseES256Key(&key.PublicKey), SignCount: 5}}}
+	if err := verifyAssertion(signAssertion(t, key, "credential-id", challenge, valid), challenge, user, false); err != nil {
+		t.Fatalf("valid assertion refused: %v", err)
+	}
+	if user.WebAuthnCredentials[0].SignCount != 6 {
+		t.Fatalf("sign count updated to %d, expected 6", user.WebAuthnCredentials[0].SignCount)
+	}
+}
+
+// TestParseCOSEKeyRSAExponent checks that RSA keys with exponents below 3 are refused
+func TestParseCOSEKeyRSAExponent(t *testing.T) {
+	modulus := make([]byte, 256)
+	if _, err := rand.Read(modulus); err != nil {
+		t.Fatal(err)
+	}
+	modulus[0] |= 0x80
+
+	for _, exponent := range [][]byte{{}, {0}, {1}, {2}, {0, 0, 0, 2}} {
+		if _, err := parseCOSEKey(coseRS256Key(modulus, exponent)); !errors.Is(err, errWebAuthnKey) {
+			t.Errorf("exponent %x: %v", exponent, err)
+		}
+	}
+	for _, exponent := range [][]byte{{3}, {1, 0, 1}} {
+		if _, err := parseCOSEKey(coseRS256Key(modulus, exponent)); err != nil {
+			t.Errorf("exponent %x refused: %v", exponent, err)
+		}
+	}
+}
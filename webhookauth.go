@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	authWebhookURL     = os.Getenv("AUTH_WEBHOOK_URL")
+	authWebhookToken   = os.Getenv("AUTH_WEBHOOK_TOKEN")
+	authWebhookTimeout = envDuration("AUTH_WEBHOOK_TIMEOUT", 5*time.Second)
+)
+
+// passwordAuthenticator verifies usernames and passwords, against the user store unless AUTH_WEBHOOK_URL,
+// VAULT_ADDR or KONG_BASIC_AUTH is set
+var passwordAuthenticator = newPasswordAuthenticator()
+
+// PasswordAuthenticator verifies a username and password and returns the user they belong to
+//
+// Implementations return ErrInvalidCredentials when the username and password do not match.
+type PasswordAuthenticator interface {
+	Authenticate(credentials Credentials, clientIP string) (*User, error)
+}
+
+// newPasswordAuthenticator returns a webhook authenticator if AUTH_WEBHOOK_URL is configured, a Vault
+// authenticator if VAULT_ADDR is, one backed by Kong's basic-auth credentials if KONG_BASIC_AUTH is set, otherwise
+// one backed by the user store
+func newPasswordAuthenticator() PasswordAuthenticator {
+	switch {
+	case authWebhookURL != "":
+		return webhookPasswordAuthenticator{
+			url:    authWebhookURL,
+			token:  authWebhookToken,
+			client: newExternalHTTPClient(authWebhookTimeout),
+		}
+	case vaultAddr != "":
+		return vaultPasswordAuthenticator{
+			addr:   vaultAddr,
+			mount:  vaultAuthMount,
+			client: vaultClient,
+		}
+	case kongBasicAuth:
+		return kongBasicAuthenticator{}
+	default:
+		return storePasswordAuthenticator{}
+	}
+}
+
+// checkAuthWebhookURL returns an error if the authentication webhook or Vault would be sent passwords in the clear
+//
+// Plain HTTP is only allowed to a loopback address, such as a sidecar on the same host.
+func checkAuthWebhookURL() error {
+	for name, value := range map[string]string{"AUTH_WEBHOOK_URL": authWebhookURL, "VAULT_ADDR": vaultAddr} {
+		if value == "" {
+			continue
+		}
+		uri, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		if uri.Scheme != "https" && !isLoopbackRedirect(uri) {
+			return errors.New(name + " must use https")
+		}
+	}
+	return nil
+}
+
+// checkPasswordAuthenticator returns an error if more than one external password authenticator is configured, or
+// KONG_BASIC_AUTH_USERID is not a consumer attribute
+func checkPasswordAuthenticator() error {
+	configured := 0
+	for _, set := range []bool{authWebhookURL != "", vaultAddr != "", kongBasicAuth} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return errors.New("only one of AUTH_WEBHOOK_URL, VAULT_ADDR and KONG_BASIC_AUTH can be set")
+	}
+	switch kongBasicAuthUserID {
+	case "consumer_id", "custom_id", "username":
+		return nil
+	}
+	return errors.New("KONG_BASIC_AUTH_USERID must be consumer_id, custom_id or username")
+}
+
+// storePasswordAuthenticator verifies passwords against the hashes in the user store
+type storePasswordAuthenticator struct{}
+
+// Authenticate verifies the credentials with authenticate
+func (storePasswordAuthenticator) Authenticate(credentials Credentials, clientIP string) (*User, error) {
+	return authenticate(credentials)
+}
+
+// webhookPasswordAuthenticator verifies usernames and passwords with an existing authentication service
+//
+// The service is sent {"username": "...", "password": "...", "client_ip": "..."} and responds 200 OK with
+// {"allow": true, "username": "...", "email": "...", "email_verified": true, "phone": "...", "roles": [...]}
+// to accept the login, or with {"allow": false}, 401 Unauthorized or 403 Forbidden to refuse it. The username and
+// attributes are optional; when present they are copied to the user, who is added to the user store on their
+// first login.
+type webhookPasswordAuthenticator struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// webhookAuthResponse is the authentication service's decision and the user's attributes
+type webhookAuthResponse struct {
+	Allow    bool   `json:"allow"`
+	Username string `json:"username"`
+	UserAttributes
+}
+
+// UserAttributes are user attributes vouched for by an external authority, copied to the user on each login
+type UserAttributes struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Phone         string `json:"phone"`
+
+	// Roles replace the user's roles when present
+	Roles []string `json:"roles"`
+
+	// Language is the user's preferred language, kept until the user chooses one on their account
+	Language string `json:"language"`
+}
+
+// apply copies the attributes that are present to user and reports whether any of them changed
+func (a UserAttributes) apply(user *User) bool {
+	changed := false
+	if a.Email != "" && (a.Email != user.Email || a.EmailVerified != user.EmailVerified) {
+		user.Email = a.Email
+		user.EmailVerified = a.EmailVerified
+		changed = true
+	}
+	if a.Phone != "" && a.Phone != user.Phone {
+		user.Phone = a.Phone
+		changed = true
+	}
+	if a.Roles != nil && strings.Join(a.Roles, ",") != strings.Join(user.Roles, ",") {
+		user.Roles = a.Roles
+		changed = true
+	}
+	if language := matchLanguage(a.Language); language != "" && user.Language == "" {
+		user.Language = language
+		changed = true
+	}
+	return changed
+}
+
+// Authenticate posts the credentials to the service and returns the user it identifies
+func (a webhookPasswordAuthenticator) Authenticate(credentials Credentials, clientIP string) (*User, error) {
+	if credentials.Username == "" || credentials.Password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"username":  credentials.Username,
+		"password":  credentials.Password,
+		"client_ip": clientIP,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrInvalidCredentials
+	default:
+		return nil, errors.New("authentication service responded " + res.Status)
+	}
+
+	response := webhookAuthResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if !response.Allow {
+		return nil, ErrInvalidCredentials
+	}
+	if response.Username == "" {
+		response.Username = credentials.Username
+	}
+
+	return syncExternalUser(response.Username, response.UserAttributes)
+}
+
+// syncExternalUser returns the user an external authenticator accepted, creating them or updating their
+// attributes in the user store
+func syncExternalUser(username string, attributes UserAttributes) (*User, error) {
+	user, err := users.Get(username)
+	if err == ErrUserNotFound {
+		user = &User{Username: username}
+		err = users.Create(user)
+		if err == ErrUserExists {
+			user, err = users.Get(username)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if attributes.apply(user) {
+		if err := users.Save(user); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+var (
+	// securityTxtFile is served as security.txt as it is, in place of one generated from the settings below
+	securityTxtFile = os.Getenv("SECURITY_TXT_FILE")
+	// securityContacts are the URIs, such as mailto: or https: URIs, to report vulnerabilities to
+	securityContacts = envList("SECURITY_CONTACT")
+	// securityPolicy is the URI of the vulnerability disclosure policy
+	securityPolicy = os.Getenv("SECURITY_POLICY")
+	// securityPreferredLanguages are the languages reports are preferred in, such as en, de
+	securityPreferredLanguages = envList("SECURITY_PREFERRED_LANGUAGES")
+	// securityTxtExpires is when the security.txt is to be considered stale, in RFC 3339 format; a year after the
+	// application started if unset
+	securityTxtExpires = os.Getenv("SECURITY_TXT_EXPIRES")
+)
+
+// Paths of the well-known URIs expected by password managers and security scanners
+const (
+	changePasswordPath = "/.well-known/change-password"
+	securityTxtPath    = "/.well-known/security.txt"
+)
+
+// securityTxt is the security.txt served, or empty if none is configured
+var securityTxt []byte
+
+// loadSecurityTxt reads SECURITY_TXT_FILE, or generates the security.txt of RFC 9116 from SECURITY_CONTACT and the
+// other settings
+func loadSecurityTxt() error {
+	if securityTxtFile != "" {
+		data, err := ioutil.ReadFile(securityTxtFile)
+		if err != nil {
+			return err
+		}
+		securityTxt = data
+		return nil
+	}
+	if len(securityContacts) == 0 {
+		return nil
+	}
+
+	expires := time.Now().AddDate(1, 0, 0)
+	if securityTxtExpires != "" {
+		var err error
+		if expires, err = time.Parse(time.RFC3339, securityTxtExpires); err != nil {
+			return err
+		}
+	}
+
+	fields := []string{}
+	for _, contact := range securityContacts {
+		fields = append(fields, "Contact: "+contact)
+	}
+	fields = append(fields, "Expires: "+expires.UTC().Format(time.RFC3339))
+	if securityPolicy != "" {
+		fields = append(fields, "Policy: "+securityPolicy)
+	}
+	if len(securityPreferredLanguages) > 0 {
+		fields = append(fields, "Preferred-Languages: "+strings.Join(securityPreferredLanguages, ", "))
+	}
+	fields = append(fields, "Canonical: "+strings.TrimSuffix(publicURL, "/")+securityTxtPath)
+	securityTxt = []byte(strings.Join(fields, "\n") + "\n")
+	return nil
+}
+
+// getSecurityTxt returns the security.txt telling researchers how to report vulnerabilities, if one is configured
+func getSecurityTxt(ctx iris.Context) {
+	if len(securityTxt) == 0 {
+		ctx.StatusCode(iris.StatusNotFound)
+		return
+	}
+	ctx.ContentType("text/plain; charset=utf-8")
+	ctx.Write(securityTxt)
+}
+
+// getChangePassword redirects password managers to the page where users change their password
+func getChangePassword(ctx iris.Context) {
+	ctx.Redirect("/account/password", iris.StatusFound)
+}